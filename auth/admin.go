@@ -0,0 +1,356 @@
+package auth
+
+// Operations used by administrators to manage users, access to these
+// is restricted in the graph package with the @hasRole directive
+
+import (
+	"encoding/base64"
+	"regexp"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+// updateUser applies update to the user with the given id and returns the updated user,
+// erased users are left as they are. The lookups of both the previous and the new
+// username and email are invalidated
+func (db *DB) updateUser(ctx context.Context, id string, update bson.M) (*model.User, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid user id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	fields, _ := update["$set"].(bson.M)
+	if fields != nil {
+		sealed, err := sealFields(oid, fields)
+		if err != nil {
+			return nil, Errorf(CodeInternal, "Could not update user.")
+		}
+		update["$set"] = sealed
+	}
+
+	var previous UserModel
+	username, _ := fields["username"].(string)
+	email, _ := fields["email"].(string)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	filter := bson.M{"_id": oid, "erasedAt": bson.M{"$exists": false}}
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous); err != nil {
+		// The username or email was taken since UpdateProfile checked it
+		if taken := takenError(err, username, email); taken != nil {
+			return nil, taken
+		}
+
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+	db.invalidateUser(ctx, previous.OrgID, previous.Username, previous.Email)
+	db.invalidateUser(ctx, previous.OrgID, username, email)
+
+	user, err := db.FindByID(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+
+	return toGraphUser(user), nil
+}
+
+// GetUser returns the user with the given id
+func (db *DB) GetUser(ctx context.Context, id string) (*model.User, error) {
+	user, err := db.FindByID(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+
+	return toGraphUser(user), nil
+}
+
+// SetDisabled disables or enables an account, disabled users can't log in
+// and their outstanding tokens are rejected
+func (db *DB) SetDisabled(ctx context.Context, id string, disabled bool) (*model.User, error) {
+	return db.updateUser(ctx, id, bson.M{"$set": bson.M{"disabled": disabled}})
+}
+
+// ForcePasswordReset requires the user to go through changePassword before logging in again
+func (db *DB) ForcePasswordReset(ctx context.Context, id string) (*model.User, error) {
+	return db.updateUser(ctx, id, bson.M{"$set": bson.M{"mustResetPassword": true}})
+}
+
+// SetRoles replaces the roles of a user
+func (db *DB) SetRoles(ctx context.Context, id string, roles []model.Role) (*model.User, error) {
+	for _, role := range roles {
+		if !role.IsValid() {
+			return nil, gqlerror.Errorf("Invalid role %s.", role)
+		}
+	}
+
+	return db.updateUser(ctx, id, bson.M{"$set": bson.M{"roles": roles}})
+}
+
+// UpdateProfile edits the profile fields that are present in input
+func (db *DB) UpdateProfile(ctx context.Context, id string, input *model.UpdateUserInput) (*model.User, error) {
+	// Usernames and emails only have to be unique in the namespace of the user
+	current, err := db.FindByID(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+
+	fields := bson.M{}
+
+	if input.Fname != nil {
+		fields["fname"] = *input.Fname
+	}
+	if input.Lname != nil {
+		fields["lname"] = *input.Lname
+	}
+	if input.Email != nil {
+		if errs := checkEmail("email", *input.Email); len(errs) > 0 {
+			return nil, validationError(errs)
+		}
+		if user, _ := db.FindByEmail(ctx, current.OrgID, *input.Email); user != nil && user.ID != id {
+			return nil, Errorf(CodeEmailTaken, "Email %s taken.", *input.Email)
+		}
+		// A disposable email is handled as at registration, an account
+		// switching to one waits for approval again in approve mode
+		if NormalizeEmail(*input.Email) != NormalizeEmail(current.Email) {
+			pending, err := db.checkDisposable(ctx, *input.Email)
+			if err != nil {
+				return nil, err
+			}
+			if pending {
+				fields["pendingApproval"] = true
+			}
+		}
+		fields["email"] = NormalizeEmail(*input.Email)
+	}
+	if input.Username != nil {
+		// Admins are held to the policy new usernames follow
+		if errs := usernamePolicy.Check("username", NormalizeUsername(*input.Username)); len(errs) > 0 {
+			return nil, validationError(errs)
+		}
+		if user, _ := db.FindByUsername(ctx, current.OrgID, *input.Username); user != nil && user.ID != id {
+			return nil, Errorf(CodeUsernameTaken, "Username %s taken.", *input.Username)
+		}
+		fields["username"] = NormalizeUsername(*input.Username)
+	}
+	if input.Verified != nil {
+		fields["verified"] = *input.Verified
+	}
+	if input.Locale != nil {
+		if !validLocale(*input.Locale) {
+			return nil, gqlerror.Errorf("Invalid locale.")
+		}
+		fields["locale"] = *input.Locale
+	}
+
+	if len(fields) == 0 {
+		return nil, gqlerror.Errorf("Nothing to update.")
+	}
+
+	return db.updateUser(ctx, id, bson.M{"$set": fields})
+}
+
+// DeleteUser removes an account immediately, without a grace period
+func (db *DB) DeleteUser(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return gqlerror.Errorf("Invalid user id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user UserModel
+	err = collection.FindOneAndDelete(ctx, bson.M{"_id": oid}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+	if err != nil {
+		return Errorf(CodeInternal, "Could not delete user.")
+	}
+	db.invalidateUser(ctx, user.OrgID, user.Username, user.Email)
+
+	memberships := db.client.Database(db.database).Collection(membershipsCollection)
+	if _, err := memberships.DeleteMany(ctx, bson.M{"userId": oid}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove memberships")
+	}
+
+	return nil
+}
+
+// maxPageSize caps how many users a single page of ListUsers can return
+const maxPageSize = 100
+
+// encodeCursor hides the ObjectID behind an opaque cursor
+func encodeCursor(id primitive.ObjectID) string {
+	return base64.URLEncoding.EncodeToString([]byte(id.Hex()))
+}
+
+// decodeCursor returns the ObjectID a cursor points to
+func decodeCursor(cursor string) (primitive.ObjectID, error) {
+	hex, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	return primitive.ObjectIDFromHex(string(hex))
+}
+
+// ListUsers returns a page of users after the given cursor. Pages are walked
+// with range queries on _id so large collections don't need offset scans.
+func (db *DB) ListUsers(ctx context.Context, first *int, after *string, filter *model.UserFilter, sort *model.UserSort) (*model.UserConnection, error) {
+	query := bson.M{}
+	if filter != nil {
+		if filter.Disabled != nil {
+			query["disabled"] = *filter.Disabled
+		}
+		if filter.Role != nil {
+			query["roles"] = *filter.Role
+		}
+	}
+
+	direction := 1
+	if sort != nil && *sort == model.UserSortIDDesc {
+		direction = -1
+	}
+
+	return db.pageUsers(ctx, query, first, after, direction)
+}
+
+// SearchUsers matches the query against usernames and emails. Prefix matches
+// are served by the username and email indexes, substring matches scan.
+// Encrypted emails only match the whole address.
+func (db *DB) SearchUsers(ctx context.Context, search *model.UserSearch, first *int, after *string) (*model.UserConnection, error) {
+	if search.Query == "" {
+		return nil, gqlerror.Errorf("Search query can't be empty.")
+	}
+
+	pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(search.Query)}
+	if search.Mode != nil && *search.Mode == model.MatchModeSubstring {
+		pattern = primitive.Regex{Pattern: regexp.QuoteMeta(search.Query), Options: "i"}
+	}
+
+	email := bson.M{"email": pattern}
+	if pii != nil {
+		email = emailFilter(NormalizeEmail(search.Query))
+	}
+	query := bson.M{
+		"$or": bson.A{
+			bson.M{"username": pattern},
+			email,
+		},
+	}
+
+	// Creation time is encoded in the ObjectID so date filters are ranges on _id
+	created := bson.M{}
+	if search.CreatedAfter != nil {
+		created["$gte"] = primitive.NewObjectIDFromTimestamp(*search.CreatedAfter)
+	}
+	if search.CreatedBefore != nil {
+		created["$lt"] = primitive.NewObjectIDFromTimestamp(*search.CreatedBefore)
+	}
+	if len(created) > 0 {
+		query["$and"] = bson.A{bson.M{"_id": created}}
+	}
+
+	if search.Verified != nil {
+		query["verified"] = *search.Verified
+	}
+	if len(search.Roles) > 0 {
+		query["roles"] = bson.M{"$in": search.Roles}
+	}
+
+	return db.pageUsers(ctx, query, first, after, 1)
+}
+
+// pageLimit validates the requested page size
+func pageLimit(first *int) (int, error) {
+	limit := 20
+	if first != nil {
+		limit = *first
+	}
+	if limit < 1 || limit > maxPageSize {
+		return 0, gqlerror.Errorf("first must be between 1 and %d.", maxPageSize)
+	}
+
+	return limit, nil
+}
+
+// afterCursor restricts query to the documents after the cursor in the given sort direction
+func afterCursor(query bson.M, after *string, direction int) (bson.M, error) {
+	if after == nil {
+		return query, nil
+	}
+
+	oid, err := decodeCursor(*after)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid cursor.")
+	}
+
+	// Sort direction decides which side of the cursor we read
+	op := "$gt"
+	if direction < 0 {
+		op = "$lt"
+	}
+
+	return bson.M{"$and": bson.A{query, bson.M{"_id": bson.M{op: oid}}}}, nil
+}
+
+// pageUsers runs query and returns the page of results after the given cursor
+func (db *DB) pageUsers(ctx context.Context, query bson.M, first *int, after *string, direction int) (*model.UserConnection, error) {
+	limit, err := pageLimit(first)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err = afterCursor(query, after, direction)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Fetch one extra document to know whether there is a next page
+	opts := options.Find().SetSort(bson.M{"_id": direction}).SetLimit(int64(limit + 1))
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not list users.")
+	}
+
+	var users []UserModel
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list users.")
+	}
+
+	conn := &model.UserConnection{
+		Edges:    []*model.UserEdge{},
+		PageInfo: &model.PageInfo{HasNextPage: len(users) > limit},
+	}
+	if len(users) > limit {
+		users = users[:limit]
+	}
+
+	for i := range users {
+		conn.Edges = append(conn.Edges, &model.UserEdge{
+			Cursor: encodeCursor(users[i].ID),
+			Node:   toGraphUser(&users[i]),
+		})
+	}
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+
+	return conn, nil
+}
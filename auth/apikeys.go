@@ -0,0 +1,243 @@
+package auth
+
+// Long lived API keys of service clients, for machine callers that can't
+// run the client_credentials grant. Administrators mint keys for a service
+// client with a subset of its scopes and an optional expiry, keys are shown
+// once and stored hashed like provisioning tokens. Callers send them in the
+// X-API-Key header, Middleware then stores the claims of the client for
+// APIKeyForContext, and services without the database introspect them.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeyHeader carries the API keys of machine callers
+const APIKeyHeader = "X-API-Key"
+
+// apiKeysCollection stores the API keys
+const apiKeysCollection = "api_keys"
+
+// apiKeyPrefix starts every key, so leaked keys are easy to scan for
+const apiKeyPrefix = "ak_"
+
+var apiKeyCtxKey = &contextKey{"api key"}
+
+// apiKey representation of an API key in the database
+type apiKey struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	ClientID primitive.ObjectID `bson:"clientId"`
+	Name     string             `bson:"name"`
+	// Start of the key, shown to tell keys apart
+	Prefix string `bson:"prefix"`
+	// Hex SHA-256 of the key, the key itself is only shown once
+	Hash       string     `bson:"hash"`
+	Scopes     []string   `bson:"scopes"`
+	CreatedAt  time.Time  `bson:"createdAt"`
+	ExpiresAt  *time.Time `bson:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `bson:"lastUsedAt,omitempty"`
+}
+
+// toGraphAPIKey converts the database representation into the GraphQL one
+func toGraphAPIKey(key *apiKey) *model.APIKey {
+	return &model.APIKey{
+		ID:         key.ID.Hex(),
+		ClientID:   key.ClientID.Hex(),
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     append([]string{}, key.Scopes...),
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+// ensureAPIKeyIndexes looks keys up by hash and by client
+func (db *DB) ensureAPIKeyIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(apiKeysCollection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"hash": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"clientId": 1}},
+	})
+	return err
+}
+
+// CreateAPIKey returns a new key of a service client, it can't be read again
+func (db *DB) CreateAPIKey(ctx context.Context, input *model.APIKeyInput) (*model.APIKeyCredentials, error) {
+	client, err := db.FindOAuthClient(ctx, input.ClientID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find client with id '%s'.", input.ClientID)
+	}
+	if !client.AllowsGrant(GrantClientCredentials) {
+		return nil, gqlerror.Errorf("API keys are for service clients.")
+	}
+	if strings.TrimSpace(input.Name) == "" {
+		return nil, gqlerror.Errorf("A name is required.")
+	}
+
+	// Keys get the scopes of the client unless they are narrowed down
+	scopes := input.Scopes
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if _, declared := scopePolicy[scope]; !declared || !client.HasScope(scope) {
+			return nil, gqlerror.Errorf("The client can't be granted the scope '%s'.", scope)
+		}
+	}
+
+	now := time.Now()
+	record := apiKey{
+		ID:        primitive.NewObjectID(),
+		ClientID:  client.ID,
+		Name:      input.Name,
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if input.ExpiresIn != nil {
+		if *input.ExpiresIn <= 0 {
+			return nil, gqlerror.Errorf("expiresIn must be positive.")
+		}
+		expiresAt := now.Add(seconds(input.ExpiresIn))
+		record.ExpiresAt = &expiresAt
+	}
+
+	prefix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	record.Prefix = apiKeyPrefix + hex.EncodeToString(prefix)
+	key := record.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	record.Hash = hashSecret(key)
+
+	collection := db.client.Database(db.database).Collection(apiKeysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		return nil, Errorf(CodeInternal, "Could not create API key.")
+	}
+
+	return &model.APIKeyCredentials{APIKey: toGraphAPIKey(&record), Key: key}, nil
+}
+
+// ListAPIKeys returns the API keys of the client with the given id, of every
+// client when it is nil
+func (db *DB) ListAPIKeys(ctx context.Context, clientID *string) ([]*model.APIKey, error) {
+	filter := bson.M{}
+	if clientID != nil {
+		oid, err := primitive.ObjectIDFromHex(*clientID)
+		if err != nil {
+			return nil, gqlerror.Errorf("Invalid client id.")
+		}
+		filter["clientId"] = oid
+	}
+
+	collection := db.client.Database(db.database).Collection(apiKeysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var keys []apiKey
+	if err := findAll(ctx, collection, filter, &keys); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list API keys.")
+	}
+
+	list := []*model.APIKey{}
+	for i := range keys {
+		list = append(list, toGraphAPIKey(&keys[i]))
+	}
+
+	return list, nil
+}
+
+// RevokeAPIKey deletes an API key, it stops working right away
+func (db *DB) RevokeAPIKey(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return gqlerror.Errorf("Invalid API key id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(apiKeysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not revoke API key.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find API key with id '%s'.", id)
+	}
+
+	return nil
+}
+
+// VerifyAPIKey returns the claims of the service client of an API key that
+// hasn't expired, and records it was used
+func (db *DB) VerifyAPIKey(ctx context.Context, key string) (*Claims, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, Errorf(CodeInvalidToken, "Invalid API key.")
+	}
+
+	collection := db.client.Database(db.database).Collection(apiKeysCollection)
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"hash": hashSecret(key),
+		"$or":  bson.A{bson.M{"expiresAt": bson.M{"$exists": false}}, bson.M{"expiresAt": bson.M{"$gt": now}}},
+	}
+	var record apiKey
+	err := collection.FindOneAndUpdate(findCtx, filter, bson.M{"$set": bson.M{"lastUsedAt": now}}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return nil, Errorf(CodeInvalidToken, "Invalid API key.")
+	}
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not look up API key")
+		return nil, Errorf(CodeInternal, "Could not verify API key, try again later.")
+	}
+
+	// Keys stop working along with their client
+	client, err := db.FindOAuthClient(ctx, record.ClientID.Hex())
+	if err != nil || !client.AllowsGrant(GrantClientCredentials) {
+		return nil, Errorf(CodeInvalidToken, "Invalid API key.")
+	}
+
+	claims := &Claims{
+		ClientID: client.ID.Hex(),
+		Scopes:   record.Scopes,
+		Issuer:   db.tokens.issuer,
+		IssuedAt: record.CreatedAt,
+	}
+	if record.ExpiresAt != nil {
+		claims.Expiry = *record.ExpiresAt
+	}
+
+	return claims, nil
+}
+
+// APIKeyForContext returns the claims of the service client whose API key
+// the request was made with, nil otherwise. Requests made with API keys have
+// no user, so ForContext and ClaimsForContext return nil for them.
+// REQUIRES Middleware to have run.
+func APIKeyForContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(apiKeyCtxKey).(*Claims)
+	return claims
+}
@@ -0,0 +1,294 @@
+package auth
+
+// Audit log of security relevant events. Events are only ever inserted,
+// nothing in this package updates or deletes them.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+// indexOptionsConflict is the Mongo error code for an existing index with different options
+const indexOptionsConflict = 85
+
+// AuditEvent representation of an audit record in the database
+type AuditEvent struct {
+	ID primitive.ObjectID `bson:"_id" json:"_id"`
+	// What happened
+	Type model.AuditEventType `bson:"type" json:"type"`
+	// Id of the authenticated user that caused the event, empty for anonymous requests
+	ActorID string `bson:"actorId" json:"actorId"`
+	// The account the event is about, an id, username or email depending on what's known
+	Subject   string            `bson:"subject" json:"subject"`
+	IP        string            `bson:"ip" json:"ip"`
+	UserAgent string            `bson:"userAgent" json:"userAgent"`
+	Details   map[string]string `bson:"details,omitempty" json:"details,omitempty"`
+	Timestamp time.Time         `bson:"timestamp" json:"timestamp"`
+}
+
+// Name maps the event to the name published to other systems, such as
+// "user.registered". Events that are not interesting outside the service
+// map to an empty string.
+func (event AuditEvent) Name() string {
+	switch event.Type {
+	case model.AuditEventTypeRegister:
+		return "user.registered"
+	case model.AuditEventTypeLoginSuccess:
+		return "user.login"
+	case model.AuditEventTypeLoginFailure:
+		return "user.login_failed"
+	case model.AuditEventTypePasswordChange:
+		return "user.password_changed"
+	case model.AuditEventTypeAccountDeletion:
+		return "user.deletion_scheduled"
+	case model.AuditEventTypeAccountRestored:
+		return "user.restored"
+	case model.AuditEventTypeLogout:
+		return "user.logout"
+	case model.AuditEventTypeNewDevice:
+		return "user.new_device"
+	case model.AuditEventTypeReauthenticate:
+		return "user.reauthenticated"
+	case model.AuditEventTypeLoginReported:
+		return "user.login_reported"
+	case model.AuditEventTypeDataExport:
+		return "user.data_exported"
+	case model.AuditEventTypeUserErased:
+		return "user.erased"
+	case model.AuditEventTypeTermsAccepted:
+		return "user.terms_accepted"
+	case model.AuditEventTypeMemberInvited:
+		return "org.member_invited"
+	case model.AuditEventTypeInvitationRevoked:
+		return "org.invitation_revoked"
+	case model.AuditEventTypeInvitationAccepted:
+		return "org.invitation_accepted"
+	case model.AuditEventTypeMemberRoleChanged:
+		return "org.member_role_changed"
+	case model.AuditEventTypeMemberRemoved:
+		return "org.member_removed"
+	case model.AuditEventTypeOrgKeyRotated:
+		return "org.signing_key_rotated"
+	case model.AuditEventTypeProvisioning:
+		return "org.provisioning"
+	case model.AuditEventTypeImpersonation:
+		return "user.impersonated"
+	case model.AuditEventTypeTokenReuse:
+		return "user.token_reused"
+	case model.AuditEventTypeMfaEnabled:
+		return "user.mfa_enabled"
+	case model.AuditEventTypeMfaDisabled:
+		return "user.mfa_disabled"
+	case model.AuditEventTypeTrustedDeviceRevoked:
+		return "user.trusted_device_revoked"
+	case model.AuditEventTypeAdminAction:
+		switch event.Details["action"] {
+		case "disableUser":
+			return "user.locked"
+		case "enableUser":
+			return "user.unlocked"
+		case "adminDeleteUser":
+			return "user.deleted"
+		case "eraseUser":
+			return "user.erased"
+		case "approveUser":
+			return "user.approved"
+		case "revokeToken":
+			return "user.token_revoked"
+		case "resetTwoFactor":
+			return "user.mfa_disabled"
+		case "rotateSigningKey", "blockDisposableDomain", "unblockDisposableDomain":
+			// Not about a user
+			return ""
+		default:
+			return "user.updated"
+		}
+	}
+
+	return ""
+}
+
+// EventSink receives every audit event once it has been recorded, it is how
+// other subsystems react to what happens in the service
+type EventSink interface {
+	Publish(event AuditEvent)
+}
+
+// AddSink registers a sink that is notified of every audit event
+func (db *DB) AddSink(sink EventSink) {
+	db.sinks = append(db.sinks, sink)
+}
+
+// Audit records an event. The actor, client address and user agent are taken
+// from ctx so every caller reports them the same way. Failures are logged
+// rather than returned so auditing never breaks the operation being audited.
+func (db *DB) Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string) {
+	event := AuditEvent{
+		ID:        primitive.NewObjectID(),
+		Type:      eventType,
+		Subject:   subject,
+		Details:   details,
+		Timestamp: time.Now(),
+	}
+
+	if user := ForContext(ctx); user != nil {
+		event.ActorID = user.ID
+	}
+	// Whatever is done while impersonating is done by the administrator
+	if claims := ClaimsForContext(ctx); claims != nil && claims.Actor != "" {
+		event.ActorID = claims.Actor
+		event.Details = map[string]string{"impersonating": claims.UserID}
+		for key, value := range details {
+			event.Details[key] = value
+		}
+	}
+	if info := requestForContext(ctx); info != nil {
+		event.IP = info.IP
+		event.UserAgent = info.UserAgent
+	}
+
+	collection := db.client.Database(db.database).Collection(db.auditCollection)
+	// Security events are recorded even when the client cancels the request
+	insertCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, event); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Str("event", string(eventType)).Msg("could not record audit event")
+	}
+
+	for _, sink := range db.sinks {
+		sink.Publish(event)
+	}
+}
+
+// toGraphAuditEvent converts the database representation into the GraphQL one
+func toGraphAuditEvent(event *AuditEvent) *model.AuditEvent {
+	details := []*model.AuditDetail{}
+	for key, value := range event.Details {
+		details = append(details, &model.AuditDetail{Key: key, Value: value})
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].Key < details[j].Key })
+
+	return &model.AuditEvent{
+		ID:        event.ID.Hex(),
+		Type:      event.Type,
+		ActorID:   event.ActorID,
+		Subject:   event.Subject,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		Details:   details,
+		Timestamp: event.Timestamp,
+	}
+}
+
+// ListAuditEvents returns a page of audit events, newest first
+func (db *DB) ListAuditEvents(ctx context.Context, first *int, after *string, filter *model.AuditEventFilter) (*model.AuditEventConnection, error) {
+	limit, err := pageLimit(first)
+	if err != nil {
+		return nil, err
+	}
+
+	query := bson.M{}
+	if filter != nil {
+		if filter.User != nil {
+			query["$or"] = bson.A{
+				bson.M{"actorId": *filter.User},
+				bson.M{"subject": *filter.User},
+			}
+		}
+		if filter.Type != nil {
+			query["type"] = *filter.Type
+		}
+
+		timestamp := bson.M{}
+		if filter.From != nil {
+			timestamp["$gte"] = *filter.From
+		}
+		if filter.To != nil {
+			timestamp["$lt"] = *filter.To
+		}
+		if len(timestamp) > 0 {
+			query["timestamp"] = timestamp
+		}
+	}
+
+	query, err = afterCursor(query, after, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(db.auditCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Fetch one extra document to know whether there is a next page
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit + 1))
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not list audit events.")
+	}
+
+	var events []AuditEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list audit events.")
+	}
+
+	conn := &model.AuditEventConnection{
+		Edges:    []*model.AuditEventEdge{},
+		PageInfo: &model.PageInfo{HasNextPage: len(events) > limit},
+	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	for i := range events {
+		conn.Edges = append(conn.Edges, &model.AuditEventEdge{
+			Cursor: encodeCursor(events[i].ID),
+			Node:   toGraphAuditEvent(&events[i]),
+		})
+	}
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+
+	return conn, nil
+}
+
+// ensureAuditIndexes indexes the audit collection for the queries above and
+// expires events once they are older than the AUDIT_RETENTION period
+func (db *DB) ensureAuditIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(db.auditCollection)
+	retention := db.auditRetention
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"actorId": 1}},
+		{Keys: bson.M{"subject": 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ttl := mongo.IndexModel{
+		Keys:    bson.M{"timestamp": 1},
+		Options: options.Index().SetName("timestamp_ttl").SetExpireAfterSeconds(int32(retention.Seconds())),
+	}
+	_, err = collection.Indexes().CreateOne(ctx, ttl)
+
+	// The index already exists with another retention, update it in place
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == indexOptionsConflict {
+		return db.client.Database(db.database).RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: db.auditCollection},
+			{Key: "index", Value: bson.M{"name": "timestamp_ttl", "expireAfterSeconds": int32(retention.Seconds())}},
+		}).Err()
+	}
+
+	return err
+}
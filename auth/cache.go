@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/cache"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// notFound is cached for lookups that matched no user, most availability checks
+var notFound = []byte("null")
+
+// SetCache caches username and email lookups in c for ttl. Only the id a
+// lookup found is cached, never personal data, the document is read again by
+// id. Writes through DB invalidate the entries they affect, users removed by
+// the purge job may be reported as taken until their entries expire
+func (db *DB) SetCache(c cache.Cache, ttl time.Duration) {
+	db.cache = c
+	db.cacheTTL = ttl
+}
+
+// usernameKey and emailKey name the cached lookups in the namespace of org
+func usernameKey(org primitive.ObjectID, username string) string {
+	return "user:" + namespace(org) + "username:" + username
+}
+func emailKey(org primitive.ObjectID, email string) string {
+	// Sealed emails are only known by their blind index
+	if pii != nil {
+		return "user:" + namespace(org) + "emailIndex:" + pii.blindIndex(email)
+	}
+	return "user:" + namespace(org) + "email:" + email
+}
+
+// namespace prefixes the keys of an organization, the default namespace keeps the original keys
+func namespace(org primitive.ObjectID) string {
+	if org.IsZero() {
+		return ""
+	}
+
+	return org.Hex() + ":"
+}
+
+// cachedFind is a read through findWithFilter keeping the id of the user
+// found, whose sealed document is then read by id. matches tells whether the
+// user still fits the lookup, it may have been renamed since
+func (db *DB) cachedFind(ctx context.Context, key string, filter bson.M, matches func(*model.User) bool) (*model.User, error) {
+	if db.cache == nil {
+		return db.findWithFilter(ctx, filter)
+	}
+
+	if value, ok, err := db.cache.Get(ctx, key); err == nil && ok {
+		if string(value) == string(notFound) {
+			return nil, mongo.ErrNoDocuments
+		}
+
+		if oid, err := primitive.ObjectIDFromHex(string(value)); err == nil {
+			if user, err := db.findWithFilter(ctx, bson.M{"_id": oid}); err == nil && matches(user) {
+				return user, nil
+			}
+		}
+	} else if err != nil {
+		logging.Ctx(ctx).Warn().Err(err).Msg("user cache unavailable")
+	}
+
+	user, err := db.findWithFilter(ctx, filter)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		db.cache.Set(ctx, key, notFound, db.cacheTTL)
+	case err == nil:
+		db.cache.Set(ctx, key, []byte(user.ID), db.cacheTTL)
+	}
+
+	return user, err
+}
+
+// invalidateUser drops the cached lookups of a username and email in the
+// namespace of org, empty values are skipped
+func (db *DB) invalidateUser(ctx context.Context, org primitive.ObjectID, username, email string) {
+	if db.cache == nil {
+		return
+	}
+
+	var keys []string
+	if username != "" {
+		keys = append(keys, usernameKey(org, username))
+	}
+	if email != "" {
+		keys = append(keys, emailKey(org, email))
+	}
+
+	if err := db.cache.Delete(ctx, keys...); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not invalidate cached user")
+	}
+}
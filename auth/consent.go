@@ -0,0 +1,92 @@
+package auth
+
+// Consent to the terms of service and privacy policy. Deployments configure
+// the current version of each document, users accept them when they
+// register and again at login whenever a version changes.
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/net/context"
+)
+
+// Consent records the version of a document a user accepted
+type Consent struct {
+	Version    string    `bson:"version" json:"version"`
+	AcceptedAt time.Time `bson:"acceptedAt" json:"acceptedAt"`
+}
+
+// CurrentTerms returns the versions users must have accepted
+func (db *DB) CurrentTerms() *model.Terms {
+	terms := &model.Terms{}
+	if v, ok := db.terms[model.ConsentDocumentTermsOfService]; ok {
+		terms.TermsOfService = &v
+	}
+	if v, ok := db.terms[model.ConsentDocumentPrivacyPolicy]; ok {
+		terms.PrivacyPolicy = &v
+	}
+
+	return terms
+}
+
+// pendingTerms reports whether user hasn't accepted the current version of a document
+func (db *DB) pendingTerms(user *UserModel) bool {
+	for document, version := range db.terms {
+		if user.Consents[string(document)].Version != version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptedTerms returns the consents recording the acceptance of the current versions
+func (db *DB) acceptedTerms(now time.Time) bson.M {
+	consents := bson.M{}
+	for document, version := range db.terms {
+		consents["consents."+string(document)] = Consent{Version: version, AcceptedAt: now}
+	}
+
+	return consents
+}
+
+// AcceptTerms logs in like AuthenticateUser, recording that the user accepted
+// the current terms, which logins require once they change
+func (db *DB) AcceptTerms(ctx context.Context, auth *model.Authenticate) (*model.Token, error) {
+	return db.login(ctx, auth, true)
+}
+
+// recordConsent stores the acceptance of the current terms by user
+func (db *DB) recordConsent(ctx context.Context, user *UserModel) error {
+	if len(db.terms) == 0 {
+		return nil
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": db.acceptedTerms(time.Now())}); err != nil {
+		return Errorf(CodeInternal, "Could not record your consent, try again later.")
+	}
+
+	return nil
+}
+
+// toGraphConsents lists the consents of a user by document
+func toGraphConsents(consents map[string]Consent) []*model.Consent {
+	list := []*model.Consent{}
+	for document, consent := range consents {
+		list = append(list, &model.Consent{
+			Document:   model.ConsentDocument(document),
+			Version:    consent.Version,
+			AcceptedAt: consent.AcceptedAt,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Document < list[j].Document })
+
+	return list
+}
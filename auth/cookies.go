@@ -0,0 +1,180 @@
+package auth
+
+// Cookie delivery of tokens, for browser apps that must not keep tokens
+// where scripts can read them. With COOKIE_AUTH the GraphQL API sets the
+// access and refresh tokens in Secure, HttpOnly cookies instead of
+// answering them, and Middleware accepts them from there. Browsers send
+// cookies along with requests other sites make, so requests authenticated
+// by the cookies must prove they come from the app: the CSRF cookie set
+// next to them is readable by the app, which echoes it in the X-CSRF-Token
+// header (double submit).
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/config"
+)
+
+// Names of the cookies and of the header echoing the CSRF token
+const (
+	TokenCookie   = "auth_token"
+	RefreshCookie = "auth_refresh"
+	CSRFCookie    = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+	// Token of a trusted device, it outlives logouts
+	DeviceCookie = "auth_device"
+)
+
+// CookiePolicy describes the cookies tokens are delivered in
+type CookiePolicy struct {
+	Domain   string
+	SameSite http.SameSite
+	Secure   bool
+	// Lifetime of the cookies, the ones of access and refresh tokens and
+	// of device tokens
+	MaxAge        time.Duration
+	RefreshMaxAge time.Duration
+	DeviceMaxAge  time.Duration
+}
+
+var cookiePolicy *CookiePolicy
+
+var writerCtxKey = &contextKey{"writer"}
+var cookieTokenCtxKey = &contextKey{"cookie token"}
+var refreshCookieCtxKey = &contextKey{"refresh cookie"}
+var deviceCookieCtxKey = &contextKey{"device cookie"}
+
+// SetCookiePolicy enables cookie delivery of tokens, nil disables it
+func SetCookiePolicy(p *CookiePolicy) {
+	cookiePolicy = p
+}
+
+// NewCookiePolicy returns the policy of COOKIE_AUTH, nil when it is off
+func NewCookiePolicy(cfg *config.Config) *CookiePolicy {
+	if !cfg.CookieAuth {
+		return nil
+	}
+
+	p := &CookiePolicy{Domain: cfg.CookieDomain, SameSite: http.SameSiteLaxMode, Secure: cfg.CookieSecure, MaxAge: cfg.TokenTTL, RefreshMaxAge: cfg.RefreshTokenTTL, DeviceMaxAge: cfg.TrustedDeviceTTL}
+	switch strings.ToLower(cfg.CookieSameSite) {
+	case "strict":
+		p.SameSite = http.SameSiteStrictMode
+	case "none":
+		p.SameSite = http.SameSiteNoneMode
+	}
+
+	return p
+}
+
+// cookie returns a cookie of the policy lasting maxAge, scripts can read it
+// unless httpOnly
+func (p *CookiePolicy) cookie(name, value string, httpOnly bool, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   p.Domain,
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   p.Secure,
+		HttpOnly: httpOnly,
+		SameSite: p.SameSite,
+	}
+}
+
+// SetTokenCookie delivers the access token, and the refresh token when not
+// empty, in cookies of the response and reports whether it did, it doesn't
+// without COOKIE_AUTH or outside Middleware
+func SetTokenCookie(ctx context.Context, token, refresh string) bool {
+	w, _ := ctx.Value(writerCtxKey).(http.ResponseWriter)
+	if cookiePolicy == nil || w == nil {
+		return false
+	}
+
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return false
+	}
+	// The CSRF cookie is needed as long as either token can be used
+	maxAge := cookiePolicy.MaxAge
+	http.SetCookie(w, cookiePolicy.cookie(TokenCookie, token, true, maxAge))
+	if refresh != "" {
+		maxAge = cookiePolicy.RefreshMaxAge
+		http.SetCookie(w, cookiePolicy.cookie(RefreshCookie, refresh, true, maxAge))
+	}
+	http.SetCookie(w, cookiePolicy.cookie(CSRFCookie, base64.RawURLEncoding.EncodeToString(csrf), false, maxAge))
+
+	return true
+}
+
+// SetDeviceCookie delivers the token of a trusted device in a cookie of the
+// response and reports whether it did, like SetTokenCookie
+func SetDeviceCookie(ctx context.Context, token string) bool {
+	w, _ := ctx.Value(writerCtxKey).(http.ResponseWriter)
+	if cookiePolicy == nil || w == nil {
+		return false
+	}
+
+	http.SetCookie(w, cookiePolicy.cookie(DeviceCookie, token, true, cookiePolicy.DeviceMaxAge))
+	return true
+}
+
+// ClearTokenCookie removes the cookies of SetTokenCookie, on logout
+func ClearTokenCookie(ctx context.Context) {
+	clearCookies(ctx, TokenCookie, RefreshCookie, CSRFCookie)
+}
+
+// clearCookies removes the cookies with the given names
+func clearCookies(ctx context.Context, names ...string) {
+	w, _ := ctx.Value(writerCtxKey).(http.ResponseWriter)
+	if cookiePolicy == nil || w == nil {
+		return
+	}
+
+	for _, name := range names {
+		http.SetCookie(w, cookiePolicy.cookie(name, "", name != CSRFCookie, -time.Second))
+	}
+}
+
+// CookieTokenForContext returns the token of the cookie the request was
+// authenticated with, empty when it used the Authorization header
+func CookieTokenForContext(ctx context.Context) string {
+	token, _ := ctx.Value(cookieTokenCtxKey).(string)
+	return token
+}
+
+// DeviceCookieForContext returns the token of the device cookie sent with
+// the request, empty without one
+func DeviceCookieForContext(ctx context.Context) string {
+	token, _ := ctx.Value(deviceCookieCtxKey).(string)
+	return token
+}
+
+// RefreshCookieForContext returns the refresh token of the cookie sent with
+// the request, empty without one or when the request failed the CSRF check
+func RefreshCookieForContext(ctx context.Context) string {
+	token, _ := ctx.Value(refreshCookieCtxKey).(string)
+	return token
+}
+
+// ValidCSRF reports whether a request authenticated by a cookie proves it
+// comes from the app, requests that can't change anything need no proof
+func ValidCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := r.Cookie(CSRFCookie)
+	header := r.Header.Get(CSRFHeader)
+	if err != nil || cookie.Value == "" || header == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
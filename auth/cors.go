@@ -0,0 +1,98 @@
+package auth
+
+// CORS lets browser apps served from other origins call the service. Only
+// the origins of CORS_ORIGINS get the Access-Control headers, others are
+// answered as before and the browser keeps the response from them. With
+// CORS_CREDENTIALS browsers send cookies along, which COOKIE_AUTH needs
+// when the app lives on another origin.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/config"
+)
+
+// CORSPolicy describes the cross-origin requests browsers may make
+type CORSPolicy struct {
+	// Allowed origins such as "https://app.example.com", "*" allows any and
+	// "https://*.example.com" any subdomain
+	Origins []string
+	// Whether requests may carry cookies
+	Credentials bool
+	// How long browsers cache the answer to preflight requests
+	MaxAge time.Duration
+}
+
+// Headers apps may send and read
+var (
+	corsMethods        = []string{http.MethodGet, http.MethodPost, http.MethodOptions}
+	corsHeaders        = []string{"Authorization", "Content-Type", DPoPHeader, CSRFHeader, APIKeyHeader, "X-Request-ID"}
+	corsExposedHeaders = []string{"X-Request-ID", "WWW-Authenticate"}
+)
+
+// NewCORSPolicy returns the policy of CORS_ORIGINS, nil when it is empty
+func NewCORSPolicy(cfg *config.Config) *CORSPolicy {
+	if len(cfg.CORSOrigins) == 0 {
+		return nil
+	}
+
+	return &CORSPolicy{Origins: cfg.CORSOrigins, Credentials: cfg.CORSCredentials, MaxAge: cfg.CORSMaxAge}
+}
+
+// allowed reports whether requests from origin are allowed
+func (p *CORSPolicy) allowed(origin string) bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if i := strings.Index(allowed, "://*."); i > 0 {
+			scheme, domain := allowed[:i+3], allowed[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CORS returns middleware adding the headers of p to the responses of
+// allowed origins and answering their preflight requests, nil p changes
+// nothing
+func CORS(p *CORSPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if p == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			// Answers differ by origin, caches must keep them apart
+			w.Header().Add("Vary", "Origin")
+			if origin == "" || !p.allowed(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			if p.Credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+				h.Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ", "))
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
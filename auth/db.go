@@ -5,24 +5,76 @@ package auth
 // authentication located in the util.go file
 
 import (
-	"log"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/cesar-yoab/authService/cache"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/geoip"
 	"github.com/cesar-yoab/authService/graph/model"
-	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/mail"
+	"github.com/cesar-yoab/authService/metrics"
+	"github.com/cesar-yoab/authService/tracing"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"golang.org/x/net/context"
 )
 
 // DB wraps the mongo.Client object
 type DB struct {
-	client     *mongo.Client
-	database   string
-	collection string
+	client          *mongo.Client
+	database        string
+	collection      string
+	auditCollection string
+	sinks           []EventSink
+	// Keys used to sign and verify tokens
+	keys   *keySet
+	tokens *TokenIssuer
+	// How long deleted accounts can be restored
+	gracePeriod time.Duration
+	// How long audit events are kept
+	auditRetention time.Duration
+	// What registration does with disposable emails, one of the Disposable* modes
+	disposableMode string
+	// Tokens revoked before they expire
+	denylist Denylist
+	// Where opaque tokens are kept, nil when logins get signed tokens
+	opaque TokenStore
+	// Caches username and email lookups, nil when disabled
+	cache    cache.Cache
+	cacheTTL time.Duration
+	// Sends notifications to users
+	mailer    mail.Mailer
+	templates *mail.Templates
+	// Locates clients in login emails, nil when disabled
+	locator geoip.Locator
+	// Logins users are emailed about unless they chose otherwise
+	notifyLogins model.LoginNotifications
+	// Page the "this wasn't me" link of login emails points to
+	reportURL string
+	// Address of the service in links sent to users
+	publicURL string
+	// Current version of each document users must accept
+	terms map[model.ConsentDocument]string
+	// Page the link of invitations points to, and how long they last
+	inviteURL string
+	inviteTTL time.Duration
+	// How long refresh tokens of OAuth clients last
+	oauthRefreshTTL time.Duration
+	// How long login sessions last unused, zero when they last as long as
+	// their refresh token
+	sessionIdle time.Duration
+	// How long sessions last at most since the login, however they're used
+	sessionMax time.Duration
+	// How long trusted devices skip the second factor
+	trustedTTL time.Duration
 }
 
 // UserModel representation of data in database
@@ -33,104 +85,489 @@ type UserModel struct {
 	Email    string             `json:"email"`
 	Username string             `json:"username"`
 	Password string             `json:"password"`
+	Roles    []model.Role       `bson:"roles" json:"roles"`
+	Verified bool               `bson:"verified" json:"verified"`
+	// Backfilled from the _id for accounts created before it was stored
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	// Disabled accounts can't log in until an admin enables them again
+	Disabled bool `bson:"disabled" json:"disabled"`
+	// Set by admins to force the user through changePassword before logging in
+	MustResetPassword bool `bson:"mustResetPassword" json:"mustResetPassword"`
+	// Tokens carrying an older version (ver claim) are rejected, bumped by logoutAllDevices
+	TokenVersion int `bson:"tokenVersion,omitempty" json:"tokenVersion,omitempty"`
+	// Language of the emails sent to the user, e.g. "es" or "pt-BR", empty for the default
+	Locale string `bson:"locale,omitempty" json:"locale,omitempty"`
+	// Which logins the user is emailed about, empty for the default of the deployment
+	LoginNotifications model.LoginNotifications `bson:"loginNotifications,omitempty" json:"loginNotifications,omitempty"`
+	// Set on accounts registered with a disposable email until an admin approves them
+	PendingApproval bool `bson:"pendingApproval,omitempty" json:"pendingApproval,omitempty"`
+	// Set when the user asks to delete their account, the record is purged after this time
+	DeleteAfter *time.Time `bson:"deleteAfter,omitempty" json:"deleteAfter,omitempty"`
+	// Organization whose namespace the user lives in, zero for the default namespace
+	OrgID primitive.ObjectID `bson:"orgId,omitempty" json:"orgId,omitempty"`
+	// Versions of the terms the user accepted, keyed by model.ConsentDocument
+	Consents map[string]Consent `bson:"consents,omitempty" json:"consents,omitempty"`
+	// Set when the personal data of the user was erased, the document is only a tombstone
+	ErasedAt *time.Time `bson:"erasedAt,omitempty" json:"erasedAt,omitempty"`
+	// Id of the user in the identity provider that provisioned it through SCIM
+	ExternalID string `bson:"externalId,omitempty" json:"externalId,omitempty"`
+	// Accounts of identity providers the user logs in with
+	Identities []LinkedIdentity `bson:"identities,omitempty" json:"identities,omitempty"`
+	// Secret of the authenticator app logins need a code of, and the one
+	// being set up until enableTwoFactor confirms it
+	TOTPSecret  string `bson:"totpSecret,omitempty" json:"-"`
+	TOTPPending string `bson:"totpPending,omitempty" json:"-"`
+	// Time step of the last code used, each code works once
+	TOTPStep int64 `bson:"totpStep,omitempty" json:"-"`
 }
 
-// ConnectMongo to database and return a pointer to a DB object
-func ConnectMongo() *DB {
-	// Get URI from .env file
-	uri := getFromEnv("DB")
-	dtb := getFromEnv("DBNAME")
-	coll := getFromEnv("COLLECTION")
-	if uri == "" {
-		log.Fatal("Unable to access .env database variable")
+// Active reports whether tokens issued to the user should still be accepted
+func (user *UserModel) Active() bool {
+	return !user.Disabled && !user.MustResetPassword && !user.PendingApproval && user.DeleteAfter == nil && user.ErasedAt == nil
+}
+
+// toGraphUser converts the database representation into the GraphQL one
+func toGraphUser(user *UserModel) *model.User {
+	graphUser := &model.User{
+		ID:                user.ID.Hex(),
+		Username:          user.Username,
+		Fname:             user.Fname,
+		Lname:             user.Lname,
+		Email:             user.Email,
+		Roles:             user.Roles,
+		Disabled:          user.Disabled,
+		MustResetPassword: user.MustResetPassword,
+		PendingApproval:   user.PendingApproval,
+		Verified:          user.Verified,
+		CreatedAt:         user.CreatedAt,
+		ErasedAt:          user.ErasedAt,
+		Consents:          toGraphConsents(user.Consents),
+		Identities:        toGraphIdentities(user.Identities),
+		TwoFactorEnabled:  user.TOTPSecret != "",
+	}
+	if !user.OrgID.IsZero() {
+		org := user.OrgID.Hex()
+		graphUser.OrgID = &org
+	}
+	if user.LoginNotifications != "" {
+		graphUser.LoginNotifications = &user.LoginNotifications
 	}
+	if user.Locale != "" {
+		graphUser.Locale = &user.Locale
+	}
+
+	return graphUser
+}
 
+// ConnectMongo to database and return a pointer to a DB object
+func ConnectMongo(cfg *config.Config) (*DB, error) {
 	// Connect to database
-	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	client, err := mongo.NewClient(options.Client().ApplyURI(cfg.MongoURI).SetMonitor(combineMonitors(metrics.MongoMonitor(), tracing.MongoMonitor())))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("could not create Mongo client: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err = client.Connect(ctx)
+	if err := client.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("could not connect to Mongo: %w", err)
+	}
+
+	templates, err := mail.LoadTemplates(cfg.MailTemplates, cfg.DefaultLocale)
+	if err != nil {
+		return nil, fmt.Errorf("could not load email templates: %w", err)
+	}
+
+	keys := newKeySet(cfg.SigningKey, cfg.TokenTTL)
+	tokens := NewTokenIssuer(keys, cfg.TokenTTL, cfg.TokenIssuer, cfg.TokenAudience)
+	tokens.SetFormat(TokenFormat(cfg.TokenFormat))
+	tokens.SetLeeway(cfg.ClockLeeway)
+	refreshKey := []byte(cfg.RefreshKey)
+	if cfg.RefreshKey == "" {
+		refreshKey = DeriveRefreshKey(cfg.SigningKey)
+	}
+	tokens.SetRefreshKey(refreshKey, cfg.RefreshTokenTTL)
+	if cfg.SigningAlg == "EdDSA" {
+		private, err := ParseEdDSAKey(cfg.EdDSAKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read EDDSA_KEY: %w", err)
+		}
+		tokens.SetEdDSAKey(private)
+	}
+	if cfg.TokenEncryptionKey != "" {
+		key, err := ParseEncryptionKey(cfg.TokenEncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := tokens.SetEncryptionKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	terms := map[model.ConsentDocument]string{}
+	if cfg.TermsVersion != "" {
+		terms[model.ConsentDocumentTermsOfService] = cfg.TermsVersion
+	}
+	if cfg.PrivacyPolicyVersion != "" {
+		terms[model.ConsentDocumentPrivacyPolicy] = cfg.PrivacyPolicyVersion
+	}
 
 	return &DB{
-		client:     client,
-		database:   dtb,
-		collection: coll,
+		client:          client,
+		database:        cfg.Database,
+		collection:      cfg.Collection,
+		auditCollection: cfg.AuditCollection,
+		keys:            keys,
+		tokens:          tokens,
+		gracePeriod:     cfg.DeletionGracePeriod,
+		auditRetention:  cfg.AuditRetention,
+		disposableMode:  cfg.DisposableEmails,
+		denylist:        NewMemoryDenylist(),
+		mailer:          mail.Log{},
+		templates:       templates,
+		notifyLogins:    model.LoginNotifications(strings.ToUpper(cfg.LoginNotifications)),
+		reportURL:       cfg.LoginReportURL,
+		publicURL:       strings.TrimSuffix(cfg.PublicURL, "/"),
+		terms:           terms,
+		inviteURL:       cfg.InviteURL,
+		inviteTTL:       cfg.InviteTTL,
+		oauthRefreshTTL: cfg.OAuthRefreshTTL,
+		sessionIdle:     cfg.SessionIdleTimeout,
+		sessionMax:      cfg.SessionMaxLifetime,
+		trustedTTL:      cfg.TrustedDeviceTTL,
+	}, nil
+}
+
+// Ping verifies the database can be reached
+func (db *DB) Ping(ctx context.Context) error {
+	return db.client.Ping(ctx, readpref.Primary())
+}
+
+// Close disconnects from the database, waiting for operations in progress until ctx is done
+func (db *DB) Close(ctx context.Context) error {
+	return db.client.Disconnect(ctx)
+}
+
+// combineMonitors forwards command events to each of the monitors
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				m.Started(ctx, e)
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				m.Succeeded(ctx, e)
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				m.Failed(ctx, e)
+			}
+		},
 	}
 }
 
+// Collection returns a collection of the service database, for subsystems
+// that keep their own records next to the users
+func (db *DB) Collection(name string) *mongo.Collection {
+	return db.client.Database(db.database).Collection(name)
+}
+
+// EnsureIndexes creates the indexes used for lookups and searches on users and audit events
+func (db *DB) EnsureIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Ascending indexes also serve anchored prefix searches. Emails are stored
+	// normalized, the case insensitive collation also keeps older mixed case
+	// documents from being registered twice
+	caseInsensitive := &options.Collation{Locale: "en", Strength: 2}
+	// Encrypted emails are unique and looked up through their blind index.
+	// Uniqueness is per organization, Migrate drops the global indexes
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"email": 1}},
+		{
+			Keys:    bson.D{{Key: "orgId", Value: 1}, {Key: "email", Value: 1}},
+			Options: options.Index().SetName("email_org_ci").SetUnique(true).SetCollation(caseInsensitive),
+		},
+		{
+			Keys:    bson.D{{Key: "orgId", Value: 1}, {Key: "emailIndex", Value: 1}},
+			Options: options.Index().SetName("emailIndex_org").SetUnique(true).SetPartialFilterExpression(bson.M{"emailIndex": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The unique indexes are what keeps concurrent registrations from taking the
+	// same username or email, the lookups in RegisterUser only give nicer errors.
+	// Run Migrate first, it drops the non unique index older deployments have
+	username := mongo.IndexModel{
+		Keys:    bson.D{{Key: "orgId", Value: 1}, {Key: "username", Value: 1}},
+		Options: options.Index().SetName("username_org").SetUnique(true),
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, username); err != nil {
+		return err
+	}
+
+	if err := db.ensureDisposableDomains(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureSessionIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureDeviceIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureTrustedDeviceIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureOrgIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureScimIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureIdentityIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureOAuthIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureGrantIndexes(ctx); err != nil {
+		return err
+	}
+
+	if err := db.ensureAPIKeyIndexes(ctx); err != nil {
+		return err
+	}
+
+	return db.ensureAuditIndexes(ctx)
+}
+
+// duplicateKey is the Mongo error code for writes that violate a unique index
+const duplicateKey = 11000
+
+// duplicateKeyMessages returns the messages of the unique index violations in err
+func duplicateKeyMessages(err error) []string {
+	var messages []string
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, writeErr := range e.WriteErrors {
+			if writeErr.Code == duplicateKey {
+				messages = append(messages, writeErr.Message)
+			}
+		}
+	case mongo.CommandError:
+		if e.Code == duplicateKey {
+			messages = append(messages, e.Message)
+		}
+	}
+
+	return messages
+}
+
+// isDuplicateKey reports whether err is a write that violated a unique index
+func isDuplicateKey(err error) bool {
+	return len(duplicateKeyMessages(err)) > 0
+}
+
+// takenError translates a duplicate key error on the username or email index
+// into the error users get when they pick a taken one, nil for other errors
+func takenError(err error, username, email string) error {
+	// The message names the index, e.g. "E11000 duplicate key error collection: auth.users index: username_1 dup key: ..."
+	for _, message := range duplicateKeyMessages(err) {
+		switch {
+		case strings.Contains(message, "index: username"):
+			return Errorf(CodeUsernameTaken, "Username %s taken.", username)
+		case strings.Contains(message, "index: email"):
+			return Errorf(CodeEmailTaken, "Email %s taken.", email)
+		}
+	}
+
+	return nil
+}
+
 // CreateUser fills struct values for insertion in database
 func CreateUser(input *model.RegisterInput) *UserModel {
-	return &UserModel{
-		ID:       primitive.NewObjectID(),
-		Fname:    input.Fname,
-		Lname:    input.Lname,
-		Email:    input.Email,
-		Username: input.Username,
-		Password: input.Password,
+	id := primitive.NewObjectID()
+	user := &UserModel{
+		ID:        id,
+		Fname:     input.Fname,
+		Lname:     input.Lname,
+		Email:     input.Email,
+		Username:  input.Username,
+		Password:  input.Password,
+		Roles:     []model.Role{model.RoleUser},
+		CreatedAt: id.Timestamp(),
+	}
+	if input.Locale != nil {
+		user.Locale = *input.Locale
 	}
+
+	return user
 }
 
 // RegisterUser a new user into the database, this function asumes input validation has been performed
-func (db *DB) RegisterUser(input *model.RegisterInput) (*model.Token, error) {
+func (db *DB) RegisterUser(ctx context.Context, input *model.RegisterInput) (*model.Token, error) {
 	// Select our mongo collection
 	collection := db.client.Database(db.database).Collection(db.collection)
 
 	// Connect
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	// Usernames and emails are unique within the organization, invitations
+	// pick the organization and email
+	var invite *invitation
+	var org primitive.ObjectID
+	var err error
+	if input.InviteToken != nil && *input.InviteToken != "" {
+		if invite, err = db.findInvitation(ctx, *input.InviteToken); err != nil {
+			return nil, err
+		}
+		if NormalizeEmail(input.Email) != invite.Email {
+			return nil, validationError([]FieldError{{Field: "email", Rule: "invitation", Message: "Register with the email the invitation was sent to."}})
+		}
+		org = invite.OrgID
+	} else if org, err = db.resolveOrg(ctx, input.Org); err != nil {
+		return nil, err
+	}
+
 	// Check that we don't have any duplicates
-	if user, _ := db.FindByUsername(input.Username); user != nil {
-		return nil, gqlerror.Errorf("Username %s taken.", input.Username)
+	if user, _ := db.FindByUsername(ctx, org, input.Username); user != nil {
+		return nil, Errorf(CodeUsernameTaken, "Username %s taken.", input.Username)
 	}
-	if user, _ := db.FindByEmail(input.Email); user != nil {
-		return nil, gqlerror.Errorf("Email %s taken.", input.Email)
+	if user, _ := db.FindByEmail(ctx, org, input.Email); user != nil {
+		return nil, Errorf(CodeEmailTaken, "Email %s taken.", input.Email)
+	}
+
+	if len(db.terms) > 0 && (input.AcceptTerms == nil || !*input.AcceptTerms) {
+		return nil, validationError([]FieldError{{Field: "acceptTerms", Rule: "required", Message: "You must accept the terms to register."}})
+	}
+
+	// Invited emails were chosen by an admin of the organization
+	var pending bool
+	if invite == nil {
+		if pending, err = db.checkDisposable(ctx, input.Email); err != nil {
+			return nil, err
+		}
 	}
 
 	user := CreateUser(input)
+	user.OrgID = org
+	user.PendingApproval = pending
+	if len(db.terms) > 0 {
+		now := time.Now()
+		user.Consents = map[string]Consent{}
+		for document, version := range db.terms {
+			user.Consents[string(document)] = Consent{Version: version, AcceptedAt: now}
+		}
+	}
+
+	// The invitation is claimed first so it is used once, receiving the token
+	// proves the user owns the email
+	role := model.OrgRoleMember
+	if invite != nil {
+		if err := db.claimInvitation(ctx, invite); err != nil {
+			return nil, err
+		}
+		user.Verified = true
+		role = invite.Role
+	}
 
 	// Insert to collection
-	res, err := collection.InsertOne(ctx, user)
+	_, err = collection.InsertOne(ctx, user)
 	if err != nil {
-		log.Fatal(err)
+		if invite != nil {
+			db.releaseInvitation(ctx, invite)
+		}
+
+		// Lost a race with a concurrent registration
+		if taken := takenError(err, input.Username, input.Email); taken != nil {
+			return nil, taken
+		}
+
+		logging.Logger.Error().Err(err).Msg("could not insert user")
+		return nil, Errorf(CodeInternal, "Could not register user, try again later.")
 	}
 
-	// If insertion is successful generate token
-	token, err := generateToken(jwt.MapClaims{
-		"_id":      res.InsertedID.(primitive.ObjectID).Hex(),
-		"username": input.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
+	metrics.Registrations.Inc()
+	db.invalidateUser(ctx, org, user.Username, user.Email)
 
-	// return token
-	return &model.Token{
-		Jwt: token,
-	}, nil
+	var member *Membership
+	if !org.IsZero() {
+		if member, err = db.addMember(ctx, org, user.ID, role); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not add member")
+			return nil, Errorf(CodeInternal, "Could not register user, try again later.")
+		}
+	}
+
+	// If insertion is successful generate token
+	return db.issueToken(ctx, user, member, "", time.Time{}, nil)
 }
 
-// FindByUsername utility function from the Mongo database
-func (db *DB) FindByUsername(username string) (*model.User, error) {
+// FindByUsername utility function from the Mongo database, org is the zero
+// id for the default namespace
+func (db *DB) FindByUsername(ctx context.Context, org primitive.ObjectID, username string) (*model.User, error) {
 	// Filter to pass to the mongo Find function
-	filter := bson.M{"username": username}
+	username = NormalizeUsername(username)
+	filter := bson.M{"orgId": orgScope(org), "username": username}
+
+	return db.cachedFind(ctx, usernameKey(org, username), filter, func(user *model.User) bool {
+		return user.Username == username
+	})
+}
+
+// UsernameAvailable reports whether nobody registered the username yet in the
+// organization with the given slug, or the default namespace when it is nil
+func (db *DB) UsernameAvailable(ctx context.Context, username string, orgSlug *string) (bool, error) {
+	if len(usernamePolicy.Check("username", NormalizeUsername(username))) > 0 {
+		return false, nil
+	}
 
-	return db.findWithFilter(filter)
+	org, err := db.resolveOrg(ctx, orgSlug)
+	if err != nil {
+		return false, err
+	}
+
+	user, err := db.FindByUsername(ctx, org, username)
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	if err != nil {
+		return false, Errorf(CodeInternal, "Could not check username availability.")
+	}
+
+	return user == nil, nil
 }
 
-// FindByEmail in database
-func (db *DB) FindByEmail(email string) (*model.User, error) {
-	filter := bson.M{"email": email}
+// FindByEmail in database, org is the zero id for the default namespace
+func (db *DB) FindByEmail(ctx context.Context, org primitive.ObjectID, email string) (*model.User, error) {
+	email = NormalizeEmail(email)
+	filter := emailFilter(email)
+	filter["orgId"] = orgScope(org)
 
-	return db.findWithFilter(filter)
+	return db.cachedFind(ctx, emailKey(org, email), filter, func(user *model.User) bool {
+		return user.Email == email
+	})
 }
 
 // findWithFilter in the database, this is to avoid repeating code
-func (db *DB) findWithFilter(filter bson.M) (*model.User, error) {
+func (db *DB) findWithFilter(ctx context.Context, filter bson.M) (*model.User, error) {
 	collection := db.client.Database(db.database).Collection(db.collection)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	// Where we store the resulting values
@@ -142,22 +579,21 @@ func (db *DB) findWithFilter(filter bson.M) (*model.User, error) {
 	}
 
 	// If nothing goes wrong then return
-	return &model.User{
-		ID:       user.ID.Hex(),
-		Username: user.Username,
-	}, nil
+	return toGraphUser(&user), nil
 }
 
-// FindUser from database and return
-func (db *DB) FindUser(email string) (*UserModel, error) {
+// FindUser from database and return, org is the zero id for the default namespace
+func (db *DB) FindUser(ctx context.Context, org primitive.ObjectID, email string) (*UserModel, error) {
 	collection := db.client.Database(db.database).Collection(db.collection)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	// To store user
 	var user UserModel
 	// Search in database
-	if res := collection.FindOne(ctx, bson.M{"email": email}).Decode(&user); res != nil {
+	filter := emailFilter(NormalizeEmail(email))
+	filter["orgId"] = orgScope(org)
+	if res := collection.FindOne(ctx, filter).Decode(&user); res != nil {
 		// Something went wrong
 		return nil, res
 	}
@@ -166,25 +602,346 @@ func (db *DB) FindUser(email string) (*UserModel, error) {
 }
 
 // AuthenticateUser and return a token
-func (db *DB) AuthenticateUser(auth *model.Authenticate) (*model.Token, error) {
-	user, err := db.FindUser(auth.Email)
+func (db *DB) AuthenticateUser(ctx context.Context, auth *model.Authenticate) (*model.Token, error) {
+	return db.login(ctx, auth, false)
+}
+
+// login checks the credentials and state of the account and issues a token,
+// acceptTerms records the consent of users who haven't accepted the current terms
+func (db *DB) login(ctx context.Context, auth *model.Authenticate, acceptTerms bool) (token *model.Token, err error) {
+	ctx, span := tracing.Start(ctx, "auth.AuthenticateUser")
+	defer span.End()
+	defer func() {
+		metrics.Logins.WithLabelValues(metrics.Result(err)).Inc()
+		span.RecordError(err)
+	}()
+
+	user, member, err := db.findLogin(ctx, auth.Org, auth.Email)
 	if err != nil {
-		return nil, gqlerror.Errorf("Could not find user with email '%s'.", auth.Email)
+		return nil, err
 	}
 
-	if !ComparePasswords([]byte(user.Password), []byte(auth.Password)) {
-		return nil, gqlerror.Errorf("Passwords don't match.")
+	// Password hashing dominates login latency, give it its own span
+	_, compare := tracing.Start(ctx, "password.compare")
+	match := ComparePasswords([]byte(user.Password), []byte(auth.Password))
+	compare.End()
+	if !match {
+		return nil, Errorf(CodeInvalidCredentials, "Passwords don't match.")
 	}
 
+	if err := checkAccount(user); err != nil {
+		return nil, err
+	}
+
+	if user.MustResetPassword {
+		return nil, Errorf(CodePasswordResetRequired, "Password reset required, use changePassword to set a new one.")
+	}
+
+	amr, err := db.secondFactor(ctx, user, auth.Otp, auth.DeviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if acceptTerms {
+		if err := db.recordConsent(ctx, user); err != nil {
+			return nil, err
+		}
+	} else if db.pendingTerms(user) {
+		return nil, Errorf(CodeTermsNotAccepted, "The terms have changed, use acceptTerms to accept them.")
+	}
+
+	if hasher.NeedsRehash(user.Password) {
+		go db.rehashPassword(user, auth.Password)
+	}
+
+	db.notifyLogin(ctx, user, db.checkDevice(ctx, user))
+
 	// If passwords match then we issue a token for the user
-	token, err := generateToken(jwt.MapClaims{
-		"_id":      user.ID.Hex(),
-		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
+	_, sign := tracing.Start(ctx, "jwt.sign")
+	defer sign.End()
+	if token, err = db.issueToken(ctx, user, member, "", time.Time{}, amr); err != nil {
+		return nil, err
+	}
+	if isAMR(amr, amrOTP) && auth.RememberDevice != nil && *auth.RememberDevice {
+		token.DeviceToken = db.rememberDevice(ctx, user)
+	}
+	return token, nil
+}
 
-	// Finally return a token for graphql
-	return &model.Token{
-		Jwt: token,
+// checkAccount rejects logins to accounts that are disabled, awaiting
+// approval, scheduled for deletion or erased
+func checkAccount(user *UserModel) error {
+	if user.Disabled {
+		return Errorf(CodeAccountLocked, "Account is disabled.")
+	}
+
+	if user.PendingApproval {
+		return Errorf(CodeAccountPendingApproval, "Account is awaiting approval by an administrator.")
+	}
+
+	if user.DeleteAfter != nil {
+		return Errorf(CodeAccountPendingDeletion, "Account is scheduled for deletion, use cancelDeletion to restore it.")
+	}
+
+	if user.ErasedAt != nil {
+		return Errorf(CodeInvalidCredentials, "Passwords don't match.")
+	}
+
+	return nil
+}
+
+// rehashPassword replaces a hash made with an old algorithm or parameters by one
+// from the current hasher. It runs after the login is answered, so it doesn't
+// use the request context, and leaves the document alone if the password changed
+func (db *DB) rehashPassword(user *UserModel, password string) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		logging.Logger.Error().Err(err).Msg("could not rehash password")
+		return
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": user.ID, "password": user.Password}
+	if _, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"password": hash}}); err != nil {
+		logging.Logger.Error().Err(err).Str("user_id", user.ID.Hex()).Msg("could not store rehashed password")
+	}
+}
+
+// FindByID returns the full user document for a hex encoded id
+func (db *DB) FindByID(ctx context.Context, id string) (*UserModel, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user UserModel
+	if res := collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&user); res != nil {
+		return nil, res
+	}
+
+	return &user, nil
+}
+
+// RefreshUserToken trades a refresh token for a new pair of tokens as long
+// as the account is still active
+func (db *DB) RefreshUserToken(ctx context.Context, token *model.RefreshToken) (newToken *model.Token, err error) {
+	defer func() { metrics.TokenRefreshes.WithLabelValues(metrics.Result(err)).Inc() }()
+
+	// Tokens of disabled accounts or accounts scheduled for deletion are revoked.
+	// Impersonations have no refresh token, they end when their token expires
+	claims, user, err := db.verifyRefresh(ctx, token.OldToken)
+	if err != nil {
+		return nil, err
+	}
+	// A stolen bound token can't be refreshed into one bound to another key
+	if claims.JKT != "" {
+		if jkt, err := db.checkProof(ctx, ""); err != nil || jkt != claims.JKT {
+			return nil, Errorf(CodeInvalidToken, "Invalid DPoP proof.")
+		}
+	}
+
+	// Each token is refreshed once, whoever refreshes a copy after that is refused
+	if err := db.useForRefresh(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	member, err := db.membershipFor(ctx, claims, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reissue from the account so role changes are picked up, in the same session
+	return db.issueToken(ctx, user, member, claims.SessionID, claims.AuthTime, claims.AMR)
+}
+
+// ScheduleDeletion marks the account for deletion once the grace period is over.
+// Outstanding tokens stop being accepted as soon as the account is marked.
+func (db *DB) ScheduleDeletion(ctx context.Context, id string) (*model.AccountDeletion, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid user id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	purgeAt := time.Now().Add(db.gracePeriod)
+	filter := bson.M{"_id": oid, "deleteAfter": bson.M{"$exists": false}}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"deleteAfter": purgeAt}})
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not schedule account deletion.")
+	}
+	if res.MatchedCount == 0 {
+		return nil, gqlerror.Errorf("Account is already scheduled for deletion.")
+	}
+
+	return &model.AccountDeletion{
+		ID:      id,
+		PurgeAt: purgeAt,
 	}, nil
 }
+
+// CancelDeletion restores an account during the grace period and issues a new token.
+// The user authenticates with their credentials since their tokens were revoked.
+func (db *DB) CancelDeletion(ctx context.Context, auth *model.Authenticate) (*model.Token, error) {
+	user, member, err := db.findLogin(ctx, auth.Org, auth.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ComparePasswords([]byte(user.Password), []byte(auth.Password)) {
+		return nil, Errorf(CodeInvalidCredentials, "Passwords don't match.")
+	}
+
+	if user.DeleteAfter == nil {
+		return nil, gqlerror.Errorf("Account is not scheduled for deletion.")
+	}
+
+	amr, err := db.secondFactor(ctx, user, auth.Otp, auth.DeviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"deleteAfter": ""}}); err != nil {
+		return nil, Errorf(CodeInternal, "Could not cancel account deletion.")
+	}
+
+	return db.issueToken(ctx, user, member, "", time.Time{}, amr)
+}
+
+// ChangePassword replaces the password of a user after checking the current one,
+// this also clears a reset forced by an admin. Every other token of the user is revoked
+func (db *DB) ChangePassword(ctx context.Context, input *model.ChangePasswordInput) (*model.Token, error) {
+	user, member, err := db.findLogin(ctx, input.Org, input.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ComparePasswords([]byte(user.Password), []byte(input.Password)) {
+		return nil, Errorf(CodeInvalidCredentials, "Passwords don't match.")
+	}
+
+	// Changing the password is a login, it is how required resets end
+	if err := checkAccount(user); err != nil {
+		return nil, err
+	}
+
+	amr, err := db.secondFactor(ctx, user, input.Otp, input.DeviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := validPassword("newPassword", input.NewPassword, input.ConfirmPassword, user.Username, user.Email); len(errs) > 0 {
+		return nil, validationError(errs)
+	}
+
+	password, err := HashPassword(input.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	// Other sessions and refresh tokens may belong to whoever knew the old password
+	update := bson.M{
+		"$set": bson.M{"password": password, "mustResetPassword": false},
+		"$inc": bson.M{"tokenVersion": 1},
+	}
+	if _, err := db.updateUser(ctx, user.ID.Hex(), update); err != nil {
+		return nil, Errorf(CodeInternal, "Could not change password.")
+	}
+	user.TokenVersion++
+
+	sessions := db.client.Database(db.database).Collection(sessionsCollection)
+	if _, err := sessions.DeleteMany(ctx, bson.M{"userId": user.ID}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove sessions")
+	}
+
+	// The new password is kept, the user accepts the terms when logging in with it
+	if db.pendingTerms(user) {
+		return nil, Errorf(CodeTermsNotAccepted, "The terms have changed, use acceptTerms to accept them.")
+	}
+
+	return db.issueToken(ctx, user, member, "", time.Time{}, amr)
+}
+
+// Reauthenticate checks the password of the user a token was issued to and
+// returns a token of the same session with a fresh auth_time, for operations
+// that require a recent login
+func (db *DB) Reauthenticate(ctx context.Context, claims *Claims, password string, otp, deviceToken *string) (*model.Token, error) {
+	user, err := db.FindByID(ctx, claims.UserID)
+	if err != nil || !user.Active() {
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	if !ComparePasswords([]byte(user.Password), []byte(password)) {
+		return nil, Errorf(CodeInvalidCredentials, "Passwords don't match.")
+	}
+
+	// A fresh auth_time must take what a login takes
+	amr, err := db.secondFactor(ctx, user, otp, deviceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := db.membershipFor(ctx, claims, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.issueToken(ctx, user, member, claims.SessionID, time.Time{}, amr)
+}
+
+// PurgeDeletedUsers removes every account whose grace period has ended, with its memberships
+func (db *DB) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"deleteAfter": bson.M{"$lte": time.Now()}}
+	ids, err := collection.Distinct(ctx, "_id", filter)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	res, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	// Accounts restored in the meantime keep their memberships
+	restored, err := collection.Distinct(ctx, "_id", bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return res.DeletedCount, err
+	}
+	memberships := db.client.Database(db.database).Collection(membershipsCollection)
+	purged := bson.M{"userId": bson.M{"$in": ids, "$nin": restored}}
+	if _, err := memberships.DeleteMany(ctx, purged); err != nil {
+		return res.DeletedCount, err
+	}
+
+	return res.DeletedCount, nil
+}
+
+// PurgeJob runs PurgeDeletedUsers as a periodic task, logging what it removed
+func (db *DB) PurgeJob(ctx context.Context) error {
+	n, err := db.PurgeDeletedUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logging.Logger.Info().Int64("count", n).Msg("purged deleted users")
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/cache"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Denylist holds the ids (jti) of revoked tokens until the tokens expire
+type Denylist interface {
+	Revoke(ctx context.Context, jti string, expiry time.Time) error
+	Revoked(ctx context.Context, jti string) (bool, error)
+}
+
+// MemoryDenylist keeps revoked tokens in process, for single instance deployments
+type MemoryDenylist struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryDenylist returns an empty denylist
+func NewMemoryDenylist() *MemoryDenylist {
+	return &MemoryDenylist{revoked: map[string]time.Time{}}
+}
+
+// Revoke implements Denylist, expired entries stay until the next Sweep
+func (d *MemoryDenylist) Revoke(ctx context.Context, jti string, expiry time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.revoked[jti] = expiry
+	return nil
+}
+
+// Sweep implements Sweeper
+func (d *MemoryDenylist) Sweep(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for id, until := range d.revoked {
+		if now.After(until) {
+			delete(d.revoked, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Revoked implements Denylist
+func (d *MemoryDenylist) Revoked(ctx context.Context, jti string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	until, ok := d.revoked[jti]
+	return ok && time.Now().Before(until), nil
+}
+
+// CacheDenylist keeps revoked tokens in a shared cache such as Redis, entries
+// expire with the tokens. The cache must not evict entries early, an LRU won't do
+type CacheDenylist struct {
+	cache cache.Cache
+}
+
+// NewCacheDenylist returns a denylist stored in c
+func NewCacheDenylist(c cache.Cache) *CacheDenylist {
+	return &CacheDenylist{cache: c}
+}
+
+// Revoke implements Denylist
+func (d *CacheDenylist) Revoke(ctx context.Context, jti string, expiry time.Time) error {
+	ttl := time.Until(expiry)
+	if ttl <= 0 {
+		return nil
+	}
+
+	return d.cache.Set(ctx, "denylist:"+jti, []byte{1}, ttl)
+}
+
+// Revoked implements Denylist
+func (d *CacheDenylist) Revoked(ctx context.Context, jti string) (bool, error) {
+	_, ok, err := d.cache.Get(ctx, "denylist:"+jti)
+	return ok, err
+}
+
+// SetDenylist changes where revoked tokens are kept, the default is in process
+func (db *DB) SetDenylist(d Denylist) {
+	db.denylist = d
+}
+
+// refreshedTokensCollection holds the ids of the tokens refreshed, until they expire
+const refreshedTokensCollection = "refreshed_tokens"
+
+// useForRefresh records that the token with claims was refreshed, it fails
+// when it was before so a captured token can't be refreshed again. The
+// session is then revoked, see refreshReused
+func (db *DB) useForRefresh(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return Errorf(CodeInvalidToken, "Token can't be refreshed.")
+	}
+
+	collection := db.client.Database(db.database).Collection(refreshedTokensCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// The token could be presented until its expiry plus the leeway
+	record := bson.M{"_id": claims.ID, "expiresAt": claims.Expiry.Add(db.tokens.leeway)}
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		if isDuplicateKey(err) {
+			db.refreshReused(ctx, claims.UserID, claims.SessionID, claims.ClientID)
+			return Errorf(CodeTokenReused, "Token was already refreshed, log in again.")
+		}
+		logging.Ctx(ctx).Error().Err(err).Msg("could not record refreshed token")
+		return Errorf(CodeInternal, "Server error could not generate a new token.")
+	}
+
+	return nil
+}
+
+// refreshReused handles a token or refresh token presented again after it
+// was refreshed. Either the client or a thief holds a copy, there is no
+// telling which, so the session and every token of it are revoked and the
+// user has to log in again. Tokens without a session revoke every session
+func (db *DB) refreshReused(ctx context.Context, userID, sessionID, clientID string) {
+	logging.Ctx(ctx).Warn().Str("user_id", userID).Str("session_id", sessionID).Msg("refreshed token reused, revoking its session")
+
+	var err error
+	if sessionID != "" {
+		err = db.endOAuthSession(ctx, userID, sessionID)
+	} else {
+		err = db.revokeAllSessions(ctx, userID)
+	}
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not revoke session of reused token")
+	}
+
+	details := map[string]string{"sessionId": sessionID}
+	if clientID != "" {
+		details["clientId"] = clientID
+	}
+	db.Audit(ctx, model.AuditEventTypeTokenReuse, userID, details)
+}
+
+// RevokeToken rejects a token from now on, even though it hasn't expired
+func (db *DB) RevokeToken(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return gqlerror.Errorf("Token can't be revoked.")
+	}
+
+	// Expired tokens are accepted for the leeway, they stay denied until then
+	if err := db.denylist.Revoke(ctx, claims.ID, claims.Expiry.Add(db.tokens.leeway)); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not revoke token")
+		return Errorf(CodeInternal, "Could not revoke token.")
+	}
+	// The denylist already rejects it, this only frees the record
+	if db.opaque != nil {
+		if err := db.opaque.Delete(ctx, claims.ID); err != nil {
+			logging.Ctx(ctx).Warn().Err(err).Msg("could not delete opaque token")
+		}
+	}
+
+	return nil
+}
+
+// RevokeTokenString revokes a token given in full, such as one that leaked
+func (db *DB) RevokeTokenString(ctx context.Context, tokenString string) error {
+	tokenString, err := db.resolveOpaque(ctx, tokenString)
+	if err != nil {
+		return err
+	}
+	claims, err := db.tokens.VerifyToken(tokenString)
+	if err != nil {
+		return err
+	}
+
+	return db.RevokeToken(ctx, claims)
+}
+
+// checkRevoked fails for tokens on the denylist. When the denylist can't be
+// reached tokens are rejected rather than risk accepting a revoked one
+func (db *DB) checkRevoked(ctx context.Context, claims *Claims) error {
+	// Tokens issued before jti was added can't be revoked individually
+	if claims.ID == "" {
+		return nil
+	}
+
+	revoked, err := db.denylist.Revoked(ctx, claims.ID)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not check the token denylist")
+		return Errorf(CodeInternal, "Could not verify token, try again later.")
+	}
+	if revoked {
+		return Errorf(CodeTokenRevoked, "Token has been revoked.")
+	}
+
+	return nil
+}
+
+// newTokenID returns a random jti
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
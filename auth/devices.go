@@ -0,0 +1,112 @@
+package auth
+
+// Detection of logins from devices a user hasn't logged in from before. A
+// device is identified by its user agent and the network it connects from,
+// so a phone changing address within its carrier's range isn't new.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// devicesCollection holds a document per user and device
+const devicesCollection = "devices"
+
+// deviceRetention is how long a device is remembered after its last login
+const deviceRetention = 180 * 24 * time.Hour
+
+// Device is a device a user logged in from
+type Device struct {
+	// Hash of the user and the device fingerprint
+	ID        string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	UserAgent string             `bson:"userAgent"`
+	IP        string             `bson:"ip"`
+	FirstSeen time.Time          `bson:"firstSeen"`
+	LastSeen  time.Time          `bson:"lastSeen"`
+}
+
+// ensureDeviceIndexes indexes devices by user, the TTL index forgetting the
+// ones not seen in a while is created by a migration
+func (db *DB) ensureDeviceIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(devicesCollection)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"userId": 1}})
+	return err
+}
+
+// ipRange returns the network an address belongs to, the /24 for IPv4 and
+// the /48 for IPv6
+func ipRange(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// deviceID hashes the user and the fingerprint of the device
+func deviceID(userID primitive.ObjectID, userAgent, ip string) string {
+	sum := sha256.Sum256([]byte(userID.Hex() + "\n" + userAgent + "\n" + ipRange(ip)))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkDevice records the device of a successful login and reports whether it
+// wasn't seen before. Accounts without any known device, such as accounts that
+// existed before devices were recorded, don't get a new device on their first
+// login. Failures are logged, they never fail the login.
+func (db *DB) checkDevice(ctx context.Context, user *UserModel) bool {
+	info := requestForContext(ctx)
+	if info == nil {
+		return false
+	}
+
+	collection := db.client.Database(db.database).Collection(devicesCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	known, err := collection.CountDocuments(ctx, bson.M{"userId": user.ID})
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not look up devices")
+		return false
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{"lastSeen": now, "ip": info.IP},
+		"$setOnInsert": bson.M{
+			"userId":    user.ID,
+			"userAgent": info.UserAgent,
+			"firstSeen": now,
+		},
+	}
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": deviceID(user.ID, info.UserAgent, info.IP)}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not record device")
+		return false
+	}
+
+	if res.UpsertedCount == 0 || known == 0 {
+		return false
+	}
+
+	db.Audit(ctx, model.AuditEventTypeNewDevice, user.ID.Hex(), map[string]string{
+		"ip":        info.IP,
+		"userAgent": info.UserAgent,
+	})
+
+	return true
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// disposableCollection holds the blocklist, documents look like {_id: "mailinator.com", blocked: true}.
+// Removed domains are kept with blocked set to false so they aren't seeded again
+const disposableCollection = "disposable_domains"
+
+// What registration does with a disposable email, set by DISPOSABLE_EMAILS
+const (
+	DisposableOff     = "off"
+	DisposableWarn    = "warn"
+	DisposableBlock   = "block"
+	DisposableApprove = "approve"
+)
+
+// disposableDomains seed the blocklist, admins can add and remove domains at runtime
+var disposableDomains = []string{
+	"mailinator.com", "guerrillamail.com", "guerrillamail.net", "sharklasers.com", "grr.la", "10minutemail.com",
+	"temp-mail.org", "tempmail.net", "tempail.com", "yopmail.com", "trashmail.com", "getnada.com",
+	"dispostable.com", "maildrop.cc", "throwawaymail.com", "fakeinbox.com", "mailnesia.com", "mintemail.com",
+	"emailondeck.com", "moakt.com", "mohmal.com", "burnermail.io", "spamgourmet.com", "mytemp.email",
+}
+
+// ensureDisposableDomains seeds the blocklist with the built in domains
+func (db *DB) ensureDisposableDomains(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(disposableCollection)
+
+	var models []mongo.WriteModel
+	for _, domain := range disposableDomains {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": domain}).
+			SetUpdate(bson.M{"$setOnInsert": bson.M{"blocked": true}}).
+			SetUpsert(true))
+	}
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// isDisposable reports whether email belongs to a blocked domain or one of its subdomains
+func (db *DB) isDisposable(ctx context.Context, email string) (bool, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false, nil
+	}
+
+	// a.b.mailinator.com also matches b.mailinator.com and mailinator.com
+	var domains []string
+	for domain := email[at+1:]; strings.Contains(domain, "."); domain = domain[strings.Index(domain, ".")+1:] {
+		domains = append(domains, domain)
+	}
+
+	collection := db.client.Database(db.database).Collection(disposableCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	n, err := collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": domains}, "blocked": true})
+	return n > 0, err
+}
+
+// checkDisposable applies DISPOSABLE_EMAILS to the email of a new registration
+// or profile update, it returns whether the account has to wait for an
+// administrator's approval
+func (db *DB) checkDisposable(ctx context.Context, email string) (bool, error) {
+	if db.disposableMode == DisposableOff {
+		return false, nil
+	}
+
+	disposable, err := db.isDisposable(ctx, email)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not check for disposable email")
+		return false, Errorf(CodeInternal, "Could not check the email address, try again later.")
+	}
+	if !disposable {
+		return false, nil
+	}
+
+	switch db.disposableMode {
+	case DisposableBlock:
+		return false, validationError([]FieldError{{Field: "email", Rule: "disposable", Message: "Disposable email addresses are not allowed."}})
+	case DisposableApprove:
+		return true, nil
+	default:
+		logging.Ctx(ctx).Warn().Str("email", email).Msg("disposable email used")
+		return false, nil
+	}
+}
+
+// DisposableDomains lists the blocked domains
+func (db *DB) DisposableDomains(ctx context.Context) ([]string, error) {
+	collection := db.client.Database(db.database).Collection(disposableCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"blocked": true}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not list disposable domains.")
+	}
+
+	var docs []struct {
+		Domain string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list disposable domains.")
+	}
+
+	domains := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		domains = append(domains, doc.Domain)
+	}
+
+	return domains, nil
+}
+
+// SetDisposableDomain adds a domain to the blocklist or removes it
+func (db *DB) SetDisposableDomain(ctx context.Context, domain string, blocked bool) error {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if !strings.Contains(domain, ".") || strings.Contains(domain, "@") {
+		return gqlerror.Errorf("Invalid domain %s.", domain)
+	}
+
+	collection := db.client.Database(db.database).Collection(disposableCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"blocked": blocked}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": domain}, update, options.Update().SetUpsert(true)); err != nil {
+		return Errorf(CodeInternal, "Could not update disposable domain %s.", domain)
+	}
+
+	return nil
+}
+
+// ApproveUser lets an account registered with a disposable email log in
+func (db *DB) ApproveUser(ctx context.Context, id string) (*model.User, error) {
+	return db.updateUser(ctx, id, bson.M{"$set": bson.M{"pendingApproval": false}})
+}
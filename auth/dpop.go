@@ -0,0 +1,239 @@
+package auth
+
+// DPoP sender-constrained tokens, RFC 9449, so a stolen token is useless
+// without the private key of the client it was issued to. Clients send a
+// proof, a JWT signed with their key carrying the key itself, in the DPoP
+// header when logging in or refreshing. The token is then bound to the key
+// through the thumbprint in its cnf claim, and every request using it must
+// come with a new proof of the same key, sent as "Authorization: DPoP
+// <token>". Proofs are single use: their jti is kept in the denylist until
+// they are too old to be accepted anyway.
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// DPoPHeader carries the proofs
+const DPoPHeader = "DPoP"
+
+// dpopWindow is how far the iat of proofs can be from now
+const dpopWindow = 5 * time.Minute
+
+var errInvalidProof = errors.New("invalid DPoP proof")
+
+var dpopCtxKey = &contextKey{"dpop"}
+
+// DPoPProof is a verified proof
+type DPoPProof struct {
+	// Unique id of the proof, to detect replays
+	ID string
+	// Thumbprint of the key that signed it, RFC 7638
+	JKT      string
+	IssuedAt time.Time
+}
+
+// dpopJWK is the public key in the header of a proof
+type dpopJWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+// publicKey returns the key for jwt-go and its thumbprint, EC P-256 keys
+// for ES256 and Ed25519 keys for EdDSA are supported
+func (k *dpopJWK) publicKey() (interface{}, string, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, "", errInvalidProof
+	}
+
+	// The thumbprint hashes the required members in lexicographic order
+	var key interface{}
+	var members string
+	switch {
+	case k.Kty == "EC" && k.Crv == "P-256":
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil || len(x) != 32 || len(y) != 32 {
+			return nil, "", errInvalidProof
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, "", errInvalidProof
+		}
+		key = public
+		members = `{"crv":"P-256","kty":"EC","x":"` + k.X + `","y":"` + k.Y + `"}`
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, "", errInvalidProof
+		}
+		key = ed25519.PublicKey(x)
+		members = `{"crv":"Ed25519","kty":"OKP","x":"` + k.X + `"}`
+	default:
+		return nil, "", errInvalidProof
+	}
+	sum := sha256.Sum256([]byte(members))
+
+	return key, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// htu returns url without its query and fragment, as proofs name it
+func htu(url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		return url[:i]
+	}
+
+	return url
+}
+
+// VerifyDPoPProof checks a proof for a request with method to url, made
+// along with accessToken or at a login when it is empty, and returns it.
+// Callers must reject proofs whose ID they already saw
+func VerifyDPoPProof(proof, method, url, accessToken string) (*DPoPProof, error) {
+	var jkt string
+	// iat is checked below with leeway, jwt-go would refuse clocks slightly ahead
+	parser := jwt.Parser{ValidMethods: []string{"ES256", "EdDSA"}, SkipClaimsValidation: true}
+	token, err := parser.Parse(proof, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, errInvalidProof
+		}
+		raw, err := json.Marshal(token.Header["jwk"])
+		if err != nil {
+			return nil, errInvalidProof
+		}
+		var jwk dpopJWK
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, errInvalidProof
+		}
+		// Keys of the wrong type fail verification in jwt-go
+		var key interface{}
+		key, jkt, err = jwk.publicKey()
+		return key, err
+	})
+	if err != nil || !token.Valid {
+		return nil, errInvalidProof
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	htm, _ := claims["htm"].(string)
+	u, _ := claims["htu"].(string)
+	iat, _ := claims["iat"].(float64)
+	issuedAt := time.Unix(int64(iat), 0)
+	if age := time.Since(issuedAt); age > dpopWindow || age < -dpopWindow {
+		return nil, errInvalidProof
+	}
+	if jti == "" || htm != method || htu(u) != htu(url) {
+		return nil, errInvalidProof
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return nil, errInvalidProof
+		}
+	}
+
+	return &DPoPProof{ID: jti, JKT: jkt, IssuedAt: issuedAt}, nil
+}
+
+// ProofExpiry is until when the ID of proof must be remembered to reject replays
+func ProofExpiry(proof *DPoPProof) time.Time {
+	return proof.IssuedAt.Add(dpopWindow)
+}
+
+// dpopRequest is the proof sent with a request, checked once
+type dpopRequest struct {
+	proof  string
+	method string
+	url    string
+
+	once sync.Once
+	jkt  string
+	err  error
+}
+
+// withProof keeps the DPoP proof of r around, url is r as the client
+// addressed it
+func withProof(r *http.Request, url string) *http.Request {
+	proof := r.Header.Get(DPoPHeader)
+	if proof == "" {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), dpopCtxKey, &dpopRequest{proof: proof, method: r.Method, url: url}))
+}
+
+// checkProof verifies the proof of the request, once, and returns the
+// thumbprint of its key. accessToken is the token sent with it, empty at
+// logins. Requests without a proof return an empty thumbprint
+func (db *DB) checkProof(ctx context.Context, accessToken string) (string, error) {
+	req, _ := ctx.Value(dpopCtxKey).(*dpopRequest)
+	if req == nil {
+		return "", nil
+	}
+
+	req.once.Do(func() {
+		proof, err := VerifyDPoPProof(req.proof, req.method, req.url, accessToken)
+		if err != nil {
+			req.err = Errorf(CodeInvalidToken, "Invalid DPoP proof.")
+			return
+		}
+
+		replayed, err := db.denylist.Revoked(ctx, "dpop:"+proof.ID)
+		if err == nil && !replayed {
+			err = db.denylist.Revoke(ctx, "dpop:"+proof.ID, ProofExpiry(proof))
+		}
+		if err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not check DPoP proof replay")
+			req.err = Errorf(CodeInternal, "Could not verify the DPoP proof, try again later.")
+			return
+		}
+		if replayed {
+			req.err = Errorf(CodeInvalidToken, "Invalid DPoP proof.")
+			return
+		}
+		req.jkt = proof.JKT
+	})
+
+	return req.jkt, req.err
+}
+
+// checkBinding verifies a token sent with scheme, "Bearer", "DPoP" or
+// empty for cookies, is bound to the key of the proof of the request when
+// it is bound at all
+func (db *DB) checkBinding(ctx context.Context, scheme, token string, claims *Claims) error {
+	switch {
+	case claims.JKT == "" && scheme == DPoPHeader:
+		return Errorf(CodeInvalidToken, "The token isn't bound to a DPoP key.")
+	case claims.JKT == "":
+		return nil
+	case scheme == "Bearer":
+		// Sending a bound token as a bearer token would skip the proof
+		return Errorf(CodeInvalidToken, "Bound tokens must be sent with the DPoP scheme.")
+	}
+
+	jkt, err := db.checkProof(ctx, token)
+	if err != nil {
+		return err
+	}
+	if jkt == "" || jkt != claims.JKT {
+		return Errorf(CodeInvalidToken, "Invalid DPoP proof.")
+	}
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const testDPoPURL = "https://auth.example.com/query"
+
+func newDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// ecJWK returns the JWK of key as clients put it in proofs
+func ecJWK(key *ecdsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// ath returns the hash of token proofs made along with it carry
+func ath(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// newProof returns a proof signed with key for a POST to testDPoPURL, edit
+// changes its header and claims before signing
+func newProof(t *testing.T, key *ecdsa.PrivateKey, edit func(header map[string]interface{}, claims jwt.MapClaims)) string {
+	t.Helper()
+
+	jti := make([]byte, 16)
+	rand.Read(jti)
+	claims := jwt.MapClaims{"jti": hex.EncodeToString(jti), "htm": http.MethodPost, "htu": testDPoPURL, "iat": time.Now().Unix()}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = ecJWK(&key.PublicKey)
+	if edit != nil {
+		edit(token.Header, claims)
+	}
+
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+// The key and thumbprint of the examples of RFC 9449
+func TestDPoPThumbprint(t *testing.T) {
+	jwk := dpopJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   "l8tFrhx-34tV3hRICRDY9zCkDlpBhF42UQUfWVAWBFs",
+		Y:   "9VE4jf_Ok_o64zbTTlcuNJajHmt6v9TDVrU0CdvGRDA",
+	}
+	_, jkt, err := jwk.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"; jkt != want {
+		t.Errorf("publicKey() thumbprint = %s, want %s", jkt, want)
+	}
+}
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key, other := newDPoPKey(t), newDPoPKey(t)
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		proof       func() string
+		method      string
+		url         string
+		accessToken string
+		wantErr     bool
+	}{
+		{
+			name:  "login proof",
+			proof: func() string { return newProof(t, key, nil) },
+		},
+		{
+			name: "proof with a token",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) { claims["ath"] = ath("token") })
+			},
+			accessToken: "token",
+		},
+		{
+			name: "Ed25519 key",
+			proof: func() string {
+				claims := jwt.MapClaims{"jti": "ed", "htm": http.MethodPost, "htu": testDPoPURL, "iat": time.Now().Unix()}
+				token := jwt.NewWithClaims(signingMethodEd25519, claims)
+				token.Header["typ"] = "dpop+jwt"
+				token.Header["jwk"] = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(edPublic)}
+				proof, _ := token.SignedString(edPrivate)
+				return proof
+			},
+		},
+		{
+			name: "bad signature",
+			proof: func() string {
+				return newProof(t, key, func(header map[string]interface{}, _ jwt.MapClaims) { header["jwk"] = ecJWK(&other.PublicKey) })
+			},
+			wantErr: true,
+		},
+		{
+			name: "claims changed after signing",
+			proof: func() string {
+				parts := strings.Split(newProof(t, key, nil), ".")
+				payload, _ := jwt.DecodeSegment(parts[1])
+				parts[1] = jwt.EncodeSegment([]byte(strings.Replace(string(payload), `"POST"`, `"GET"`, 1)))
+				return strings.Join(parts, ".")
+			},
+			method:  http.MethodGet,
+			wantErr: true,
+		},
+		{
+			name: "wrong typ",
+			proof: func() string {
+				return newProof(t, key, func(header map[string]interface{}, _ jwt.MapClaims) { header["typ"] = "JWT" })
+			},
+			wantErr: true,
+		},
+		{
+			name: "no jwk",
+			proof: func() string {
+				return newProof(t, key, func(header map[string]interface{}, _ jwt.MapClaims) { delete(header, "jwk") })
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsigned",
+			proof: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"jti": "none", "htm": http.MethodPost, "htu": testDPoPURL, "iat": time.Now().Unix()})
+				token.Header["typ"] = "dpop+jwt"
+				token.Header["jwk"] = ecJWK(&key.PublicKey)
+				proof, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+				return proof
+			},
+			wantErr: true,
+		},
+		{
+			name:    "htm mismatch",
+			proof:   func() string { return newProof(t, key, nil) },
+			method:  http.MethodGet,
+			wantErr: true,
+		},
+		{
+			name:    "htu mismatch",
+			proof:   func() string { return newProof(t, key, nil) },
+			url:     "https://auth.example.com/v1/login",
+			wantErr: true,
+		},
+		{
+			name:  "htu without the query",
+			proof: func() string { return newProof(t, key, nil) },
+			url:   testDPoPURL + "?operation=me",
+		},
+		{
+			name: "ath mismatch",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) { claims["ath"] = ath("other") })
+			},
+			accessToken: "token",
+			wantErr:     true,
+		},
+		{
+			name:        "login proof with a token",
+			proof:       func() string { return newProof(t, key, nil) },
+			accessToken: "token",
+			wantErr:     true,
+		},
+		{
+			name: "iat too old",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) {
+					claims["iat"] = time.Now().Add(-dpopWindow - time.Minute).Unix()
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "iat too far ahead",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) {
+					claims["iat"] = time.Now().Add(dpopWindow + time.Minute).Unix()
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "iat slightly ahead",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) {
+					claims["iat"] = time.Now().Add(time.Minute).Unix()
+				})
+			},
+		},
+		{
+			name: "no iat",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) { delete(claims, "iat") })
+			},
+			wantErr: true,
+		},
+		{
+			name: "no jti",
+			proof: func() string {
+				return newProof(t, key, func(_ map[string]interface{}, claims jwt.MapClaims) { delete(claims, "jti") })
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, url := tt.method, tt.url
+			if method == "" {
+				method = http.MethodPost
+			}
+			if url == "" {
+				url = testDPoPURL
+			}
+
+			proof, err := VerifyDPoPProof(tt.proof(), method, url, tt.accessToken)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyDPoPProof() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && proof.JKT == "" {
+				t.Error("VerifyDPoPProof() returned no thumbprint")
+			}
+		})
+	}
+}
+
+// dpopContext returns the context of a request to testDPoPURL sending proof
+func dpopContext(proof string) context.Context {
+	r := httptest.NewRequest(http.MethodPost, testDPoPURL, nil)
+	if proof != "" {
+		r.Header.Set(DPoPHeader, proof)
+	}
+
+	return withProof(r, testDPoPURL).Context()
+}
+
+func TestCheckBinding(t *testing.T) {
+	key, other := newDPoPKey(t), newDPoPKey(t)
+	verified, err := VerifyDPoPProof(newProof(t, key, nil), http.MethodPost, testDPoPURL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt := verified.JKT
+	withToken := func(_ map[string]interface{}, claims jwt.MapClaims) { claims["ath"] = ath("token") }
+
+	tests := []struct {
+		name    string
+		scheme  string
+		jkt     string
+		proof   string
+		wantErr bool
+	}{
+		{name: "bound token with a proof", scheme: DPoPHeader, jkt: jkt, proof: newProof(t, key, withToken)},
+		{name: "bound token without a proof", scheme: DPoPHeader, jkt: jkt, wantErr: true},
+		{name: "bound token as a bearer token", scheme: "Bearer", jkt: jkt, proof: newProof(t, key, withToken), wantErr: true},
+		{name: "bound token in a cookie without a proof", jkt: jkt, wantErr: true},
+		{name: "proof of another key", scheme: DPoPHeader, jkt: jkt, proof: newProof(t, other, withToken), wantErr: true},
+		{name: "proof for another token", scheme: DPoPHeader, jkt: jkt, proof: newProof(t, key, nil), wantErr: true},
+		{name: "unbound token with the DPoP scheme", scheme: DPoPHeader, proof: newProof(t, key, withToken), wantErr: true},
+		{name: "unbound bearer token", scheme: "Bearer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &DB{denylist: NewMemoryDenylist()}
+			err := db.checkBinding(dpopContext(tt.proof), tt.scheme, "token", &Claims{JKT: tt.jkt})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkBinding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && CodeOf(err) != CodeInvalidToken {
+				t.Errorf("checkBinding() code = %s, want %s", CodeOf(err), CodeInvalidToken)
+			}
+		})
+	}
+}
+
+func TestCheckProofReplay(t *testing.T) {
+	db := &DB{denylist: NewMemoryDenylist()}
+	proof := newProof(t, newDPoPKey(t), nil)
+
+	jkt, err := db.checkProof(dpopContext(proof), "")
+	if err != nil || jkt == "" {
+		t.Fatalf("checkProof() = %q, %v", jkt, err)
+	}
+
+	// The proof is checked once per request, a second request replays it
+	ctx := dpopContext(proof)
+	if _, err := db.checkProof(ctx, ""); CodeOf(err) != CodeInvalidToken {
+		t.Errorf("checkProof() of a replayed proof error = %v, want %s", err, CodeInvalidToken)
+	}
+	if _, err := db.checkProof(ctx, ""); CodeOf(err) != CodeInvalidToken {
+		t.Errorf("checkProof() checked again error = %v, want %s", err, CodeInvalidToken)
+	}
+
+	if jkt, err := db.checkProof(dpopContext(""), ""); jkt != "" || err != nil {
+		t.Errorf("checkProof() without a proof = %q, %v, want no thumbprint", jkt, err)
+	}
+}
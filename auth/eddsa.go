@@ -0,0 +1,179 @@
+package auth
+
+// Ed25519 signatures for tokens, for deployments that want short modern
+// signatures and services verifying tokens without the shared secret. With
+// SIGNING_ALG "EdDSA" tokens are JWTs signed with the Ed25519 key in
+// EDDSA_KEY, made with the genkey command, and its public half is published
+// at /oauth/jwks.json next to the ID token keys. The jwt library predates
+// RFC 8037 so the EdDSA algorithm is registered here. Tokens signed with
+// the shared key keep verifying until they expire, and organizations with
+// keys of their own keep getting ES256 tokens.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// signingMethodEdDSA signs JWTs with Ed25519 keys, RFC 8037
+type signingMethodEdDSA struct{}
+
+var signingMethodEd25519 = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEd25519.Alg(), func() jwt.SigningMethod {
+		return signingMethodEd25519
+	})
+}
+
+// Alg implements jwt.SigningMethod
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Sign implements jwt.SigningMethod, key is an ed25519.PrivateKey
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok || len(private) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+// Verify implements jwt.SigningMethod, key is an ed25519.PublicKey
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok || len(public) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
+
+// edKey is an Ed25519 key tokens are signed or verified with, private is
+// nil for keys that only verify
+type edKey struct {
+	ID      string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// newEdKey wraps public, its id is derived from it so every instance and
+// verifier agrees on it
+func newEdKey(public ed25519.PublicKey) *edKey {
+	sum := sha256.Sum256(public)
+	return &edKey{ID: "ed-" + hex.EncodeToString(sum[:8]), public: public}
+}
+
+// GenerateEdDSAKey returns a new Ed25519 private key as a PKCS #8 PEM block,
+// the format of EDDSA_KEY
+func GenerateEdDSAKey() (string, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParseEdDSAKey reads an Ed25519 private key in a PKCS #8 PEM block
+func ParseEdDSAKey(encoded string) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("EDDSA_KEY is not a PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("EDDSA_KEY is not an Ed25519 key")
+	}
+
+	return private, nil
+}
+
+// SetEdDSAKey signs new tokens with private instead of the shared key
+func (t *TokenIssuer) SetEdDSAKey(private ed25519.PrivateKey) {
+	key := newEdKey(private.Public().(ed25519.PublicKey))
+	key.private = private
+
+	t.keys.mu.Lock()
+	t.keys.eddsa = key
+	t.keys.mu.Unlock()
+}
+
+// NewEdDSAVerifier returns a TokenIssuer for services that only verify
+// tokens signed with the Ed25519 key whose public half is public, issuer and
+// audience must match the settings of this service
+func NewEdDSAVerifier(public ed25519.PublicKey, issuer, audience string) *TokenIssuer {
+	keys := newKeySet("", 24*time.Hour)
+	keys.eddsa = newEdKey(public)
+
+	return NewTokenIssuer(keys, 24*time.Hour, issuer, audience)
+}
+
+// edSigner returns the Ed25519 key new tokens are signed with, nil when they
+// are signed with the shared key
+func (k *keySet) edSigner() *edKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.eddsa == nil || k.eddsa.private == nil {
+		return nil
+	}
+
+	return k.eddsa
+}
+
+// lookupEd returns the Ed25519 key with the given id
+func (k *keySet) lookupEd(kid string) *edKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.eddsa == nil || k.eddsa.ID != kid {
+		return nil
+	}
+
+	return k.eddsa
+}
+
+// edJWK returns the public half of the Ed25519 key, nil without one
+func (k *keySet) edJWK() *JSONWebKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.eddsa == nil {
+		return nil
+	}
+
+	return &JSONWebKey{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(k.eddsa.public),
+		Kid: k.eddsa.ID,
+		Use: "sig",
+		Alg: "EdDSA",
+	}
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+)
+
+// EmailPolicy decides how emails are stored and compared
+type EmailPolicy struct {
+	// Drops dots and +tags from Gmail addresses, which Gmail ignores
+	FoldGmail bool
+	// Only emails of these domains can be used, any domain when empty
+	AllowedDomains []string
+}
+
+// emailPolicy is applied to every email, set from the config with SetEmailPolicy
+var emailPolicy EmailPolicy
+
+// SetEmailPolicy changes how emails are normalized
+func SetEmailPolicy(p EmailPolicy) {
+	emailPolicy = p
+}
+
+// NewEmailPolicy returns the policy described by the EMAIL_* settings
+func NewEmailPolicy(cfg *config.Config) EmailPolicy {
+	p := EmailPolicy{FoldGmail: cfg.EmailFoldGmail}
+	for _, domain := range cfg.EmailAllowedDomains {
+		p.AllowedDomains = append(p.AllowedDomains, strings.ToLower(strings.TrimPrefix(domain, "@")))
+	}
+
+	return p
+}
+
+// Allowed reports whether email belongs to one of the allowed domains
+func (p EmailPolicy) Allowed(email string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, allowed := range p.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkEmail returns the problems of a new email, reported against field
+func checkEmail(field, email string) []FieldError {
+	if !IsValidEmail(email) {
+		return []FieldError{{Field: field, Rule: "format", Message: "Invalid email address.", Key: "email.format"}}
+	}
+
+	if !emailPolicy.Allowed(email) {
+		domains := strings.Join(emailPolicy.AllowedDomains, ", ")
+		return []FieldError{{Field: field, Rule: "domain", Message: fmt.Sprintf("Only %s addresses can be used.", domains), Key: "email.domain", Args: []interface{}{domains}}}
+	}
+
+	return nil
+}
+
+// NormalizeEmail returns the canonical form used to store and look up emails
+func NormalizeEmail(email string) string {
+	return emailPolicy.Normalize(email)
+}
+
+// Normalize lowercases email and, when enabled, folds Gmail addresses so
+// f.o.o+news@googlemail.com and foo@gmail.com are the same account
+func (p EmailPolicy) Normalize(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if !p.FoldGmail || at < 0 {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+	if domain != "gmail.com" && domain != "googlemail.com" {
+		return email
+	}
+
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+
+	return strings.ReplaceAll(local, ".", "") + "@gmail.com"
+}
@@ -0,0 +1,93 @@
+package auth
+
+// Erasure of accounts on request (the right to be forgotten). Unlike
+// DeleteUser the user document is kept as an anonymized tombstone so the
+// id it was known by still resolves, and audit events about the user keep
+// their type and time but lose anything that identifies a person.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// tombstone returns the anonymized document that replaces an erased user.
+// The username and email are derived from the id so they stay unique
+func tombstone(user *UserModel, erasedAt time.Time) *UserModel {
+	id := user.ID.Hex()
+	return &UserModel{
+		ID:           user.ID,
+		Username:     "erased-" + id,
+		Email:        id + "@erased.invalid",
+		Roles:        []model.Role{},
+		CreatedAt:    user.CreatedAt,
+		Disabled:     true,
+		TokenVersion: user.TokenVersion + 1,
+		ErasedAt:     &erasedAt,
+	}
+}
+
+// EraseUser scrubs the personal data of an account: the user document is
+// replaced by a tombstone, its sessions, devices, data exports and
+// memberships are removed
+// and its audit events are anonymized
+func (db *DB) EraseUser(ctx context.Context, id string) error {
+	user, err := db.FindByID(ctx, id)
+	if err != nil {
+		return Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+	if user.ErasedAt != nil {
+		return gqlerror.Errorf("Account was already erased.")
+	}
+
+	database := db.client.Database(db.database)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": user.ID, "erasedAt": bson.M{"$exists": false}}
+	if _, err := database.Collection(db.collection).ReplaceOne(ctx, filter, tombstone(user, time.Now())); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not replace user with tombstone")
+		return Errorf(CodeInternal, "Could not erase account.")
+	}
+	db.invalidateUser(ctx, user.OrgID, user.Username, user.Email)
+
+	for _, collection := range []string{sessionsCollection, devicesCollection, trustedDevicesCollection, exportsCollection, membershipsCollection, oauthGrantsCollection, oauthRefreshCollection} {
+		if _, err := database.Collection(collection).DeleteMany(ctx, bson.M{"userId": user.ID}); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Str("collection", collection).Msg("could not remove erased user data")
+			return Errorf(CodeInternal, "Could not erase account.")
+		}
+	}
+
+	if err := db.anonymizeAuditEvents(ctx, user); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not anonymize audit events")
+		return Errorf(CodeInternal, "Could not erase account.")
+	}
+
+	return nil
+}
+
+// anonymizeAuditEvents rewrites the events about user so they only refer to
+// it by id and drops the client address, user agent and failure reasons,
+// which can quote the email
+func (db *DB) anonymizeAuditEvents(ctx context.Context, user *UserModel) error {
+	collection := db.client.Database(db.database).Collection(db.auditCollection)
+	id := user.ID.Hex()
+
+	// Events of anonymous requests name the user by username or email
+	named := bson.M{"subject": bson.M{"$in": bson.A{user.Username, user.Email}}}
+	if _, err := collection.UpdateMany(ctx, named, bson.M{"$set": bson.M{"subject": id}}); err != nil {
+		return err
+	}
+
+	filter := bson.M{"$or": bson.A{bson.M{"actorId": id}, bson.M{"subject": id}}}
+	update := bson.M{
+		"$set":   bson.M{"ip": "", "userAgent": ""},
+		"$unset": bson.M{"details.reason": ""},
+	}
+	_, err := collection.UpdateMany(ctx, filter, update)
+	return err
+}
@@ -0,0 +1,267 @@
+package auth
+
+// Error codes. Every error of the GraphQL API carries one in its "code"
+// extension so clients can branch on it, messages are meant for people and
+// may change. GraphQL errors made without a code are BAD_REQUEST.
+//
+// Any other error a resolver returns, such as a Mongo error, and panics are
+// INTERNAL_SERVER_ERROR. In production their details are only logged, the
+// client gets a generic message with the id of the request to quote.
+//
+// Messages of coded errors and validation failures are translated to the
+// language of the user, or the one the client asks for in Accept-Language,
+// when SetTranslations loaded a translation.
+//
+// Internal errors are also sent to the error tracker of SetErrorReporter,
+// with their cause when there is one.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/i18n"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/reporting"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ErrorCode identifies the kind of an error
+type ErrorCode string
+
+// Codes of the error catalog
+const (
+	CodeBadRequest             ErrorCode = "BAD_REQUEST"
+	CodeValidationFailed       ErrorCode = "VALIDATION_FAILED"
+	CodeInternal               ErrorCode = "INTERNAL_SERVER_ERROR"
+	CodeNotFound               ErrorCode = "NOT_FOUND"
+	CodeRateLimited            ErrorCode = "RATE_LIMITED"
+	CodeComplexityLimit        ErrorCode = "COMPLEXITY_LIMIT_EXCEEDED"
+	CodeDepthLimit             ErrorCode = "DEPTH_LIMIT_EXCEEDED"
+	CodeTimeout                ErrorCode = "TIMEOUT"
+	CodeQueryNotAllowed        ErrorCode = "PERSISTED_QUERY_NOT_ALLOWED"
+	CodeUnauthenticated        ErrorCode = "UNAUTHENTICATED"
+	CodeForbidden              ErrorCode = "FORBIDDEN"
+	CodeInvalidCredentials     ErrorCode = "INVALID_CREDENTIALS"
+	CodeAccountLocked          ErrorCode = "ACCOUNT_LOCKED"
+	CodeAccountPendingApproval ErrorCode = "ACCOUNT_PENDING_APPROVAL"
+	CodeAccountPendingDeletion ErrorCode = "ACCOUNT_PENDING_DELETION"
+	CodePasswordResetRequired  ErrorCode = "PASSWORD_RESET_REQUIRED"
+	CodeTermsNotAccepted       ErrorCode = "TERMS_NOT_ACCEPTED"
+	CodeMFARequired            ErrorCode = "MFA_REQUIRED"
+	CodeInvalidOTP             ErrorCode = "INVALID_OTP"
+	CodeReauthRequired         ErrorCode = "REAUTHENTICATION_REQUIRED"
+	CodeUsernameTaken          ErrorCode = "USERNAME_TAKEN"
+	CodeEmailTaken             ErrorCode = "EMAIL_TAKEN"
+	CodeSlugTaken              ErrorCode = "SLUG_TAKEN"
+	CodeInvalidToken           ErrorCode = "INVALID_TOKEN"
+	CodeTokenExpired           ErrorCode = "TOKEN_EXPIRED"
+	CodeTokenRevoked           ErrorCode = "TOKEN_REVOKED"
+	CodeTokenReused            ErrorCode = "TOKEN_REUSED"
+	CodeSessionRevoked         ErrorCode = "SESSION_REVOKED"
+	CodeInvalidLink            ErrorCode = "INVALID_LINK"
+	CodeLinkExpired            ErrorCode = "LINK_EXPIRED"
+)
+
+// translations of the messages of errors, nil answers them in English
+var translations *i18n.Bundle
+
+// SetTranslations changes the translations of error messages
+func SetTranslations(b *i18n.Bundle) {
+	translations = b
+}
+
+// NewTranslations loads the built in translations and the ones of TRANSLATIONS
+func NewTranslations(cfg *config.Config) (*i18n.Bundle, error) {
+	return i18n.Load(cfg.Translations, cfg.DefaultLocale)
+}
+
+// reporter sends internal errors to an error tracker, nil sends none
+var reporter reporting.Reporter
+
+// SetErrorReporter changes where internal errors are reported
+func SetErrorReporter(r reporting.Reporter) {
+	reporter = r
+}
+
+// reportedExtension marks internal errors reported with their cause, the
+// presenter removes it
+const reportedExtension = "reported"
+
+// argsExtension keeps the arguments of a message for its translation, the
+// presenter removes it
+const argsExtension = "args"
+
+// Errorf returns a GraphQL error with the given code and message
+func Errorf(code ErrorCode, format string, args ...interface{}) *gqlerror.Error {
+	err := gqlerror.Errorf(format, args...)
+	err.Extensions = map[string]interface{}{"code": code}
+	if len(args) > 0 {
+		err.Extensions[argsExtension] = args
+	}
+	return err
+}
+
+// CodeOf returns the code of err, INTERNAL_SERVER_ERROR for errors that
+// aren't GraphQL errors
+func CodeOf(err error) ErrorCode {
+	var gqlErr *gqlerror.Error
+	if !errors.As(err, &gqlErr) {
+		return CodeInternal
+	}
+
+	switch code := gqlErr.Extensions["code"].(type) {
+	case ErrorCode:
+		return code
+	case string:
+		return ErrorCode(code)
+	}
+	return CodeBadRequest
+}
+
+// ErrorPresenter is the GraphQL error presenter, it sets the code of errors
+// made without one and the request id of internal errors
+func ErrorPresenter(ctx context.Context, err error) *gqlerror.Error {
+	gqlErr := graphql.DefaultErrorPresenter(ctx, err)
+	if gqlErr.Extensions == nil {
+		gqlErr.Extensions = map[string]interface{}{}
+	}
+	if _, ok := gqlErr.Extensions["code"]; !ok {
+		gqlErr.Extensions["code"] = CodeOf(err)
+	}
+	if CodeOf(gqlErr) == CodeInternal {
+		if id := logging.RequestID(ctx); id != "" {
+			gqlErr.Extensions["requestId"] = id
+		}
+		if _, ok := gqlErr.Extensions[reportedExtension]; !ok {
+			report(ctx, string(CodeInternal), gqlErr.Message, nil)
+		}
+	}
+	delete(gqlErr.Extensions, reportedExtension)
+	translate(ctx, gqlErr)
+
+	return gqlErr
+}
+
+// translate replaces the message of err, and those of its field errors, by
+// their translation to the locales of the request
+func translate(ctx context.Context, err *gqlerror.Error) {
+	args, _ := err.Extensions[argsExtension].([]interface{})
+	delete(err.Extensions, argsExtension)
+	if translations == nil {
+		return
+	}
+
+	locales := localesForContext(ctx)
+	if fields, ok := err.Extensions["fields"].([]FieldError); ok && len(fields) > 0 {
+		translated := make([]FieldError, len(fields))
+		for i, field := range fields {
+			key := field.Key
+			if key == "" {
+				key = field.Field + "." + field.Rule
+			}
+			if message, ok := translations.Translate(locales, key, field.Args...); ok {
+				field.Message = message
+			}
+			translated[i] = field
+		}
+		err.Extensions["fields"] = translated
+		err.Message = translated[0].Message
+		return
+	}
+
+	if message, ok := translations.Translate(locales, string(CodeOf(err)), args...); ok {
+		err.Message = message
+	}
+}
+
+// localesForContext returns the locales errors are answered in, most
+// preferred first: the one the user chose, then those of Accept-Language
+func localesForContext(ctx context.Context) []string {
+	var locales []string
+	if user := ForContext(ctx); user != nil && user.Locale != nil {
+		locales = append(locales, *user.Locale)
+	}
+	if info := requestForContext(ctx); info != nil {
+		locales = append(locales, i18n.ParseAcceptLanguage(info.Languages)...)
+	}
+	return locales
+}
+
+// MaskErrors returns a field middleware turning errors that aren't GraphQL
+// errors into internal errors. They are logged, and only their message is
+// answered outside production
+func MaskErrors(production bool) graphql.FieldMiddleware {
+	return func(ctx context.Context, next graphql.Resolver) (interface{}, error) {
+		res, err := next(ctx)
+		var gqlErr *gqlerror.Error
+		if err == nil || errors.As(err, &gqlErr) {
+			return res, err
+		}
+
+		path := graphql.GetFieldContext(ctx).Path().String()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == context.DeadlineExceeded {
+			logging.Ctx(ctx).Warn().Err(err).Str("path", path).Msg("operation timed out")
+			return res, Errorf(CodeTimeout, "Operation timed out, try again later.")
+		}
+		logging.Ctx(ctx).Error().Err(err).Str("path", path).Msg("resolver failed")
+		report(ctx, fmt.Sprintf("%T", err), err.Error(), nil)
+		return res, internalError(production, err.Error())
+	}
+}
+
+// Recover returns the GraphQL recover function, it logs panics with their
+// stack and answers an internal error
+func Recover(production bool) graphql.RecoverFunc {
+	return func(ctx context.Context, p interface{}) error {
+		logging.Ctx(ctx).Error().Str("panic", fmt.Sprint(p)).Str("stack", string(debug.Stack())).Msg("resolver panicked")
+		report(ctx, "panic", fmt.Sprint(p), reporting.Stack(1))
+		return internalError(production, fmt.Sprintf("panic: %v", p))
+	}
+}
+
+// internalError returns the error answered for a reported failure on our
+// side, with the details in message only outside production
+func internalError(production bool, message string) *gqlerror.Error {
+	err := Errorf(CodeInternal, "Internal server error, try again later.")
+	if !production {
+		err = Errorf(CodeInternal, "%s", message)
+	}
+	err.Extensions[reportedExtension] = true
+	return err
+}
+
+// report sends an internal error to the error tracker, with the request
+// it happened in
+func report(ctx context.Context, kind, message string, stack []reporting.Frame) {
+	if reporter == nil {
+		return
+	}
+
+	event := &reporting.Event{
+		Time:      time.Now(),
+		Type:      kind,
+		Message:   message,
+		Stack:     stack,
+		RequestID: logging.RequestID(ctx),
+		IP:        IPForContext(ctx),
+	}
+	if graphql.HasOperationContext(ctx) {
+		if oc := graphql.GetOperationContext(ctx); oc.OperationName != "" {
+			event.Operation = oc.OperationName
+		} else if oc.Operation != nil {
+			event.Operation = string(oc.Operation.Operation)
+		}
+	}
+	if fc := graphql.GetFieldContext(ctx); fc != nil {
+		event.Path = fc.Path().String()
+	}
+	if claims := ClaimsForContext(ctx); claims != nil {
+		event.UserID = claims.UserID
+	}
+	reporter.Report(ctx, event)
+}
@@ -0,0 +1,267 @@
+package auth
+
+// Export of everything stored about a user, for data portability requests.
+// The export is assembled once, kept for a day and downloaded through a
+// signed link that is also emailed to the user.
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportsCollection holds the exports until their link expires
+const exportsCollection = "data_exports"
+
+// exportTTL is how long an export can be downloaded
+const exportTTL = 24 * time.Hour
+
+// dataExport representation of an export in the database
+type dataExport struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Data      []byte             `bson:"data"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+// exportProfile is the user document without its secrets
+type exportProfile struct {
+	ID                 string                   `json:"id"`
+	Username           string                   `json:"username"`
+	Fname              string                   `json:"fname"`
+	Lname              string                   `json:"lname"`
+	Email              string                   `json:"email"`
+	Roles              []model.Role             `json:"roles"`
+	Verified           bool                     `json:"verified"`
+	Locale             string                   `json:"locale,omitempty"`
+	LoginNotifications model.LoginNotifications `json:"loginNotifications,omitempty"`
+	Consents           map[string]Consent       `json:"consents,omitempty"`
+	Identities         []LinkedIdentity         `json:"identities,omitempty"`
+	TwoFactorEnabled   bool                     `json:"twoFactorEnabled"`
+	CreatedAt          time.Time                `json:"createdAt"`
+}
+
+// exportSession is a session as exported
+type exportSession struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// exportDevice is a known device as exported
+type exportDevice struct {
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// exportTrustedDevice is a device skipping the second factor as exported
+type exportTrustedDevice struct {
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// exportApplication is the grant of an OAuth client as exported
+type exportApplication struct {
+	ClientID  string    `json:"clientId"`
+	Scopes    []string  `json:"scopes"`
+	GrantedAt time.Time `json:"grantedAt"`
+}
+
+// userExport is the JSON document users download
+type userExport struct {
+	ExportedAt     time.Time             `json:"exportedAt"`
+	Profile        exportProfile         `json:"profile"`
+	Sessions       []exportSession       `json:"sessions"`
+	Devices        []exportDevice        `json:"devices"`
+	TrustedDevices []exportTrustedDevice `json:"trustedDevices"`
+	Applications   []exportApplication   `json:"applications"`
+	AuditEvents    []AuditEvent          `json:"auditEvents"`
+}
+
+// ExportUserData assembles everything stored about a user and returns the link
+// to download it, the link is emailed to the user too
+func (db *DB) ExportUserData(ctx context.Context, userID string) (*model.DataExport, error) {
+	user, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", userID)
+	}
+
+	data, err := db.collectUserData(ctx, user)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not collect user data")
+		return nil, Errorf(CodeInternal, "Could not export your data, try again later.")
+	}
+
+	now := time.Now()
+	export := dataExport{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		Data:      data,
+		CreatedAt: now,
+		ExpiresAt: now.Add(exportTTL),
+	}
+
+	collection := db.client.Database(db.database).Collection(exportsCollection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, export); err != nil {
+		return nil, Errorf(CodeInternal, "Could not export your data, try again later.")
+	}
+
+	link := withToken(db.publicURL+"/v1/exports", db.signLink("data-export", export.ExpiresAt, export.ID.Hex()))
+	msg, err := db.templates.Render("data_export", user.Locale, user.Email, map[string]string{
+		"Name":    user.Fname,
+		"Link":    link,
+		"Expires": export.ExpiresAt.UTC().Format(time.RFC1123),
+	})
+	if err == nil {
+		err = db.mailer.Send(ctx, msg)
+	}
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not email data export")
+	}
+
+	return &model.DataExport{URL: link, ExpiresAt: export.ExpiresAt}, nil
+}
+
+// collectUserData returns the JSON export of user
+func (db *DB) collectUserData(ctx context.Context, user *UserModel) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	database := db.client.Database(db.database)
+	export := userExport{
+		ExportedAt: time.Now(),
+		Profile: exportProfile{
+			ID:                 user.ID.Hex(),
+			Username:           user.Username,
+			Fname:              user.Fname,
+			Lname:              user.Lname,
+			Email:              user.Email,
+			Roles:              user.Roles,
+			Verified:           user.Verified,
+			Locale:             user.Locale,
+			LoginNotifications: user.LoginNotifications,
+			Consents:           user.Consents,
+			Identities:         user.Identities,
+			TwoFactorEnabled:   user.TOTPSecret != "",
+			CreatedAt:          user.CreatedAt,
+		},
+		Sessions:       []exportSession{},
+		Devices:        []exportDevice{},
+		TrustedDevices: []exportTrustedDevice{},
+		Applications:   []exportApplication{},
+		AuditEvents:    []AuditEvent{},
+	}
+
+	var sessions []Session
+	if err := findAll(ctx, database.Collection(sessionsCollection), bson.M{"userId": user.ID}, &sessions); err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		export.Sessions = append(export.Sessions, exportSession{
+			ID:         s.ID.Hex(),
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+		})
+	}
+
+	var devices []Device
+	if err := findAll(ctx, database.Collection(devicesCollection), bson.M{"userId": user.ID}, &devices); err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		export.Devices = append(export.Devices, exportDevice{
+			UserAgent: d.UserAgent,
+			IP:        d.IP,
+			FirstSeen: d.FirstSeen,
+			LastSeen:  d.LastSeen,
+		})
+	}
+
+	var trusted []TrustedDevice
+	if err := findAll(ctx, database.Collection(trustedDevicesCollection), bson.M{"userId": user.ID}, &trusted); err != nil {
+		return nil, err
+	}
+	for _, d := range trusted {
+		export.TrustedDevices = append(export.TrustedDevices, exportTrustedDevice{
+			UserAgent: d.UserAgent,
+			IP:        d.IP,
+			CreatedAt: d.CreatedAt,
+			ExpiresAt: d.ExpiresAt,
+		})
+	}
+
+	var grants []oauthGrant
+	if err := findAll(ctx, database.Collection(oauthGrantsCollection), bson.M{"userId": user.ID}, &grants); err != nil {
+		return nil, err
+	}
+	for _, g := range grants {
+		export.Applications = append(export.Applications, exportApplication{
+			ClientID:  g.ClientID.Hex(),
+			Scopes:    g.Scopes,
+			GrantedAt: g.CreatedAt,
+		})
+	}
+
+	// Events name the user by id, username or email depending on what was known
+	filter := bson.M{"$or": bson.A{
+		bson.M{"actorId": user.ID.Hex()},
+		bson.M{"subject": bson.M{"$in": bson.A{user.ID.Hex(), user.Username, user.Email}}},
+	}}
+	if err := findAll(ctx, database.Collection(db.auditCollection), filter, &export.AuditEvents); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// findAll decodes every document matching filter into results, oldest first
+func findAll(ctx context.Context, collection *mongo.Collection, filter bson.M, results interface{}) error {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// DownloadExport returns the JSON export a link points to
+func (db *DB) DownloadExport(ctx context.Context, token string) ([]byte, error) {
+	fields, err := db.verifyLink("data-export", token, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(fields[0])
+	if err != nil {
+		return nil, Errorf(CodeInvalidLink, "Invalid link.")
+	}
+
+	collection := db.client.Database(db.database).Collection(exportsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var export dataExport
+	if err := collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&export); err != nil {
+		return nil, Errorf(CodeLinkExpired, "This link has expired.")
+	}
+
+	return export.Data, nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+// Consent users give to OAuth clients. Approving an authorization records
+// the scopes granted to the client, a document per user and client, so the
+// login page only asks again for scopes the user hasn't granted yet and
+// users can list the apps they authorized. Revoking an app drops its grant
+// and ends the sessions it holds for the user, signing it out.
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// oauthGrantsCollection holds the scopes each user granted each client
+const oauthGrantsCollection = "oauth_grants"
+
+// oauthGrant is the consent of a user to a client
+type oauthGrant struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	ClientID  primitive.ObjectID `bson:"clientId"`
+	Scopes    []string           `bson:"scopes"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	UpdatedAt time.Time          `bson:"updatedAt"`
+}
+
+// ensureGrantIndexes allows a single grant per user and client
+func (db *DB) ensureGrantIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(oauthGrantsCollection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "clientId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"clientId": 1}},
+	})
+	return err
+}
+
+// findGrant returns the grant of user to client, nil when there is none
+func (db *DB) findGrant(ctx context.Context, userID, clientID primitive.ObjectID) (*oauthGrant, error) {
+	collection := db.client.Database(db.database).Collection(oauthGrantsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var grant oauthGrant
+	err := collection.FindOne(ctx, bson.M{"userId": userID, "clientId": clientID}).Decode(&grant)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+// recordGrant adds scopes to the grant of user to client, creating it
+func (db *DB) recordGrant(ctx context.Context, userID, clientID primitive.ObjectID, scopes []string) error {
+	collection := db.client.Database(db.database).Collection(oauthGrantsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	update := bson.M{
+		"$addToSet":    bson.M{"scopes": bson.M{"$each": scopes}},
+		"$set":         bson.M{"updatedAt": now},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "createdAt": now},
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"userId": userID, "clientId": clientID}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// consent returns the requested scopes a user with roles can grant and the
+// ones of them already granted in grant, which can be nil
+func consent(requested string, roles []model.Role, grant *oauthGrant) (scopes, granted []string) {
+	scopes = scopePolicy.grant(strings.Fields(requested), roles)
+	granted = []string{}
+	if grant == nil {
+		return scopes, granted
+	}
+	for _, scope := range scopes {
+		for _, g := range grant.Scopes {
+			if g == scope {
+				granted = append(granted, scope)
+				break
+			}
+		}
+	}
+
+	return scopes, granted
+}
+
+// ListApplications returns the clients the user authorized, with the scopes
+// granted to each
+func (db *DB) ListApplications(ctx context.Context, userID string) ([]*model.ApplicationGrant, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid user id.")
+	}
+
+	database := db.client.Database(db.database)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var grants []oauthGrant
+	if err := findAll(ctx, database.Collection(oauthGrantsCollection), bson.M{"userId": oid}, &grants); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list applications.")
+	}
+	ids := bson.A{}
+	for _, grant := range grants {
+		ids = append(ids, grant.ClientID)
+	}
+	var clients []OAuthClient
+	if err := findAll(ctx, database.Collection(oauthClientsCollection), bson.M{"_id": bson.M{"$in": ids}}, &clients); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list applications.")
+	}
+	byID := map[primitive.ObjectID]*OAuthClient{}
+	for i := range clients {
+		byID[clients[i].ID] = &clients[i]
+	}
+
+	list := []*model.ApplicationGrant{}
+	for _, grant := range grants {
+		// Grants of deleted clients are removed along with them
+		client, ok := byID[grant.ClientID]
+		if !ok {
+			continue
+		}
+		list = append(list, &model.ApplicationGrant{
+			Client:    toGraphOAuthClient(client),
+			Scopes:    append([]string{}, grant.Scopes...),
+			GrantedAt: grant.CreatedAt,
+			UpdatedAt: grant.UpdatedAt,
+		})
+	}
+
+	return list, nil
+}
+
+// RevokeApplication drops the grant of the user to a client and ends the
+// sessions the client holds for the user, along with its refresh tokens
+func (db *DB) RevokeApplication(ctx context.Context, userID, clientID string) error {
+	if err := notImpersonating(ctx); err != nil {
+		return err
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid user id.")
+	}
+	cid, err := primitive.ObjectIDFromHex(clientID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid client id.")
+	}
+
+	database := db.client.Database(db.database)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"userId": uid, "clientId": cid}
+	res, err := database.Collection(oauthGrantsCollection).DeleteOne(ctx, filter)
+	if err != nil {
+		return Errorf(CodeInternal, "Could not revoke the application.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find application with id '%s'.", clientID)
+	}
+
+	// Sessions started before they recorded their client are found through
+	// their refresh tokens
+	sessionIDs := bson.A{}
+	var tokens []oauthRefreshToken
+	if err := findAll(ctx, database.Collection(oauthRefreshCollection), filter, &tokens); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not find refresh tokens of revoked application")
+		return Errorf(CodeInternal, "Could not revoke the application.")
+	}
+	for _, token := range tokens {
+		if sid, err := primitive.ObjectIDFromHex(token.SessionID); err == nil {
+			sessionIDs = append(sessionIDs, sid)
+		}
+	}
+
+	sessions := bson.M{"userId": uid, "$or": bson.A{bson.M{"clientId": cid}, bson.M{"_id": bson.M{"$in": sessionIDs}}}}
+	if _, err := database.Collection(sessionsCollection).DeleteMany(ctx, sessions); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not end sessions of revoked application")
+		return Errorf(CodeInternal, "Could not revoke the application.")
+	}
+	if _, err := database.Collection(oauthRefreshCollection).DeleteMany(ctx, filter); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove refresh tokens of revoked application")
+		return Errorf(CodeInternal, "Could not revoke the application.")
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package auth
+
+// Accounts of identity providers linked to users. A linked identity logs in
+// the user it is linked to whatever email the provider sends. Users link one
+// from a session with linkIdentity followed by a login at the provider, and
+// single sign-on links them on its own to accounts with the same email that
+// have no password. Accounts with a password must be linked from a session,
+// so a provider vouching for an email can't take over an account.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// linkTTL is how long the URL of linkIdentity can be opened
+const linkTTL = 10 * time.Minute
+
+// ssoProviders are the single sign-on endpoints identities are linked through
+var ssoProviders = map[string]bool{"saml": true, "oidc": true}
+
+// LinkedIdentity is an account of an identity provider the user can log in with
+type LinkedIdentity struct {
+	// Issuer and subject joined, an identity is linked to one user
+	ID       string    `bson:"id" json:"id"`
+	Provider string    `bson:"provider" json:"provider"`
+	Issuer   string    `bson:"issuer" json:"issuer"`
+	Subject  string    `bson:"subject" json:"subject"`
+	LinkedAt time.Time `bson:"linkedAt" json:"linkedAt"`
+}
+
+// identityID returns the id of the identity subject has at issuer
+func identityID(issuer, subject string) string {
+	return issuer + "|" + subject
+}
+
+// toGraphIdentities converts linked identities into their GraphQL form
+func toGraphIdentities(identities []LinkedIdentity) []*model.LinkedIdentity {
+	graphIdentities := []*model.LinkedIdentity{}
+	for _, identity := range identities {
+		graphIdentities = append(graphIdentities, &model.LinkedIdentity{
+			Provider: identity.Provider,
+			Issuer:   identity.Issuer,
+			Subject:  identity.Subject,
+			LinkedAt: identity.LinkedAt,
+		})
+	}
+
+	return graphIdentities
+}
+
+// ensureIdentityIndexes keeps an identity from being linked to two users
+func (db *DB) ensureIdentityIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(db.collection)
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"identities.id": 1},
+		Options: options.Index().SetName("identities_unique").SetUnique(true).SetPartialFilterExpression(bson.M{"identities.id": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// LinkIdentityURL returns the URL that links an account of provider to the
+// user with the given id, once the user logs in there
+func (db *DB) LinkIdentityURL(ctx context.Context, userID, provider string) (string, error) {
+	if !ssoProviders[provider] {
+		return "", gqlerror.Errorf("Unknown identity provider, use saml or oidc.")
+	}
+	user, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return "", Errorf(CodeNotFound, "Could not find user with id '%s'.", userID)
+	}
+
+	token := db.signLink("link-identity", time.Now().Add(linkTTL), user.ID.Hex())
+	return db.publicURL + "/" + provider + "/login?link=" + token, nil
+}
+
+// LinkIdentity links the identity a provider logged in to the user of a
+// token from LinkIdentityURL and returns the id of the user. Providers of an
+// organization link identities to its members only
+func (db *DB) LinkIdentity(ctx context.Context, token, org string, identity *SSOIdentity) (string, error) {
+	fields, err := db.verifyLink("link-identity", token, 1)
+	if err != nil {
+		return "", err
+	}
+	user, err := db.FindByID(ctx, fields[0])
+	if err != nil || !user.Active() {
+		return "", Errorf(CodeNotFound, "Could not find an active user to link the identity to.")
+	}
+
+	oid, err := db.resolveOrg(ctx, &org)
+	if err != nil {
+		return "", err
+	}
+	if !oid.IsZero() && user.OrgID != oid {
+		if _, err := db.findMembership(ctx, oid, user.ID); err != nil {
+			return "", Errorf(CodeForbidden, "Only members of the organization can link this identity provider.")
+		}
+	}
+
+	return user.ID.Hex(), db.addIdentity(ctx, user, identity)
+}
+
+// addIdentity links identity to user, which can have one identity per issuer
+func (db *DB) addIdentity(ctx context.Context, user *UserModel, identity *SSOIdentity) error {
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	linked := LinkedIdentity{
+		ID:       identityID(identity.Issuer, identity.Subject),
+		Provider: identity.Provider,
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		LinkedAt: time.Now(),
+	}
+	filter := bson.M{"_id": user.ID, "identities.issuer": bson.M{"$ne": identity.Issuer}}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"identities": linked}})
+	if err != nil {
+		if isDuplicateKey(err) {
+			return gqlerror.Errorf("This identity is linked to another account.")
+		}
+		logging.Ctx(ctx).Error().Err(err).Msg("could not link identity")
+		return Errorf(CodeInternal, "Could not link the identity, try again later.")
+	}
+	if res.MatchedCount == 0 {
+		if linkedTo(user, identity.Issuer, identity.Subject) {
+			return nil
+		}
+		return gqlerror.Errorf("An account of this identity provider is already linked, unlink it first.")
+	}
+	db.invalidateUser(ctx, user.OrgID, user.Username, user.Email)
+
+	return nil
+}
+
+// linkedTo reports whether user is linked to the identity subject has at issuer
+func linkedTo(user *UserModel, issuer, subject string) bool {
+	for _, identity := range user.Identities {
+		if identity.ID == identityID(issuer, subject) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// linkedToIssuer reports whether user is linked to any identity of issuer
+func linkedToIssuer(user *UserModel, issuer string) bool {
+	for _, identity := range user.Identities {
+		if identity.Issuer == issuer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnlinkIdentity removes an identity from the user with the given id. The
+// last identity of a user without a password can't be removed, it is the
+// only way the user logs in
+func (db *DB) UnlinkIdentity(ctx context.Context, userID, issuer, subject string) (*model.User, error) {
+	user, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", userID)
+	}
+	if !linkedTo(user, issuer, subject) {
+		return nil, gqlerror.Errorf("This identity isn't linked to your account.")
+	}
+	if user.Password == "" && len(user.Identities) == 1 {
+		return nil, gqlerror.Errorf("This is the only way you can log in to your account, it can't be unlinked.")
+	}
+
+	return db.updateUser(ctx, userID, bson.M{"$pull": bson.M{"identities": bson.M{"id": identityID(issuer, subject)}}})
+}
+
+// findIdentity returns the user an identity is linked to and its membership
+// of org, nil when the identity isn't linked. Users of other namespaces must
+// be members of org
+func (db *DB) findIdentity(ctx context.Context, org primitive.ObjectID, issuer, subject string) (*UserModel, *Membership, error) {
+	collection := db.client.Database(db.database).Collection(db.collection)
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user UserModel
+	if err := collection.FindOne(findCtx, bson.M{"identities.id": identityID(issuer, subject)}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, nil
+		}
+		return nil, nil, Errorf(CodeInternal, "Could not log in, try again later.")
+	}
+	if org.IsZero() {
+		if !user.OrgID.IsZero() {
+			return nil, nil, gqlerror.Errorf("This identity is linked to an account of an organization.")
+		}
+		return &user, nil, nil
+	}
+
+	member, err := db.findMembership(ctx, org, user.ID)
+	if err != nil {
+		return nil, nil, gqlerror.Errorf("You are no longer a member of this organization.")
+	}
+
+	return &user, member, nil
+}
@@ -0,0 +1,159 @@
+package auth
+
+// OpenID Connect on top of the OAuth 2.0 endpoints: ID tokens for clients
+// that request the openid scope, and the claims of userinfo. Clients can't
+// verify tokens signed with the shared HMAC keys, so ID tokens are signed
+// with ES256 keys derived from them. Every instance derives the same keys,
+// they rotate along with the keys they come from and their public halves
+// are published at /oauth/jwks.json.
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// idTokenKey returns the ES256 key ID tokens are signed with while k is the
+// current key, derived from its secret
+func (k *signingKey) idTokenKey() *ecdsa.PrivateKey {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte("id-token-signing-key"))
+
+	// A scalar in [1, N-1]
+	curve := elliptic.P256()
+	n := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	d := new(big.Int).Mod(new(big.Int).SetBytes(mac.Sum(nil)), n)
+	d.Add(d, big.NewInt(1))
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, 32)))
+
+	return key
+}
+
+// idTokenKid is the kid of the ID token key derived from k
+func (k *signingKey) idTokenKid() string {
+	return "id-" + k.ID
+}
+
+// JWKS returns the public keys ID tokens are verified with, and the Ed25519
+// key of access tokens with SIGNING_ALG EdDSA
+func (db *DB) JWKS() *JSONWebKeySet {
+	db.keys.mu.RLock()
+	keys := []*signingKey{db.keys.configured}
+	keys = append(keys, db.keys.stored...)
+	keys = append(keys, db.keys.previous...)
+	db.keys.mu.RUnlock()
+
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	now := time.Now()
+	for _, key := range keys {
+		if len(key.Secret) == 0 || !key.usable(now, db.keys.ttl) {
+			continue
+		}
+		public := key.idTokenKey().PublicKey
+		set.Keys = append(set.Keys, JSONWebKey{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32))),
+			Kid: key.idTokenKid(),
+			Use: "sig",
+			Alg: "ES256",
+		})
+	}
+	if key := db.keys.edJWK(); key != nil {
+		set.Keys = append(set.Keys, *key)
+	}
+
+	return set
+}
+
+// hasScope reports whether the space separated scopes include scope
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// userInfoClaims returns the OpenID Connect claims about user that scopes,
+// space separated, grant: profile grants the names and email the email
+func userInfoClaims(user *UserModel, scopes string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": user.ID.Hex()}
+	if hasScope(scopes, "profile") {
+		claims["preferred_username"] = user.Username
+		claims["given_name"] = user.Fname
+		claims["family_name"] = user.Lname
+		claims["name"] = strings.TrimSpace(user.Fname + " " + user.Lname)
+	}
+	if hasScope(scopes, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.Verified
+	}
+
+	return claims
+}
+
+// UserInfo returns the claims about the user of an access token for the
+// userinfo endpoint. Tokens of logins grant every claim
+func (db *DB) UserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+	claims, err := db.VerifyToken(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID == "" {
+		return nil, gqlerror.Errorf("Tokens of service clients have no user.")
+	}
+	user, err := db.FindByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	scopes := strings.Join(claims.Scopes, " ")
+	if claims.ClientID == "" {
+		scopes = "openid profile email"
+	}
+
+	return userInfoClaims(user, scopes), nil
+}
+
+// IssueIDToken returns an ID token of user for the client, with the claims
+// scopes grant. nonce is the one of the authorization request, empty when
+// it had none or the token is refreshed
+func (t *TokenIssuer) IssueIDToken(user *UserModel, clientID, nonce, scopes string, authTime time.Time) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       t.issuer,
+		"aud":       clientID,
+		"azp":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(t.ttl).Unix(),
+		"auth_time": authTime.Unix(),
+	}
+	for key, value := range userInfoClaims(user, scopes) {
+		claims[key] = value
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	key := t.keys.current()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = key.idTokenKid()
+
+	return token.SignedString(key.idTokenKey())
+}
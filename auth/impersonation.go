@@ -0,0 +1,83 @@
+package auth
+
+// Impersonation lets support staff see the service as a user sees it
+// without their password. Administrators get a short lived token of the
+// user naming them in its act claim, which can't be refreshed nor used for
+// @recentAuth operations, nor for changes outlasting it such as approving an
+// OAuth app, which would hand out refresh tokens. Starting an impersonation
+// is audited, and so is everything done with the token: events name the
+// administrator as actor.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// impersonationTTL is how long impersonation tokens last
+const impersonationTTL = 15 * time.Minute
+
+// notImpersonating rejects requests made with an impersonation token, for
+// operations whose effects would outlast it
+func notImpersonating(ctx context.Context) error {
+	if claims := ClaimsForContext(ctx); claims != nil && claims.Actor != "" {
+		return Errorf(CodeForbidden, "Not allowed while impersonating.")
+	}
+	return nil
+}
+
+// Impersonate returns a token of the user with the given id for the
+// administrator making the request
+func (db *DB) Impersonate(ctx context.Context, userID string) (*model.Token, error) {
+	actor := ForContext(ctx)
+	if actor == nil {
+		return nil, Errorf(CodeUnauthenticated, "Access denied.")
+	}
+	// Impersonation tokens can't start another impersonation
+	if err := notImpersonating(ctx); err != nil {
+		return nil, err
+	}
+	if userID == actor.ID {
+		return nil, gqlerror.Errorf("You can't impersonate yourself.")
+	}
+
+	user, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", userID)
+	}
+	if !user.Active() {
+		return nil, gqlerror.Errorf("Disabled accounts and accounts being deleted can't be impersonated.")
+	}
+	// Otherwise an administrator could act with the rights of another one
+	for _, role := range user.Roles {
+		if role == model.RoleAdmin {
+			return nil, Errorf(CodeForbidden, "Administrators can't be impersonated.")
+		}
+	}
+
+	token, err := db.tokens.IssueImpersonation(user, actor.ID, impersonationTTL)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+	}
+	claims, err := db.tokens.VerifyToken(token)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+	}
+	if db.opaque != nil {
+		if token, err = db.storeOpaque(ctx, token, claims); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not store opaque token")
+			return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+		}
+	}
+
+	db.Audit(ctx, model.AuditEventTypeImpersonation, userID, map[string]string{
+		"jti":       claims.ID,
+		"expiresAt": claims.Expiry.UTC().Format(time.RFC3339),
+	})
+
+	expiresIn := int(impersonationTTL.Seconds())
+	return &model.Token{Jwt: token, ExpiresIn: &expiresIn}, nil
+}
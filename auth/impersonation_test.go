@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Impersonation tokens are refused before anything is looked up, so the
+// operations are called on a DB without Mongo
+func TestImpersonationRefused(t *testing.T) {
+	userID := primitive.NewObjectID().Hex()
+	claims := &Claims{UserID: userID, Actor: primitive.NewObjectID().Hex()}
+	ctx := context.WithValue(context.Background(), claimsCtxKey, claims)
+	db := &DB{}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{
+			name: "approveAuthorization",
+			call: func() error {
+				_, err := db.ApproveAuthorization(ctx, claims, primitive.NewObjectID().Hex())
+				return err
+			},
+		},
+		{
+			name: "acceptInvite",
+			call: func() error {
+				_, err := db.AcceptInvite(ctx, userID, "invitation")
+				return err
+			},
+		},
+		{name: "revokeApplication", call: func() error { return db.RevokeApplication(ctx, userID, primitive.NewObjectID().Hex()) }},
+		{name: "logoutAllDevices", call: func() error { return db.LogoutAllDevices(ctx, userID) }},
+		{
+			name: "setLoginNotifications",
+			call: func() error {
+				_, err := db.SetLoginNotifications(ctx, userID, nil)
+				return err
+			},
+		},
+		{
+			name: "impersonate",
+			call: func() error {
+				_, err := db.Impersonate(context.WithValue(ctx, userCtxKey, toGraphUser(testTokenUser())), userID)
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); CodeOf(err) != CodeForbidden {
+				t.Errorf("%s with an impersonation token error = %v, want %s", tt.name, err, CodeForbidden)
+			}
+		})
+	}
+}
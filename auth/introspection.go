@@ -0,0 +1,150 @@
+package auth
+
+// Token introspection, RFC 7662. Resource servers ask whether a token is
+// still active, which catches revoked tokens, ended sessions and disabled
+// accounts that checking the signature alone can't.
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Introspection describes a token, inactive tokens only have Active set
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+	// Key the token is bound to, RFC 9449
+	Cnf *Confirmation `json:"cnf,omitempty"`
+	// Administrator impersonating the user, RFC 8693
+	Act *Actor `json:"act,omitempty"`
+	// Permissions of the user, see permissions.go
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// Actor names who acts as the subject of a token
+type Actor struct {
+	Sub string `json:"sub"`
+}
+
+// Confirmation names the DPoP key of a bound token
+type Confirmation struct {
+	JKT string `json:"jkt"`
+}
+
+// IntrospectToken describes an access token or a refresh token of an OAuth
+// client, or an API key. hint is the token_type_hint of the request, it only
+// decides which kind is looked up first
+func (db *DB) IntrospectToken(ctx context.Context, token, hint string) *Introspection {
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return db.introspectAPIKey(ctx, token)
+	}
+	if hint == "refresh_token" {
+		if res := db.introspectRefreshToken(ctx, token); res.Active {
+			return res
+		}
+		return db.introspectAccessToken(ctx, token)
+	}
+
+	if res := db.introspectAccessToken(ctx, token); res.Active {
+		return res
+	}
+	return db.introspectRefreshToken(ctx, token)
+}
+
+// introspectAccessToken describes a token while DB.VerifyToken accepts it
+func (db *DB) introspectAccessToken(ctx context.Context, token string) *Introspection {
+	claims, err := db.VerifyToken(ctx, token)
+	if err != nil {
+		return &Introspection{}
+	}
+
+	res := &Introspection{
+		Active:      true,
+		Scope:       strings.Join(claims.Scopes, " "),
+		ClientID:    claims.ClientID,
+		Username:    claims.Username,
+		TokenType:   "Bearer",
+		Exp:         claims.Expiry.Unix(),
+		Iat:         claims.IssuedAt.Unix(),
+		Sub:         claims.UserID,
+		Aud:         claims.Audience,
+		Iss:         claims.Issuer,
+		Jti:         claims.ID,
+		Permissions: claims.Permissions,
+	}
+	if claims.JKT != "" {
+		res.TokenType = "DPoP"
+		res.Cnf = &Confirmation{JKT: claims.JKT}
+	}
+	if claims.Actor != "" {
+		res.Act = &Actor{Sub: claims.Actor}
+	}
+
+	return res
+}
+
+// introspectRefreshToken describes a refresh token of an OAuth client while
+// it can be exchanged
+func (db *DB) introspectRefreshToken(ctx context.Context, token string) *Introspection {
+	collection := db.client.Database(db.database).Collection(oauthRefreshCollection)
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var record oauthRefreshToken
+	filter := bson.M{"_id": hashSecret(token), "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": time.Now()}}
+	if err := collection.FindOne(findCtx, filter).Decode(&record); err != nil {
+		return &Introspection{}
+	}
+	if err := db.checkSession(ctx, &Claims{SessionID: record.SessionID}); err != nil {
+		return &Introspection{}
+	}
+	user, err := db.FindByID(ctx, record.UserID.Hex())
+	if err != nil || !user.Active() {
+		return &Introspection{}
+	}
+
+	return &Introspection{
+		Active:    true,
+		Scope:     record.Scope,
+		ClientID:  record.ClientID.Hex(),
+		Username:  user.Username,
+		TokenType: "refresh_token",
+		Exp:       record.ExpiresAt.Unix(),
+		Sub:       user.ID.Hex(),
+		Iss:       db.tokens.issuer,
+	}
+}
+
+// introspectAPIKey describes an API key while it can be used
+func (db *DB) introspectAPIKey(ctx context.Context, key string) *Introspection {
+	claims, err := db.VerifyAPIKey(ctx, key)
+	if err != nil {
+		return &Introspection{}
+	}
+
+	res := &Introspection{
+		Active:    true,
+		Scope:     strings.Join(claims.Scopes, " "),
+		ClientID:  claims.ClientID,
+		TokenType: "api_key",
+		Iat:       claims.IssuedAt.Unix(),
+		Iss:       claims.Issuer,
+	}
+	if !claims.Expiry.IsZero() {
+		res.Exp = claims.Expiry.Unix()
+	}
+
+	return res
+}
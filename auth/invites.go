@@ -0,0 +1,349 @@
+package auth
+
+// Invitations to join an organization. Its admins invite an email with a
+// role, the invitation emails a signed token naming it. Someone without an
+// account registers with the token, existing users accept it while logged
+// in. Invitations are claimed with a single conditional update, so each is
+// used once, and resending replaces the nonce in the token so only the last
+// email works.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// invitationsCollection holds invitations until they expire
+const invitationsCollection = "invitations"
+
+// invitation representation of an invitation in the database
+type invitation struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	OrgID     primitive.ObjectID `bson:"orgId"`
+	Email     string             `bson:"email"`
+	Role      model.OrgRole      `bson:"role"`
+	InvitedBy primitive.ObjectID `bson:"invitedBy"`
+	// Random value in the token, replaced when the invitation is resent
+	Nonce      string     `bson:"nonce"`
+	CreatedAt  time.Time  `bson:"createdAt"`
+	ExpiresAt  time.Time  `bson:"expiresAt"`
+	AcceptedAt *time.Time `bson:"acceptedAt,omitempty"`
+}
+
+// toGraphInvitation converts the database representation into the GraphQL one
+func toGraphInvitation(inv *invitation) *model.Invitation {
+	return &model.Invitation{
+		ID:        inv.ID.Hex(),
+		OrgID:     inv.OrgID.Hex(),
+		Email:     inv.Email,
+		Role:      inv.Role,
+		InvitedBy: inv.InvitedBy.Hex(),
+		CreatedAt: inv.CreatedAt,
+		ExpiresAt: inv.ExpiresAt,
+	}
+}
+
+// pendingInvitation matches invitations that can still be accepted
+func pendingInvitation(filter bson.M) bson.M {
+	filter["acceptedAt"] = bson.M{"$exists": false}
+	filter["expiresAt"] = bson.M{"$gt": time.Now()}
+	return filter
+}
+
+// newNonce returns the random value of an invitation token
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// InviteMember invites email to join the organization with the given id as
+// role, invitedBy is the id of the user sending it
+func (db *DB) InviteMember(ctx context.Context, orgID, email string, role model.OrgRole, invitedBy string) (*model.Invitation, error) {
+	oid, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid organization id.")
+	}
+	org, err := db.findOrg(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find organization with id '%s'.", orgID)
+	}
+
+	email = NormalizeEmail(email)
+	if !IsValidEmail(email) {
+		return nil, validationError([]FieldError{{Field: "email", Rule: "format", Message: "Invalid email."}})
+	}
+	if !role.IsValid() {
+		return nil, gqlerror.Errorf("Invalid role %s.", role)
+	}
+	if user, _, err := db.findLogin(ctx, &org.Slug, email); err == nil && user != nil {
+		return nil, gqlerror.Errorf("%s is already a member.", email)
+	}
+
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	pending, err := collection.CountDocuments(ctx, pendingInvitation(bson.M{"orgId": oid, "email": email}), options.Count().SetLimit(1))
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not invite %s, try again later.", email)
+	}
+	if pending > 0 {
+		return nil, gqlerror.Errorf("%s was already invited, resend the invitation instead.", email)
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not invite %s, try again later.", email)
+	}
+	inviter, _ := primitive.ObjectIDFromHex(invitedBy)
+	now := time.Now()
+	inv := &invitation{
+		ID:        primitive.NewObjectID(),
+		OrgID:     oid,
+		Email:     email,
+		Role:      role,
+		InvitedBy: inviter,
+		Nonce:     nonce,
+		CreatedAt: now,
+		ExpiresAt: now.Add(db.inviteTTL),
+	}
+
+	if _, err := collection.InsertOne(ctx, inv); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not insert invitation")
+		return nil, Errorf(CodeInternal, "Could not invite %s, try again later.", email)
+	}
+
+	db.sendInvitation(ctx, inv, org)
+	return toGraphInvitation(inv), nil
+}
+
+// sendInvitation emails the token of inv
+func (db *DB) sendInvitation(ctx context.Context, inv *invitation, org *Organization) {
+	token := db.signLink("org-invite", inv.ExpiresAt, inv.ID.Hex(), inv.Nonce)
+	var link string
+	if db.inviteURL != "" {
+		link = withToken(db.inviteURL, token)
+	}
+
+	// The invitee has no locale yet, the default one is used
+	msg, err := db.templates.Render("invite", "", inv.Email, map[string]string{
+		"Org":     org.Name,
+		"Link":    link,
+		"Token":   token,
+		"Expires": inv.ExpiresAt.UTC().Format(time.RFC1123),
+	})
+	if err == nil {
+		err = db.mailer.Send(ctx, msg)
+	}
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Str("invitation", inv.ID.Hex()).Msg("could not email invitation")
+	}
+}
+
+// GetInvitation returns the invitation with the given id
+func (db *DB) GetInvitation(ctx context.Context, id string) (*model.Invitation, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid invitation id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var inv invitation
+	if err := collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&inv); err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find invitation with id '%s'.", id)
+	}
+
+	return toGraphInvitation(&inv), nil
+}
+
+// ListInvitations returns the pending invitations of the organization with the given id
+func (db *DB) ListInvitations(ctx context.Context, orgID string) ([]*model.Invitation, error) {
+	oid, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid organization id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var invitations []invitation
+	if err := findAll(ctx, collection, pendingInvitation(bson.M{"orgId": oid}), &invitations); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list invitations.")
+	}
+
+	list := []*model.Invitation{}
+	for i := range invitations {
+		list = append(list, toGraphInvitation(&invitations[i]))
+	}
+
+	return list, nil
+}
+
+// ResendInvitation emails a pending invitation again with a new token and
+// expiry, tokens emailed before stop working
+func (db *DB) ResendInvitation(ctx context.Context, id string) (*model.Invitation, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid invitation id.")
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not resend invitation, try again later.")
+	}
+
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Expired invitations can be resent until Mongo removes them
+	var inv invitation
+	update := bson.M{"$set": bson.M{"nonce": nonce, "expiresAt": time.Now().Add(db.inviteTTL)}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	filter := bson.M{"_id": oid, "acceptedAt": bson.M{"$exists": false}}
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&inv); err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find pending invitation with id '%s'.", id)
+	}
+
+	org, err := db.findOrg(ctx, bson.M{"_id": inv.OrgID})
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find organization with id '%s'.", inv.OrgID.Hex())
+	}
+
+	db.sendInvitation(ctx, &inv, org)
+	return toGraphInvitation(&inv), nil
+}
+
+// RevokeInvitation deletes a pending invitation, its token stops working
+func (db *DB) RevokeInvitation(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return gqlerror.Errorf("Invalid invitation id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": oid, "acceptedAt": bson.M{"$exists": false}})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not revoke invitation.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find pending invitation with id '%s'.", id)
+	}
+
+	return nil
+}
+
+// findInvitation returns the pending invitation a token was made for
+func (db *DB) findInvitation(ctx context.Context, token string) (*invitation, error) {
+	invalid := gqlerror.Errorf("This invitation is no longer valid.")
+
+	fields, err := db.verifyLink("org-invite", token, 2)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := primitive.ObjectIDFromHex(fields[0])
+	if err != nil {
+		return nil, invalid
+	}
+
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var inv invitation
+	if err := collection.FindOne(ctx, pendingInvitation(bson.M{"_id": oid, "nonce": fields[1]})).Decode(&inv); err != nil {
+		return nil, invalid
+	}
+
+	return &inv, nil
+}
+
+// claimInvitation marks inv accepted, it fails when it was accepted, resent
+// or revoked since it was found
+func (db *DB) claimInvitation(ctx context.Context, inv *invitation) error {
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"acceptedAt": time.Now()}}
+	res, err := collection.UpdateOne(ctx, pendingInvitation(bson.M{"_id": inv.ID, "nonce": inv.Nonce}), update)
+	if err != nil || res.ModifiedCount == 0 {
+		return gqlerror.Errorf("This invitation is no longer valid.")
+	}
+
+	return nil
+}
+
+// releaseInvitation makes a claimed invitation pending again when joining failed
+func (db *DB) releaseInvitation(ctx context.Context, inv *invitation) {
+	collection := db.client.Database(db.database).Collection(invitationsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": inv.ID}, bson.M{"$unset": bson.M{"acceptedAt": ""}}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Str("invitation", inv.ID.Hex()).Msg("could not release invitation")
+	}
+}
+
+// AcceptInvite makes the user with the given id a member of the organization
+// it was invited to, returning a token for the organization. The invitation
+// must have been sent to the email of the user
+func (db *DB) AcceptInvite(ctx context.Context, userID, token string) (*model.Token, error) {
+	if err := notImpersonating(ctx); err != nil {
+		return nil, err
+	}
+
+	user, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", userID)
+	}
+
+	inv, err := db.findInvitation(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if NormalizeEmail(user.Email) != inv.Email {
+		return nil, gqlerror.Errorf("This invitation was sent to another email address.")
+	}
+	if _, err := db.findMembership(ctx, inv.OrgID, user.ID); err == nil {
+		return nil, gqlerror.Errorf("You are already a member of this organization.")
+	}
+
+	if err := db.claimInvitation(ctx, inv); err != nil {
+		return nil, err
+	}
+
+	member, err := db.addMember(ctx, inv.OrgID, user.ID, inv.Role)
+	if err != nil {
+		db.releaseInvitation(ctx, inv)
+		if isDuplicateKey(err) {
+			return nil, gqlerror.Errorf("You are already a member of this organization.")
+		}
+		logging.Ctx(ctx).Error().Err(err).Msg("could not add member")
+		return nil, Errorf(CodeInternal, "Could not accept the invitation, try again later.")
+	}
+
+	// The login goes on in the organization, with the methods it used
+	var amr []string
+	if claims := ClaimsForContext(ctx); claims != nil {
+		amr = claims.AMR
+	}
+	return db.issueToken(ctx, user, member, "", time.Time{}, amr)
+}
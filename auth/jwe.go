@@ -0,0 +1,159 @@
+package auth
+
+// Encrypted tokens, for deployments that don't want the username and roles
+// readable by anyone who captures a token. With TOKEN_ENCRYPTION_KEY signed
+// JWTs are wrapped in a JWE (RFC 7516) encrypted with AES-256-GCM under the
+// key directly, a nested JWT. Services verifying tokens need the key too,
+// see TokenIssuer.SetEncryptionKey, and TokenIssuer.VerifyToken unwraps
+// encrypted tokens before checking the signature inside.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var errInvalidJWE = errors.New("invalid encrypted token")
+
+// jweHeader is the protected header of encrypted tokens
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Kid string `json:"kid"`
+	Cty string `json:"cty"`
+}
+
+// encryptionKey is a 256-bit key tokens are encrypted with
+type encryptionKey struct {
+	ID  string
+	key []byte
+}
+
+// ParseEncryptionKey reads a TOKEN_ENCRYPTION_KEY, 32 bytes in base64
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("TOKEN_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+	}
+
+	return key, nil
+}
+
+// SetEncryptionKey encrypts new tokens with key, 32 bytes, and decrypts the
+// tokens it encrypted. Verifiers call it with the TOKEN_ENCRYPTION_KEY of
+// this service to read encrypted tokens
+func (t *TokenIssuer) SetEncryptionKey(key []byte) error {
+	if len(key) != 32 {
+		return errors.New("token encryption keys must be 32 bytes")
+	}
+
+	// The kid is derived from the key so every instance and verifier agrees on it
+	sum := sha256.Sum256(key)
+	t.keys.mu.Lock()
+	t.keys.encryption = &encryptionKey{ID: "enc-" + hex.EncodeToString(sum[:8]), key: key}
+	t.keys.mu.Unlock()
+
+	return nil
+}
+
+// encryptionKey returns the key tokens are encrypted with, nil when they aren't
+func (k *keySet) encryptionKey() *encryptionKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.encryption
+}
+
+// isJWE reports whether token is in the compact JWE serialization, five
+// parts where JWTs have three
+func isJWE(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// encryptJWE wraps the signed token in a JWE encrypted with key
+func encryptJWE(signed string, key *encryptionKey) (string, error) {
+	header, err := json.Marshal(jweHeader{Alg: "dir", Enc: "A256GCM", Kid: key.ID, Cty: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+
+	aead, err := newGCM(key.key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	// The protected header is authenticated along with the token
+	sealed := aead.Seal(nil, iv, []byte(signed), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	// dir has no encrypted key, its part is empty
+	return strings.Join([]string{
+		protected,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decryptJWE returns the signed token inside a JWE encrypted with key
+func decryptJWE(token string, key *encryptionKey) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 || parts[1] != "" || key == nil {
+		return "", errInvalidJWE
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errInvalidJWE
+	}
+	var header jweHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return "", errInvalidJWE
+	}
+	if header.Alg != "dir" || header.Enc != "A256GCM" || header.Kid != key.ID {
+		return "", errInvalidJWE
+	}
+
+	var decoded [3][]byte
+	for i, part := range parts[2:] {
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return "", errInvalidJWE
+		}
+	}
+	iv, ciphertext, tag := decoded[0], decoded[1], decoded[2]
+
+	aead, err := newGCM(key.key)
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != aead.NonceSize() || len(tag) != aead.Overhead() {
+		return "", errInvalidJWE
+	}
+	signed, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", errInvalidJWE
+	}
+
+	return string(signed), nil
+}
+
+// newGCM returns AES-GCM with key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
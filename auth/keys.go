@@ -0,0 +1,231 @@
+package auth
+
+// Keyset used to sign and verify tokens. Tokens carry the id of their key
+// in the kid header so keys can be rotated without invalidating tokens
+// that are still valid: new tokens are signed with the current key while
+// retired keys keep verifying until the tokens they signed have expired.
+//
+// Keys come from two places, the configured KEY (which can change when
+// secrets are refreshed) and keys promoted through RotateSigningKey, which
+// are stored in Mongo so every instance shares them. Organizations can have
+// keys of their own, see tenantkeys.go.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// keysCollection stores the promoted keys
+const keysCollection = "signing_keys"
+
+// signingKey representation of a key in the database
+type signingKey struct {
+	ID        string     `bson:"_id"`
+	Secret    []byte     `bson:"secret"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	RetiredAt *time.Time `bson:"retiredAt,omitempty"`
+}
+
+// usable reports whether tokens signed with the key can still be valid,
+// retired keys verify tokens for as long as tokens live
+func (k *signingKey) usable(now time.Time, ttl time.Duration) bool {
+	return k.RetiredAt == nil || now.Sub(*k.RetiredAt) < ttl
+}
+
+// keySet holds the keys tokens can be verified with
+type keySet struct {
+	mu sync.RWMutex
+	// Lifetime of tokens
+	ttl time.Duration
+	// Key from the configuration
+	configured *signingKey
+	// Configured keys replaced by secret refreshes
+	previous []*signingKey
+	// Keys promoted with RotateSigningKey, newest first
+	stored []*signingKey
+	// Keys of organizations by organization id, newest first
+	orgs map[string][]*orgKey
+	// Ed25519 key of SIGNING_ALG EdDSA, see eddsa.go
+	eddsa *edKey
+	// Key JWTs are encrypted with, see jwe.go
+	encryption *encryptionKey
+}
+
+// configuredKey wraps the KEY setting, its id is derived from the secret so
+// every instance agrees on it
+func configuredKey(secret string) *signingKey {
+	sum := sha256.Sum256([]byte(secret))
+	return &signingKey{ID: hex.EncodeToString(sum[:8]), Secret: []byte(secret), CreatedAt: time.Now()}
+}
+
+func newKeySet(secret string, ttl time.Duration) *keySet {
+	return &keySet{configured: configuredKey(secret), ttl: ttl}
+}
+
+// current returns the key new tokens are signed with
+func (k *keySet) current() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if len(k.stored) > 0 && k.stored[0].RetiredAt == nil {
+		return k.stored[0]
+	}
+
+	return k.configured
+}
+
+// lookup returns the key with the given id, tokens without a kid predate
+// rotation and were signed with the configured key
+func (k *keySet) lookup(kid string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" || kid == k.configured.ID {
+		return k.configured
+	}
+
+	now := time.Now()
+	for _, keys := range [][]*signingKey{k.stored, k.previous} {
+		for _, key := range keys {
+			if key.ID == kid && key.usable(now, k.ttl) {
+				return key
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetSigningKey replaces the configured key, the previous one keeps
+// verifying the tokens it signed until they expire
+func (db *DB) SetSigningKey(secret string) {
+	key := configuredKey(secret)
+
+	db.keys.mu.Lock()
+	defer db.keys.mu.Unlock()
+
+	if key.ID == db.keys.configured.ID {
+		return
+	}
+
+	now := time.Now()
+	old := db.keys.configured
+	old.RetiredAt = &now
+
+	// Drop the keys that can't verify anything anymore
+	previous := []*signingKey{old}
+	for _, p := range db.keys.previous {
+		if p.usable(now, db.keys.ttl) {
+			previous = append(previous, p)
+		}
+	}
+
+	db.keys.previous = previous
+	db.keys.configured = key
+}
+
+// CheckSigningKey reports whether a key to sign tokens is configured
+func (db *DB) CheckSigningKey(ctx context.Context) error {
+	if len(db.keys.current().Secret) == 0 {
+		return errors.New("signing KEY is not set")
+	}
+
+	return nil
+}
+
+// LoadKeys reads the promoted keys that can still verify tokens
+func (db *DB) LoadKeys(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(keysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"retiredAt": bson.M{"$exists": false}},
+		bson.M{"retiredAt": bson.M{"$gt": time.Now().Add(-db.keys.ttl)}},
+	}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return err
+	}
+
+	var stored []*signingKey
+	if err := cursor.All(ctx, &stored); err != nil {
+		return err
+	}
+
+	orgs, err := db.loadOrgKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	db.keys.mu.Lock()
+	db.keys.stored = stored
+	db.keys.orgs = orgs
+	db.keys.mu.Unlock()
+
+	return nil
+}
+
+// StartKeyRefresh reloads the promoted keys every interval until stop is called,
+// so keys rotated on another instance are picked up
+func (db *DB) StartKeyRefresh(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if err := db.LoadKeys(context.Background()); err != nil {
+				logging.Logger.Error().Err(err).Msg("could not reload signing keys")
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// RotateSigningKey promotes a new random key and retires the current one,
+// outstanding tokens stay valid until they expire. Returns the id of the new key.
+func (db *DB) RotateSigningKey(ctx context.Context) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	now := time.Now()
+	key := signingKey{ID: hex.EncodeToString(id), Secret: secret, CreatedAt: now}
+
+	collection := db.client.Database(db.database).Collection(keysCollection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, key); err != nil {
+		return "", err
+	}
+
+	filter := bson.M{"_id": bson.M{"$ne": key.ID}, "retiredAt": bson.M{"$exists": false}}
+	if _, err := collection.UpdateMany(insertCtx, filter, bson.M{"$set": bson.M{"retiredAt": now}}); err != nil {
+		return "", err
+	}
+
+	return key.ID, db.LoadKeys(ctx)
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// localePattern accepts language tags such as "en", "es-MX" or "pt_BR"
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$`)
+
+// validLocale reports whether locale looks like a language tag
+func validLocale(locale string) bool {
+	return localePattern.MatchString(locale)
+}
+
+// SetLocale changes the language of the emails sent to the user, nil goes back
+// to the default of the deployment
+func (db *DB) SetLocale(ctx context.Context, id string, locale *string) (*model.User, error) {
+	if locale == nil {
+		return db.updateUser(ctx, id, bson.M{"$unset": bson.M{"locale": ""}})
+	}
+	if !validLocale(*locale) {
+		return nil, gqlerror.Errorf("Invalid locale.")
+	}
+
+	return db.updateUser(ctx, id, bson.M{"$set": bson.M{"locale": *locale}})
+}
@@ -0,0 +1,174 @@
+package auth
+
+// HTTP middleware that identifies the user making a request from the
+// token in the Authorization header, or in the token cookie with
+// COOKIE_AUTH, resolvers can then retrieve it with ForContext. Machine
+// callers send an API key instead, see APIKeyForContext
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// contextKey is unexported to avoid collisions with other packages
+type contextKey struct {
+	name string
+}
+
+var userCtxKey = &contextKey{"user"}
+var requestCtxKey = &contextKey{"request"}
+var claimsCtxKey = &contextKey{"claims"}
+
+// requestInfo describes the client behind a request
+type requestInfo struct {
+	IP        string
+	UserAgent string
+	// Accept-Language header, the languages the client reads
+	Languages string
+}
+
+// withClient keeps the client details of r around for rate limiting and
+// auditing, the address of the client is the one proxies forwarded
+func withClient(r *http.Request) *http.Request {
+	ip := proxyPolicy.ClientIP(r)
+	logging.With(r.Context(), "ip", ip)
+
+	return r.WithContext(context.WithValue(r.Context(), requestCtxKey, &requestInfo{
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Languages: r.Header.Get("Accept-Language"),
+	}))
+}
+
+// ClientMiddleware only stores the client details, for endpoints whose
+// bearer tokens aren't user tokens
+func ClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, withClient(r))
+	})
+}
+
+// Middleware decodes the bearer token and stores the user in the request context
+func Middleware(db *DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withProof(withClient(r), db.publicURL+r.URL.Path)
+			if cookiePolicy != nil {
+				// Resolvers deliver tokens in cookies through the response
+				r = r.WithContext(context.WithValue(r.Context(), writerCtxKey, w))
+				// and refresh them from the refresh cookie, which outlives the token cookie
+				if cookie, err := r.Cookie(RefreshCookie); err == nil && cookie.Value != "" && ValidCSRF(r) {
+					r = r.WithContext(context.WithValue(r.Context(), refreshCookieCtxKey, cookie.Value))
+				}
+				// Logins skip the second factor on trusted devices
+				if cookie, err := r.Cookie(DeviceCookie); err == nil && cookie.Value != "" {
+					r = r.WithContext(context.WithValue(r.Context(), deviceCookieCtxKey, cookie.Value))
+				}
+			}
+
+			header := r.Header.Get("Authorization")
+			scheme, token := "Bearer", strings.TrimPrefix(header, "Bearer ")
+			if strings.HasPrefix(header, DPoPHeader+" ") {
+				scheme, token = DPoPHeader, strings.TrimPrefix(header, DPoPHeader+" ")
+			}
+			fromCookie := false
+			if header == "" && cookiePolicy != nil {
+				if cookie, err := r.Cookie(TokenCookie); err == nil && cookie.Value != "" {
+					if !ValidCSRF(r) {
+						http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+						return
+					}
+					scheme, token, fromCookie = "", cookie.Value, true
+				}
+			}
+
+			if key := r.Header.Get(APIKeyHeader); header == "" && key != "" {
+				claims, err := db.VerifyAPIKey(r.Context(), key)
+				if err != nil {
+					http.Error(w, "Invalid API key", http.StatusForbidden)
+					return
+				}
+				logging.With(r.Context(), "client_id", claims.ClientID)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey, claims)))
+				return
+			}
+
+			// Allow unauthenticated users in, resolvers decide what they can do
+			if header == "" && !fromCookie {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Tokens of accounts that no longer exist, are disabled or are being deleted are revoked
+			claims, user, err := db.verifyUser(r.Context(), token)
+			if err != nil && fromCookie {
+				// Browsers keep sending stale cookies, drop them and let the
+				// request in anonymously so the user can refresh or sign in again
+				clearCookies(r.Context(), TokenCookie)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusForbidden)
+				return
+			}
+			// Tokens of OAuth apps are limited to the scopes the user granted,
+			// the API is only for tokens of the user's own logins
+			if claims.ClientID != "" {
+				http.Error(w, "OAuth access tokens can't be used with this API", http.StatusForbidden)
+				return
+			}
+			// Bound tokens are only accepted with a proof of their key
+			if err := db.checkBinding(r.Context(), scheme, token, claims); err != nil {
+				w.Header().Set("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+				http.Error(w, "Invalid DPoP proof", http.StatusUnauthorized)
+				return
+			}
+
+			logging.With(r.Context(), "user_id", user.ID.Hex())
+			if claims.Actor != "" {
+				logging.With(r.Context(), "actor_id", claims.Actor)
+			}
+			ctx := context.WithValue(r.Context(), userCtxKey, toGraphUser(user))
+			ctx = context.WithValue(ctx, claimsCtxKey, claims)
+			if fromCookie {
+				ctx = context.WithValue(ctx, cookieTokenCtxKey, token)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ForContext finds the user from the context, returns nil for anonymous requests.
+// REQUIRES Middleware to have run.
+func ForContext(ctx context.Context) *model.User {
+	user, _ := ctx.Value(userCtxKey).(*model.User)
+	return user
+}
+
+// ClaimsForContext returns the claims of the token the request was made with,
+// nil for anonymous requests. REQUIRES Middleware to have run.
+func ClaimsForContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsCtxKey).(*Claims)
+	return claims
+}
+
+// requestForContext returns the client details stored by Middleware
+func requestForContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestCtxKey).(*requestInfo)
+	return info
+}
+
+// IPForContext returns the address of the client that made the request
+func IPForContext(ctx context.Context) string {
+	if info := requestForContext(ctx); info != nil {
+		return info.IP
+	}
+
+	return ""
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/migrate"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migrate brings the users collection up to date with UserModel, it returns
+// how many migrations ran
+func (db *DB) Migrate(ctx context.Context) (int, error) {
+	return migrate.Run(ctx, db.client.Database(db.database), db.migrations())
+}
+
+// migrations evolve the users collection, new ones take the next version.
+// Pipeline updates need Mongo 4.2 or later. Emails and names can't be
+// rewritten in place once they are encrypted, see pii.go
+func (db *DB) migrations() []migrate.Migration {
+	users := db.collection
+
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "backfill roles",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				filter := bson.M{"roles": bson.M{"$exists": false}}
+				_, err := d.Collection(users).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"roles": []model.Role{model.RoleUser}}})
+				return err
+			},
+		},
+		{
+			Version:     2,
+			Description: "backfill account flags",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				for _, field := range []string{"verified", "disabled", "mustResetPassword"} {
+					filter := bson.M{field: bson.M{"$exists": false}}
+					if _, err := d.Collection(users).UpdateMany(ctx, filter, bson.M{"$set": bson.M{field: false}}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     3,
+			Description: "backfill createdAt from the _id",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				filter := bson.M{"createdAt": bson.M{"$exists": false}}
+				update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"createdAt": bson.M{"$toDate": "$_id"}}}}}
+				_, err := d.Collection(users).UpdateMany(ctx, filter, update)
+				return err
+			},
+		},
+		{
+			Version:     4,
+			Description: "lowercase usernames and emails",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+					"username": bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$username"}}},
+					"email":    bson.M{"$toLower": bson.M{"$trim": bson.M{"input": "$email"}}},
+				}}}}
+				_, err := d.Collection(users).UpdateMany(ctx, bson.M{}, update)
+				return err
+			},
+		},
+		{
+			Version:     5,
+			Description: "drop the non unique username index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				cursor, err := d.Collection(users).Indexes().List(ctx)
+				if err != nil {
+					return err
+				}
+
+				var indexes []struct {
+					Name   string `bson:"name"`
+					Unique bool   `bson:"unique"`
+				}
+				if err := cursor.All(ctx, &indexes); err != nil {
+					return err
+				}
+
+				// EnsureIndexes creates the unique one in its place
+				for _, index := range indexes {
+					if index.Name == "username_1" && !index.Unique {
+						_, err := d.Collection(users).Indexes().DropOne(ctx, index.Name)
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     6,
+			Description: "expire sessions and devices with TTL indexes",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, sessionsCollection, devicesCollection)
+			},
+		},
+		{
+			Version:     7,
+			Description: "expire data exports with a TTL index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, exportsCollection)
+			},
+		},
+		{
+			Version:     8,
+			Description: "make usernames and emails unique per organization",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				cursor, err := d.Collection(users).Indexes().List(ctx)
+				if err != nil {
+					return err
+				}
+
+				var indexes []struct {
+					Name string `bson:"name"`
+				}
+				if err := cursor.All(ctx, &indexes); err != nil {
+					return err
+				}
+
+				// EnsureIndexes creates the indexes scoped by orgId in their place
+				for _, index := range indexes {
+					switch index.Name {
+					case "username_1", "email_unique_ci", "emailIndex_1":
+						if _, err := d.Collection(users).Indexes().DropOne(ctx, index.Name); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version:     9,
+			Description: "expire organization invitations with a TTL index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, invitationsCollection)
+			},
+		},
+		{
+			Version:     10,
+			Description: "expire used SAML assertions with a TTL index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, assertionsCollection)
+			},
+		},
+		{
+			Version:     11,
+			Description: "expire OAuth requests, codes and refresh tokens with TTL indexes",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, oauthRequestsCollection, oauthCodesCollection, oauthRefreshCollection)
+			},
+		},
+		{
+			Version:     12,
+			Description: "expire opaque tokens with a TTL index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, opaqueTokensCollection)
+			},
+		},
+		{
+			Version:     13,
+			Description: "expire the records of refreshed tokens with a TTL index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, refreshedTokensCollection)
+			},
+		},
+		{
+			Version:     14,
+			Description: "expire trusted devices with a TTL index",
+			Up: func(ctx context.Context, d *mongo.Database) error {
+				return createTTLIndexes(ctx, d, trustedDevicesCollection)
+			},
+		},
+	}
+}
+
+// createTTLIndexes creates the TTL indexes of the given collections
+func createTTLIndexes(ctx context.Context, d *mongo.Database, collections ...string) error {
+	indexes := ttlIndexes()
+	for _, collection := range collections {
+		if _, err := d.Collection(collection).Indexes().CreateOne(ctx, indexes[collection]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ttlIndexes are the indexes Mongo removes expired records with, by collection.
+// Audit events are not in here, their retention is a setting applied by EnsureIndexes
+func ttlIndexes() map[string]mongo.IndexModel {
+	return map[string]mongo.IndexModel{
+		// Sessions end with their last token
+		sessionsCollection: {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		devicesCollection:  {Keys: bson.M{"lastSeen": 1}, Options: options.Index().SetExpireAfterSeconds(int32(deviceRetention.Seconds()))},
+		exportsCollection:  {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		// Accepted invitations are kept until they would have expired
+		invitationsCollection: {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		// Used assertions are remembered until they would have expired
+		assertionsCollection: {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		// Expired OAuth records are rejected before the TTL monitor removes them
+		oauthRequestsCollection: {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		oauthCodesCollection:    {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		oauthRefreshCollection:  {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		opaqueTokensCollection:  {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		// Refreshed tokens are remembered until they would have expired
+		refreshedTokensCollection: {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		trustedDevicesCollection:  {Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	}
+}
@@ -0,0 +1,142 @@
+package auth
+
+// Mutual TLS of internal services. On MTLS_PORT, and on the gRPC port when
+// MTLS_CA_FILE is set, callers present a client certificate the TLS
+// handshake verifies against the configured CA, which is how they are
+// identified instead of with OAuth client credentials or GRPC_TOKEN.
+// Handlers find who is calling with PeerForContext.
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/logging"
+)
+
+var peerCtxKey = &contextKey{"peer"}
+
+// Peer identifies an internal service from its client certificate
+type Peer struct {
+	// Common name of the subject
+	CommonName string
+	// Subject alternative names, URIs are such as SPIFFE ids
+	DNSNames []string
+	URIs     []string
+	// SHA-256 of the certificate in base64url, RFC 8705 x5t#S256
+	Thumbprint string
+	NotAfter   time.Time
+}
+
+// Name returns the most specific name of the peer: its first URI, then its
+// first DNS name, then its common name
+func (p *Peer) Name() string {
+	switch {
+	case len(p.URIs) > 0:
+		return p.URIs[0]
+	case len(p.DNSNames) > 0:
+		return p.DNSNames[0]
+	}
+	return p.CommonName
+}
+
+// names returns every name of the peer
+func (p *Peer) names() []string {
+	names := append(append([]string{}, p.URIs...), p.DNSNames...)
+	if p.CommonName != "" {
+		names = append(names, p.CommonName)
+	}
+	return names
+}
+
+// MutualTLSPolicy decides which verified peers are let in
+type MutualTLSPolicy struct {
+	// Names a peer must have one of, empty allows any certificate the CA signed
+	AllowedNames []string
+}
+
+var (
+	errNoClientCertificate = errors.New("a client certificate is required")
+	errPeerNotAllowed      = errors.New("the client certificate isn't allowed")
+)
+
+// NewMutualTLSPolicy returns the policy of MTLS_ALLOWED_NAMES, nil when
+// MTLS_CA_FILE is empty
+func NewMutualTLSPolicy(cfg *config.Config) *MutualTLSPolicy {
+	if cfg.MTLSCAFile == "" {
+		return nil
+	}
+
+	return &MutualTLSPolicy{AllowedNames: cfg.MTLSAllowedNames}
+}
+
+// Identify returns the peer of a connection whose client certificate the
+// handshake verified, or an error when there is none or it isn't allowed
+func (p *MutualTLSPolicy) Identify(state *tls.ConnectionState) (*Peer, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, errNoClientCertificate
+	}
+
+	cert := state.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	peer := &Peer{
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+		Thumbprint: base64.RawURLEncoding.EncodeToString(sum[:]),
+		NotAfter:   cert.NotAfter,
+	}
+	for _, uri := range cert.URIs {
+		peer.URIs = append(peer.URIs, uri.String())
+	}
+
+	if len(p.AllowedNames) == 0 {
+		return peer, nil
+	}
+	for _, name := range peer.names() {
+		for _, allowed := range p.AllowedNames {
+			if name == allowed {
+				return peer, nil
+			}
+		}
+	}
+	return nil, errPeerNotAllowed
+}
+
+// WithPeer returns a copy of ctx carrying peer
+func WithPeer(ctx context.Context, peer *Peer) context.Context {
+	return context.WithValue(ctx, peerCtxKey, peer)
+}
+
+// PeerForContext returns the internal service making the request, nil
+// unless it came in over mutual TLS
+func PeerForContext(ctx context.Context) *Peer {
+	peer, _ := ctx.Value(peerCtxKey).(*Peer)
+	return peer
+}
+
+// RequirePeer returns middleware rejecting requests without an allowed
+// client certificate and storing the peer of the others in their context
+func RequirePeer(p *MutualTLSPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer, err := p.Identify(r.TLS)
+			if err == errNoClientCertificate {
+				http.Error(w, "A client certificate is required.", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				logging.Ctx(r.Context()).Warn().Str("subject", r.TLS.VerifiedChains[0][0].Subject.String()).Msg("client certificate not allowed")
+				http.Error(w, "Access denied.", http.StatusForbidden)
+				return
+			}
+
+			logging.With(r.Context(), "peer", peer.Name())
+			next.ServeHTTP(w, r.WithContext(WithPeer(r.Context(), peer)))
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package auth
+
+// Emails telling users their account was logged into. Deployments pick
+// whether users hear about every login, only logins from new devices or
+// none, and users can override it. Each email carries a link to report
+// the login, which locks the account.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/geoip"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/mail"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reportLinkTTL is how long the link of a login email can be used
+const reportLinkTTL = 7 * 24 * time.Hour
+
+// SetMailer replaces the mailer used to notify users
+func (db *DB) SetMailer(m mail.Mailer) {
+	db.mailer = m
+}
+
+// SetLocator sets how login emails locate the client, nil leaves the location out
+func (db *DB) SetLocator(l geoip.Locator) {
+	db.locator = l
+}
+
+// loginNotifications returns which logins user is emailed about
+func (db *DB) loginNotifications(user *UserModel) model.LoginNotifications {
+	if user.LoginNotifications != "" {
+		return user.LoginNotifications
+	}
+	return db.notifyLogins
+}
+
+// SetLoginNotifications changes which logins the user is emailed about, nil
+// goes back to the default of the deployment
+func (db *DB) SetLoginNotifications(ctx context.Context, id string, mode *model.LoginNotifications) (*model.User, error) {
+	if err := notImpersonating(ctx); err != nil {
+		return nil, err
+	}
+
+	if mode == nil {
+		return db.updateUser(ctx, id, bson.M{"$unset": bson.M{"loginNotifications": ""}})
+	}
+	if !mode.IsValid() {
+		return nil, gqlerror.Errorf("Invalid login notification setting %s.", *mode)
+	}
+
+	return db.updateUser(ctx, id, bson.M{"$set": bson.M{"loginNotifications": *mode}})
+}
+
+// loginAlert is the data of the login_alert email template
+type loginAlert struct {
+	Name       string
+	NewDevice  bool
+	Time       string
+	IP         string
+	Location   string
+	Device     string
+	ReportLink string
+}
+
+// notifyLogin emails user about a successful login if their settings ask for
+// it. The email is sent in the background, the login doesn't wait for it
+func (db *DB) notifyLogin(ctx context.Context, user *UserModel, newDevice bool) {
+	switch db.loginNotifications(user) {
+	case model.LoginNotificationsAll:
+	case model.LoginNotificationsSuspicious:
+		if !newDevice {
+			return
+		}
+	default:
+		return
+	}
+
+	var ip, userAgent string
+	if info := requestForContext(ctx); info != nil {
+		ip, userAgent = info.IP, info.UserAgent
+	}
+	link := db.reportLink(user, time.Now().Add(reportLinkTTL))
+	now := time.Now()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		var location string
+		if db.locator != nil && ip != "" {
+			loc, err := db.locator.Locate(ctx, ip)
+			if err != nil {
+				logging.Logger.Warn().Err(err).Msg("could not locate client")
+			}
+			location = loc
+		}
+
+		msg, err := db.templates.Render("login_alert", user.Locale, user.Email, loginAlert{
+			Name:       user.Fname,
+			NewDevice:  newDevice,
+			Time:       now.UTC().Format(time.RFC1123),
+			IP:         ip,
+			Location:   location,
+			Device:     userAgent,
+			ReportLink: link,
+		})
+		if err != nil {
+			logging.Logger.Error().Err(err).Msg("could not render login notification")
+			return
+		}
+
+		if err := db.mailer.Send(ctx, msg); err != nil {
+			logging.Logger.Error().Err(err).Str("user_id", user.ID.Hex()).Msg("could not send login notification")
+		}
+	}()
+}
+
+// reportLink returns the "this wasn't me" link of a login email, empty when
+// no LOGIN_REPORT_URL is configured
+func (db *DB) reportLink(user *UserModel, expiry time.Time) string {
+	if db.reportURL == "" {
+		return ""
+	}
+
+	return withToken(db.reportURL, db.signLink("login-report", expiry, user.ID.Hex()))
+}
+
+// ReportLogin locks the account a login email was sent to: it is disabled,
+// must reset its password, every token is revoked and no device is trusted. It returns the id of the user
+func (db *DB) ReportLogin(ctx context.Context, token string) (string, error) {
+	fields, err := db.verifyLink("login-report", token, 1)
+	if err != nil {
+		return "", err
+	}
+
+	oid, err := primitive.ObjectIDFromHex(fields[0])
+	if err != nil {
+		return "", Errorf(CodeInvalidLink, "Invalid link.")
+	}
+
+	update := bson.M{
+		"$set": bson.M{"disabled": true, "mustResetPassword": true},
+		"$inc": bson.M{"tokenVersion": 1},
+	}
+	if _, err := db.updateUser(ctx, oid.Hex(), update); err != nil {
+		return "", err
+	}
+
+	sessions := db.client.Database(db.database).Collection(sessionsCollection)
+	if _, err := sessions.DeleteMany(ctx, bson.M{"userId": oid}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove sessions")
+	}
+	// The login may have come from a device the user trusted
+	if err := db.RevokeTrustedDevices(ctx, oid.Hex()); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove trusted devices")
+	}
+
+	return oid.Hex(), nil
+}
@@ -0,0 +1,560 @@
+package auth
+
+// Storage behind the OAuth 2.0 authorization server of the oauth package.
+// Apps are registered as clients, see oauthclients.go. Users authorize them on
+// the login page of the deployment, which the authorization endpoint sends
+// them to with the id of the request and which calls approveAuthorization,
+// and clients exchange the code they get back, proving it with PKCE, for an
+// access token and a refresh token. Access tokens are user tokens carrying
+// the client_id claim, in a session of their own that lasts as long as the
+// refresh token, so revoking the session in mySessions signs the client out.
+// Refresh tokens are random, stored hashed and replaced on every use.
+// Service clients are backend services instead, they get tokens of their own
+// with the client_credentials grant, carrying scopes and no user.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	oauthClientsCollection  = "oauth_clients"
+	oauthRequestsCollection = "oauth_requests"
+	oauthCodesCollection    = "oauth_codes"
+	oauthRefreshCollection  = "oauth_refresh_tokens"
+)
+
+// authorizationRequestTTL is how long users have to log in and approve a request
+const authorizationRequestTTL = 10 * time.Minute
+
+// authorizationCodeTTL is how long clients have to exchange a code
+const authorizationCodeTTL = time.Minute
+
+// AuthorizationRequest is a validated request of the authorization endpoint
+// waiting for the user to approve it
+type AuthorizationRequest struct {
+	ID            string             `bson:"_id"`
+	ClientID      primitive.ObjectID `bson:"clientId"`
+	RedirectURI   string             `bson:"redirectUri"`
+	Scope         string             `bson:"scope"`
+	State         string             `bson:"state"`
+	CodeChallenge string             `bson:"codeChallenge"`
+	// OpenID Connect nonce, copied into the ID token
+	Nonce     string    `bson:"nonce,omitempty"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// authorizationCode is a code handed to a client, stored hashed
+type authorizationCode struct {
+	Hash          string             `bson:"_id"`
+	ClientID      primitive.ObjectID `bson:"clientId"`
+	UserID        primitive.ObjectID `bson:"userId"`
+	RedirectURI   string             `bson:"redirectUri"`
+	Scope         string             `bson:"scope"`
+	CodeChallenge string             `bson:"codeChallenge"`
+	Nonce         string             `bson:"nonce,omitempty"`
+	AuthTime      time.Time          `bson:"authTime"`
+	AMR           []string           `bson:"amr,omitempty"`
+	ExpiresAt     time.Time          `bson:"expiresAt"`
+}
+
+// oauthRefreshToken is a refresh token of a client, stored hashed
+type oauthRefreshToken struct {
+	Hash      string             `bson:"_id"`
+	ClientID  primitive.ObjectID `bson:"clientId"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	SessionID string             `bson:"sessionId"`
+	Scope     string             `bson:"scope"`
+	AuthTime  time.Time          `bson:"authTime"`
+	AMR       []string           `bson:"amr,omitempty"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	// When it was exchanged, used tokens are kept to detect their reuse
+	UsedAt *time.Time `bson:"usedAt,omitempty"`
+}
+
+// OAuthToken is the answer of the token endpoint, RFC 6749 section 5.1
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// OpenID Connect ID token, for the openid scope
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// OAuthError is a failure of the token endpoint with its error code, RFC 6749 section 5.2
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Description
+}
+
+// invalidGrant is the error of codes and refresh tokens that can't be used
+func invalidGrant(description string) error {
+	return &OAuthError{Code: "invalid_grant", Description: description}
+}
+
+// randomToken returns a new random code, secret or token
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns the value stored for a random token, key or secret,
+// which is only ever looked up by that value
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureOAuthIndexes indexes refresh tokens by client and user, the TTL
+// indexes of requests, codes and refresh tokens are created by migration 11
+func (db *DB) ensureOAuthIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(oauthRefreshCollection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"clientId": 1}},
+		{Keys: bson.M{"userId": 1}},
+	})
+	return err
+}
+
+// StartAuthorization stores a validated request of the authorization
+// endpoint of client and returns its id, for the login page
+func (db *DB) StartAuthorization(ctx context.Context, client *OAuthClient, request *AuthorizationRequest) (string, error) {
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return "", &OAuthError{Code: "unauthorized_client", Description: "The client can't use the authorization code grant."}
+	}
+	scopes := strings.Fields(request.Scope)
+	if scope := scopePolicy.unknown(scopes); scope != "" {
+		return "", &OAuthError{Code: "invalid_scope", Description: fmt.Sprintf("Unknown scope '%s'.", scope)}
+	}
+	for _, scope := range scopes {
+		if !client.HasScope(scope) {
+			return "", &OAuthError{Code: "invalid_scope", Description: fmt.Sprintf("The client can't request the scope '%s'.", scope)}
+		}
+	}
+	request.ClientID = client.ID
+
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	request.ID = id
+	request.ExpiresAt = time.Now().Add(authorizationRequestTTL)
+
+	collection := db.client.Database(db.database).Collection(oauthRequestsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, request); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not store authorization request")
+		return "", Errorf(CodeInternal, "Could not start the authorization, try again later.")
+	}
+
+	return id, nil
+}
+
+// findAuthorizationRequest returns the pending request with the given id,
+// remove takes it so it can only be answered once
+func (db *DB) findAuthorizationRequest(ctx context.Context, id string, remove bool) (*AuthorizationRequest, error) {
+	collection := db.client.Database(db.database).Collection(oauthRequestsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// The TTL monitor only runs every minute
+	filter := bson.M{"_id": id, "expiresAt": bson.M{"$gt": time.Now()}}
+	var res *mongo.SingleResult
+	if remove {
+		res = collection.FindOneAndDelete(ctx, filter)
+	} else {
+		res = collection.FindOne(ctx, filter)
+	}
+
+	var request AuthorizationRequest
+	if err := res.Decode(&request); err != nil {
+		return nil, gqlerror.Errorf("The authorization request expired, start again from the app.")
+	}
+
+	return &request, nil
+}
+
+// GetAuthorizationRequest returns a pending request for the login page to
+// show to the user of claims, with the scopes they already granted
+func (db *DB) GetAuthorizationRequest(ctx context.Context, claims *Claims, id string) (*model.AuthorizationRequest, error) {
+	request, err := db.findAuthorizationRequest(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	client, err := db.FindOAuthClient(ctx, request.ClientID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.FindByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, Errorf(CodeForbidden, "Access denied.")
+	}
+	grant, err := db.findGrant(ctx, user.ID, client.ID)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not find grant")
+		return nil, Errorf(CodeInternal, "Could not load the authorization request.")
+	}
+	scopes, granted := consent(request.Scope, user.Roles, grant)
+
+	return &model.AuthorizationRequest{
+		ID:              request.ID,
+		Client:          toGraphOAuthClient(client),
+		Scope:           request.Scope,
+		Scopes:          scopes,
+		GrantedScopes:   granted,
+		ConsentRequired: grant == nil || len(granted) < len(scopes),
+		ExpiresAt:       request.ExpiresAt,
+	}, nil
+}
+
+// ApproveAuthorization answers a request with a code for the user of claims
+// and returns the URL sending the browser back to the client with it
+func (db *DB) ApproveAuthorization(ctx context.Context, claims *Claims, requestID string) (string, error) {
+	// The app would get refresh tokens outliving the impersonation
+	if claims.Actor != "" {
+		return "", Errorf(CodeForbidden, "Not allowed while impersonating.")
+	}
+
+	request, err := db.findAuthorizationRequest(ctx, requestID, true)
+	if err != nil {
+		return "", err
+	}
+	user, err := db.FindByID(ctx, claims.UserID)
+	if err != nil || !user.Active() {
+		return "", Errorf(CodeForbidden, "Access denied.")
+	}
+
+	scopes, _ := consent(request.Scope, user.Roles, nil)
+	if err := db.recordGrant(ctx, user.ID, request.ClientID, scopes); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not record grant")
+		return "", Errorf(CodeInternal, "Could not authorize the app, try again later.")
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	record := authorizationCode{
+		Hash:          hashSecret(code),
+		ClientID:      request.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		CodeChallenge: request.CodeChallenge,
+		Nonce:         request.Nonce,
+		AuthTime:      claims.AuthTime,
+		AMR:           claims.AMR,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL),
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthCodesCollection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, record); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not store authorization code")
+		return "", Errorf(CodeInternal, "Could not authorize the app, try again later.")
+	}
+
+	return withQuery(request.RedirectURI, url.Values{"code": {code}, "state": {request.State}}), nil
+}
+
+// DenyAuthorization drops a request and returns the URL sending the browser
+// back to the client with the access_denied error
+func (db *DB) DenyAuthorization(ctx context.Context, requestID string) (string, error) {
+	request, err := db.findAuthorizationRequest(ctx, requestID, true)
+	if err != nil {
+		return "", err
+	}
+
+	return withQuery(request.RedirectURI, url.Values{"error": {"access_denied"}, "state": {request.State}}), nil
+}
+
+// withQuery adds parameters to the query of a URL, empty values are left out
+func withQuery(rawURL string, values url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	query := u.Query()
+	for key, value := range values {
+		if len(value) > 0 && value[0] != "" {
+			query[key] = value
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// ExchangeCode trades a code given to client for tokens. verifier is the
+// PKCE code_verifier the challenge of the request was derived from
+func (db *DB) ExchangeCode(ctx context.Context, client *OAuthClient, code, redirectURI, verifier string) (*OAuthToken, error) {
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return nil, &OAuthError{Code: "unauthorized_client", Description: "The client can't use the authorization code grant."}
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthCodesCollection)
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Codes are taken on the first attempt, right or wrong
+	var record authorizationCode
+	filter := bson.M{"_id": hashSecret(code), "expiresAt": bson.M{"$gt": time.Now()}}
+	if err := collection.FindOneAndDelete(findCtx, filter).Decode(&record); err != nil {
+		return nil, invalidGrant("The code is invalid, expired or was already used.")
+	}
+	if record.ClientID != client.ID {
+		return nil, invalidGrant("The code was issued to another client.")
+	}
+	if record.RedirectURI != redirectURI {
+		return nil, invalidGrant("The redirect_uri doesn't match the authorization request.")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(record.CodeChallenge)) != 1 {
+		return nil, invalidGrant("The code_verifier doesn't match the code_challenge.")
+	}
+
+	user, err := db.FindByID(ctx, record.UserID.Hex())
+	if err != nil || !user.Active() {
+		return nil, invalidGrant("The user can't be issued tokens.")
+	}
+
+	return db.issueOAuthTokens(ctx, client, user, "", record.AuthTime, record.AMR, record.Scope, record.Nonce)
+}
+
+// RefreshOAuthToken trades a refresh token of client for new tokens, the
+// refresh token is replaced. Exchanging it again revokes the authorization
+func (db *DB) RefreshOAuthToken(ctx context.Context, client *OAuthClient, token string) (*OAuthToken, error) {
+	if !client.AllowsGrant(GrantRefreshToken) {
+		return nil, &OAuthError{Code: "unauthorized_client", Description: "The client can't use the refresh token grant."}
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthRefreshCollection)
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	hash := hashSecret(token)
+	var record oauthRefreshToken
+	filter := bson.M{"_id": hash, "clientId": client.ID, "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}}
+	if err := collection.FindOneAndUpdate(findCtx, filter, bson.M{"$set": bson.M{"usedAt": now}}).Decode(&record); err != nil {
+		var used oauthRefreshToken
+		reused := bson.M{"_id": hash, "clientId": client.ID, "usedAt": bson.M{"$exists": true}}
+		if collection.FindOne(findCtx, reused).Decode(&used) == nil {
+			db.refreshReused(ctx, used.UserID.Hex(), used.SessionID, client.ID.Hex())
+		}
+		return nil, invalidGrant("The refresh token is invalid or expired.")
+	}
+
+	user, err := db.FindByID(ctx, record.UserID.Hex())
+	if err != nil || !user.Active() {
+		return nil, invalidGrant("The user can't be issued tokens.")
+	}
+	// Revoking the session, or every session, signs the client out
+	if err := db.checkSession(ctx, &Claims{SessionID: record.SessionID}); err != nil {
+		return nil, invalidGrant("The session was revoked.")
+	}
+
+	// Scopes the user can no longer grant, e.g. after losing a role, are dropped
+	scope := strings.Join(scopePolicy.grant(strings.Fields(record.Scope), user.Roles), " ")
+
+	return db.issueOAuthTokens(ctx, client, user, record.SessionID, record.AuthTime, record.AMR, scope, "")
+}
+
+// issueOAuthTokens issues an access token of client to user, and a refresh
+// token when the client can use them, in a new session when sessionID is
+// empty. The session lasts as long as the refresh token. The openid scope
+// adds an ID token carrying nonce. authTime and amr are those of the login
+// the user approved the client with
+func (db *DB) issueOAuthTokens(ctx context.Context, client *OAuthClient, user *UserModel, sessionID string, authTime time.Time, amr []string, scope, nonce string) (*OAuthToken, error) {
+	failed := &OAuthError{Code: "server_error", Description: "Could not issue tokens, try again later."}
+	ttl := db.tokens.lifetime(client.AccessTokenTTL)
+	expiry := time.Now().Add(ttl)
+	if client.AllowsGrant(GrantRefreshToken) {
+		expiry = time.Now().Add(client.refreshTokenTTL(db.oauthRefreshTTL))
+	}
+
+	if sessionID == "" {
+		id, err := db.startClientSession(ctx, user, client.ID, expiry)
+		if err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not start session")
+			return nil, failed
+		}
+		sessionID = id
+	} else if err := db.touchSession(ctx, sessionID, expiry); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not extend session")
+	}
+
+	access, err := db.tokens.IssueForClient(user, nil, sessionID, authTime, amr, client.ID.Hex(), strings.Fields(scope), ttl)
+	if err != nil {
+		return nil, failed
+	}
+	res := &OAuthToken{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ttl.Seconds()),
+		Scope:       scope,
+	}
+	if hasScope(scope, "openid") {
+		if res.IDToken, err = db.tokens.IssueIDToken(user, client.ID.Hex(), nonce, scope, authTime); err != nil {
+			return nil, failed
+		}
+	}
+	if !client.AllowsGrant(GrantRefreshToken) {
+		return res, nil
+	}
+
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, failed
+	}
+	record := oauthRefreshToken{
+		Hash:      hashSecret(refresh),
+		ClientID:  client.ID,
+		UserID:    user.ID,
+		SessionID: sessionID,
+		Scope:     scope,
+		AuthTime:  authTime,
+		AMR:       amr,
+		ExpiresAt: expiry,
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthRefreshCollection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, record); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not store refresh token")
+		return nil, failed
+	}
+
+	res.RefreshToken = refresh
+
+	return res, nil
+}
+
+// IssueServiceToken issues a token to a service client for the requested
+// space separated scopes, all of its scopes when none are requested
+func (db *DB) IssueServiceToken(ctx context.Context, client *OAuthClient, scope string) (*OAuthToken, error) {
+	if !client.AllowsGrant(GrantClientCredentials) {
+		return nil, &OAuthError{Code: "unauthorized_client", Description: "The client can't use the client credentials grant."}
+	}
+
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, s := range scopes {
+		if _, declared := scopePolicy[s]; !declared || !client.HasScope(s) {
+			return nil, &OAuthError{Code: "invalid_scope", Description: fmt.Sprintf("The client can't request the scope '%s'.", s)}
+		}
+	}
+
+	ttl := db.tokens.lifetime(client.AccessTokenTTL)
+	access, err := db.tokens.IssueForService(client.ID.Hex(), scopes, ttl)
+	if err != nil {
+		return nil, &OAuthError{Code: "server_error", Description: "Could not issue tokens, try again later."}
+	}
+
+	return &OAuthToken{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ttl.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+// verifyServiceClient fails for revoked tokens of service clients and the
+// tokens of deleted clients
+func (db *DB) verifyServiceClient(ctx context.Context, claims *Claims) error {
+	if err := db.checkRevoked(ctx, claims); err != nil {
+		return err
+	}
+
+	client, err := db.FindOAuthClient(ctx, claims.ClientID)
+	if err != nil || !client.AllowsGrant(GrantClientCredentials) {
+		return Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	return nil
+}
+
+// RevokeOAuthToken revokes an access or refresh token of client, RFC 7009,
+// and returns the user it was issued to, empty for service clients. Tokens
+// of users end their session, which revokes the other tokens of the
+// authorization too. Unknown tokens and tokens of other clients are ignored
+func (db *DB) RevokeOAuthToken(ctx context.Context, client *OAuthClient, token string) (string, error) {
+	collection := db.client.Database(db.database).Collection(oauthRefreshCollection)
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Refresh tokens are tried first whatever the token_type_hint, looking
+	// them up is cheap
+	var record oauthRefreshToken
+	filter := bson.M{"_id": hashSecret(token), "clientId": client.ID}
+	if err := collection.FindOneAndDelete(findCtx, filter).Decode(&record); err == nil {
+		return record.UserID.Hex(), db.endOAuthSession(ctx, record.UserID.Hex(), record.SessionID)
+	}
+
+	claims, err := db.tokens.VerifyToken(token)
+	if err != nil || claims.ClientID != client.ID.Hex() {
+		return "", nil
+	}
+	if err := db.RevokeToken(ctx, claims); err != nil {
+		return "", &OAuthError{Code: "server_error", Description: "Could not revoke the token, try again later."}
+	}
+	if claims.UserID == "" {
+		return "", nil
+	}
+
+	return claims.UserID, db.endOAuthSession(ctx, claims.UserID, claims.SessionID)
+}
+
+// endOAuthSession ends the session of an authorization and removes its refresh tokens
+func (db *DB) endOAuthSession(ctx context.Context, userID, sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+	// Already gone when the user revoked it in mySessions
+	db.RevokeSession(ctx, userID, sessionID)
+
+	collection := db.client.Database(db.database).Collection(oauthRefreshCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.DeleteMany(ctx, bson.M{"sessionId": sessionID}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove refresh tokens of revoked session")
+		return &OAuthError{Code: "server_error", Description: "Could not revoke the token, try again later."}
+	}
+
+	return nil
+}
@@ -0,0 +1,446 @@
+package auth
+
+// Registry of the OAuth 2.0 clients. Each client has the grants it can use,
+// the scopes it can request and optionally lifetimes of its own for its
+// tokens. Secrets are only shown when created or rotated, a rotated secret
+// can keep working for a grace period so clients can be redeployed.
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Grant types of RFC 6749 clients can be allowed
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// OAuthClient representation of a registered client in the database
+type OAuthClient struct {
+	ID   primitive.ObjectID `bson:"_id"`
+	Name string             `bson:"name"`
+	// Hex SHA-256 of the secret, empty for public clients
+	SecretHash string `bson:"secretHash,omitempty"`
+	// Secret replaced by rotateOAuthClientSecret, accepted until it expires
+	PreviousSecretHash      string     `bson:"previousSecretHash,omitempty"`
+	PreviousSecretExpiresAt *time.Time `bson:"previousSecretExpiresAt,omitempty"`
+	RedirectURIs            []string   `bson:"redirectUris"`
+	// Empty for clients registered before grants could be chosen, see grants
+	GrantTypes []string `bson:"grantTypes,omitempty"`
+	// Set on service clients registered before grants could be chosen
+	Service bool `bson:"service,omitempty"`
+	// Scopes the client can request, any declared scope when empty
+	Scopes []string `bson:"scopes,omitempty"`
+	// Lifetimes of the tokens of the client, zero for the defaults
+	AccessTokenTTL  time.Duration `bson:"accessTokenTtl,omitempty"`
+	RefreshTokenTTL time.Duration `bson:"refreshTokenTtl,omitempty"`
+	CreatedAt       time.Time     `bson:"createdAt"`
+}
+
+// Public reports whether the client has no secret
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// grants returns the grant types of the client
+func (c *OAuthClient) grants() []string {
+	switch {
+	case len(c.GrantTypes) > 0:
+		return c.GrantTypes
+	case c.Service:
+		return []string{GrantClientCredentials}
+	}
+
+	return []string{GrantAuthorizationCode, GrantRefreshToken}
+}
+
+// AllowsGrant reports whether the client can use the grant type
+func (c *OAuthClient) AllowsGrant(grant string) bool {
+	for _, g := range c.grants() {
+		if g == grant {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsRedirect reports whether uri is one of the registered redirect URIs
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope reports whether the client can request scope. Service clients
+// only get the scopes they were registered with
+func (c *OAuthClient) HasScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return !c.AllowsGrant(GrantClientCredentials)
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refreshTokenTTL returns how long refresh tokens of the client last
+func (c *OAuthClient) refreshTokenTTL(def time.Duration) time.Duration {
+	if c.RefreshTokenTTL > 0 {
+		return c.RefreshTokenTTL
+	}
+
+	return def
+}
+
+// toGraphOAuthClient converts the database representation into the GraphQL one
+func toGraphOAuthClient(client *OAuthClient) *model.OAuthClient {
+	graph := &model.OAuthClient{
+		ID:           client.ID.Hex(),
+		Name:         client.Name,
+		RedirectUris: client.RedirectURIs,
+		Public:       client.Public(),
+		Service:      client.AllowsGrant(GrantClientCredentials),
+		GrantTypes:   []model.GrantType{},
+		Scopes:       append([]string{}, client.Scopes...),
+		CreatedAt:    client.CreatedAt,
+	}
+	for _, grant := range client.grants() {
+		graph.GrantTypes = append(graph.GrantTypes, model.GrantType(strings.ToUpper(grant)))
+	}
+	if client.AccessTokenTTL > 0 {
+		seconds := int(client.AccessTokenTTL.Seconds())
+		graph.AccessTokenLifetime = &seconds
+	}
+	if client.RefreshTokenTTL > 0 {
+		seconds := int(client.RefreshTokenTTL.Seconds())
+		graph.RefreshTokenLifetime = &seconds
+	}
+
+	return graph
+}
+
+// validRedirectURI reports whether uri can be registered: absolute and
+// without a fragment. Native apps use custom schemes
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Scheme != "" && u.Fragment == "" && (u.Host != "" || (u.Scheme != "http" && u.Scheme != "https"))
+}
+
+// validateClient checks the settings of a client before it is stored
+func validateClient(client *OAuthClient) error {
+	if client.Name == "" {
+		return gqlerror.Errorf("A client needs a name.")
+	}
+	if len(client.GrantTypes) == 0 {
+		return gqlerror.Errorf("A client needs a grant type.")
+	}
+	for _, uri := range client.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return gqlerror.Errorf("Invalid redirect URI %s, it must be absolute and without a fragment.", uri)
+		}
+	}
+	if client.AllowsGrant(GrantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return gqlerror.Errorf("Clients using the authorization code grant need a redirect URI.")
+	}
+	if client.AllowsGrant(GrantRefreshToken) && !client.AllowsGrant(GrantAuthorizationCode) {
+		return gqlerror.Errorf("The refresh token grant needs the authorization code grant.")
+	}
+	if client.AllowsGrant(GrantClientCredentials) && client.Public() {
+		return gqlerror.Errorf("Public clients can't use the client credentials grant.")
+	}
+	if scope := scopePolicy.unknown(client.Scopes); scope != "" {
+		return gqlerror.Errorf("Unknown scope '%s', declare it in SCOPES.", scope)
+	}
+	if client.AccessTokenTTL < 0 || client.RefreshTokenTTL < 0 {
+		return gqlerror.Errorf("Token lifetimes can't be negative.")
+	}
+
+	return nil
+}
+
+// grantTypes converts the grant types of the GraphQL API, nil stays nil
+func grantTypes(grants []model.GrantType) []string {
+	if grants == nil {
+		return nil
+	}
+
+	converted := []string{}
+	seen := map[model.GrantType]bool{}
+	for _, grant := range grants {
+		if !seen[grant] {
+			seen[grant] = true
+			converted = append(converted, strings.ToLower(string(grant)))
+		}
+	}
+
+	return converted
+}
+
+// seconds converts a lifetime of the GraphQL API, nil is zero
+func seconds(n *int) time.Duration {
+	if n == nil {
+		return 0
+	}
+
+	return time.Duration(*n) * time.Second
+}
+
+// CreateOAuthClient registers a client and returns it with its secret, which
+// can't be read again
+func (db *DB) CreateOAuthClient(ctx context.Context, input *model.OAuthClientInput) (*model.OAuthClientCredentials, error) {
+	client := &OAuthClient{
+		ID:              primitive.NewObjectID(),
+		Name:            input.Name,
+		RedirectURIs:    input.RedirectUris,
+		GrantTypes:      grantTypes(input.GrantTypes),
+		Scopes:          input.Scopes,
+		AccessTokenTTL:  seconds(input.AccessTokenLifetime),
+		RefreshTokenTTL: seconds(input.RefreshTokenLifetime),
+		CreatedAt:       time.Now(),
+	}
+	if client.GrantTypes == nil {
+		client.GrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+
+	var secret *string
+	if input.Public == nil || !*input.Public {
+		value, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		client.SecretHash = hashSecret(value)
+		secret = &value
+	}
+	if err := validateClient(client); err != nil {
+		return nil, err
+	}
+
+	return db.insertOAuthClient(ctx, client, secret)
+}
+
+// CreateServiceClient registers a service client and returns it with its
+// secret, which can't be read again
+func (db *DB) CreateServiceClient(ctx context.Context, input *model.ServiceClientInput) (*model.OAuthClientCredentials, error) {
+	return db.CreateOAuthClient(ctx, &model.OAuthClientInput{
+		Name:       input.Name,
+		GrantTypes: []model.GrantType{model.GrantTypeClientCredentials},
+		Scopes:     input.Scopes,
+	})
+}
+
+// insertOAuthClient stores a new client
+func (db *DB) insertOAuthClient(ctx context.Context, client *OAuthClient, secret *string) (*model.OAuthClientCredentials, error) {
+	collection := db.client.Database(db.database).Collection(oauthClientsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, client); err != nil {
+		return nil, Errorf(CodeInternal, "Could not create client.")
+	}
+
+	return &model.OAuthClientCredentials{Client: toGraphOAuthClient(client), Secret: secret}, nil
+}
+
+// UpdateOAuthClient changes the settings of a client, tokens it holds keep
+// the scopes and lifetimes they were issued with
+func (db *DB) UpdateOAuthClient(ctx context.Context, id string, input *model.OAuthClientUpdate) (*model.OAuthClient, error) {
+	client, err := db.FindOAuthClient(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find client with id '%s'.", id)
+	}
+
+	if input.Name != nil {
+		client.Name = *input.Name
+	}
+	if input.RedirectUris != nil {
+		client.RedirectURIs = input.RedirectUris
+	}
+	// Clients registered before grants could be chosen get theirs stored
+	client.GrantTypes = client.grants()
+	if input.GrantTypes != nil {
+		client.GrantTypes = grantTypes(input.GrantTypes)
+	}
+	if input.Scopes != nil {
+		client.Scopes = input.Scopes
+	}
+	if input.AccessTokenLifetime != nil {
+		client.AccessTokenTTL = seconds(input.AccessTokenLifetime)
+	}
+	if input.RefreshTokenLifetime != nil {
+		client.RefreshTokenTTL = seconds(input.RefreshTokenLifetime)
+	}
+	if err := validateClient(client); err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthClientsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.ReplaceOne(ctx, bson.M{"_id": client.ID}, client); err != nil {
+		return nil, Errorf(CodeInternal, "Could not update client.")
+	}
+
+	return toGraphOAuthClient(client), nil
+}
+
+// RotateOAuthClientSecret gives a confidential client a new secret, the
+// current one keeps working for grace
+func (db *DB) RotateOAuthClientSecret(ctx context.Context, id string, grace time.Duration) (*model.OAuthClientCredentials, error) {
+	client, err := db.FindOAuthClient(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find client with id '%s'.", id)
+	}
+	if client.Public() {
+		return nil, gqlerror.Errorf("Public clients have no secret.")
+	}
+	if grace < 0 {
+		return nil, gqlerror.Errorf("The grace period can't be negative.")
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	update := bson.M{"secretHash": hashSecret(secret)}
+	unset := bson.M{}
+	if grace > 0 {
+		expiresAt := time.Now().Add(grace)
+		update["previousSecretHash"] = client.SecretHash
+		update["previousSecretExpiresAt"] = expiresAt
+	} else {
+		unset["previousSecretHash"] = ""
+		unset["previousSecretExpiresAt"] = ""
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthClientsCollection)
+	updateCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	changes := bson.M{"$set": update}
+	if len(unset) > 0 {
+		changes["$unset"] = unset
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated OAuthClient
+	if err := collection.FindOneAndUpdate(updateCtx, bson.M{"_id": client.ID}, changes, opts).Decode(&updated); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not rotate client secret")
+		return nil, Errorf(CodeInternal, "Could not rotate the secret.")
+	}
+
+	return &model.OAuthClientCredentials{Client: toGraphOAuthClient(&updated), Secret: &secret}, nil
+}
+
+// ListOAuthClients returns the registered clients
+func (db *DB) ListOAuthClients(ctx context.Context) ([]*model.OAuthClient, error) {
+	collection := db.client.Database(db.database).Collection(oauthClientsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var clients []OAuthClient
+	if err := findAll(ctx, collection, bson.M{}, &clients); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list clients.")
+	}
+
+	list := []*model.OAuthClient{}
+	for i := range clients {
+		list = append(list, toGraphOAuthClient(&clients[i]))
+	}
+
+	return list, nil
+}
+
+// DeleteOAuthClient removes a client with its refresh tokens and the grants
+// users gave it. Access tokens it holds stay valid until they expire
+func (db *DB) DeleteOAuthClient(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return gqlerror.Errorf("Invalid client id.")
+	}
+
+	database := db.client.Database(db.database)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := database.Collection(oauthClientsCollection).DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not delete client.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find client with id '%s'.", id)
+	}
+	for _, collection := range []string{oauthRefreshCollection, oauthGrantsCollection, apiKeysCollection} {
+		if _, err := database.Collection(collection).DeleteMany(ctx, bson.M{"clientId": oid}); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Str("collection", collection).Msg("could not remove data of deleted client")
+		}
+	}
+
+	return nil
+}
+
+// FindOAuthClient returns the client with the given client_id
+func (db *DB) FindOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Unknown client.")
+	}
+
+	collection := db.client.Database(db.database).Collection(oauthClientsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var client OAuthClient
+	if err := collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&client); err != nil {
+		return nil, Errorf(CodeNotFound, "Unknown client.")
+	}
+
+	return &client, nil
+}
+
+// AuthenticateClient returns the client with the given credentials. Public
+// clients only identify themselves
+func (db *DB) AuthenticateClient(ctx context.Context, id, secret string) (*OAuthClient, error) {
+	invalid := &OAuthError{Code: "invalid_client", Description: "Unknown client or wrong secret."}
+
+	client, err := db.FindOAuthClient(ctx, id)
+	if err != nil {
+		return nil, invalid
+	}
+	if client.Public() {
+		return client, nil
+	}
+
+	hash := []byte(hashSecret(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(client.SecretHash)) == 1 {
+		return client, nil
+	}
+	if client.PreviousSecretExpiresAt != nil && time.Now().Before(*client.PreviousSecretExpiresAt) &&
+		subtle.ConstantTimeCompare(hash, []byte(client.PreviousSecretHash)) == 1 {
+		return client, nil
+	}
+
+	return nil, invalid
+}
@@ -0,0 +1,187 @@
+package auth
+
+// Opaque tokens, for deployments that don't want tokens anyone can read.
+// With TOKEN_FORMAT "opaque" logins get a random token, the signed token
+// it stands for stays on the server in a TokenStore keyed by its jti, and
+// DB.VerifyToken looks it up before the usual checks. Deleting the record
+// revokes the token at once. Services without the database verify opaque
+// tokens through introspection, TokenIssuer.VerifyToken can't.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/cache"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// FormatOpaque is the TOKEN_FORMAT of opaque tokens
+const FormatOpaque TokenFormat = "opaque"
+
+// opaqueTokensCollection holds the tokens of MongoTokenStore
+const opaqueTokensCollection = "opaque_tokens"
+
+// opaquePrefix starts opaque tokens, followed by the jti and the secret
+const opaquePrefix = "opaque."
+
+// OpaqueToken is what the server keeps of an opaque token
+type OpaqueToken struct {
+	// Hex SHA-256 of the secret half of the token
+	SecretHash string `bson:"secretHash" json:"secretHash"`
+	// The signed token it stands for
+	Token     string    `bson:"token" json:"token"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// TokenStore keeps opaque tokens by jti until they expire
+type TokenStore interface {
+	Save(ctx context.Context, jti string, token *OpaqueToken) error
+	// Load returns nil for unknown tokens
+	Load(ctx context.Context, jti string) (*OpaqueToken, error)
+	Delete(ctx context.Context, jti string) error
+}
+
+// MongoTokenStore keeps opaque tokens in Mongo, a TTL index removes them
+type MongoTokenStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoTokenStore returns a store in the database of db
+func NewMongoTokenStore(db *DB) *MongoTokenStore {
+	return &MongoTokenStore{collection: db.client.Database(db.database).Collection(opaqueTokensCollection)}
+}
+
+// opaqueRecord is an opaque token as stored in Mongo
+type opaqueRecord struct {
+	ID          string `bson:"_id"`
+	OpaqueToken `bson:",inline"`
+}
+
+// Save implements TokenStore
+func (s *MongoTokenStore) Save(ctx context.Context, jti string, token *OpaqueToken) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := s.collection.InsertOne(ctx, opaqueRecord{ID: jti, OpaqueToken: *token})
+	return err
+}
+
+// Load implements TokenStore
+func (s *MongoTokenStore) Load(ctx context.Context, jti string) (*OpaqueToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var record opaqueRecord
+	err := s.collection.FindOne(ctx, bson.M{"_id": jti}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record.OpaqueToken, nil
+}
+
+// Delete implements TokenStore
+func (s *MongoTokenStore) Delete(ctx context.Context, jti string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": jti})
+	return err
+}
+
+// CacheTokenStore keeps opaque tokens in a shared cache such as Redis,
+// entries expire with the tokens. Like CacheDenylist an LRU won't do
+type CacheTokenStore struct {
+	cache cache.Cache
+}
+
+// NewCacheTokenStore returns a store kept in c
+func NewCacheTokenStore(c cache.Cache) *CacheTokenStore {
+	return &CacheTokenStore{cache: c}
+}
+
+// Save implements TokenStore
+func (s *CacheTokenStore) Save(ctx context.Context, jti string, token *OpaqueToken) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	return s.cache.Set(ctx, "opaque:"+jti, value, time.Until(token.ExpiresAt))
+}
+
+// Load implements TokenStore
+func (s *CacheTokenStore) Load(ctx context.Context, jti string) (*OpaqueToken, error) {
+	value, ok, err := s.cache.Get(ctx, "opaque:"+jti)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var token OpaqueToken
+	if err := json.Unmarshal(value, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Delete implements TokenStore
+func (s *CacheTokenStore) Delete(ctx context.Context, jti string) error {
+	return s.cache.Delete(ctx, "opaque:"+jti)
+}
+
+// SetTokenStore makes logins return opaque tokens kept in s, nil goes back
+// to handing out the signed tokens
+func (db *DB) SetTokenStore(s TokenStore) {
+	db.opaque = s
+}
+
+// storeOpaque keeps the signed token with claims on the server and returns
+// the opaque token standing for it
+func (db *DB) storeOpaque(ctx context.Context, signed string, claims *Claims) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	token := &OpaqueToken{SecretHash: hashSecret(encoded), Token: signed, ExpiresAt: claims.Expiry}
+	if err := db.opaque.Save(ctx, claims.ID, token); err != nil {
+		return "", err
+	}
+
+	return opaquePrefix + claims.ID + "." + encoded, nil
+}
+
+// resolveOpaque returns the signed token an opaque token stands for, other
+// tokens are returned as they are
+func (db *DB) resolveOpaque(ctx context.Context, tokenString string) (string, error) {
+	if !strings.HasPrefix(tokenString, opaquePrefix) {
+		return tokenString, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(tokenString, opaquePrefix), ".")
+	if db.opaque == nil || len(parts) != 2 {
+		return "", Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	token, err := db.opaque.Load(ctx, parts[0])
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not load opaque token")
+		return "", Errorf(CodeInternal, "Could not verify token, try again later.")
+	}
+	if token == nil || subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(token.SecretHash)) != 1 {
+		return "", Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	return token.Token, nil
+}
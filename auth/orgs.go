@@ -0,0 +1,588 @@
+package auth
+
+// Organizations let one deployment serve several tenants. Every user lives
+// in a namespace, the default one or an organization's, and usernames and
+// emails are only unique within it. Users registered in an organization
+// are its members, logging in with its slug puts its id in the org claim
+// and the role of the member in org_role.
+//
+// Members are owners, admins or plain members. Admins manage members and
+// invitations, only owners grant or take away ownership and there is always
+// one left. Administrators of the deployment act as owners of every organization.
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	orgsCollection        = "organizations"
+	membershipsCollection = "memberships"
+)
+
+// slugPattern is what organization slugs look like, e.g. "acme-corp"
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}[a-z0-9]$`)
+
+// Organization representation of a tenant in the database
+type Organization struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Slug      string             `bson:"slug"`
+	Name      string             `bson:"name"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+// Membership links a user to an organization
+type Membership struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	OrgID  primitive.ObjectID `bson:"orgId"`
+	UserID primitive.ObjectID `bson:"userId"`
+	// Empty for memberships created before roles, which are members
+	Role      model.OrgRole `bson:"role,omitempty"`
+	CreatedAt time.Time     `bson:"createdAt"`
+}
+
+// roleRank orders the roles of members, a role includes those ranked below it
+var roleRank = map[model.OrgRole]int{
+	model.OrgRoleMember: 1,
+	model.OrgRoleAdmin:  2,
+	model.OrgRoleOwner:  3,
+}
+
+// role returns the role of the member in its organization
+func (m *Membership) role() model.OrgRole {
+	if m.Role == "" {
+		return model.OrgRoleMember
+	}
+	return m.Role
+}
+
+// toGraphOrg converts the database representation into the GraphQL one
+func toGraphOrg(org *Organization) *model.Organization {
+	return &model.Organization{
+		ID:        org.ID.Hex(),
+		Slug:      org.Slug,
+		Name:      org.Name,
+		CreatedAt: org.CreatedAt,
+	}
+}
+
+// orgScope is the value of orgId for users of org, nil matches the default
+// namespace where the field is absent
+func orgScope(org primitive.ObjectID) interface{} {
+	if org.IsZero() {
+		return nil
+	}
+
+	return org
+}
+
+// ensureOrgIndexes keeps slugs unique and a user from joining an organization twice
+func (db *DB) ensureOrgIndexes(ctx context.Context) error {
+	database := db.client.Database(db.database)
+
+	slug := mongo.IndexModel{Keys: bson.M{"slug": 1}, Options: options.Index().SetUnique(true)}
+	if _, err := database.Collection(orgsCollection).Indexes().CreateOne(ctx, slug); err != nil {
+		return err
+	}
+
+	_, err := database.Collection(membershipsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "orgId", Value: 1}, {Key: "userId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"userId": 1}},
+	})
+	return err
+}
+
+// findOrg returns the organization matching filter
+func (db *DB) findOrg(ctx context.Context, filter bson.M) (*Organization, error) {
+	collection := db.client.Database(db.database).Collection(orgsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var org Organization
+	if err := collection.FindOne(ctx, filter).Decode(&org); err != nil {
+		return nil, err
+	}
+
+	return &org, nil
+}
+
+// resolveOrg returns the id of the organization with the given slug, the zero
+// id for the default namespace when slug is nil or empty
+func (db *DB) resolveOrg(ctx context.Context, slug *string) (primitive.ObjectID, error) {
+	if slug == nil || *slug == "" {
+		return primitive.NilObjectID, nil
+	}
+
+	org, err := db.findOrg(ctx, bson.M{"slug": *slug})
+	if err != nil {
+		return primitive.NilObjectID, Errorf(CodeNotFound, "Could not find organization '%s'.", *slug)
+	}
+
+	return org.ID, nil
+}
+
+// findMembership returns the membership of the user in org
+func (db *DB) findMembership(ctx context.Context, org, userID primitive.ObjectID) (*Membership, error) {
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var member Membership
+	if err := collection.FindOne(ctx, bson.M{"orgId": org, "userId": userID}).Decode(&member); err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+// addMember makes the user a member of org with the given role
+func (db *DB) addMember(ctx context.Context, org, userID primitive.ObjectID, role model.OrgRole) (*Membership, error) {
+	member := &Membership{
+		ID:        primitive.NewObjectID(),
+		OrgID:     org,
+		UserID:    userID,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, member); err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+// findLogin returns the user with the given email in the organization with
+// the given slug and its membership, or in the default namespace when slug
+// is empty. Members from the default namespace can log into organizations too
+func (db *DB) findLogin(ctx context.Context, slug *string, email string) (*UserModel, *Membership, error) {
+	org, err := db.resolveOrg(ctx, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	notFound := Errorf(CodeInvalidCredentials, "Could not find user with email '%s'.", email)
+
+	user, err := db.FindUser(ctx, org, email)
+	if err != nil && !org.IsZero() {
+		user, err = db.FindUser(ctx, primitive.NilObjectID, email)
+	}
+	if err != nil {
+		return nil, nil, notFound
+	}
+	if org.IsZero() {
+		return user, nil, nil
+	}
+
+	member, err := db.findMembership(ctx, org, user.ID)
+	if err != nil {
+		return nil, nil, notFound
+	}
+
+	return user, member, nil
+}
+
+// membershipFor returns the membership a token was issued for, nil for tokens
+// outside organizations. It fails once the user left the organization
+func (db *DB) membershipFor(ctx context.Context, claims *Claims, user *UserModel) (*Membership, error) {
+	if claims.Org == "" {
+		return nil, nil
+	}
+
+	org, err := primitive.ObjectIDFromHex(claims.Org)
+	if err != nil {
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	member, err := db.findMembership(ctx, org, user.ID)
+	if err != nil {
+		return nil, gqlerror.Errorf("You are no longer a member of this organization.")
+	}
+
+	return member, nil
+}
+
+// orgRole returns the role the token grants in org, owner for administrators
+// and empty when its user isn't a member
+func (db *DB) orgRole(ctx context.Context, claims *Claims, org primitive.ObjectID) model.OrgRole {
+	if claims.HasRole(model.RoleAdmin) {
+		return model.OrgRoleOwner
+	}
+
+	user, err := primitive.ObjectIDFromHex(claims.UserID)
+	if err != nil {
+		return ""
+	}
+	member, err := db.findMembership(ctx, org, user)
+	if err != nil {
+		return ""
+	}
+
+	return member.role()
+}
+
+// RequireOrgRole fails unless the token grants at least role in the
+// organization with the given id
+func (db *DB) RequireOrgRole(ctx context.Context, claims *Claims, orgID string, role model.OrgRole) error {
+	org, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid organization id.")
+	}
+
+	if roleRank[db.orgRole(ctx, claims, org)] < roleRank[role] {
+		return Errorf(CodeForbidden, "Access denied.")
+	}
+
+	return nil
+}
+
+// parseMember parses the ids of an organization and one of its users
+func parseMember(orgID, userID string) (primitive.ObjectID, primitive.ObjectID, error) {
+	org, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return org, primitive.NilObjectID, gqlerror.Errorf("Invalid organization id.")
+	}
+	user, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return org, user, gqlerror.Errorf("Invalid user id.")
+	}
+
+	return org, user, nil
+}
+
+// checkMemberChange fails unless the token can change the membership of
+// member to role, an empty role removes it
+func (db *DB) checkMemberChange(ctx context.Context, claims *Claims, member *Membership, role model.OrgRole) error {
+	actor := db.orgRole(ctx, claims, member.OrgID)
+	self := claims.UserID == member.UserID.Hex()
+
+	switch {
+	// Members can leave on their own
+	case role == "" && self:
+	case roleRank[actor] < roleRank[model.OrgRoleAdmin]:
+		return Errorf(CodeForbidden, "Access denied.")
+	case (member.role() == model.OrgRoleOwner || role == model.OrgRoleOwner) && actor != model.OrgRoleOwner:
+		return Errorf(CodeForbidden, "Only owners can change the role of owners.")
+	}
+
+	return db.keepOwner(ctx, member.OrgID, member.role(), role)
+}
+
+// keepOwner fails when changing the role of a member of org from current to
+// role, empty for leaving, would leave the organization without owners
+func (db *DB) keepOwner(ctx context.Context, org primitive.ObjectID, current, role model.OrgRole) error {
+	if current != model.OrgRoleOwner || role == model.OrgRoleOwner {
+		return nil
+	}
+
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	owners, err := collection.CountDocuments(ctx, bson.M{"orgId": org, "role": model.OrgRoleOwner}, options.Count().SetLimit(2))
+	if err != nil {
+		return Errorf(CodeInternal, "Could not update member.")
+	}
+	if owners < 2 {
+		return gqlerror.Errorf("An organization must keep an owner.")
+	}
+
+	return nil
+}
+
+// SetMemberRole changes the role of a member of the organization, the change
+// shows in the tokens of the member from its next refresh
+func (db *DB) SetMemberRole(ctx context.Context, claims *Claims, orgID, userID string, role model.OrgRole) (*model.Member, error) {
+	org, user, err := parseMember(orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !role.IsValid() {
+		return nil, gqlerror.Errorf("Invalid role %s.", role)
+	}
+
+	member, err := db.findMembership(ctx, org, user)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find member with id '%s'.", userID)
+	}
+	if err := db.checkMemberChange(ctx, claims, member, role); err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	updateCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.UpdateOne(updateCtx, bson.M{"_id": member.ID}, bson.M{"$set": bson.M{"role": role}}); err != nil {
+		return nil, Errorf(CodeInternal, "Could not update member.")
+	}
+	member.Role = role
+
+	account, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find member with id '%s'.", userID)
+	}
+
+	return toGraphMember(member, account), nil
+}
+
+// RemoveMember takes a user out of the organization, its tokens for the
+// organization can't be refreshed anymore. Accounts registered in the
+// organization's namespace stay but can't log in
+func (db *DB) RemoveMember(ctx context.Context, claims *Claims, orgID, userID string) error {
+	org, user, err := parseMember(orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	member, err := db.findMembership(ctx, org, user)
+	if err != nil {
+		return Errorf(CodeNotFound, "Could not find member with id '%s'.", userID)
+	}
+	if err := db.checkMemberChange(ctx, claims, member, ""); err != nil {
+		return err
+	}
+
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": member.ID}); err != nil {
+		return Errorf(CodeInternal, "Could not remove member.")
+	}
+
+	return nil
+}
+
+// toGraphMember converts a membership and the user it is for into the GraphQL representation
+func toGraphMember(member *Membership, user *UserModel) *model.Member {
+	return &model.Member{
+		User:     toGraphUser(user),
+		Role:     member.role(),
+		JoinedAt: member.CreatedAt,
+	}
+}
+
+// validOrgInput checks the name and slug of an organization
+func validOrgInput(input *model.OrganizationInput) error {
+	var errs []FieldError
+	if input.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Rule: "required", Message: "Organization name can't be empty."})
+	}
+	if !slugPattern.MatchString(input.Slug) {
+		errs = append(errs, FieldError{Field: "slug", Rule: "format", Message: "Slugs are 3 to 40 lowercase letters, digits and '-'."})
+	}
+
+	return validationError(errs)
+}
+
+// CreateOrganization adds a tenant
+func (db *DB) CreateOrganization(ctx context.Context, input *model.OrganizationInput) (*model.Organization, error) {
+	if err := validOrgInput(input); err != nil {
+		return nil, err
+	}
+
+	org := &Organization{
+		ID:        primitive.NewObjectID(),
+		Slug:      input.Slug,
+		Name:      input.Name,
+		CreatedAt: time.Now(),
+	}
+
+	collection := db.client.Database(db.database).Collection(orgsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, org); err != nil {
+		if isDuplicateKey(err) {
+			return nil, Errorf(CodeSlugTaken, "Slug %s taken.", input.Slug)
+		}
+		return nil, Errorf(CodeInternal, "Could not create organization.")
+	}
+
+	return toGraphOrg(org), nil
+}
+
+// UpdateOrganization renames a tenant or changes its slug
+func (db *DB) UpdateOrganization(ctx context.Context, id string, input *model.OrganizationInput) (*model.Organization, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid organization id.")
+	}
+	if err := validOrgInput(input); err != nil {
+		return nil, err
+	}
+
+	collection := db.client.Database(db.database).Collection(orgsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var org Organization
+	update := bson.M{"$set": bson.M{"name": input.Name, "slug": input.Slug}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := collection.FindOneAndUpdate(ctx, bson.M{"_id": oid}, update, opts).Decode(&org); err != nil {
+		if isDuplicateKey(err) {
+			return nil, Errorf(CodeSlugTaken, "Slug %s taken.", input.Slug)
+		}
+		return nil, Errorf(CodeNotFound, "Could not find organization with id '%s'.", id)
+	}
+
+	return toGraphOrg(&org), nil
+}
+
+// DeleteOrganization removes a tenant, it must not have members left
+func (db *DB) DeleteOrganization(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return gqlerror.Errorf("Invalid organization id.")
+	}
+
+	database := db.client.Database(db.database)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	members, err := database.Collection(membershipsCollection).CountDocuments(ctx, bson.M{"orgId": oid}, options.Count().SetLimit(1))
+	if err != nil {
+		return Errorf(CodeInternal, "Could not delete organization.")
+	}
+	if members > 0 {
+		return gqlerror.Errorf("Organization still has members.")
+	}
+
+	res, err := database.Collection(orgsCollection).DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not delete organization.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find organization with id '%s'.", id)
+	}
+
+	for _, collection := range []string{orgKeysCollection, scimTokensCollection, invitationsCollection} {
+		if _, err := database.Collection(collection).DeleteMany(ctx, bson.M{"orgId": oid}); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Str("collection", collection).Msg("could not clean up organization")
+		}
+	}
+
+	return nil
+}
+
+// GetOrganization returns the organization with the given id
+func (db *DB) GetOrganization(ctx context.Context, id string) (*model.Organization, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid organization id.")
+	}
+
+	org, err := db.findOrg(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find organization with id '%s'.", id)
+	}
+
+	return toGraphOrg(org), nil
+}
+
+// ListOrganizations returns every organization by slug
+func (db *DB) ListOrganizations(ctx context.Context) ([]*model.Organization, error) {
+	collection := db.client.Database(db.database).Collection(orgsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"slug": 1}))
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not list organizations.")
+	}
+
+	var orgs []Organization
+	if err := cursor.All(ctx, &orgs); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list organizations.")
+	}
+
+	list := []*model.Organization{}
+	for i := range orgs {
+		list = append(list, toGraphOrg(&orgs[i]))
+	}
+
+	return list, nil
+}
+
+// orgMembers returns the memberships of the organization with the given id
+// and the users they are for, by id
+func (db *DB) orgMembers(ctx context.Context, id string) ([]Membership, map[primitive.ObjectID]*UserModel, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, nil, gqlerror.Errorf("Invalid organization id.")
+	}
+
+	database := db.client.Database(db.database)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var members []Membership
+	if err := findAll(ctx, database.Collection(membershipsCollection), bson.M{"orgId": oid}, &members); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not list members")
+		return nil, nil, Errorf(CodeInternal, "Could not list members.")
+	}
+
+	ids := bson.A{}
+	for _, member := range members {
+		ids = append(ids, member.UserID)
+	}
+
+	var users []UserModel
+	if err := findAll(ctx, database.Collection(db.collection), bson.M{"_id": bson.M{"$in": ids}}, &users); err != nil {
+		return nil, nil, Errorf(CodeInternal, "Could not list members.")
+	}
+
+	byID := map[primitive.ObjectID]*UserModel{}
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+
+	return members, byID, nil
+}
+
+// OrganizationMembers returns the users who are members of the organization
+func (db *DB) OrganizationMembers(ctx context.Context, id string) ([]*model.User, error) {
+	members, users, err := db.orgMembers(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*model.User{}
+	for _, member := range members {
+		if user, ok := users[member.UserID]; ok {
+			list = append(list, toGraphUser(user))
+		}
+	}
+
+	return list, nil
+}
+
+// OrganizationMemberships returns the members of the organization with their roles
+func (db *DB) OrganizationMemberships(ctx context.Context, id string) ([]*model.Member, error) {
+	members, users, err := db.orgMembers(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*model.Member{}
+	for i := range members {
+		if user, ok := users[members[i].UserID]; ok {
+			list = append(list, toGraphMember(&members[i], user))
+		}
+	}
+
+	return list, nil
+}
@@ -0,0 +1,247 @@
+package auth
+
+// PASETO tokens, for deployments that prefer them over JWTs. TOKEN_FORMAT
+// picks the format new tokens are minted in, v2.local tokens are encrypted
+// with XChaCha20-Poly1305 and v4.public tokens are signed with Ed25519.
+// Like ID token keys, their keys are derived from the signing keys so every
+// instance and verifier built with NewVerifier agrees on them, and the kid
+// travels in the footer. Tokens are verified whatever their format, so
+// changing it doesn't sign anyone out. Organizations with keys of their own
+// keep getting ES256 JWTs, verified with their published keys.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TokenFormat is the format tokens are minted in
+type TokenFormat string
+
+// Formats of TOKEN_FORMAT
+const (
+	FormatJWT          TokenFormat = "jwt"
+	FormatPasetoLocal  TokenFormat = "v2.local"
+	FormatPasetoPublic TokenFormat = "v4.public"
+)
+
+// PASETO reserves these claims for RFC 3339 dates, JWTs use numeric dates
+var pasetoDateClaims = []string{"exp", "iat", "nbf"}
+
+var errInvalidPaseto = errors.New("invalid PASETO token")
+
+// pasetoFooter is the footer of the tokens, naming the key that made them
+type pasetoFooter struct {
+	Kid string `json:"kid"`
+}
+
+// derive returns 32 bytes derived from the secret of k for purpose
+func (k *signingKey) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// pasetoLocalKey is the key v2.local tokens are encrypted with while k is the current key
+func (k *signingKey) pasetoLocalKey() []byte {
+	return k.derive("paseto-v2-local")
+}
+
+// pasetoPublicKey is the key v4.public tokens are signed with while k is the current key
+func (k *signingKey) pasetoPublicKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(k.derive("paseto-v4-public"))
+}
+
+// isPaseto reports whether token is a PASETO token of a supported format
+func isPaseto(token string) bool {
+	return strings.HasPrefix(token, string(FormatPasetoLocal)+".") || strings.HasPrefix(token, string(FormatPasetoPublic)+".")
+}
+
+// pae is the pre-authentication encoding of PASETO, binding the pieces
+// together before they are authenticated
+func pae(pieces ...[]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint64(len(pieces)))
+	for _, piece := range pieces {
+		binary.Write(&buf, binary.LittleEndian, uint64(len(piece)))
+		buf.Write(piece)
+	}
+
+	return buf.Bytes()
+}
+
+// encodePaseto returns a token of format carrying claims, made with key
+func encodePaseto(format TokenFormat, claims jwt.MapClaims, key *signingKey) (string, error) {
+	payload := jwt.MapClaims{}
+	for name, value := range claims {
+		payload[name] = value
+	}
+	for _, name := range pasetoDateClaims {
+		if unix, ok := payload[name].(int64); ok {
+			payload[name] = time.Unix(unix, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	message, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	footer, err := json.Marshal(pasetoFooter{Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	var body []byte
+	switch format {
+	case FormatPasetoLocal:
+		random := make([]byte, chacha20poly1305.NonceSizeX)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		if body, err = sealLocal(key.pasetoLocalKey(), random, message, footer); err != nil {
+			return "", err
+		}
+	case FormatPasetoPublic:
+		body = signPublic(key.pasetoPublicKey(), message, footer)
+	default:
+		return "", errors.New("unsupported token format " + string(format))
+	}
+
+	return pasetoToken(format, body, footer), nil
+}
+
+// pasetoToken returns the token of format with body and footer, which is
+// left out when empty
+func pasetoToken(format TokenFormat, body, footer []byte) string {
+	token := string(format) + "." + base64.RawURLEncoding.EncodeToString(body)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+
+	return token
+}
+
+// sealLocal returns the body of a v2.local token encrypting message with
+// key. The nonce is a keyed hash of the message with random, so a weak
+// random source can't repeat nonces of different messages
+func sealLocal(key, random, message, footer []byte) ([]byte, error) {
+	hash, err := blake2b.New(chacha20poly1305.NonceSizeX, random)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(message)
+	nonce := hash.Sum(nil)
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, message, pae([]byte(FormatPasetoLocal+"."), nonce, footer)), nil
+}
+
+// openLocal returns the message of the body of a v2.local token encrypted with key
+func openLocal(key, body, footer []byte) ([]byte, error) {
+	if len(body) < chacha20poly1305.NonceSizeX {
+		return nil, errInvalidPaseto
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := body[:chacha20poly1305.NonceSizeX]
+	message, err := aead.Open(nil, nonce, body[len(nonce):], pae([]byte(FormatPasetoLocal+"."), nonce, footer))
+	if err != nil {
+		return nil, errInvalidPaseto
+	}
+
+	return message, nil
+}
+
+// signPublic returns the body of a v4.public token of message signed with key
+func signPublic(key ed25519.PrivateKey, message, footer []byte) []byte {
+	signature := ed25519.Sign(key, pae([]byte(FormatPasetoPublic+"."), message, footer, nil))
+	return append(append([]byte{}, message...), signature...)
+}
+
+// verifyPublic returns the message of the body of a v4.public token signed with key
+func verifyPublic(key ed25519.PublicKey, body, footer []byte) ([]byte, error) {
+	if len(body) < ed25519.SignatureSize {
+		return nil, errInvalidPaseto
+	}
+
+	message := body[:len(body)-ed25519.SignatureSize]
+	if !ed25519.Verify(key, pae([]byte(FormatPasetoPublic+"."), message, footer, nil), body[len(message):]) {
+		return nil, errInvalidPaseto
+	}
+
+	return message, nil
+}
+
+// decodePaseto returns the claims of a PASETO token made with one of the
+// keys lookup finds, dates are converted back to numbers for toClaims
+func decodePaseto(token string, lookup func(kid string) *signingKey) (jwt.MapClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return nil, errInvalidPaseto
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidPaseto
+	}
+	footer, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errInvalidPaseto
+	}
+
+	// The footer is authenticated along with the message below
+	var f pasetoFooter
+	if err := json.Unmarshal(footer, &f); err != nil {
+		return nil, errInvalidPaseto
+	}
+	key := lookup(f.Kid)
+	if key == nil || len(key.Secret) == 0 {
+		return nil, errInvalidPaseto
+	}
+
+	var message []byte
+	switch TokenFormat(parts[0] + "." + parts[1]) {
+	case FormatPasetoLocal:
+		message, err = openLocal(key.pasetoLocalKey(), body, footer)
+	case FormatPasetoPublic:
+		message, err = verifyPublic(key.pasetoPublicKey().Public().(ed25519.PublicKey), body, footer)
+	default:
+		err = errInvalidPaseto
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	if err := json.Unmarshal(message, &claims); err != nil {
+		return nil, errInvalidPaseto
+	}
+	for _, name := range pasetoDateClaims {
+		if value, ok := claims[name].(string); ok {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, errInvalidPaseto
+			}
+			claims[name] = float64(date.Unix())
+		}
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testTokenUser() *UserModel {
+	return &UserModel{ID: primitive.NewObjectID(), Username: "ada", Roles: []model.Role{model.RoleUser}}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// splitPaseto returns the body and footer of a token
+func splitPaseto(t *testing.T, token string) ([]byte, []byte) {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	body, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var footer []byte
+	if len(parts) == 4 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[3]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return body, footer
+}
+
+// The v2.local test vectors of the PASETO specification
+func TestPasetoLocalVectors(t *testing.T) {
+	nullKey := make([]byte, 32)
+	fullKey := bytes.Repeat([]byte{0xff}, 32)
+	symmetricKey := mustHex(t, "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f")
+	nullNonce := make([]byte, 24)
+	nonce := mustHex(t, "45742c976d684ff84ebdc0de59809a97cda2f64c84fda19b")
+	message := []byte("Love is stronger than hate or fear")
+	footer := []byte("Cuon Alpinus")
+
+	tests := []struct {
+		name    string
+		key     []byte
+		nonce   []byte
+		message []byte
+		footer  []byte
+		token   string
+	}{
+		{"empty, null key", nullKey, nullNonce, nil, nil, "v2.local.driRNhM20GQPvlWfJCepzh6HdijAq-yNUtKpdy5KXjKfpSKrOlqQvQ"},
+		{"empty, full key", fullKey, nullNonce, nil, nil, "v2.local.driRNhM20GQPvlWfJCepzh6HdijAq-yNSOvpveyCsjPYfe9mtiJDVg"},
+		{"empty, symmetric key", symmetricKey, nullNonce, nil, nil, "v2.local.driRNhM20GQPvlWfJCepzh6HdijAq-yNkIWACdHuLiJiW16f2GuGYA"},
+		{"footer, null key", nullKey, nullNonce, nil, footer, "v2.local.driRNhM20GQPvlWfJCepzh6HdijAq-yNfzz6yGkE4ZxojJAJwKLfvg.Q3VvbiBBbHBpbnVz"},
+		{"footer, full key", fullKey, nullNonce, nil, footer, "v2.local.driRNhM20GQPvlWfJCepzh6HdijAq-yNJbTJxAGtEg4ZMXY9g2LSoQ.Q3VvbiBBbHBpbnVz"},
+		{"footer, symmetric key", symmetricKey, nullNonce, nil, footer, "v2.local.driRNhM20GQPvlWfJCepzh6HdijAq-yNreCcZAS0iGVlzdHjTf2ilg.Q3VvbiBBbHBpbnVz"},
+		{"message, null key", nullKey, nullNonce, message, nil, "v2.local.BEsKs5AolRYDb_O-bO-lwHWUextpShFSvu6cB-KuR4wR9uDMjd45cPiOF0zxb7rrtOB5tRcS7dWsFwY4ONEuL5sWeunqHC9jxU0"},
+		{"message, full key", fullKey, nullNonce, message, nil, "v2.local.BEsKs5AolRYDb_O-bO-lwHWUextpShFSjvSia2-chHyMi4LtHA8yFr1V7iZmKBWqzg5geEyNAAaD6xSEfxoET1xXqahe1jqmmPw"},
+		{"message, symmetric key", symmetricKey, nullNonce, message, nil, "v2.local.BEsKs5AolRYDb_O-bO-lwHWUextpShFSXlvv8MsrNZs3vTSnGQG4qRM9ezDl880jFwknSA6JARj2qKhDHnlSHx1GSCizfcF019U"},
+		{"message and footer, null key", nullKey, nonce, message, footer, "v2.local.FGVEQLywggpvH0AzKtLXz0QRmGYuC6yvbcqXgWxM3vJGrJ9kWqquP61Xl7bz4ZEqN5XwH7xyzV0QqPIo0k52q5sWxUQ4LMBFFso.Q3VvbiBBbHBpbnVz"},
+		{"message and footer, full key", fullKey, nonce, message, footer, "v2.local.FGVEQLywggpvH0AzKtLXz0QRmGYuC6yvZMW3MgUMFplQXsxcNlg2RX8LzFxAqj4qa2FwgrUdH4vYAXtCFrlGiLnk-cHHOWSUSaw.Q3VvbiBBbHBpbnVz"},
+		{"message and footer, symmetric key", symmetricKey, nonce, message, footer, "v2.local.FGVEQLywggpvH0AzKtLXz0QRmGYuC6yvl05z9GIX0cnol6UK94cfV77AXnShlUcNgpDR12FrQiurS8jxBRmvoIKmeMWC5wY9Y6w.Q3VvbiBBbHBpbnVz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := sealLocal(tt.key, tt.nonce, tt.message, tt.footer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pasetoToken(FormatPasetoLocal, body, tt.footer); got != tt.token {
+				t.Errorf("sealLocal() = %s, want %s", got, tt.token)
+			}
+
+			body, footer := splitPaseto(t, tt.token)
+			got, err := openLocal(tt.key, body, footer)
+			if err != nil || !bytes.Equal(got, tt.message) {
+				t.Errorf("openLocal() = %q, %v, want %q", got, err, tt.message)
+			}
+		})
+	}
+}
+
+// The v4.public vectors of the PASETO specification
+func TestPasetoPublicVectors(t *testing.T) {
+	key := ed25519.PrivateKey(mustHex(t, "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a3774"+
+		"1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"))
+	message := []byte(`{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`)
+
+	tests := []struct {
+		name   string
+		footer []byte
+		token  string
+	}{
+		{"4-S-1", nil, "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pasetoToken(FormatPasetoPublic, signPublic(key, message, tt.footer), tt.footer); got != tt.token {
+				t.Errorf("signPublic() = %s, want %s", got, tt.token)
+			}
+
+			body, footer := splitPaseto(t, tt.token)
+			got, err := verifyPublic(key.Public().(ed25519.PublicKey), body, footer)
+			if err != nil || !bytes.Equal(got, message) {
+				t.Errorf("verifyPublic() = %q, %v, want %q", got, err, message)
+			}
+		})
+	}
+}
+
+// replacePart returns token with its part i replaced by the base64 of value
+func replacePart(token string, i int, value string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = base64.RawURLEncoding.EncodeToString([]byte(value))
+	return strings.Join(parts, ".")
+}
+
+// flipPart returns token with a bit of the decoded part i flipped
+func flipPart(token string, i int) string {
+	parts := strings.Split(token, ".")
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[i])
+	raw[len(raw)/2] ^= 1
+	parts[i] = base64.RawURLEncoding.EncodeToString(raw)
+	return strings.Join(parts, ".")
+}
+
+func TestPasetoTokens(t *testing.T) {
+	const secret = "secret"
+	kid := configuredKey(secret).ID
+
+	for _, format := range []TokenFormat{FormatPasetoLocal, FormatPasetoPublic} {
+		t.Run(string(format), func(t *testing.T) {
+			tests := []struct {
+				name     string
+				ttl      time.Duration
+				tamper   func(token string) string
+				verifier *TokenIssuer
+				wantCode ErrorCode
+			}{
+				{name: "round trip"},
+				{name: "verifier", verifier: NewVerifier(secret, "auth", "")},
+				{name: "tampered body", tamper: func(token string) string { return flipPart(token, 2) }, wantCode: CodeInvalidToken},
+				{
+					name:     "footer changed",
+					tamper:   func(token string) string { return replacePart(token, 3, `{"kid":"`+kid+`" }`) },
+					wantCode: CodeInvalidToken,
+				},
+				{
+					name:     "unknown kid",
+					tamper:   func(token string) string { return replacePart(token, 3, `{"kid":"unknown"}`) },
+					wantCode: CodeInvalidToken,
+				},
+				{
+					name:     "no footer",
+					tamper:   func(token string) string { return token[:strings.LastIndex(token, ".")] },
+					wantCode: CodeInvalidToken,
+				},
+				{
+					name: "other format",
+					tamper: func(token string) string {
+						other := FormatPasetoPublic
+						if format == FormatPasetoPublic {
+							other = FormatPasetoLocal
+						}
+						return string(other) + strings.TrimPrefix(token, string(format))
+					},
+					wantCode: CodeInvalidToken,
+				},
+				{name: "wrong key", verifier: NewVerifier("other secret", "auth", ""), wantCode: CodeInvalidToken},
+				{name: "wrong issuer", verifier: NewVerifier(secret, "other", ""), wantCode: CodeInvalidToken},
+				{name: "expired", ttl: -time.Hour, wantCode: CodeTokenExpired},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					ttl := tt.ttl
+					if ttl == 0 {
+						ttl = time.Hour
+					}
+					issuer := NewTokenIssuer(newKeySet(secret, time.Hour), ttl, "auth", "")
+					issuer.SetFormat(format)
+					user := testTokenUser()
+
+					token, err := issuer.Issue(user, nil, "", time.Time{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !strings.HasPrefix(token, string(format)+".") {
+						t.Fatalf("Issue() = %s, want a %s token", token, format)
+					}
+					if tt.tamper != nil {
+						token = tt.tamper(token)
+					}
+					verifier := tt.verifier
+					if verifier == nil {
+						verifier = issuer
+					}
+
+					claims, err := verifier.VerifyToken(token)
+					if tt.wantCode != "" {
+						if CodeOf(err) != tt.wantCode {
+							t.Fatalf("VerifyToken() error = %v, want %s", err, tt.wantCode)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatalf("VerifyToken() error = %v", err)
+					}
+					if claims.UserID != user.ID.Hex() || claims.ID == "" {
+						t.Errorf("VerifyToken() = %+v, want the claims of %s", claims, user.ID.Hex())
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestPasetoLocalIsEncrypted(t *testing.T) {
+	issuer := NewTokenIssuer(newKeySet("secret", time.Hour), time.Hour, "auth", "")
+	issuer.SetFormat(FormatPasetoLocal)
+
+	token, err := issuer.Issue(testTokenUser(), nil, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := splitPaseto(t, token); bytes.Contains(body, []byte("ada")) {
+		t.Error("Issue() left the username readable in a v2.local token")
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords and checks them against its own hashes
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Compare(hash, password string) bool
+	// NeedsRehash reports whether hash was made by another algorithm or with other parameters
+	NeedsRehash(hash string) bool
+}
+
+// hasherFor returns the hasher that produced hash
+func hasherFor(hash string) PasswordHasher {
+	if strings.HasPrefix(hash, argon2Prefix) {
+		return Argon2id{}
+	}
+
+	return Bcrypt{}
+}
+
+// hasher is used for new passwords, set from the config with SetPasswordHasher
+var hasher PasswordHasher = Bcrypt{Cost: 14}
+
+// SetPasswordHasher changes how new passwords are hashed
+func SetPasswordHasher(h PasswordHasher) {
+	hasher = h
+}
+
+// NewPasswordHasher returns the hasher selected by PASSWORD_HASHER
+func NewPasswordHasher(cfg *config.Config) PasswordHasher {
+	if cfg.PasswordHasher == "argon2id" {
+		return Argon2id{
+			Memory:      uint32(cfg.Argon2Memory),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		}
+	}
+
+	return Bcrypt{Cost: cfg.BcryptCost}
+}
+
+// Bcrypt hashes passwords with bcrypt at the given cost
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash implements PasswordHasher
+func (b Bcrypt) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(bytes), err
+}
+
+// Compare implements PasswordHasher, the cost is read from the hash
+func (b Bcrypt) Compare(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NeedsRehash implements PasswordHasher
+func (b Bcrypt) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
+
+// Argon2id hashes passwords with Argon2id, memory is in KiB. Hashes are
+// encoded in the PHC format, $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	argon2Prefix    = "$argon2id$"
+	argon2SaltLen   = 16
+	argon2KeyLength = 32
+)
+
+// Hash implements PasswordHasher
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Compare implements PasswordHasher, the parameters are read from the hash
+func (a Argon2id) Compare(hash, password string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// NeedsRehash implements PasswordHasher
+func (a Argon2id) NeedsRehash(hash string) bool {
+	params, _, key, err := decodeArgon2id(hash)
+	return err != nil || params != a || len(key) != argon2KeyLength
+}
+
+// decodeArgon2id splits an encoded hash into its parameters, salt and key
+func decodeArgon2id(hash string) (params Argon2id, salt, key []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2Prefix), "$")
+	if !strings.HasPrefix(hash, argon2Prefix) || len(parts) != 4 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return params, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return params, nil, nil, err
+	}
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,107 @@
+package auth
+
+// Permissions are what the roles of a user allow, declared in PERMISSIONS so
+// services authorize with Claims.HasPermission instead of knowing the roles.
+// With PERMISSION_CLAIMS "lookup" they are resolved from the account when a
+// token is verified, by DB.VerifyToken, introspection and gRPC. "embed"
+// lists them in the perms claim at issuance so services verifying tokens
+// on their own have them, and "hash" only adds perms_hash, a hash of the
+// list services can cache the list they looked up under.
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/model"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// How tokens carry permissions, see PERMISSION_CLAIMS
+const (
+	PermissionsLookup = "lookup"
+	PermissionsEmbed  = "embed"
+	PermissionsHash   = "hash"
+)
+
+// PermissionPolicy maps roles to the permissions they grant
+type PermissionPolicy struct {
+	Roles map[model.Role][]string
+	Mode  string
+}
+
+var permissionPolicy = NewPermissionPolicy(&config.Config{})
+
+// SetPermissionPolicy replaces the permissions of the deployment
+func SetPermissionPolicy(p *PermissionPolicy) {
+	permissionPolicy = p
+}
+
+// NewPermissionPolicy returns the permissions declared in PERMISSIONS,
+// entries are permission=ROLE and can repeat a permission for other roles
+func NewPermissionPolicy(cfg *config.Config) *PermissionPolicy {
+	p := &PermissionPolicy{Roles: map[model.Role][]string{}, Mode: cfg.PermissionClaims}
+	if p.Mode == "" {
+		p.Mode = PermissionsLookup
+	}
+	for _, entry := range cfg.Permissions {
+		if i := strings.LastIndex(entry, "="); i > 0 {
+			role := model.Role(strings.ToUpper(entry[i+1:]))
+			p.Roles[role] = append(p.Roles[role], entry[:i])
+		}
+	}
+
+	return p
+}
+
+// resolve returns the sorted permissions of a user with roles
+func (p *PermissionPolicy) resolve(roles []model.Role) []string {
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, role := range roles {
+		for _, permission := range p.Roles[role] {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	sort.Strings(permissions)
+
+	return permissions
+}
+
+// embed adds the permissions of a user with roles to the claims of a token
+// as the mode asks
+func (p *PermissionPolicy) embed(claims jwt.MapClaims, roles []model.Role) {
+	switch p.Mode {
+	case PermissionsEmbed:
+		claims["perms"] = p.resolve(roles)
+	case PermissionsHash:
+		claims["perms_hash"] = PermissionsDigest(p.resolve(roles))
+	}
+}
+
+// PermissionsDigest returns the perms_hash of a list of permissions, the
+// truncated SHA-256 of the sorted list joined with spaces
+func PermissionsDigest(permissions []string) string {
+	sorted := append([]string{}, permissions...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, " ")))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// HasPermission reports whether the token grants permission. Only tokens
+// with the perms claim, or verified by DB.VerifyToken, have permissions
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,309 @@
+package auth
+
+// Field level encryption of the personal data in user documents, so a dump
+// of the database doesn't reveal who the users are. The email, first and
+// last name, and the secrets of authenticator apps, are sealed with AES-GCM
+// under a data key, which is itself stored in Mongo wrapped by the PII_KEY
+// master key (envelope encryption).
+//
+// Sealed values can't be queried, emails are looked up through a blind
+// index instead: an HMAC of the normalized email stored in emailIndex.
+// Documents are sealed and opened by UserModel's MarshalBSON and
+// UnmarshalBSON, values written before encryption was enabled are read as
+// they are until EncryptUsers rewrites them.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// piiKeysCollection stores the wrapped data keys
+const piiKeysCollection = "pii_keys"
+
+// sealedPrefix marks encrypted values, "enc:<key id>:<base64 nonce and ciphertext>"
+const sealedPrefix = "enc:"
+
+// piiFields returns the encrypted fields of a user document by name
+func piiFields(doc *userDocument) map[string]*string {
+	return map[string]*string{
+		"email":       &doc.Email,
+		"fname":       &doc.Fname,
+		"lname":       &doc.Lname,
+		"totpSecret":  &doc.TOTPSecret,
+		"totpPending": &doc.TOTPPending,
+	}
+}
+
+// dataKey representation of a wrapped data key in the database
+type dataKey struct {
+	ID        string    `bson:"_id"`
+	Wrapped   []byte    `bson:"wrapped"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// piiCipher seals and opens personal data
+type piiCipher struct {
+	// Id of the data key new values are sealed with
+	current string
+	keys    map[string]cipher.AEAD
+	// Key of the blind index of emails
+	indexKey []byte
+}
+
+// pii encrypts user documents, nil when PII_KEY isn't set
+var pii *piiCipher
+
+// newAEAD returns AES-GCM keyed with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts value for a field of the user with the given id, which are
+// authenticated so sealed values can't be moved between fields or documents
+func (c *piiCipher) seal(id primitive.ObjectID, field, value string) (string, error) {
+	aead := c.keys[c.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(id.Hex()+"/"+field))
+	return sealedPrefix + c.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value made by seal, other values are returned as they are
+func (c *piiCipher) open(id primitive.ObjectID, field, value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("user document is encrypted but PII_KEY is not set")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ":", 2)
+	aead, ok := c.keys[parts[0]]
+	if !ok || len(parts) != 2 {
+		return "", fmt.Errorf("unknown data key in %s", field)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed %s", field)
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id.Hex()+"/"+field))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt %s: %w", field, err)
+	}
+
+	return string(plain), nil
+}
+
+// blindIndex returns the value stored in emailIndex for email
+func (c *piiCipher) blindIndex(email string) string {
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(NormalizeEmail(email)))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userDocument has the fields of UserModel without its BSON methods
+type userDocument UserModel
+
+// sealedUser is the document of a user with encryption enabled
+type sealedUser struct {
+	User       userDocument `bson:",inline"`
+	EmailIndex string       `bson:"emailIndex"`
+}
+
+// MarshalBSON implements bson.Marshaler, encrypting the personal data when
+// PII_KEY is set
+func (user UserModel) MarshalBSON() ([]byte, error) {
+	if pii == nil {
+		return bson.Marshal(userDocument(user))
+	}
+
+	doc := sealedUser{User: userDocument(user), EmailIndex: pii.blindIndex(user.Email)}
+	for name, value := range piiFields(&doc.User) {
+		sealed, err := pii.seal(user.ID, name, *value)
+		if err != nil {
+			return nil, err
+		}
+		*value = sealed
+	}
+
+	return bson.Marshal(doc)
+}
+
+// UnmarshalBSON implements bson.Unmarshaler, decrypting the personal data
+func (user *UserModel) UnmarshalBSON(data []byte) error {
+	var doc userDocument
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	for name, value := range piiFields(&doc) {
+		plain, err := pii.open(doc.ID, name, *value)
+		if err != nil {
+			return err
+		}
+		*value = plain
+	}
+
+	*user = UserModel(doc)
+	return nil
+}
+
+// sealFields encrypts the personal data in the $set of an update of the user
+// with the given id and adds its blind index, fields is left untouched
+func sealFields(id primitive.ObjectID, fields bson.M) (bson.M, error) {
+	if pii == nil {
+		return fields, nil
+	}
+
+	sealed := bson.M{}
+	for name, value := range fields {
+		sealed[name] = value
+	}
+
+	for name := range piiFields(&userDocument{}) {
+		value, ok := fields[name].(string)
+		if !ok {
+			continue
+		}
+		if name == "email" {
+			sealed["emailIndex"] = pii.blindIndex(value)
+		}
+
+		var err error
+		if sealed[name], err = pii.seal(id, name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return sealed, nil
+}
+
+// emailFilter matches the user with the given normalized email
+func emailFilter(email string) bson.M {
+	if pii == nil {
+		return bson.M{"email": email}
+	}
+
+	return bson.M{"emailIndex": pii.blindIndex(email)}
+}
+
+// EnablePIIEncryption seals the personal data of users from now on. masterKey
+// is the base64 PII_KEY, it unwraps the data key which is created the first
+// time. The key can't be changed afterwards, it also keys the blind index
+func (db *DB) EnablePIIEncryption(ctx context.Context, masterKey string) error {
+	master, err := base64.StdEncoding.DecodeString(masterKey)
+	if err != nil {
+		return fmt.Errorf("PII_KEY is not valid base64: %w", err)
+	}
+	wrapper, err := newAEAD(master)
+	if err != nil {
+		return fmt.Errorf("invalid PII_KEY: %w", err)
+	}
+
+	// The id is derived from the master key so concurrent first starts agree
+	// on a single data key
+	sum := sha256.Sum256(append([]byte("pii data key\n"), master...))
+	id := hex.EncodeToString(sum[:8])
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	nonce := make([]byte, wrapper.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	collection := db.client.Database(db.database).Collection(piiKeysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Only inserted when the key doesn't exist yet
+	fresh := dataKey{ID: id, Wrapped: wrapper.Seal(nonce, nonce, secret, []byte(id)), CreatedAt: time.Now()}
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$setOnInsert": fresh}, options.Update().SetUpsert(true))
+	if err != nil && !isDuplicateKey(err) {
+		return fmt.Errorf("could not store the data key: %w", err)
+	}
+
+	var key dataKey
+	if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&key); err != nil {
+		return fmt.Errorf("could not load the data key: %w", err)
+	}
+	if len(key.Wrapped) < wrapper.NonceSize() {
+		return errors.New("malformed data key")
+	}
+	secret, err = wrapper.Open(nil, key.Wrapped[:wrapper.NonceSize()], key.Wrapped[wrapper.NonceSize():], []byte(id))
+	if err != nil {
+		return fmt.Errorf("could not unwrap the data key, PII_KEY changed? %w", err)
+	}
+
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return err
+	}
+
+	index := hmac.New(sha256.New, master)
+	index.Write([]byte("pii blind index"))
+
+	pii = &piiCipher{current: id, keys: map[string]cipher.AEAD{id: aead}, indexKey: index.Sum(nil)}
+	return nil
+}
+
+// EncryptUsers seals the users written before encryption was enabled,
+// returning how many were rewritten
+func (db *DB) EncryptUsers(ctx context.Context) (int, error) {
+	if pii == nil {
+		return 0, nil
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	cursor, err := collection.Find(ctx, bson.M{"emailIndex": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	for cursor.Next(ctx) {
+		var user UserModel
+		if err := cursor.Decode(&user); err != nil {
+			return n, err
+		}
+
+		if _, err := collection.ReplaceOne(ctx, bson.M{"_id": user.ID}, user); err != nil {
+			return n, err
+		}
+		db.invalidateUser(ctx, user.OrgID, user.Username, user.Email)
+		n++
+	}
+	if n > 0 {
+		logging.Logger.Info().Int("count", n).Msg("encrypted users")
+	}
+
+	return n, cursor.Err()
+}
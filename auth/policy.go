@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cesar-yoab/authService/breach"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// FieldError is a validation failure of one input field
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	// Translation key of the message and its arguments, the key defaults to
+	// field.rule
+	Key  string        `json:"-"`
+	Args []interface{} `json:"-"`
+}
+
+// validationError reports field errors as one GraphQL error carrying the message
+// of the first failure, all of them are listed in the "fields" extension
+func validationError(errs []FieldError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return &gqlerror.Error{
+		Message:    errs[0].Message,
+		Extensions: map[string]interface{}{"code": CodeValidationFailed, "fields": errs},
+	}
+}
+
+// PasswordPolicy are the rules new passwords must follow, zero values disable a rule
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// How many of lowercase, uppercase, digits and symbols must be present
+	MinClasses int
+	// Longest run of the same character allowed
+	MaxRepeated int
+	// Words passwords can't contain, compared case insensitively
+	BannedWords []string
+	// Common passwords, looked up lowercased. Nil disables the check
+	Common *breach.Filter
+	// Looks passwords up in known breaches, nil disables the check
+	Breaches BreachChecker
+	// Rejects breached passwords, otherwise they are only logged
+	BlockBreached bool
+}
+
+// BreachChecker counts how often a password appears in known breaches
+type BreachChecker interface {
+	Count(ctx context.Context, password string) (int, error)
+}
+
+// policy is checked against new passwords, set from the config with SetPasswordPolicy
+var policy = PasswordPolicy{MaxLength: 100}
+
+// SetPasswordPolicy changes the rules new passwords must follow
+func SetPasswordPolicy(p PasswordPolicy) {
+	policy = p
+}
+
+// NewPasswordPolicy returns the policy described by the PASSWORD_* settings
+func NewPasswordPolicy(cfg *config.Config) (PasswordPolicy, error) {
+	p := PasswordPolicy{
+		MinLength:     cfg.PasswordMinLength,
+		MaxLength:     cfg.PasswordMaxLength,
+		MinClasses:    cfg.PasswordMinClasses,
+		MaxRepeated:   cfg.PasswordMaxRepeated,
+		BannedWords:   cfg.PasswordBannedWords,
+		BlockBreached: cfg.PasswordBreachCheck == "block",
+	}
+	if cfg.PasswordBreachCheck != "" {
+		p.Breaches = breach.NewHIBP(cfg.HIBPURL, cfg.BreachCacheTTL)
+	}
+
+	if cfg.PasswordBlockCommon {
+		common, err := breach.CommonPasswords()
+		if err != nil {
+			return p, err
+		}
+		p.Common = common
+	}
+
+	return p, nil
+}
+
+// Check returns the rules password breaks, reported against field. Personal are
+// the username and email of the account, which the password can't contain either
+func (p PasswordPolicy) Check(field, password string, personal ...string) []FieldError {
+	var errs []FieldError
+	fail := func(rule, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...), Key: "password." + rule, Args: args})
+	}
+
+	if length := utf8.RuneCountInString(password); p.MinLength > 0 && length < p.MinLength {
+		fail("min_length", "Password must be at least %d characters long.", p.MinLength)
+	} else if p.MaxLength > 0 && length > p.MaxLength {
+		fail("max_length", "Password is too long.")
+	}
+
+	if p.MinClasses > 0 && characterClasses(password) < p.MinClasses {
+		fail("character_classes", "Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols.", p.MinClasses)
+	}
+
+	if p.MaxRepeated > 0 && longestRun(password) > p.MaxRepeated {
+		fail("repeated_characters", "Password can't repeat a character more than %d times in a row.", p.MaxRepeated)
+	}
+
+	if containsAny(password, personalWords(personal)) {
+		fail("personal_information", "Password can't contain your username or email.")
+	} else if containsAny(password, p.BannedWords) {
+		fail("banned_word", "Password contains a word that is not allowed.")
+	}
+
+	if p.Common != nil && p.Common.Contains(strings.ToLower(password)) {
+		fail("common", "Password is too common, choose a different one.")
+	}
+
+	// Only worth a remote lookup when the password is otherwise acceptable
+	if len(errs) == 0 && p.breached(password) {
+		if p.BlockBreached {
+			fail("breached", "Password appeared in a data breach, choose a different one.")
+		} else {
+			logging.Logger.Warn().Str("field", field).Msg("accepted a password found in data breaches")
+		}
+	}
+
+	return errs
+}
+
+// breached reports whether password is known to have leaked. The check fails
+// open, passwords are accepted when the breach service can't be reached
+func (p PasswordPolicy) breached(password string) bool {
+	if p.Breaches == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := p.Breaches.Count(ctx, password)
+	if err != nil {
+		logging.Logger.Warn().Err(err).Msg("password breach check unavailable")
+		return false
+	}
+
+	return count > 0
+}
+
+// characterClasses counts the kinds of characters in s
+func characterClasses(s string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// longestRun returns the length of the longest run of one character in s
+func longestRun(s string) int {
+	var longest, run int
+	var prev rune
+	for i, r := range []rune(s) {
+		if i > 0 && r == prev {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = r
+	}
+
+	return longest
+}
+
+// personalWords splits the username and email into the parts worth checking
+func personalWords(values []string) []string {
+	var words []string
+	for _, value := range values {
+		if at := strings.LastIndex(value, "@"); at >= 0 {
+			value = value[:at]
+		}
+		words = append(words, value)
+	}
+
+	return words
+}
+
+// containsAny reports whether s contains one of words, ignoring case. Words
+// shorter than 3 characters match too many passwords to be useful
+func containsAny(s string, words []string) bool {
+	s = strings.ToLower(s)
+	for _, word := range words {
+		if utf8.RuneCountInString(word) >= 3 && strings.Contains(s, strings.ToLower(word)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,128 @@
+package auth
+
+// Just-in-time provisioning of the users single sign-on logs in for the
+// first time. The policy of the deployment decides whether they are created,
+// for which email domains and with which roles, and a hook can change or
+// refuse each user before it is created.
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Provisioning modes
+const (
+	// Users are created
+	ProvisionAuto = "auto"
+	// Users are created awaiting approval by an administrator
+	ProvisionApproval = "approval"
+	// Users are refused, administrators or SCIM create them
+	ProvisionOff = "off"
+)
+
+// ProvisioningPolicy decides what happens to users single sign-on logs in
+// for the first time
+type ProvisioningPolicy struct {
+	Mode string
+	// Email domains users can be created with, any when empty
+	AllowedDomains []string
+	// Roles of the users created
+	Roles []model.Role
+	// Role of the users created in the organization of the identity provider
+	OrgRole model.OrgRole
+	// Changes or refuses users before they are created, nil for none
+	Hook ProvisioningHook
+}
+
+// SSOUser is a user single sign-on is about to create
+type SSOUser struct {
+	// Derived from the email when empty
+	Username string        `json:"username"`
+	Fname    string        `json:"fname"`
+	Lname    string        `json:"lname"`
+	Roles    []model.Role  `json:"roles"`
+	OrgRole  model.OrgRole `json:"orgRole"`
+	// Created awaiting approval by an administrator
+	PendingApproval bool `json:"pendingApproval"`
+}
+
+// ProvisioningHook customizes the users single sign-on creates, e.g. to read
+// their roles from the attributes of the identity. It can change the user,
+// or refuse it with an error whose message is shown to the user
+type ProvisioningHook interface {
+	Provision(ctx context.Context, identity *SSOIdentity, user *SSOUser) error
+}
+
+var provisioningPolicy = ProvisioningPolicy{
+	Mode:    ProvisionAuto,
+	Roles:   []model.Role{model.RoleUser},
+	OrgRole: model.OrgRoleMember,
+}
+
+// SetProvisioningPolicy replaces the policy users are created by single sign-on with
+func SetProvisioningPolicy(p ProvisioningPolicy) {
+	provisioningPolicy = p
+}
+
+// NewProvisioningPolicy returns the policy described by the SSO_* settings, without a hook
+func NewProvisioningPolicy(cfg *config.Config) ProvisioningPolicy {
+	p := ProvisioningPolicy{
+		Mode:    cfg.SSOProvisioning,
+		Roles:   []model.Role{model.RoleUser},
+		OrgRole: model.OrgRole(strings.ToUpper(cfg.SSODefaultOrgRole)),
+	}
+	if len(cfg.SSODefaultRoles) > 0 {
+		p.Roles = nil
+		for _, role := range cfg.SSODefaultRoles {
+			p.Roles = append(p.Roles, model.Role(strings.ToUpper(role)))
+		}
+	}
+	for _, domain := range cfg.SSOAllowedDomains {
+		p.AllowedDomains = append(p.AllowedDomains, strings.ToLower(strings.TrimPrefix(domain, "@")))
+	}
+
+	return p
+}
+
+// provision returns the user to create for identity, whose normalized
+// email is given, or why it can't be created
+func (p ProvisioningPolicy) provision(ctx context.Context, email string, identity *SSOIdentity) (*SSOUser, error) {
+	if p.Mode == ProvisionOff {
+		return nil, gqlerror.Errorf("There is no account for this email, ask an administrator to create one.")
+	}
+	if !(EmailPolicy{AllowedDomains: p.AllowedDomains}).Allowed(email) {
+		return nil, gqlerror.Errorf("Single sign-on doesn't create accounts for this email domain.")
+	}
+
+	user := &SSOUser{
+		Username:        identity.Username,
+		Fname:           identity.Fname,
+		Lname:           identity.Lname,
+		Roles:           append([]model.Role{}, p.Roles...),
+		OrgRole:         p.OrgRole,
+		PendingApproval: p.Mode == ProvisionApproval,
+	}
+	if p.Hook == nil {
+		return user, nil
+	}
+
+	if err := p.Hook.Provision(ctx, identity, user); err != nil {
+		return nil, err
+	}
+	// Hooks can't make owners, an organization's owners choose them
+	valid := user.OrgRole == model.OrgRoleMember || user.OrgRole == model.OrgRoleAdmin
+	for _, role := range user.Roles {
+		valid = valid && role.IsValid()
+	}
+	if !valid {
+		logging.Ctx(ctx).Error().Interface("roles", user.Roles).Str("orgRole", string(user.OrgRole)).Msg("provisioning hook returned invalid roles")
+		return nil, Errorf(CodeInternal, "Could not create user, try again later.")
+	}
+
+	return user, nil
+}
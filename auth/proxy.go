@@ -0,0 +1,96 @@
+package auth
+
+// Client addresses behind reverse proxies and load balancers. Requests then
+// come from the proxy, which names the client in X-Forwarded-For or
+// X-Real-IP. Anyone can send those headers, so they are only believed from
+// the addresses of TRUSTED_PROXIES, and X-Forwarded-For is read from the
+// right, skipping the trusted hops, since clients can prepend any address.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+)
+
+// ProxyPolicy lists the proxies whose forwarding headers are believed
+type ProxyPolicy struct {
+	Trusted []*net.IPNet
+}
+
+var proxyPolicy *ProxyPolicy
+
+// SetProxyPolicy sets the proxies requests come through, nil trusts none
+func SetProxyPolicy(p *ProxyPolicy) {
+	proxyPolicy = p
+}
+
+// NewProxyPolicy returns the policy of TRUSTED_PROXIES, addresses or CIDR
+// ranges, nil when it is empty
+func NewProxyPolicy(cfg *config.Config) (*ProxyPolicy, error) {
+	if len(cfg.TrustedProxies) == 0 {
+		return nil, nil
+	}
+
+	p := &ProxyPolicy{}
+	for _, proxy := range cfg.TrustedProxies {
+		network, err := config.ParseNetwork(proxy)
+		if err != nil {
+			return nil, err
+		}
+		p.Trusted = append(p.Trusted, network)
+	}
+	return p, nil
+}
+
+// trusts reports whether ip is one of a trusted proxy
+func (p *ProxyPolicy) trusts(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, network := range p.Trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r, the nearest
+// address in X-Forwarded-For, or else X-Real-IP, that isn't a trusted proxy
+// when r comes from one
+func (p *ProxyPolicy) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !p.trusts(net.ParseIP(ip)) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+			return real.String()
+		}
+		return ip
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		// Garbage can't be told apart from a spoofed address, the last
+		// trusted hop is the client as far as we know
+		if hop == nil {
+			return ip
+		}
+		ip = hop.String()
+		if !p.trusts(hop) {
+			return ip
+		}
+	}
+	return ip
+}
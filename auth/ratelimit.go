@@ -0,0 +1,72 @@
+package auth
+
+// A small in-memory rate limiter, good enough for a single instance
+// of the service. Requests are counted per key in fixed windows.
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows up to limit calls per key in every window
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string]*bucket
+}
+
+// bucket counts the calls of a key in the current window
+type bucket struct {
+	count int
+	reset time.Time
+}
+
+// NewRateLimiter returns a limiter allowing limit calls per key every window
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string]*bucket),
+	}
+}
+
+// Allow records a call for key and reports whether it is within the limit
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.hits[key]
+	if !ok || now.After(b.reset) {
+		// Sweep runs periodically, this bounds the map between two runs
+		if len(rl.hits) > 10000 {
+			rl.sweep(now)
+		}
+		b = &bucket{reset: now.Add(rl.window)}
+		rl.hits[key] = b
+	}
+
+	b.count++
+	return b.count <= rl.limit
+}
+
+// Sweep implements Sweeper
+func (rl *RateLimiter) Sweep(now time.Time) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.sweep(now)
+}
+
+// sweep removes buckets whose window is over, callers must hold the lock
+func (rl *RateLimiter) sweep(now time.Time) int {
+	n := 0
+	for key, b := range rl.hits {
+		if now.After(b.reset) {
+			delete(rl.hits, key)
+			n++
+		}
+	}
+	return n
+}
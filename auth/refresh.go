@@ -0,0 +1,134 @@
+package auth
+
+// Refresh tokens. Logins return a short lived access token, the one APIs
+// accept, with a long lived refresh token only this service reads: a JWT
+// of type "refresh" signed with a key of its own, so neither kind of token
+// is accepted in place of the other and services verifying access tokens
+// can't mint refresh tokens. Refreshing trades one for a new pair in the
+// same session, each refresh token works once.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// refreshKeyID is the kid of refresh tokens
+const refreshKeyID = "refresh"
+
+// refreshTokenType is the typ claim of refresh tokens
+const refreshTokenType = "refresh"
+
+// DeriveRefreshKey returns the key refresh tokens are signed with when
+// REFRESH_KEY isn't set, derived from the signing key
+func DeriveRefreshKey(signingKey string) []byte {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte("refresh-token"))
+	return mac.Sum(nil)
+}
+
+// SetRefreshKey signs refresh tokens lasting ttl with key, issuers without
+// one don't issue refresh tokens
+func (t *TokenIssuer) SetRefreshKey(key []byte, ttl time.Duration) {
+	t.refreshKey = key
+	t.refreshTTL = ttl
+}
+
+// IssueRefresh returns a refresh token of user in the session, see Issue.
+// It carries what the tokens it is traded for need, jkt binds it to a DPoP
+// key when not empty
+func (t *TokenIssuer) IssueRefresh(user *UserModel, member *Membership, sessionID string, authTime time.Time, amr []string, jkt string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if authTime.IsZero() {
+		authTime = now
+	}
+	if len(amr) == 0 {
+		amr = amrPassword
+	}
+	claims := jwt.MapClaims{
+		"typ":       refreshTokenType,
+		"jti":       jti,
+		"_id":       user.ID.Hex(),
+		"sid":       sessionID,
+		"ver":       user.TokenVersion,
+		"auth_time": authTime.Unix(),
+		"amr":       amr,
+		"iss":       t.issuer,
+		"iat":       now.Unix(),
+		"exp":       now.Add(t.refreshTTL).Unix(),
+	}
+	if member != nil {
+		claims["org"] = member.OrgID.Hex()
+	}
+	if jkt != "" {
+		claims["cnf"] = map[string]string{"jkt": jkt}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = refreshKeyID
+
+	return token.SignedString(t.refreshKey)
+}
+
+// verifyRefresh checks the signature, type and dates of a refresh token and
+// returns its claims
+func (t *TokenIssuer) verifyRefresh(tokenString string) (*Claims, error) {
+	parser := jwt.Parser{ValidMethods: []string{"HS256"}, SkipClaimsValidation: true}
+	tkn, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid != refreshKeyID || len(t.refreshKey) == 0 {
+			return nil, Errorf(CodeInvalidToken, "Unknown signing key.")
+		}
+		return t.refreshKey, nil
+	})
+	if err != nil || !tkn.Valid {
+		return nil, Errorf(CodeInvalidToken, "Invalid refresh token.")
+	}
+
+	claims, _ := tkn.Claims.(jwt.MapClaims)
+	if typ, _ := claims["typ"].(string); typ != refreshTokenType {
+		return nil, Errorf(CodeInvalidToken, "Invalid refresh token.")
+	}
+	if now := time.Now(); !t.validTimes(claims, now) {
+		if t.expired(claims, now) {
+			return nil, Errorf(CodeTokenExpired, "Refresh token has expired, log in again.")
+		}
+		return nil, Errorf(CodeInvalidToken, "Invalid refresh token.")
+	}
+	if !claims.VerifyIssuer(t.issuer, true) {
+		return nil, Errorf(CodeInvalidToken, "Invalid refresh token.")
+	}
+
+	return toClaims(claims), nil
+}
+
+// verifyRefresh verifies a refresh token and returns the account it was
+// issued to, like verifyUser does for access tokens
+func (db *DB) verifyRefresh(ctx context.Context, tokenString string) (*Claims, *UserModel, error) {
+	claims, err := db.tokens.verifyRefresh(tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := db.checkSession(ctx, claims); err != nil {
+		return nil, nil, err
+	}
+
+	user, err := db.FindByID(ctx, claims.UserID)
+	if err != nil || !user.Active() {
+		return nil, nil, Errorf(CodeInvalidToken, "Invalid refresh token.")
+	}
+
+	// The user signed out of every device after the token was issued
+	if claims.Version < user.TokenVersion {
+		return nil, nil, Errorf(CodeTokenRevoked, "Token has been revoked.")
+	}
+
+	return claims, user, nil
+}
@@ -0,0 +1,396 @@
+package auth
+
+// Storage behind the SCIM provisioning API of the scim package. Identity
+// providers authenticate with long lived provisioning tokens, created by
+// owners of an organization and stored hashed, and manage the members of
+// that organization. Users they create live in the organization's
+// namespace, members from the default namespace can only be given roles
+// or removed from the organization.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// scimTokensCollection stores the provisioning tokens
+const scimTokensCollection = "scim_tokens"
+
+// scimToken representation of a provisioning token in the database
+type scimToken struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	OrgID primitive.ObjectID `bson:"orgId"`
+	// Hex SHA-256 of the token, the token itself is only shown once
+	Hash        string     `bson:"hash"`
+	Description string     `bson:"description"`
+	CreatedAt   time.Time  `bson:"createdAt"`
+	LastUsedAt  *time.Time `bson:"lastUsedAt,omitempty"`
+}
+
+// toGraphScimToken converts the database representation into the GraphQL one
+func toGraphScimToken(token *scimToken) *model.ScimToken {
+	return &model.ScimToken{
+		ID:          token.ID.Hex(),
+		OrgID:       token.OrgID.Hex(),
+		Description: token.Description,
+		CreatedAt:   token.CreatedAt,
+		LastUsedAt:  token.LastUsedAt,
+	}
+}
+
+// CreateScimToken returns a new provisioning token for the organization with
+// the given id, it can't be read again
+func (db *DB) CreateScimToken(ctx context.Context, orgID, description string) (string, error) {
+	oid, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return "", gqlerror.Errorf("Invalid organization id.")
+	}
+	if _, err := db.findOrg(ctx, bson.M{"_id": oid}); err != nil {
+		return "", Errorf(CodeNotFound, "Could not find organization with id '%s'.", orgID)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	collection := db.client.Database(db.database).Collection(scimTokensCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	record := scimToken{
+		ID:          primitive.NewObjectID(),
+		OrgID:       oid,
+		Hash:        hashSecret(token),
+		Description: description,
+		CreatedAt:   time.Now(),
+	}
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		return "", Errorf(CodeInternal, "Could not create provisioning token.")
+	}
+
+	return token, nil
+}
+
+// GetScimToken returns the provisioning token with the given id
+func (db *DB) GetScimToken(ctx context.Context, id string) (*model.ScimToken, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid token id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(scimTokensCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var token scimToken
+	if err := collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&token); err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find provisioning token with id '%s'.", id)
+	}
+
+	return toGraphScimToken(&token), nil
+}
+
+// ListScimTokens returns the provisioning tokens of the organization with the given id
+func (db *DB) ListScimTokens(ctx context.Context, orgID string) ([]*model.ScimToken, error) {
+	oid, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid organization id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(scimTokensCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var tokens []scimToken
+	if err := findAll(ctx, collection, bson.M{"orgId": oid}, &tokens); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list provisioning tokens.")
+	}
+
+	list := []*model.ScimToken{}
+	for i := range tokens {
+		list = append(list, toGraphScimToken(&tokens[i]))
+	}
+
+	return list, nil
+}
+
+// RevokeScimToken deletes a provisioning token, it stops working right away
+func (db *DB) RevokeScimToken(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return gqlerror.Errorf("Invalid token id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(scimTokensCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not revoke provisioning token.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find provisioning token with id '%s'.", id)
+	}
+
+	return nil
+}
+
+// ScimOrg returns the id of the organization a provisioning token was created for
+func (db *DB) ScimOrg(ctx context.Context, token string) (string, error) {
+	collection := db.client.Database(db.database).Collection(scimTokensCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var record scimToken
+	update := bson.M{"$set": bson.M{"lastUsedAt": time.Now()}}
+	if err := collection.FindOneAndUpdate(ctx, bson.M{"hash": hashSecret(token)}, update).Decode(&record); err != nil {
+		return "", Errorf(CodeInvalidToken, "Invalid provisioning token.")
+	}
+
+	return record.OrgID.Hex(), nil
+}
+
+// OrgMember is a member of an organization with its account
+type OrgMember struct {
+	User *UserModel
+	Role model.OrgRole
+	// Whether the account lives in the organization's namespace, only those
+	// can be changed through the organization
+	Managed bool
+}
+
+// OrgMembers returns the members of the organization with the given id
+func (db *DB) OrgMembers(ctx context.Context, orgID string) ([]*OrgMember, error) {
+	members, users, err := db.orgMembers(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*OrgMember{}
+	for i := range members {
+		if user, ok := users[members[i].UserID]; ok {
+			list = append(list, &OrgMember{User: user, Role: members[i].role(), Managed: user.OrgID == members[i].OrgID})
+		}
+	}
+
+	return list, nil
+}
+
+// FindOrgMember returns the member of the organization with the given user id
+func (db *DB) FindOrgMember(ctx context.Context, orgID, userID string) (*OrgMember, error) {
+	org, user, err := parseMember(orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := db.findMembership(ctx, org, user)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find member with id '%s'.", userID)
+	}
+	account, err := db.FindByID(ctx, userID)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find member with id '%s'.", userID)
+	}
+
+	return &OrgMember{User: account, Role: member.role(), Managed: account.OrgID == org}, nil
+}
+
+// ProvisionedUser is what identity providers set about a user
+type ProvisionedUser struct {
+	Username   string
+	Fname      string
+	Lname      string
+	Email      string
+	ExternalID string
+	Active     bool
+	// In plain text, empty to leave the password unset or unchanged. Without
+	// one the user can only log in through single sign-on
+	Password string
+}
+
+// checkProvisioned validates a provisioned user and returns its password
+// hashed, empty when it has none
+func checkProvisioned(user *ProvisionedUser) (string, error) {
+	errs := usernamePolicy.Check("userName", NormalizeUsername(user.Username))
+	errs = append(errs, checkEmail("emails", user.Email)...)
+	if user.Password != "" {
+		errs = append(errs, policy.Check("password", user.Password, user.Username, user.Email)...)
+	}
+	if len(errs) > 0 {
+		return "", validationError(errs)
+	}
+
+	if user.Password == "" {
+		return "", nil
+	}
+	return HashPassword(user.Password)
+}
+
+// ProvisionUser creates a user in the namespace of the organization with the
+// given id and makes it a member. Identity providers vouch for the email
+func (db *DB) ProvisionUser(ctx context.Context, orgID string, input *ProvisionedUser) (*OrgMember, error) {
+	org, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid organization id.")
+	}
+	password, err := checkProvisioned(input)
+	if err != nil {
+		return nil, err
+	}
+
+	id := primitive.NewObjectID()
+	user := &UserModel{
+		ID:         id,
+		Fname:      input.Fname,
+		Lname:      input.Lname,
+		Email:      NormalizeEmail(input.Email),
+		Username:   NormalizeUsername(input.Username),
+		Password:   password,
+		Roles:      []model.Role{model.RoleUser},
+		Verified:   true,
+		Disabled:   !input.Active,
+		CreatedAt:  id.Timestamp(),
+		OrgID:      org,
+		ExternalID: input.ExternalID,
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, user); err != nil {
+		if taken := takenError(err, user.Username, user.Email); taken != nil {
+			return nil, taken
+		}
+		logging.Ctx(ctx).Error().Err(err).Msg("could not insert provisioned user")
+		return nil, Errorf(CodeInternal, "Could not create user, try again later.")
+	}
+	db.invalidateUser(ctx, org, user.Username, user.Email)
+
+	if _, err := db.addMember(ctx, org, user.ID, model.OrgRoleMember); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not add member")
+		return nil, Errorf(CodeInternal, "Could not create user, try again later.")
+	}
+
+	return &OrgMember{User: user, Role: model.OrgRoleMember, Managed: true}, nil
+}
+
+// UpdateProvisionedUser replaces the attributes of a user in the namespace of
+// the organization with the given id. Deactivating it revokes its tokens
+func (db *DB) UpdateProvisionedUser(ctx context.Context, orgID, userID string, input *ProvisionedUser) (*OrgMember, error) {
+	member, err := db.FindOrgMember(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !member.Managed {
+		return nil, Errorf(CodeForbidden, "Only users created in the organization can be changed.")
+	}
+	password, err := checkProvisioned(input)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bson.M{
+		"username":   NormalizeUsername(input.Username),
+		"email":      NormalizeEmail(input.Email),
+		"fname":      input.Fname,
+		"lname":      input.Lname,
+		"externalId": input.ExternalID,
+		"disabled":   !input.Active,
+	}
+	if password != "" {
+		fields["password"] = password
+	}
+	update := bson.M{"$set": fields}
+	if !input.Active && !member.User.Disabled {
+		update["$inc"] = bson.M{"tokenVersion": 1}
+	}
+
+	if _, err := db.updateUser(ctx, userID, update); err != nil {
+		return nil, err
+	}
+
+	return db.FindOrgMember(ctx, orgID, userID)
+}
+
+// DeprovisionUser deletes a user created in the organization with the given
+// id, members from the default namespace only leave it
+func (db *DB) DeprovisionUser(ctx context.Context, orgID, userID string) error {
+	org, user, err := parseMember(orgID, userID)
+	if err != nil {
+		return err
+	}
+	member, err := db.FindOrgMember(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if err := db.keepOwner(ctx, org, member.Role, ""); err != nil {
+		return err
+	}
+
+	if member.Managed {
+		return db.DeleteUser(ctx, userID)
+	}
+
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"orgId": org, "userId": user}); err != nil {
+		return Errorf(CodeInternal, "Could not remove member.")
+	}
+
+	return nil
+}
+
+// SetOrgRole changes the role of a member of the organization with the given
+// id, identity providers manage roles through SCIM groups
+func (db *DB) SetOrgRole(ctx context.Context, orgID, userID string, role model.OrgRole) error {
+	org, user, err := parseMember(orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	member, err := db.findMembership(ctx, org, user)
+	if err != nil {
+		return Errorf(CodeNotFound, "Could not find member with id '%s'.", userID)
+	}
+	if member.role() == role {
+		return nil
+	}
+	if err := db.keepOwner(ctx, org, member.role(), role); err != nil {
+		return err
+	}
+
+	collection := db.client.Database(db.database).Collection(membershipsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": member.ID}, bson.M{"$set": bson.M{"role": role}}); err != nil {
+		return Errorf(CodeInternal, "Could not update member.")
+	}
+
+	return nil
+}
+
+// ensureScimIndexes looks provisioning tokens up by hash
+func (db *DB) ensureScimIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(scimTokensCollection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"hash": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"orgId": 1}},
+	})
+	return err
+}
@@ -0,0 +1,75 @@
+package auth
+
+// Scopes limit what the tokens of clients grant. The deployment declares its
+// scopes in SCOPES, each optionally restricted to users with a role, next to
+// the OpenID Connect scopes every user can grant. Apps only get the scopes
+// their user can grant, service clients the ones they were registered with,
+// and the scope claim of tokens lists them for Claims.HasScope.
+
+import (
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
+// openIDScopes are the scopes of OpenID Connect, known to every deployment
+var openIDScopes = []string{"openid", "profile", "email"}
+
+// ScopePolicy maps the scopes of the deployment to the role users need to
+// grant them, empty when any user can
+type ScopePolicy map[string]model.Role
+
+var scopePolicy = NewScopePolicy(&config.Config{})
+
+// SetScopePolicy replaces the scopes of the deployment
+func SetScopePolicy(p ScopePolicy) {
+	scopePolicy = p
+}
+
+// NewScopePolicy returns the OpenID Connect scopes and the ones declared in
+// SCOPES, entries are a scope or scope=ROLE
+func NewScopePolicy(cfg *config.Config) ScopePolicy {
+	p := ScopePolicy{}
+	for _, scope := range openIDScopes {
+		p[scope] = ""
+	}
+	for _, entry := range cfg.Scopes {
+		// Scopes can have = of their own, roles can't
+		if i := strings.LastIndex(entry, "="); i > 0 {
+			p[entry[:i]] = model.Role(strings.ToUpper(entry[i+1:]))
+			continue
+		}
+		p[entry] = ""
+	}
+
+	return p
+}
+
+// unknown returns the first scope that isn't declared, empty when all are
+func (p ScopePolicy) unknown(scopes []string) string {
+	for _, scope := range scopes {
+		if _, ok := p[scope]; !ok {
+			return scope
+		}
+	}
+
+	return ""
+}
+
+// grant returns the scopes a user with roles can grant out of the requested
+// ones, the others are left out of the token as RFC 6749 section 3.3 allows
+func (p ScopePolicy) grant(scopes []string, roles []model.Role) []string {
+	granted := []string{}
+	for _, scope := range scopes {
+		role, ok := p[scope]
+		if !ok {
+			continue
+		}
+		if role == "" || (&Claims{Roles: roles}).HasRole(role) {
+			granted = append(granted, scope)
+		}
+	}
+
+	return granted
+}
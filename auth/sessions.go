@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sessionsCollection holds a document per login, tokens refreshed from it
+// carry its id in the sid claim
+const sessionsCollection = "sessions"
+
+// Session is a login on one device, it lasts as long as it keeps being refreshed
+type Session struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	UserID     primitive.ObjectID `bson:"userId"`
+	IP         string             `bson:"ip"`
+	UserAgent  string             `bson:"userAgent"`
+	CreatedAt  time.Time          `bson:"createdAt"`
+	LastUsedAt time.Time          `bson:"lastUsedAt"`
+	// Expiry of the latest token, Mongo removes the session afterwards
+	ExpiresAt time.Time `bson:"expiresAt"`
+	// OAuth client the session was authorized for, zero for logins
+	ClientID primitive.ObjectID `bson:"clientId,omitempty"`
+}
+
+// ensureSessionIndexes indexes sessions by user, the TTL index expiring them
+// with their last token is created by a migration
+func (db *DB) ensureSessionIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"userId": 1}})
+	return err
+}
+
+// startSession records a new login of user from the client making the request
+func (db *DB) startSession(ctx context.Context, user *UserModel, expiry time.Time) (string, error) {
+	return db.startClientSession(ctx, user, primitive.NilObjectID, expiry)
+}
+
+// startClientSession records a new authorization of user for an OAuth client
+func (db *DB) startClientSession(ctx context.Context, user *UserModel, clientID primitive.ObjectID, expiry time.Time) (string, error) {
+	now := time.Now()
+	session := Session{
+		ID:         primitive.NewObjectID(),
+		UserID:     user.ID,
+		ClientID:   clientID,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expiry,
+	}
+	if info := requestForContext(ctx); info != nil {
+		session.IP = info.IP
+		session.UserAgent = info.UserAgent
+	}
+
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, session); err != nil {
+		return "", err
+	}
+
+	return session.ID.Hex(), nil
+}
+
+// touchSession extends a session to the expiry of its new token
+func (db *DB) touchSession(ctx context.Context, id string, expiry time.Time) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{"lastUsedAt": time.Now(), "expiresAt": expiry}}
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": oid}, update)
+	return err
+}
+
+// checkSession fails for tokens whose session was revoked
+func (db *DB) checkSession(ctx context.Context, claims *Claims) error {
+	// Tokens issued before sessions were tracked
+	if claims.SessionID == "" {
+		return nil
+	}
+
+	oid, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	n, err := collection.CountDocuments(ctx, db.liveSessions(bson.M{"_id": oid}))
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not check session")
+		return Errorf(CodeInternal, "Could not verify token, try again later.")
+	}
+	if n == 0 {
+		return Errorf(CodeSessionRevoked, "Session has been revoked.")
+	}
+
+	if db.sessionIdle > 0 {
+		if err := db.slideSession(ctx, oid); err != nil {
+			logging.Ctx(ctx).Warn().Err(err).Msg("could not extend session")
+		}
+	}
+
+	return nil
+}
+
+// liveSessions restricts filter to sessions that haven't expired, nor lasted
+// longer than the maximum lifetime since the login that started them
+func (db *DB) liveSessions(filter bson.M) bson.M {
+	// The TTL monitor only runs every minute
+	now := time.Now()
+	filter["expiresAt"] = bson.M{"$gt": now}
+	if db.sessionMax > 0 {
+		filter["createdAt"] = bson.M{"$gt": now.Add(-db.sessionMax)}
+	}
+	return filter
+}
+
+// slideSession extends a login session by the idle timeout from now, so it
+// only ends when unused for that long. It writes at most once a minute per
+// session, sessions of OAuth clients follow their refresh tokens instead
+func (db *DB) slideSession(ctx context.Context, oid primitive.ObjectID) error {
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+
+	now := time.Now()
+	filter := bson.M{
+		"_id":        oid,
+		"clientId":   bson.M{"$exists": false},
+		"lastUsedAt": bson.M{"$lt": now.Add(-time.Minute)},
+	}
+	update := bson.M{"$set": bson.M{"lastUsedAt": now, "expiresAt": now.Add(db.sessionIdle)}}
+	_, err := collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// ListSessions returns the active sessions of a user, most recently used first.
+// current is the session of the request, it is flagged in the result
+func (db *DB) ListSessions(ctx context.Context, userID, current string) ([]*model.Session, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid user id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, db.liveSessions(bson.M{"userId": oid}), options.Find().SetSort(bson.M{"lastUsedAt": -1}))
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not list sessions.")
+	}
+
+	var sessions []Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list sessions.")
+	}
+
+	result := make([]*model.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if end := session.CreatedAt.Add(db.sessionMax); db.sessionMax > 0 && end.Before(session.ExpiresAt) {
+			session.ExpiresAt = end
+		}
+		result = append(result, &model.Session{
+			ID:         session.ID.Hex(),
+			IP:         session.IP,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID.Hex() == current,
+		})
+	}
+
+	return result, nil
+}
+
+// RevokeSession ends a session of the user, tokens issued for it stop being accepted
+func (db *DB) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid user id.")
+	}
+	sid, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return Errorf(CodeNotFound, "Could not find session with id '%s'.", sessionID)
+	}
+
+	collection := db.client.Database(db.database).Collection(sessionsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": sid, "userId": uid})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not revoke session.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find session with id '%s'.", sessionID)
+	}
+
+	return nil
+}
+
+// LogoutAllDevices invalidates every token of the user by bumping its token
+// version and ends all of its sessions
+func (db *DB) LogoutAllDevices(ctx context.Context, userID string) error {
+	if err := notImpersonating(ctx); err != nil {
+		return err
+	}
+
+	return db.revokeAllSessions(ctx, userID)
+}
+
+// revokeAllSessions is LogoutAllDevices without its checks, for revocations
+// the service decides on
+func (db *DB) revokeAllSessions(ctx context.Context, userID string) error {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid user id.")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	users := db.client.Database(db.database).Collection(db.collection)
+	if _, err := users.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$inc": bson.M{"tokenVersion": 1}}); err != nil {
+		return Errorf(CodeInternal, "Could not sign out of all devices.")
+	}
+
+	// The version alone rejects the tokens, this only tidies up mySessions
+	sessions := db.client.Database(db.database).Collection(sessionsCollection)
+	if _, err := sessions.DeleteMany(ctx, bson.M{"userId": oid}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove sessions")
+	}
+
+	return nil
+}
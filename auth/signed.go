@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signLink returns a token for the links sent to users, such as the one
+// reporting a login. It holds fields and an expiry and is an HMAC keyed with
+// the signing key, purpose keeps a token of one kind from being used as
+// another and it can't be mistaken for a JWT
+func (db *DB) signLink(purpose string, expiry time.Time, fields ...string) string {
+	key := db.keys.current()
+	payload := strings.Join(append(append([]string{key.ID}, fields...), strconv.FormatInt(expiry.Unix(), 10)), ".")
+	return payload + "." + linkSignature(key.Secret, purpose, payload)
+}
+
+// verifyLink checks a token made by signLink for purpose and returns its fields
+func (db *DB) verifyLink(purpose, token string, fields int) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != fields+3 {
+		return nil, Errorf(CodeInvalidLink, "Invalid link.")
+	}
+
+	key := db.keys.lookup(parts[0])
+	payload := strings.Join(parts[:len(parts)-1], ".")
+	if key == nil || !hmac.Equal([]byte(parts[len(parts)-1]), []byte(linkSignature(key.Secret, purpose, payload))) {
+		return nil, Errorf(CodeInvalidLink, "Invalid link.")
+	}
+
+	expiry, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expiry, 0)) {
+		return nil, Errorf(CodeLinkExpired, "This link has expired.")
+	}
+
+	return parts[1 : len(parts)-2], nil
+}
+
+// linkSignature signs the payload of a link token
+func linkSignature(secret []byte, purpose, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose + "\n" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withToken appends a token query parameter to a URL
+func withToken(rawURL, token string) string {
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + "token=" + token
+}
@@ -0,0 +1,207 @@
+package auth
+
+// Logins through single sign-on. An identity provider vouches for the user,
+// who is looked up by its linked identity, then by email, and created on its
+// first login, verified and without a password, so it can only log in
+// through single sign-on until it sets one with a password reset.
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/metrics"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// assertionsCollection holds the SAML assertions used, until they expire
+const assertionsCollection = "saml_assertions"
+
+// SSOIdentity is a user as an identity provider describes it
+type SSOIdentity struct {
+	// How the user logged in, e.g. "saml"
+	Provider string `json:"provider"`
+	// Identity provider and the id of the user there
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Email   string `json:"email"`
+	// Derived from the email when empty
+	Username string `json:"username"`
+	Fname    string `json:"fname"`
+	Lname    string `json:"lname"`
+	// Everything the provider sent about the user, for provisioning hooks
+	Attributes map[string][]string `json:"attributes"`
+}
+
+// SSOLogin logs in the user an identity provider authenticated, in the
+// organization with the given slug or the default namespace when it is
+// empty. Users logging in for the first time are created by the
+// provisioning policy, created reports it even when they can't log in yet
+func (db *DB) SSOLogin(ctx context.Context, org string, identity *SSOIdentity) (token *model.Token, created bool, err error) {
+	defer func() { metrics.Logins.WithLabelValues(metrics.Result(err)).Inc() }()
+
+	oid, err := db.resolveOrg(ctx, &org)
+	if err != nil {
+		return nil, false, err
+	}
+	user, member, err := db.findIdentity(ctx, oid, identity.Issuer, identity.Subject)
+	if err != nil {
+		return nil, false, err
+	}
+	if user == nil {
+		if user, member, created, err = db.matchSSOUser(ctx, org, oid, identity); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if user.Disabled {
+		return nil, false, Errorf(CodeAccountLocked, "Account is disabled.")
+	}
+	if user.PendingApproval {
+		return nil, created, Errorf(CodeAccountPendingApproval, "Account is awaiting approval by an administrator.")
+	}
+	if user.DeleteAfter != nil {
+		return nil, false, Errorf(CodeAccountPendingDeletion, "Account is scheduled for deletion, use cancelDeletion to restore it.")
+	}
+
+	// The identity provider owns the names of its users
+	if !created && (identity.Fname != "" && identity.Fname != user.Fname || identity.Lname != "" && identity.Lname != user.Lname) {
+		update := bson.M{"$set": bson.M{"fname": identity.Fname, "lname": identity.Lname}}
+		if _, err := db.updateUser(ctx, user.ID.Hex(), update); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not update names from the identity provider")
+		}
+	}
+
+	db.notifyLogin(ctx, user, db.checkDevice(ctx, user))
+
+	token, err = db.issueToken(ctx, user, member, "", time.Time{}, nil)
+	return token, created, err
+}
+
+// matchSSOUser returns the user with the email of an identity that isn't
+// linked yet and links it, or creates the user when there is none
+func (db *DB) matchSSOUser(ctx context.Context, org string, oid primitive.ObjectID, identity *SSOIdentity) (*UserModel, *Membership, bool, error) {
+	email := NormalizeEmail(identity.Email)
+	if errs := checkEmail("email", email); len(errs) > 0 {
+		return nil, nil, false, validationError(errs)
+	}
+
+	user, member, err := db.findLogin(ctx, &org, email)
+	if err != nil {
+		user, member, err := db.createSSOUser(ctx, oid, email, identity)
+		return user, member, err == nil, err
+	}
+
+	// The email matches an account, which the provider only vouches for when
+	// nothing else logs into it
+	if linkedToIssuer(user, identity.Issuer) {
+		return nil, nil, false, gqlerror.Errorf("This email belongs to an account linked to another identity of this provider.")
+	}
+	if user.Password != "" {
+		return nil, nil, false, gqlerror.Errorf("An account with this email exists, log in to it and use linkIdentity to log in with this provider.")
+	}
+	if err := db.addIdentity(ctx, user, identity); err != nil {
+		return nil, nil, false, err
+	}
+
+	return user, member, false, nil
+}
+
+// createSSOUser creates the user an identity provider logged in for the
+// first time, in org, and makes it a member, as the provisioning policy says
+func (db *DB) createSSOUser(ctx context.Context, org primitive.ObjectID, email string, identity *SSOIdentity) (*UserModel, *Membership, error) {
+	provisioned, err := provisioningPolicy.provision(ctx, email, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	username := NormalizeUsername(provisioned.Username)
+	if username == "" {
+		username = NormalizeUsername(strings.SplitN(email, "@", 2)[0])
+	}
+	// Usernames derived from emails collide, a random suffix tells them apart
+	if taken, _ := db.FindByUsername(ctx, org, username); taken != nil {
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return nil, nil, err
+		}
+		username = fmt.Sprintf("%s%04d", username, n)
+	}
+	if errs := usernamePolicy.Check("username", username); len(errs) > 0 {
+		return nil, nil, validationError(errs)
+	}
+
+	id := primitive.NewObjectID()
+	user := &UserModel{
+		ID:              id,
+		Fname:           provisioned.Fname,
+		Lname:           provisioned.Lname,
+		Email:           email,
+		Username:        username,
+		Roles:           provisioned.Roles,
+		Verified:        true,
+		PendingApproval: provisioned.PendingApproval,
+		CreatedAt:       id.Timestamp(),
+		OrgID:           org,
+		Identities: []LinkedIdentity{{
+			ID:       identityID(identity.Issuer, identity.Subject),
+			Provider: identity.Provider,
+			Issuer:   identity.Issuer,
+			Subject:  identity.Subject,
+			LinkedAt: id.Timestamp(),
+		}},
+	}
+
+	collection := db.client.Database(db.database).Collection(db.collection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, user); err != nil {
+		if taken := takenError(err, user.Username, user.Email); taken != nil {
+			return nil, nil, taken
+		}
+		if isDuplicateKey(err) {
+			return nil, nil, gqlerror.Errorf("This identity is linked to another account.")
+		}
+		logging.Ctx(ctx).Error().Err(err).Msg("could not insert user")
+		return nil, nil, Errorf(CodeInternal, "Could not create user, try again later.")
+	}
+	metrics.Registrations.Inc()
+	db.invalidateUser(ctx, org, user.Username, user.Email)
+
+	if org.IsZero() {
+		return user, nil, nil
+	}
+	member, err := db.addMember(ctx, org, user.ID, provisioned.OrgRole)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not add member")
+		return nil, nil, Errorf(CodeInternal, "Could not create user, try again later.")
+	}
+
+	return user, member, nil
+}
+
+// UseAssertion records that the assertion with the given id of issuer was
+// used, it fails when it was before. Records expire with the assertion
+func (db *DB) UseAssertion(ctx context.Context, issuer, id string, expiresAt time.Time) error {
+	collection := db.client.Database(db.database).Collection(assertionsCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	record := bson.M{"_id": issuer + "|" + id, "expiresAt": expiresAt}
+	if _, err := collection.InsertOne(ctx, record); err != nil {
+		if isDuplicateKey(err) {
+			return gqlerror.Errorf("This assertion was already used.")
+		}
+		return Errorf(CodeInternal, "Could not log in, try again later.")
+	}
+
+	return nil
+}
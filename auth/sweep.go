@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// Sweeper is a store without TTL support, such as the in process ones, that
+// drops its expired entries when asked. Sweep returns how many it dropped
+type Sweeper interface {
+	Sweep(now time.Time) int
+}
+
+// Sweepers returns the stores of db that need sweeping
+func (db *DB) Sweepers() []Sweeper {
+	var stores []Sweeper
+	if s, ok := db.denylist.(Sweeper); ok {
+		stores = append(stores, s)
+	}
+	return stores
+}
+
+// SweepTask returns a periodic task sweeping every store
+func SweepTask(stores ...Sweeper) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		now := time.Now()
+		n := 0
+		for _, s := range stores {
+			n += s.Sweep(now)
+		}
+		if n > 0 {
+			logging.Logger.Debug().Int("count", n).Msg("swept expired records")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,284 @@
+package auth
+
+// Signing keys of organizations, so a leaked key only compromises one
+// tenant. Organizations that rotate a key of their own get ES256 tokens
+// signed with it instead of the shared HMAC key, their public keys are
+// published as a JWKS for the services accepting their tokens.
+//
+// The private keys are sealed with the PII data key, organization keys
+// require PII_KEY. A key only verifies tokens of its organization, and the
+// shared key stops verifying tokens of an organization once the tokens
+// issued before its first key have expired.
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// orgKeysCollection stores the keys of organizations
+const orgKeysCollection = "org_signing_keys"
+
+// orgKey representation of the key of an organization in the database
+type orgKey struct {
+	ID    string             `bson:"_id"`
+	OrgID primitive.ObjectID `bson:"orgId"`
+	// PKCS #8 private key, sealed
+	Private string `bson:"private"`
+	// PKIX public key
+	Public    []byte     `bson:"public"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	RetiredAt *time.Time `bson:"retiredAt,omitempty"`
+
+	signer   *ecdsa.PrivateKey
+	verifier *ecdsa.PublicKey
+}
+
+// usable reports whether tokens signed with the key can still be valid
+func (k *orgKey) usable(now time.Time, ttl time.Duration) bool {
+	return k.RetiredAt == nil || now.Sub(*k.RetiredAt) < ttl
+}
+
+// usableKeys matches the keys that can still verify tokens
+func usableKeys(filter bson.M, ttl time.Duration) bson.M {
+	filter["$or"] = bson.A{
+		bson.M{"retiredAt": bson.M{"$exists": false}},
+		bson.M{"retiredAt": bson.M{"$gt": time.Now().Add(-ttl)}},
+	}
+	return filter
+}
+
+// forOrg returns the key new tokens of the organization are signed with, nil
+// when it uses the shared key
+func (k *keySet) forOrg(org string) *orgKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if keys := k.orgs[org]; len(keys) > 0 && keys[0].RetiredAt == nil {
+		return keys[0]
+	}
+
+	return nil
+}
+
+// lookupOrg returns the key of the organization with the given id
+func (k *keySet) lookupOrg(org, kid string) *orgKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range k.orgs[org] {
+		if key.ID == kid && key.usable(now, k.ttl) {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// sharedKeyAccepted reports whether tokens of the organization signed with the
+// shared key can still be valid, they were issued before its first key
+func (k *keySet) sharedKeyAccepted(org string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := k.orgs[org]
+	if len(keys) == 0 {
+		return true
+	}
+
+	return time.Since(keys[len(keys)-1].CreatedAt) < k.ttl
+}
+
+// openOrgKey decrypts the private key of key
+func openOrgKey(key *orgKey) error {
+	public, err := x509.ParsePKIXPublicKey(key.Public)
+	if err != nil {
+		return err
+	}
+	verifier, ok := public.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("key %s is not an ECDSA key", key.ID)
+	}
+	key.verifier = verifier
+
+	if pii == nil {
+		return errors.New("organizations have signing keys but PII_KEY is not set")
+	}
+	encoded, err := pii.open(key.OrgID, "signingKey/"+key.ID, key.Private)
+	if err != nil {
+		return err
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	private, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return err
+	}
+	if key.signer, ok = private.(*ecdsa.PrivateKey); !ok {
+		return fmt.Errorf("key %s is not an ECDSA key", key.ID)
+	}
+
+	return nil
+}
+
+// loadOrgKeys returns the keys of organizations that can still verify tokens,
+// by organization and newest first
+func (db *DB) loadOrgKeys(ctx context.Context) (map[string][]*orgKey, error) {
+	collection := db.client.Database(db.database).Collection(orgKeysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, usableKeys(bson.M{}, db.keys.ttl), options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*orgKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+
+	orgs := map[string][]*orgKey{}
+	// Oldest first, prepending leaves the newest first
+	for _, key := range keys {
+		if err := openOrgKey(key); err != nil {
+			return nil, err
+		}
+		org := key.OrgID.Hex()
+		orgs[org] = append([]*orgKey{key}, orgs[org]...)
+	}
+
+	return orgs, nil
+}
+
+// RotateOrgSigningKey signs the tokens of the organization with a new key of
+// its own and retires its previous one, tokens it signed stay valid until
+// they expire. Returns the id of the new key
+func (db *DB) RotateOrgSigningKey(ctx context.Context, orgID string) (string, error) {
+	oid, err := primitive.ObjectIDFromHex(orgID)
+	if err != nil {
+		return "", gqlerror.Errorf("Invalid organization id.")
+	}
+	if pii == nil {
+		return "", gqlerror.Errorf("Organization signing keys require PII_KEY.")
+	}
+	if _, err := db.findOrg(ctx, bson.M{"_id": oid}); err != nil {
+		return "", Errorf(CodeNotFound, "Could not find organization with id '%s'.", orgID)
+	}
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	now := time.Now()
+	key := orgKey{ID: hex.EncodeToString(id), OrgID: oid, Public: public, CreatedAt: now}
+	if key.Private, err = pii.seal(oid, "signingKey/"+key.ID, base64.StdEncoding.EncodeToString(der)); err != nil {
+		return "", err
+	}
+
+	collection := db.client.Database(db.database).Collection(orgKeysCollection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, key); err != nil {
+		return "", Errorf(CodeInternal, "Could not store signing key.")
+	}
+
+	filter := bson.M{"orgId": oid, "_id": bson.M{"$ne": key.ID}, "retiredAt": bson.M{"$exists": false}}
+	if _, err := collection.UpdateMany(insertCtx, filter, bson.M{"$set": bson.M{"retiredAt": now}}); err != nil {
+		return "", Errorf(CodeInternal, "Could not retire the previous signing key.")
+	}
+
+	return key.ID, db.LoadKeys(ctx)
+}
+
+// JSONWebKey is the public half of an organization key, RFC 7517
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// JSONWebKeySet is the JWKS document of an organization
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// OrgJWKS returns the public keys that verify the tokens of the organization
+// with the given slug, read from the database so rotations on other
+// instances show right away
+func (db *DB) OrgJWKS(ctx context.Context, slug string) (*JSONWebKeySet, error) {
+	org, err := db.findOrg(ctx, bson.M{"slug": slug})
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find organization '%s'.", slug)
+	}
+
+	collection := db.client.Database(db.database).Collection(orgKeysCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var keys []orgKey
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetProjection(bson.M{"private": 0})
+	cursor, err := collection.Find(ctx, usableKeys(bson.M{"orgId": org.ID}, db.keys.ttl), opts)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not load signing keys.")
+	}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, Errorf(CodeInternal, "Could not load signing keys.")
+	}
+
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range keys {
+		public, err := x509.ParsePKIXPublicKey(key.Public)
+		if err != nil {
+			continue
+		}
+		ec, ok := public.(*ecdsa.PublicKey)
+		if !ok {
+			continue
+		}
+
+		set.Keys = append(set.Keys, JSONWebKey{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(ec.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(ec.Y.FillBytes(make([]byte, 32))),
+			Kid: key.ID,
+			Use: "sig",
+			Alg: "ES256",
+		})
+	}
+
+	return set, nil
+}
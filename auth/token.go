@@ -0,0 +1,519 @@
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/metrics"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// TokenIssuer mints and validates the tokens handed to users. Every token
+// carries the standard iss, aud, iat and exp claims next to the user id and
+// username, and is signed with the current key of the keyset, or the
+// Ed25519 key of eddsa.go. Tokens are JWTs unless the format is a PASETO
+// one, see paseto.go.
+type TokenIssuer struct {
+	keys     *keySet
+	ttl      time.Duration
+	issuer   string
+	audience string
+	format   TokenFormat
+	// Clock skew between servers exp, iat and nbf are checked with
+	leeway time.Duration
+	// Key and lifetime of refresh tokens, see refresh.go
+	refreshKey []byte
+	refreshTTL time.Duration
+}
+
+// Claims are the verified contents of a token
+type Claims struct {
+	// Unique id of the token (jti), used to revoke it
+	ID string
+	// Session the token belongs to (sid), empty for tokens issued before sessions were tracked
+	SessionID string
+	// Token version (ver) of the account when the token was issued
+	Version int
+	// When the user last entered their password (auth_time) and how (amr),
+	// refreshed tokens keep the values of the original login
+	AuthTime time.Time
+	AMR      []string
+	// Organization the user logged into (org) and its role there (org_role),
+	// empty outside organizations
+	Org     string
+	OrgRole model.OrgRole
+	// OAuth client the token was issued to (client_id), empty for logins.
+	// Tokens of service clients have no user
+	ClientID string
+	// Scopes granted to the client (scope)
+	Scopes []string
+	// Thumbprint of the DPoP key the token is bound to (cnf.jkt), empty for
+	// bearer tokens
+	JKT string
+	// Administrator acting as the user (act.sub), empty unless impersonating
+	Actor string
+	// Permissions of the user (perms), see permissions.go, and the hash of
+	// them (perms_hash)
+	Permissions     []string
+	PermissionsHash string
+	UserID          string
+	Username        string
+	Roles           []model.Role
+	Issuer          string
+	Audience        string
+	IssuedAt        time.Time
+	Expiry          time.Time
+}
+
+// HasRole reports whether the token grants role
+func (c *Claims) HasRole(role model.Role) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope reports whether the token grants scope. Tokens of logins aren't
+// limited to scopes, they grant every one
+func (c *Claims) HasScope(scope string) bool {
+	if c.ClientID == "" {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DefaultLeeway is the clock skew between servers tokens are verified with
+// unless SetLeeway changes it
+const DefaultLeeway = 30 * time.Second
+
+// NewTokenIssuer returns an issuer of tokens valid for ttl, audience is optional
+func NewTokenIssuer(keys *keySet, ttl time.Duration, issuer, audience string) *TokenIssuer {
+	return &TokenIssuer{keys: keys, ttl: ttl, issuer: issuer, audience: audience, format: FormatJWT, leeway: DefaultLeeway}
+}
+
+// SetLeeway changes how far the clock of the server that issued a token can
+// be from this one, tokens are accepted that long past exp and before iat
+// and nbf
+func (t *TokenIssuer) SetLeeway(leeway time.Duration) {
+	t.leeway = leeway
+}
+
+// SetFormat changes the format new tokens are minted in, tokens of every
+// format keep being verified
+func (t *TokenIssuer) SetFormat(format TokenFormat) {
+	t.format = format
+}
+
+// NewVerifier returns a TokenIssuer for services that only verify tokens,
+// secret, issuer and audience must match the settings of this service
+func NewVerifier(secret, issuer, audience string) *TokenIssuer {
+	return NewTokenIssuer(newKeySet(secret, 24*time.Hour), 24*time.Hour, issuer, audience)
+}
+
+// Authentication methods of tokens (amr, RFC 8176) by how the user logged
+// in: with a password, with a password and a code of the authenticator app,
+// or with a password on a device trusted at a login with a code
+var (
+	amrPassword      = []string{"pwd"}
+	amrOTP           = []string{"pwd", "otp", "mfa"}
+	amrTrustedDevice = []string{"pwd", "mfa"}
+)
+
+// isAMR reports whether amr lists the same methods as want
+func isAMR(amr, want []string) bool {
+	if len(amr) != len(want) {
+		return false
+	}
+	for i := range amr {
+		if amr[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Issue returns a signed token for the user, member is the membership of the
+// organization the user logged into and sessionID is optional, both may be
+// empty. authTime is when the user authenticated, the zero time means now
+func (t *TokenIssuer) Issue(user *UserModel, member *Membership, sessionID string, authTime time.Time) (string, error) {
+	claims, err := t.userClaims(user, member, sessionID, authTime, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return t.sign(claims, member)
+}
+
+// IssueBound returns a token like Issue bound to the DPoP key whose
+// thumbprint is jkt, a plain one when it is empty. amr lists the methods
+// the user authenticated with, nil for a password alone
+func (t *TokenIssuer) IssueBound(user *UserModel, member *Membership, sessionID string, authTime time.Time, amr []string, jkt string) (string, error) {
+	claims, err := t.userClaims(user, member, sessionID, authTime, amr)
+	if err != nil {
+		return "", err
+	}
+	if jkt != "" {
+		claims["cnf"] = map[string]string{"jkt": jkt}
+	}
+
+	return t.sign(claims, member)
+}
+
+// IssueImpersonation returns a token of user lasting ttl for the
+// administrator actorID, who is named in its act claim (RFC 8693)
+func (t *TokenIssuer) IssueImpersonation(user *UserModel, actorID string, ttl time.Duration) (string, error) {
+	claims, err := t.userClaims(user, nil, "", time.Time{}, nil)
+	if err != nil {
+		return "", err
+	}
+	claims["act"] = map[string]string{"sub": actorID}
+	claims["exp"] = time.Now().Add(ttl).Unix()
+
+	return t.sign(claims, nil)
+}
+
+// IssueForClient returns a token like Issue that an OAuth client was given
+// on behalf of the user, it carries the client_id and scope claims and lasts ttl.
+// Clients are only granted scopes, never the roles nor permissions of the user
+func (t *TokenIssuer) IssueForClient(user *UserModel, member *Membership, sessionID string, authTime time.Time, amr []string, clientID string, scopes []string, ttl time.Duration) (string, error) {
+	claims, err := t.userClaims(user, member, sessionID, authTime, amr)
+	if err != nil {
+		return "", err
+	}
+	delete(claims, "roles")
+	delete(claims, "perms")
+	delete(claims, "perms_hash")
+	claims["client_id"] = clientID
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	if len(scopes) > 0 {
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+
+	return t.sign(claims, member)
+}
+
+// IssueForService returns a token of a service client lasting ttl, it has
+// no user and grants scopes
+func (t *TokenIssuer) IssueForService(clientID string, scopes []string, ttl time.Duration) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti":       jti,
+		"client_id": clientID,
+		"scope":     strings.Join(scopes, " "),
+		"iss":       t.issuer,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ttl).Unix(),
+	}
+	if t.audience != "" {
+		claims["aud"] = t.audience
+	}
+
+	return t.sign(claims, nil)
+}
+
+// lifetime returns ttl, or the lifetime of tokens when it is zero
+func (t *TokenIssuer) lifetime(ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+
+	return t.ttl
+}
+
+// userClaims returns the claims of a token of user, see Issue
+func (t *TokenIssuer) userClaims(user *UserModel, member *Membership, sessionID string, authTime time.Time, amr []string) (jwt.MapClaims, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if authTime.IsZero() {
+		authTime = now
+	}
+	if len(amr) == 0 {
+		amr = amrPassword
+	}
+	claims := jwt.MapClaims{
+		"jti":       jti,
+		"_id":       user.ID.Hex(),
+		"username":  user.Username,
+		"roles":     user.Roles,
+		"ver":       user.TokenVersion,
+		"amr":       amr,
+		"auth_time": authTime.Unix(),
+		"iss":       t.issuer,
+		"iat":       now.Unix(),
+		"exp":       now.Add(t.ttl).Unix(),
+	}
+	if t.audience != "" {
+		claims["aud"] = t.audience
+	}
+	if sessionID != "" {
+		claims["sid"] = sessionID
+	}
+	if member != nil {
+		claims["org"] = member.OrgID.Hex()
+		claims["org_role"] = member.role()
+	}
+	permissionPolicy.embed(claims, user.Roles)
+
+	return claims, nil
+}
+
+// sign signs claims with the key of the organization of member, or the
+// shared key in the format of the issuer
+func (t *TokenIssuer) sign(claims jwt.MapClaims, member *Membership) (string, error) {
+	// The kid tells verifiers which key signed the token
+	var tokenString string
+	var err error
+	if orgKey := t.orgKey(member); orgKey != nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = orgKey.ID
+		tokenString, err = token.SignedString(orgKey.signer)
+	} else if key := t.keys.current(); t.format == FormatPasetoLocal || t.format == FormatPasetoPublic {
+		tokenString, err = encodePaseto(t.format, claims, key)
+	} else if edKey := t.keys.edSigner(); edKey != nil {
+		token := jwt.NewWithClaims(signingMethodEd25519, claims)
+		token.Header["kid"] = edKey.ID
+		tokenString, err = token.SignedString(edKey.private)
+	} else {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = key.ID
+		tokenString, err = token.SignedString(key.Secret)
+	}
+	if err != nil {
+		return "", err
+	}
+	// PASETO tokens have formats of their own, v2.local ones are encrypted already
+	if key := t.keys.encryptionKey(); key != nil && !isPaseto(tokenString) {
+		if tokenString, err = encryptJWE(tokenString, key); err != nil {
+			return "", err
+		}
+	}
+
+	metrics.TokensIssued.Inc()
+
+	return tokenString, nil
+}
+
+// orgKey returns the key of the organization of member, nil outside
+// organizations or when it uses the shared key
+func (t *TokenIssuer) orgKey(member *Membership) *orgKey {
+	if member == nil {
+		return nil
+	}
+
+	return t.keys.forOrg(member.OrgID.Hex())
+}
+
+// VerifyToken checks the signature, expiry, issuer and audience of a token,
+// a JWT, possibly encrypted, or a PASETO token, and returns its claims.
+// Revocation can only be checked against the database, see DB.VerifyToken.
+func (t *TokenIssuer) VerifyToken(tokenString string) (*Claims, error) {
+	if isJWE(tokenString) {
+		signed, err := decryptJWE(tokenString, t.keys.encryptionKey())
+		if err != nil {
+			return nil, Errorf(CodeInvalidToken, "Invalid token")
+		}
+		tokenString = signed
+	}
+
+	var claims jwt.MapClaims
+	if isPaseto(tokenString) {
+		claims = t.verifyPaseto(tokenString)
+	} else {
+		claims = t.verifyJWT(tokenString)
+	}
+	// Refresh tokens aren't signed with these keys, they are refused anyway
+	if typ, _ := claims["typ"].(string); claims == nil || typ == refreshTokenType {
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	if now := time.Now(); !t.validTimes(claims, now) {
+		if t.expired(claims, now) {
+			return nil, Errorf(CodeTokenExpired, "Token has expired.")
+		}
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+	// Tokens minted for another service or by another issuer are rejected
+	if !claims.VerifyIssuer(t.issuer, true) {
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+	if t.audience != "" && !claims.VerifyAudience(t.audience, true) {
+		return nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
+
+	return toClaims(claims), nil
+}
+
+// verifyPaseto returns the claims of a valid PASETO token, nil otherwise
+func (t *TokenIssuer) verifyPaseto(tokenString string) jwt.MapClaims {
+	claims, err := decodePaseto(tokenString, t.keys.lookup)
+	if err != nil {
+		return nil
+	}
+	// Keys of organizations only verify their tokens, like HS256 below
+	if org, _ := claims["org"].(string); org != "" && !t.keys.sharedKeyAccepted(org) {
+		return nil
+	}
+
+	return claims
+}
+
+// verifyJWT returns the claims of a valid JWT, nil otherwise
+func (t *TokenIssuer) verifyJWT(tokenString string) jwt.MapClaims {
+	// exp, iat and nbf are checked with leeway by VerifyToken
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	// We don't include the error because we deal with this kind of error with gqlerror
+	tkn, _ := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		var org string
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			org, _ = claims["org"].(string)
+		}
+
+		// Validate alg, keys of organizations only verify their tokens
+		switch token.Method {
+		case jwt.SigningMethodES256:
+			key := t.keys.lookupOrg(org, kid)
+			if key == nil {
+				return nil, Errorf(CodeInvalidToken, "Unknown signing key.")
+			}
+			return key.verifier, nil
+		case jwt.SigningMethodHS256:
+			// Verifiers of EdDSA tokens have no secret, anyone could sign with it
+			key := t.keys.lookup(kid)
+			if key == nil || len(key.Secret) == 0 || (org != "" && !t.keys.sharedKeyAccepted(org)) {
+				return nil, Errorf(CodeInvalidToken, "Unknown signing key.")
+			}
+			return key.Secret, nil
+		case signingMethodEd25519:
+			key := t.keys.lookupEd(kid)
+			if key == nil || (org != "" && !t.keys.sharedKeyAccepted(org)) {
+				return nil, Errorf(CodeInvalidToken, "Unknown signing key.")
+			}
+			return key.public, nil
+		default:
+			return nil, Errorf(CodeInvalidToken, "Unexpected signing method: %v", token.Header["alg"])
+		}
+	})
+
+	// Check validity of token
+	if tkn == nil || !tkn.Valid {
+		return nil
+	}
+	claims, _ := tkn.Claims.(jwt.MapClaims)
+
+	return claims
+}
+
+// validTimes reports whether a token with claims can be used at now: it
+// has an exp that hasn't passed and wasn't issued nor made valid later,
+// allowing for the leeway
+func (t *TokenIssuer) validTimes(claims jwt.MapClaims, now time.Time) bool {
+	exp, ok := claims["exp"].(float64)
+	if !ok || !now.Add(-t.leeway).Before(time.Unix(int64(exp), 0)) {
+		return false
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(t.leeway).Before(time.Unix(int64(iat), 0)) {
+		return false
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(t.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return false
+	}
+	// Malformed dates would otherwise be ignored
+	for _, name := range []string{"iat", "nbf"} {
+		if value, present := claims[name]; present {
+			if _, ok := value.(float64); !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// expired reports whether a token with claims is past its exp and the leeway
+func (t *TokenIssuer) expired(claims jwt.MapClaims, now time.Time) bool {
+	exp, ok := claims["exp"].(float64)
+	return ok && !now.Add(-t.leeway).Before(time.Unix(int64(exp), 0))
+}
+
+// toClaims converts the raw claims of a verified token
+func toClaims(raw jwt.MapClaims) *Claims {
+	claims := &Claims{}
+	claims.ID, _ = raw["jti"].(string)
+	claims.SessionID, _ = raw["sid"].(string)
+	claims.Org, _ = raw["org"].(string)
+	claims.ClientID, _ = raw["client_id"].(string)
+	claims.PermissionsHash, _ = raw["perms_hash"].(string)
+	if scope, ok := raw["scope"].(string); ok {
+		claims.Scopes = strings.Fields(scope)
+	}
+	if cnf, ok := raw["cnf"].(map[string]interface{}); ok {
+		claims.JKT, _ = cnf["jkt"].(string)
+	}
+	if act, ok := raw["act"].(map[string]interface{}); ok {
+		claims.Actor, _ = act["sub"].(string)
+	}
+	if role, ok := raw["org_role"].(string); ok {
+		claims.OrgRole = model.OrgRole(role)
+	}
+	claims.UserID, _ = raw["_id"].(string)
+	claims.Username, _ = raw["username"].(string)
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.Audience, _ = raw["aud"].(string)
+
+	// Numbers are decoded as float64
+	if iat, ok := raw["iat"].(float64); ok {
+		claims.IssuedAt = time.Unix(int64(iat), 0)
+	}
+	if ver, ok := raw["ver"].(float64); ok {
+		claims.Version = int(ver)
+	}
+	if exp, ok := raw["exp"].(float64); ok {
+		claims.Expiry = time.Unix(int64(exp), 0)
+	}
+	// Tokens issued before auth_time was added were issued on login or refresh
+	claims.AuthTime = claims.IssuedAt
+	if authTime, ok := raw["auth_time"].(float64); ok {
+		claims.AuthTime = time.Unix(int64(authTime), 0)
+	}
+
+	amr, _ := raw["amr"].([]interface{})
+	for _, m := range amr {
+		if method, ok := m.(string); ok {
+			claims.AMR = append(claims.AMR, method)
+		}
+	}
+
+	perms, _ := raw["perms"].([]interface{})
+	for _, p := range perms {
+		if permission, ok := p.(string); ok {
+			claims.Permissions = append(claims.Permissions, permission)
+		}
+	}
+
+	roles, _ := raw["roles"].([]interface{})
+	for _, r := range roles {
+		if role, ok := r.(string); ok && model.Role(role).IsValid() {
+			claims.Roles = append(claims.Roles, model.Role(role))
+		}
+	}
+
+	return claims
+}
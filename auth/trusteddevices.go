@@ -0,0 +1,180 @@
+package auth
+
+// Devices users trust to skip the second factor. A login entering a code
+// with rememberDevice gets a device token, signed like email links and
+// delivered in the device cookie with COOKIE_AUTH, and later logins sending
+// it back only need the password until TRUSTED_DEVICE_TTL runs out. The
+// token names a record of the trusted_devices collection, so users can
+// revoke a device or all of them.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// trustedDevicesCollection holds a document per trusted device
+const trustedDevicesCollection = "trusted_devices"
+
+// TrustedDevice is a device whose logins skip the second factor
+type TrustedDevice struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	IP        string             `bson:"ip"`
+	UserAgent string             `bson:"userAgent"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	// Mongo removes the device afterwards
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// ensureTrustedDeviceIndexes indexes trusted devices by user, the TTL index
+// expiring them is created by a migration
+func (db *DB) ensureTrustedDeviceIndexes(ctx context.Context) error {
+	collection := db.client.Database(db.database).Collection(trustedDevicesCollection)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"userId": 1}})
+	return err
+}
+
+// rememberDevice trusts the device of the request for the user and returns
+// its token, nil when it couldn't, the login goes on without it
+func (db *DB) rememberDevice(ctx context.Context, user *UserModel) *string {
+	now := time.Now()
+	device := TrustedDevice{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(db.trustedTTL),
+	}
+	if info := requestForContext(ctx); info != nil {
+		device.IP = info.IP
+		device.UserAgent = info.UserAgent
+	}
+
+	collection := db.client.Database(db.database).Collection(trustedDevicesCollection)
+	insertCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(insertCtx, device); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not trust device")
+		return nil
+	}
+
+	token := db.signLink("trusted-device", device.ExpiresAt, user.ID.Hex(), device.ID.Hex())
+	return &token
+}
+
+// deviceTrusted reports whether token is the device token of a device the
+// user still trusts
+func (db *DB) deviceTrusted(ctx context.Context, user *UserModel, token string) bool {
+	fields, err := db.verifyLink("trusted-device", token, 2)
+	if err != nil || fields[0] != user.ID.Hex() {
+		return false
+	}
+	oid, err := primitive.ObjectIDFromHex(fields[1])
+	if err != nil {
+		return false
+	}
+
+	collection := db.client.Database(db.database).Collection(trustedDevicesCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// The TTL monitor only runs every minute
+	filter := bson.M{"_id": oid, "userId": user.ID, "expiresAt": bson.M{"$gt": time.Now()}}
+	n, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not look up trusted device")
+		return false
+	}
+
+	return n > 0
+}
+
+// ListTrustedDevices returns the devices the user trusts, most recent first
+func (db *DB) ListTrustedDevices(ctx context.Context, userID string) ([]*model.TrustedDevice, error) {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, gqlerror.Errorf("Invalid user id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(trustedDevicesCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"userId": oid, "expiresAt": bson.M{"$gt": time.Now()}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not list trusted devices.")
+	}
+
+	var devices []TrustedDevice
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, Errorf(CodeInternal, "Could not list trusted devices.")
+	}
+
+	result := make([]*model.TrustedDevice, 0, len(devices))
+	for _, device := range devices {
+		result = append(result, &model.TrustedDevice{
+			ID:        device.ID.Hex(),
+			IP:        device.IP,
+			UserAgent: device.UserAgent,
+			CreatedAt: device.CreatedAt,
+			ExpiresAt: device.ExpiresAt,
+		})
+	}
+
+	return result, nil
+}
+
+// RevokeTrustedDevice stops trusting a device of the user, its logins need
+// the second factor again
+func (db *DB) RevokeTrustedDevice(ctx context.Context, userID, deviceID string) error {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid user id.")
+	}
+	did, err := primitive.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return Errorf(CodeNotFound, "Could not find trusted device with id '%s'.", deviceID)
+	}
+
+	collection := db.client.Database(db.database).Collection(trustedDevicesCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": did, "userId": uid})
+	if err != nil {
+		return Errorf(CodeInternal, "Could not revoke trusted device.")
+	}
+	if res.DeletedCount == 0 {
+		return Errorf(CodeNotFound, "Could not find trusted device with id '%s'.", deviceID)
+	}
+
+	return nil
+}
+
+// RevokeTrustedDevices stops trusting every device of the user
+func (db *DB) RevokeTrustedDevices(ctx context.Context, userID string) error {
+	oid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return gqlerror.Errorf("Invalid user id.")
+	}
+
+	collection := db.client.Database(db.database).Collection(trustedDevicesCollection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.DeleteMany(ctx, bson.M{"userId": oid}); err != nil {
+		return Errorf(CodeInternal, "Could not revoke trusted devices.")
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package auth
+
+// Two-factor authentication with the time-based one-time passwords of
+// authenticator apps (TOTP, RFC 6238). Users set a secret up with
+// setupTwoFactor and turn it on by entering a code with enableTwoFactor,
+// their logins then need the current code next to the password, unless they
+// come from a device they chose to trust, see trusteddevices.go.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// totpPeriod is how long a code lasts, and totpDigits its length, the
+// defaults of authenticator apps
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+// totpSkew is how many periods a code is accepted before and after its own,
+// for clocks that drifted and codes typed as they changed
+const totpSkew = 1
+
+// totpEncoding encodes secrets as authenticator apps expect them
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret, the size RFC 4226 recommends
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// hotp returns the code of secret for counter (RFC 4226), digits long
+func hotp(secret []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%uint32(math.Pow10(digits)))
+}
+
+// matchTOTP checks code against the codes of secret around now and returns
+// the time step of the one it matched
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step, totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI of secret, which authenticator apps scan
+// from a QR code. Codes are labeled with the issuer and the email of the user
+func totpURI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + params.Encode()
+}
+
+// SetupTwoFactor stores a new secret for the user with the given id, it
+// only applies once EnableTwoFactor confirms a code of it
+func (db *DB) SetupTwoFactor(ctx context.Context, id string) (*model.TwoFactorSetup, error) {
+	user, err := db.FindByID(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+	if user.TOTPSecret != "" {
+		return nil, gqlerror.Errorf("Two-factor authentication is already enabled, disable it first.")
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not set up two-factor authentication.")
+	}
+	if _, err := db.updateUser(ctx, id, bson.M{"$set": bson.M{"totpPending": secret}}); err != nil {
+		return nil, err
+	}
+
+	return &model.TwoFactorSetup{Secret: secret, URI: totpURI(db.tokens.issuer, user.Email, secret)}, nil
+}
+
+// EnableTwoFactor turns two-factor authentication on for the user with the
+// given id when code is a current code of the secret of SetupTwoFactor
+func (db *DB) EnableTwoFactor(ctx context.Context, id, code string) (*model.User, error) {
+	user, err := db.FindByID(ctx, id)
+	if err != nil {
+		return nil, Errorf(CodeNotFound, "Could not find user with id '%s'.", id)
+	}
+	if user.TOTPPending == "" {
+		return nil, gqlerror.Errorf("Set up two-factor authentication with setupTwoFactor first.")
+	}
+
+	step, ok := matchTOTP(user.TOTPPending, code, time.Now())
+	if !ok {
+		return nil, Errorf(CodeInvalidOTP, "Invalid code.")
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"totpSecret": user.TOTPPending, "totpStep": step},
+		"$unset": bson.M{"totpPending": ""},
+	}
+	return db.updateUser(ctx, id, update)
+}
+
+// DisableTwoFactor turns two-factor authentication off for the user with
+// the given id, its trusted devices are forgotten
+func (db *DB) DisableTwoFactor(ctx context.Context, id string) (*model.User, error) {
+	update := bson.M{"$unset": bson.M{"totpSecret": "", "totpPending": "", "totpStep": ""}}
+	user, err := db.updateUser(ctx, id, update)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.RevokeTrustedDevices(ctx, id); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not remove trusted devices")
+	}
+
+	return user, nil
+}
+
+// secondFactor checks the code of the authenticator app of users with
+// two-factor authentication, unless the login comes from a device they
+// trust, sending deviceToken or the device cookie. It returns the amr of
+// the tokens of the login, nil for a password alone. When it is amrOTP a
+// code was checked, the device can then be trusted with rememberDevice
+func (db *DB) secondFactor(ctx context.Context, user *UserModel, otp, deviceToken *string) ([]string, error) {
+	if user.TOTPSecret == "" {
+		return nil, nil
+	}
+
+	device := DeviceCookieForContext(ctx)
+	if deviceToken != nil {
+		device = *deviceToken
+	}
+	if device != "" && db.deviceTrusted(ctx, user, device) {
+		return amrTrustedDevice, nil
+	}
+
+	if otp == nil || *otp == "" {
+		return nil, Errorf(CodeMFARequired, "Enter the code of your authenticator app.")
+	}
+	step, ok := matchTOTP(user.TOTPSecret, *otp, time.Now())
+	if !ok {
+		return nil, Errorf(CodeInvalidOTP, "Invalid code.")
+	}
+
+	// Codes can't be replayed, by someone watching the screen for instance
+	collection := db.client.Database(db.database).Collection(db.collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": user.ID, "totpStep": bson.M{"$not": bson.M{"$gte": step}}}
+	res, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totpStep": step}})
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Could not check the code, try again later.")
+	}
+	if res.MatchedCount == 0 {
+		return nil, Errorf(CodeInvalidOTP, "This code was already used, enter the next one.")
+	}
+
+	return amrOTP, nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// The vectors of RFC 4226 appendix D and the SHA-1 ones of RFC 6238
+// appendix B, whose codes have eight digits
+func TestHOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		counter int64
+		digits  int
+		want    string
+	}{
+		{counter: 0, digits: 6, want: "755224"},
+		{counter: 1, digits: 6, want: "287082"},
+		{counter: 2, digits: 6, want: "359152"},
+		{counter: 3, digits: 6, want: "969429"},
+		{counter: 4, digits: 6, want: "338314"},
+		{counter: 5, digits: 6, want: "254676"},
+		{counter: 6, digits: 6, want: "287922"},
+		{counter: 7, digits: 6, want: "162583"},
+		{counter: 8, digits: 6, want: "399871"},
+		{counter: 9, digits: 6, want: "520489"},
+		{counter: 59 / 30, digits: 8, want: "94287082"},
+		{counter: 1111111109 / 30, digits: 8, want: "07081804"},
+		{counter: 1111111111 / 30, digits: 8, want: "14050471"},
+		{counter: 1234567890 / 30, digits: 8, want: "89005924"},
+		{counter: 2000000000 / 30, digits: 8, want: "69279037"},
+		{counter: 20000000000 / 30, digits: 8, want: "65353130"},
+	}
+
+	for _, tt := range tests {
+		if got := hotp(secret, tt.counter, tt.digits); got != tt.want {
+			t.Errorf("hotp(%d, %d) = %s, want %s", tt.counter, tt.digits, got, tt.want)
+		}
+	}
+}
+
+// The SHA-1 vectors of RFC 6238 appendix B, truncated to six digits
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		name string
+		time int64
+		code string
+		want bool
+	}{
+		{name: "59", time: 59, code: "287082", want: true},
+		{name: "1111111109", time: 1111111109, code: "081804", want: true},
+		{name: "1111111111", time: 1111111111, code: "050471", want: true},
+		{name: "1234567890", time: 1234567890, code: "005924", want: true},
+		{name: "2000000000", time: 2000000000, code: "279037", want: true},
+		{name: "previous period", time: 1111111111 + totpPeriod, code: "050471", want: true},
+		{name: "next period", time: 1111111111 - totpPeriod, code: "050471", want: true},
+		{name: "outside the skew", time: 1111111111 + 2*totpPeriod, code: "050471", want: false},
+		{name: "wrong code", time: 59, code: "287083", want: false},
+		{name: "eight digits", time: 59, code: "94287082", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(secret, tt.code, time.Unix(tt.time, 0))
+			if ok != tt.want {
+				t.Fatalf("matchTOTP() = %v, want %v", ok, tt.want)
+			}
+			if ok && (step < tt.time/totpPeriod-totpSkew || step > tt.time/totpPeriod+totpSkew) {
+				t.Errorf("matchTOTP() step = %d, want around %d", step, tt.time/totpPeriod)
+			}
+		})
+	}
+}
+
+func TestMatchTOTPInvalidSecret(t *testing.T) {
+	if _, ok := matchTOTP("not base32!", "123456", time.Now()); ok {
+		t.Error("matchTOTP() accepted a code of an invalid secret")
+	}
+}
+
+func TestTokenAMR(t *testing.T) {
+	issuer := NewTokenIssuer(newKeySet("secret", time.Hour), time.Hour, "auth", "")
+	issuer.SetRefreshKey([]byte("refresh secret"), time.Hour)
+
+	tests := []struct {
+		name string
+		amr  []string
+		want []string
+	}{
+		{name: "password", want: []string{"pwd"}},
+		{name: "code", amr: amrOTP, want: []string{"pwd", "otp", "mfa"}},
+		{name: "trusted device", amr: amrTrustedDevice, want: []string{"pwd", "mfa"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := issuer.IssueBound(testTokenUser(), nil, "", time.Time{}, tt.amr, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := issuer.VerifyToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isAMR(claims.AMR, tt.want) {
+				t.Errorf("token amr = %v, want %v", claims.AMR, tt.want)
+			}
+
+			// Refreshed tokens keep the methods of the login
+			refresh, err := issuer.IssueRefresh(testTokenUser(), nil, "session", time.Time{}, tt.amr, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err = issuer.verifyRefresh(refresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isAMR(claims.AMR, tt.want) {
+				t.Errorf("refresh token amr = %v, want %v", claims.AMR, tt.want)
+			}
+		})
+	}
+}
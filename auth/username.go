@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+)
+
+// reservedUsernames can't be registered, they could be mistaken for the service or its staff
+var reservedUsernames = []string{
+	"admin", "administrator", "root", "superuser", "system", "sysadmin", "support", "help", "helpdesk",
+	"security", "staff", "moderator", "mod", "owner", "official", "info", "contact", "abuse", "postmaster",
+	"webmaster", "hostmaster", "noreply", "no-reply", "mail", "email", "api", "www", "auth", "login",
+	"logout", "register", "signup", "account", "accounts", "settings", "billing", "null", "undefined",
+	"anonymous", "guest", "me", "self", "everyone",
+}
+
+// UsernameBlocklist decides which usernames can't be registered
+type UsernameBlocklist interface {
+	Blocked(username string) bool
+}
+
+// WordBlocklist blocks usernames containing one of its words, e.g. slurs
+type WordBlocklist []string
+
+// Blocked implements UsernameBlocklist
+func (words WordBlocklist) Blocked(username string) bool {
+	return containsAny(username, words)
+}
+
+// UsernamePolicy are the rules usernames must follow, they are checked normalized
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+	Reserved  map[string]bool
+	// Nil disables the blocklist
+	Blocklist UsernameBlocklist
+}
+
+// usernamePolicy is checked against new usernames, set from the config with SetUsernamePolicy
+var usernamePolicy = NewUsernamePolicy(&config.Config{UsernameMinLength: 3, UsernameMaxLength: 30})
+
+// SetUsernamePolicy changes the rules usernames must follow
+func SetUsernamePolicy(p UsernamePolicy) {
+	usernamePolicy = p
+}
+
+// NewUsernamePolicy returns the policy described by the USERNAME_* settings, the
+// configured reserved names are added to the built in ones
+func NewUsernamePolicy(cfg *config.Config) UsernamePolicy {
+	p := UsernamePolicy{
+		MinLength: cfg.UsernameMinLength,
+		MaxLength: cfg.UsernameMaxLength,
+		Reserved:  map[string]bool{},
+	}
+
+	for _, name := range append(reservedUsernames, cfg.UsernameReserved...) {
+		p.Reserved[NormalizeUsername(name)] = true
+	}
+	if len(cfg.UsernameBlocklist) > 0 {
+		p.Blocklist = WordBlocklist(cfg.UsernameBlocklist)
+	}
+
+	return p
+}
+
+// Check returns the rules a normalized username breaks, reported against field
+func (p UsernamePolicy) Check(field, username string) []FieldError {
+	var errs []FieldError
+	fail := func(rule, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...), Key: "username." + rule, Args: args})
+	}
+
+	if len(username) < p.MinLength || len(username) > p.MaxLength {
+		fail("length", "Username must be between %d and %d characters long.", p.MinLength, p.MaxLength)
+	}
+
+	if !validUsernameChars(username) {
+		fail("characters", "Username can only contain letters, digits, '.', '_' and '-', and must start with a letter or digit.")
+	}
+
+	if p.Reserved[username] {
+		fail("reserved", "Username %s is reserved.", username)
+	} else if p.Blocklist != nil && p.Blocklist.Blocked(username) {
+		fail("blocked", "Username is not allowed.")
+	}
+
+	return errs
+}
+
+// validUsernameChars reports whether a normalized username only holds allowed characters
+func validUsernameChars(username string) bool {
+	for i, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case i > 0 && strings.ContainsRune("._-", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,71 +1,118 @@
 package auth
 
 import (
-	"log"
-	"os"
+	"context"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/cesar-yoab/authService/graph/model"
-	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/joho/godotenv"
-	"github.com/vektah/gqlparser/v2/gqlerror"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/metrics"
 )
 
-// getFromEnv the value given a key from a .env file
-func getFromEnv(key string) string {
-	// Load .env file
-	err := godotenv.Load(".env")
+// HashPassword given password string with the configured PasswordHasher
+func HashPassword(password string) (string, error) {
+	defer metrics.ObserveSince(metrics.HashDuration, time.Now())
+
+	return hasher.Hash(password)
+}
 
+// issueToken generates a token for the given user in an existing session,
+// or starts a new one when sessionID is empty. member is the membership of
+// the organization the user logged into, nil outside organizations. authTime is when the user
+// entered their password, the zero time means now, and amr how, nil for a password alone
+func (db *DB) issueToken(ctx context.Context, user *UserModel, member *Membership, sessionID string, authTime time.Time, amr []string) (*model.Token, error) {
+	// Sessions last as long as their refresh token, or until unused for the
+	// idle timeout with sliding sessions
+	expiry := time.Now().Add(db.tokens.refreshTTL)
+	if db.sessionIdle > 0 {
+		expiry = time.Now().Add(db.sessionIdle)
+	}
+	// New sessions can't outlive the maximum lifetime, checkSession ends
+	// older ones once they reach it
+	if sessionID == "" && db.sessionMax > 0 && db.sessionMax < time.Until(expiry) {
+		expiry = time.Now().Add(db.sessionMax)
+	}
+
+	// Requests with a DPoP proof get a token bound to its key
+	jkt, err := db.checkProof(ctx, "")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return os.Getenv(key)
-}
+	if sessionID == "" {
+		id, err := db.startSession(ctx, user, expiry)
+		if err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not start session")
+			return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+		}
+		sessionID = id
+	} else if err := db.touchSession(ctx, sessionID, expiry); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("could not extend session")
+	}
+
+	token, err := db.tokens.IssueBound(user, member, sessionID, authTime, amr, jkt)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+	}
+	refresh, err := db.tokens.IssueRefresh(user, member, sessionID, authTime, amr, jkt)
+	if err != nil {
+		return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+	}
 
-// generateToken given a set of claims
-func generateToken(claims jwt.MapClaims) (string, error) {
-	// Get signing key
-	secret := getFromEnv("KEY")
-	if secret == "" {
-		log.Fatal("Could not get hold of signing KEY")
+	if db.opaque != nil {
+		claims, err := db.tokens.VerifyToken(token)
+		if err != nil {
+			return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+		}
+		if token, err = db.storeOpaque(ctx, token, claims); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("could not store opaque token")
+			return nil, Errorf(CodeInternal, "Server error could not generate a new token.")
+		}
 	}
 
-	// Create a new token object
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	expiresIn := int(db.tokens.ttl.Seconds())
+	return &model.Token{
+		Jwt:          token,
+		RefreshToken: &refresh,
+		ExpiresIn:    &expiresIn,
+	}, nil
+}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(secret))
-	if err != nil {
-		return "", err
+// validPassword checks a new password and its confirmation, field names the
+// input holding the password
+func validPassword(field, password, confirmPassword string, personal ...string) []FieldError {
+	errs := policy.Check(field, password, personal...)
+
+	// Check both passwords are equal
+	if password != confirmPassword {
+		errs = append(errs, FieldError{Field: "confirmPassword", Rule: "match", Message: "Passwords must match."})
 	}
 
-	return tokenString, nil
+	return errs
 }
 
-// HashPassword given password string. This function is a wrapper to the bcrypt GenerateFromPassword
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
+// NormalizeUsername returns the canonical form used to store and look up usernames
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
 }
 
-// ValidUserInput validates given passwords, email and username
+// ValidUserInput validates given passwords, email and username. The error lists
+// every failure in its "fields" extension
 func ValidUserInput(input *model.RegisterInput) (bool, error) {
-	// Check both passwords are equal
-	if input.Password != input.ConfirmPassword {
-		return false, gqlerror.Errorf("Passwords must match.")
-	}
+	errs := usernamePolicy.Check("username", NormalizeUsername(input.Username))
+	errs = append(errs, validPassword("password", input.Password, input.ConfirmPassword, input.Username, input.Email)...)
 
-	// Length of password in no bigger than 100 characters
-	if len(input.Password) > 100 {
-		return false, gqlerror.Errorf("Password is too long.")
+	// Check for a valid email address in an allowed domain
+	errs = append(errs, checkEmail("email", input.Email)...)
+
+	if input.Locale != nil && !validLocale(*input.Locale) {
+		errs = append(errs, FieldError{Field: "locale", Rule: "format", Message: "Invalid locale."})
 	}
 
-	// Check for a valid email address
-	if !IsValidEmail(input.Email) {
-		return false, gqlerror.Errorf("Invalid email address.")
+	if len(errs) > 0 {
+		return false, validationError(errs)
 	}
 
 	// Valid user input
@@ -78,26 +125,24 @@ func ValidateAndPrepare(registerInput *model.RegisterInput) (*model.RegisterInpu
 		return nil, err
 	}
 
-	// Hash both passwords
+	// The confirmation was checked above, only the password needs hashing
 	password, err := HashPassword(registerInput.Password)
 	if err != nil {
 		return nil, err
 	}
 
-	confPass, err := HashPassword(registerInput.ConfirmPassword)
-	if err != nil {
-		return nil, err
-	}
-
-	// Return same information but now passwords are hashed and ready
+	// Return same information but now the password is hashed and ready
 	// to be stored in database
 	return &model.RegisterInput{
-		Fname:           registerInput.Fname,
-		Lname:           registerInput.Lname,
-		Email:           registerInput.Email,
-		Password:        password,
-		ConfirmPassword: confPass,
-		Username:        registerInput.Username,
+		Fname:       registerInput.Fname,
+		Lname:       registerInput.Lname,
+		Email:       NormalizeEmail(registerInput.Email),
+		Password:    password,
+		Username:    NormalizeUsername(registerInput.Username),
+		Locale:      registerInput.Locale,
+		AcceptTerms: registerInput.AcceptTerms,
+		Org:         registerInput.Org,
+		InviteToken: registerInput.InviteToken,
 	}, nil
 }
 
@@ -111,59 +156,68 @@ func IsValidEmail(email string) bool {
 	return emailRegex.MatchString(email)
 }
 
-// ComparePasswords to check if they are equivalent
+// ComparePasswords to check if they are equivalent, the hash may be Argon2id
+// or bcrypt regardless of the hasher in use
 func ComparePasswords(hashedpassword, password []byte) bool {
-	comp := bcrypt.CompareHashAndPassword(hashedpassword, password)
-	if comp != nil {
-		return false
-	}
-
-	return true
+	return hasherFor(string(hashedpassword)).Compare(string(hashedpassword), string(password))
 }
 
-// RefreshJWT Provides a new token provided it has a least a minute left of lifetime
-func RefreshJWT(token *model.RefreshToken) (*model.Token, error) {
-	// We don't include the error because we deal with this kind of error with gqlerror
-	tkn, _ := jwt.Parse(token.OldToken, func(token *jwt.Token) (interface{}, error) {
-		// Validate alg
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, gqlerror.Errorf("Unexpected signing method: %v", token.Header["alg"])
+// VerifyToken checks a token like TokenIssuer.VerifyToken and also rejects revoked
+// tokens and the tokens of accounts that no longer exist, are disabled or are being deleted.
+// Tokens of service clients are rejected once the client is deleted
+func (db *DB) VerifyToken(ctx context.Context, tokenString string) (*Claims, error) {
+	tokenString, err := db.resolveOpaque(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := db.tokens.VerifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID == "" && claims.ClientID != "" {
+		if err := db.verifyServiceClient(ctx, claims); err != nil {
+			return nil, err
 		}
+		return claims, nil
+	}
 
-		// Get the secret
-		secret := getFromEnv("KEY")
-		if secret == "" {
-			return nil, gqlerror.Errorf("Server error could not issue new token.")
-		}
+	claims, _, err = db.verifyUser(ctx, tokenString)
+	return claims, err
+}
 
-		// Return the secret with bytes
-		return []byte(secret), nil
-	})
+// verifyUser verifies a token and returns the account it was issued to
+func (db *DB) verifyUser(ctx context.Context, tokenString string) (*Claims, *UserModel, error) {
+	tokenString, err := db.resolveOpaque(ctx, tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims, err := db.tokens.VerifyToken(tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Check validity of token
-	if !tkn.Valid {
-		return nil, gqlerror.Errorf("Invalid token")
+	if err := db.checkRevoked(ctx, claims); err != nil {
+		return nil, nil, err
 	}
 
-	// Get the payload to parse and generate a new token
-	claims, ok := tkn.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, gqlerror.Errorf("Unexpected error parsing claims.")
+	if err := db.checkSession(ctx, claims); err != nil {
+		return nil, nil, err
 	}
 
-	// If passwords match then we issue a token for the user
-	newToken, err := generateToken(jwt.MapClaims{
-		"_id":      claims["_id"],
-		"username": claims["username"],
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
+	user, err := db.FindByID(ctx, claims.UserID)
+	if err != nil || !user.Active() {
+		return nil, nil, Errorf(CodeInvalidToken, "Invalid token")
+	}
 
-	if err != nil {
-		return nil, gqlerror.Errorf("Server error could not generate a new token.")
+	// The user signed out of every device after the token was issued
+	if claims.Version < user.TokenVersion {
+		return nil, nil, Errorf(CodeTokenRevoked, "Token has been revoked.")
+	}
+	// Fat tokens keep the permissions they were issued with, tokens of
+	// OAuth apps have none
+	if permissionPolicy.Mode != PermissionsEmbed && claims.ClientID == "" {
+		claims.Permissions = permissionPolicy.resolve(user.Roles)
 	}
 
-	// Finally return a token for graphql
-	return &model.Token{
-		Jwt: newToken,
-	}, nil
+	return claims, user, nil
 }
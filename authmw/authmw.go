@@ -0,0 +1,232 @@
+package authmw
+
+// HTTP middleware for services that accept the tokens issued by this
+// service. Requests without a valid bearer token are rejected with a 401
+// and a JSON body, the claims of valid tokens are stored in the request
+// context.
+//
+//	mw := authmw.New(auth.NewVerifier(key, "auth-service", ""))
+//	http.Handle("/orders", mw.RequireAuth(orders))
+//	http.Handle("/refunds", mw.RequireAuth(authmw.RequireScope("refunds:write", refunds)))
+//	http.Handle("/reports", mw.RequireAuth(authmw.RequirePermission("reports:read", reports)))
+//
+// Tokens are signed with HMAC keys so they are verified with the shared
+// secret, which PASETO tokens are verified with too. Organizations with a
+// signing key of their own get ES256 tokens instead, which are verified
+// with the keys at /v1/orgs/{slug}/jwks.json. With SIGNING_ALG EdDSA use
+// auth.NewEdDSAVerifier with the key published at /oauth/jwks.json, and
+// with TOKEN_ENCRYPTION_KEY give the key to the verifier with
+// SetEncryptionKey so it can read encrypted tokens.
+//
+// Services behind the same site as a deployment with COOKIE_AUTH use
+// RequireAuthCookie, which also accepts the token cookie browsers send.
+//
+// Tokens bound to a DPoP key are only accepted as "Authorization: DPoP
+// <token>" with a proof of the key in the DPoP header. Proofs are single
+// use, instances behind a load balancer share the ones they saw with
+// SetProofStore.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+)
+
+// Verifier validates a token and returns its claims, implemented by auth.TokenIssuer
+type Verifier interface {
+	VerifyToken(tokenString string) (*auth.Claims, error)
+}
+
+// Middleware authenticates requests with a Verifier
+type Middleware struct {
+	verifier Verifier
+
+	// DPoP proofs already used, and when the in process store was last swept
+	proofs auth.Denylist
+	mu     sync.Mutex
+	swept  time.Time
+}
+
+// New returns middleware checking tokens with verifier
+func New(verifier Verifier) *Middleware {
+	return &Middleware{verifier: verifier, proofs: auth.NewMemoryDenylist(), swept: time.Now()}
+}
+
+// SetProofStore changes where used DPoP proofs are kept, such as
+// auth.NewCacheDenylist with Redis to share them between instances
+func (m *Middleware) SetProofStore(d auth.Denylist) {
+	m.proofs = d
+}
+
+type contextKey struct{}
+
+// ClaimsFromContext returns the claims of the request token, nil outside of RequireAuth
+func ClaimsFromContext(ctx context.Context) *auth.Claims {
+	claims, _ := ctx.Value(contextKey{}).(*auth.Claims)
+	return claims
+}
+
+// errorBody is the JSON body of rejected requests, following RFC 6750
+type errorBody struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// RequireAuth only lets requests with a valid bearer or DPoP token through
+func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token := authorization(r)
+		if scheme == "" {
+			unauthorized(w, "Bearer", "invalid_request", "Bearer token required.")
+			return
+		}
+
+		m.serve(w, r, scheme, token, next)
+	})
+}
+
+// authorization returns the scheme and token of the Authorization header,
+// an empty scheme when it has neither a bearer nor a DPoP token
+func authorization(r *http.Request) (scheme, token string) {
+	header := r.Header.Get("Authorization")
+	for _, scheme := range []string{"Bearer", auth.DPoPHeader} {
+		if strings.HasPrefix(header, scheme+" ") {
+			return scheme, strings.TrimPrefix(header, scheme+" ")
+		}
+	}
+
+	return "", ""
+}
+
+// RequireAuthCookie is RequireAuth also accepting the token in the cookie
+// set with COOKIE_AUTH. Requests authenticated by the cookie that can
+// change something must echo the CSRF cookie in the X-CSRF-Token header
+func (m *Middleware) RequireAuthCookie(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scheme, token := authorization(r); scheme != "" {
+			m.serve(w, r, scheme, token, next)
+			return
+		}
+
+		cookie, err := r.Cookie(auth.TokenCookie)
+		if err != nil || cookie.Value == "" {
+			unauthorized(w, "Bearer", "invalid_request", "Bearer token or token cookie required.")
+			return
+		}
+		if !auth.ValidCSRF(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errorBody{Error: "invalid_request", Description: "Missing or invalid CSRF token."})
+			return
+		}
+
+		m.serve(w, r, "", cookie.Value, next)
+	})
+}
+
+// serve verifies token, sent with scheme or in a cookie when it is empty,
+// and passes the request on with its claims
+func (m *Middleware) serve(w http.ResponseWriter, r *http.Request, scheme, token string, next http.Handler) {
+	claims, err := m.verifier.VerifyToken(token)
+	if err != nil {
+		unauthorized(w, "Bearer", "invalid_token", "Token is invalid or expired.")
+		return
+	}
+
+	switch {
+	case claims.JKT == "" && scheme == auth.DPoPHeader:
+		unauthorized(w, auth.DPoPHeader, "invalid_token", "The token isn't bound to a DPoP key.")
+		return
+	case claims.JKT != "" && scheme == "Bearer":
+		unauthorized(w, auth.DPoPHeader, "invalid_token", "Bound tokens must be sent with the DPoP scheme.")
+		return
+	case claims.JKT != "":
+		if !m.validProof(r, token, claims.JKT) {
+			unauthorized(w, auth.DPoPHeader, "invalid_dpop_proof", "Missing or invalid DPoP proof.")
+			return
+		}
+	}
+
+	next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, claims)))
+}
+
+// validProof reports whether the DPoP proof of r was made for it with the
+// key whose thumbprint is jkt, and wasn't used before
+func (m *Middleware) validProof(r *http.Request, token, jkt string) bool {
+	proof, err := auth.VerifyDPoPProof(r.Header.Get(auth.DPoPHeader), r.Method, requestURL(r), token)
+	if err != nil || proof.JKT != jkt {
+		return false
+	}
+
+	// Nothing sweeps the in process store, proofs are dropped here once old enough
+	m.mu.Lock()
+	if memory, ok := m.proofs.(auth.Sweeper); ok && time.Since(m.swept) > time.Minute {
+		memory.Sweep(time.Now())
+		m.swept = time.Now()
+	}
+	m.mu.Unlock()
+
+	replayed, err := m.proofs.Revoked(r.Context(), "dpop:"+proof.ID)
+	if err != nil || replayed {
+		return false
+	}
+
+	return m.proofs.Revoke(r.Context(), "dpop:"+proof.ID, auth.ProofExpiry(proof)) == nil
+}
+
+// requestURL returns the URL the client sent r to, as named in DPoP proofs
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// RequireScope only lets requests whose token grants scope through, use it
+// inside RequireAuth
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFromContext(r.Context())
+		if claims == nil || !claims.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errorBody{Error: "insufficient_scope", Description: "The token doesn't grant the " + scope + " scope."})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission only lets requests whose token carries permission
+// through, use it inside RequireAuth. Tokens only carry permissions with
+// PERMISSION_CLAIMS embed
+func RequirePermission(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFromContext(r.Context())
+		if claims == nil || !claims.HasPermission(permission) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errorBody{Error: "access_denied", Description: "The token doesn't grant the " + permission + " permission."})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unauthorized writes a 401 response asking for a token of scheme
+func unauthorized(w http.ResponseWriter, scheme, code, description string) {
+	w.Header().Set("WWW-Authenticate", scheme+` error="`+code+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(errorBody{Error: code, Description: description})
+}
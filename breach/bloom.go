@@ -0,0 +1,62 @@
+package breach
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter is a bloom filter, it answers whether a value may have been added
+// with a small rate of false positives and no false negatives
+type Filter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// NewFilter sizes a filter for n values and the false positive rate p
+func NewFilter(n int, p float64) *Filter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &Filter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// Add inserts value
+func (f *Filter) Add(value string) {
+	h1, h2 := hashes(value)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Contains reports whether value may have been added
+func (f *Filter) Contains(value string) bool {
+	h1, h2 := hashes(value)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hashes derives the two hashes combined into the k positions of a value
+func hashes(value string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+
+	return h1, h2
+}
@@ -0,0 +1,44 @@
+package breach
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"strings"
+)
+
+// Most common leaked passwords, one per line, lowercased and gzipped. Taken
+// from the zxcvbn password list (MIT), it can be swapped for a longer list
+// in the same format such as the top 100k of SecLists
+//
+//go:embed common-passwords.txt.gz
+var commonPasswords []byte
+
+// CommonPasswords loads the embedded list of common passwords into a filter,
+// look passwords up lowercased
+func CommonPasswords() (*Filter, error) {
+	r, err := gzip.NewReader(bytes.NewReader(commonPasswords))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var passwords []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			passwords = append(passwords, password)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	filter := NewFilter(len(passwords), 0.001)
+	for _, password := range passwords {
+		filter.Add(password)
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,110 @@
+package breach
+
+// Client of the Have I Been Pwned range API. Passwords never leave the
+// service, only the first 5 characters of their SHA-1 are sent and the
+// matching suffixes are compared locally (k-anonymity). Responses are
+// cached per prefix, and a stale entry is used when the API is down.
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HIBP counts how often passwords appear in known breaches
+type HIBP struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]rangeEntry
+}
+
+// rangeEntry are the suffixes returned for a prefix and their counts
+type rangeEntry struct {
+	counts  map[string]int
+	fetched time.Time
+}
+
+// NewHIBP returns a client of the API at url, caching each range for ttl
+func NewHIBP(url string, ttl time.Duration) *HIBP {
+	return &HIBP{
+		url:    strings.TrimSuffix(url, "/"),
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  map[string]rangeEntry{},
+	}
+}
+
+// Count returns how many times password was seen in breaches, 0 when it wasn't
+func (h *HIBP) Count(ctx context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	h.mu.Lock()
+	entry, cached := h.cache[prefix]
+	h.mu.Unlock()
+
+	if !cached || time.Since(entry.fetched) > h.ttl {
+		counts, err := h.fetch(ctx, prefix)
+		if err != nil {
+			if cached {
+				return entry.counts[suffix], nil
+			}
+			return 0, err
+		}
+
+		entry = rangeEntry{counts: counts, fetched: time.Now()}
+		h.mu.Lock()
+		h.cache[prefix] = entry
+		h.mu.Unlock()
+	}
+
+	return entry.counts[suffix], nil
+}
+
+// fetch downloads the suffixes of prefix, padded entries have a count of 0
+func (h *HIBP) fetch(ctx context.Context, prefix string) (map[string]int, error) {
+	req, err := http.NewRequest(http.MethodGet, h.url+"/range/"+prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	// Pads responses so their size doesn't give away the prefix
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "auth-service")
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pwned passwords returned %s", res.Status)
+	}
+
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		if n, err := strconv.Atoi(parts[1]); err == nil && n > 0 {
+			counts[parts[0]] = n
+		}
+	}
+
+	return counts, scanner.Err()
+}
@@ -0,0 +1,18 @@
+package cache
+
+// Key/value caches with expiry. The LRU keeps entries in process for single
+// instance deployments, Redis shares them between instances. Callers treat
+// errors as misses, the cache is never the source of truth.
+
+import (
+	"context"
+	"time"
+)
+
+// Cache stores values for a limited time
+type Cache interface {
+	// Get returns the value of key and whether it was found
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
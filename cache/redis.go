@@ -0,0 +1,236 @@
+package cache
+
+// Minimal Redis client speaking RESP, the cache only needs GET, SET and
+// DEL so this avoids pulling the full client in.
+// See https://redis.io/docs/reference/protocol-spec/
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxIdleConns is how many connections are kept open between commands
+const maxIdleConns = 8
+
+// Redis is a cache stored in a Redis server
+type Redis struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// redisConn is a connection with its buffered reader
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errNil is the reply for missing keys
+var errNil = errors.New("redis: nil")
+
+// NewRedis returns a cache for the server at rawURL, e.g. redis://:password@localhost:6379/0.
+// Connections are opened on first use
+func NewRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url %q", rawURL)
+	}
+
+	r := &Redis{addr: u.Host, idle: make(chan *redisConn, maxIdleConns)}
+	if password, ok := u.User.Password(); ok {
+		r.password = password
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if r.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", path)
+		}
+	}
+
+	return r, nil
+}
+
+// Get implements Cache
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := r.Do(ctx, "GET", key)
+	if err == errNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, _ := reply.([]byte)
+	return value, true, nil
+}
+
+// Set implements Cache
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := r.Do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Delete implements Cache
+func (r *Redis) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := r.Do(ctx, "DEL", keys...)
+	return err
+}
+
+// Close closes the idle connections
+func (r *Redis) Close() error {
+	for {
+		select {
+		case c := <-r.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Do sends a command and returns its reply, a []byte, int64, string or []interface{}
+func (r *Redis) Do(ctx context.Context, command string, args ...string) (interface{}, error) {
+	c, err := r.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	reply, err := c.do(command, args...)
+	if _, protocol := err.(redisError); err != nil && err != errNil && !protocol {
+		// The connection is in an unknown state
+		c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+
+	return reply, err
+}
+
+// get takes an idle connection or opens a new one
+func (r *Redis) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if r.password != "" {
+		if _, err := c.do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// put returns a connection to the pool, closing it when the pool is full
+func (r *Redis) put(c *redisConn) {
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// do writes a command as an array of bulk strings and reads the reply
+func (c *redisConn) do(command string, args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(command), command)
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+// read parses one reply
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: short reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil && err != errNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,1016 @@
+package config
+
+// Configuration of the service, read once at startup from the environment.
+// Variables can also be set in a .env file, or the file named by
+// CONFIG_FILE, values already present in the environment take precedence.
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/secrets"
+	"github.com/joho/godotenv"
+)
+
+// Config holds every setting of the service
+type Config struct {
+	Port string
+	// Address of the service in links sent to users, e.g. "https://auth.example.com"
+	PublicURL string
+
+	// Mongo
+	MongoURI        string
+	Database        string
+	Collection      string
+	AuditCollection string
+
+	// Key used to sign tokens
+	SigningKey string
+	// Lifetime of access tokens and the iss and aud claims they carry, the audience is optional
+	TokenTTL      time.Duration
+	TokenIssuer   string
+	TokenAudience string
+	// Clock skew between servers allowed when checking exp, iat and nbf
+	ClockLeeway time.Duration
+	// Key refresh tokens are signed with, derived from SigningKey when
+	// empty, and how long they last
+	RefreshKey      string
+	RefreshTokenTTL time.Duration
+	// How long sessions last unused, each request extends them, zero ends
+	// them with their refresh token
+	SessionIdleTimeout time.Duration
+	// How long sessions last at most since the login, zero for no limit
+	SessionMaxLifetime time.Duration
+	// How long devices trusted at a two-factor login skip the second factor
+	TrustedDeviceTTL time.Duration
+	// "jwt", "v2.local" or "v4.public" for PASETO tokens, or "opaque" for
+	// random tokens kept in TokenStore, "mongo" or "redis"
+	TokenFormat string
+	TokenStore  string
+	// "HS256" signs JWTs with KEY, "EdDSA" with the Ed25519 private key in
+	// EdDSAKey, a PKCS #8 PEM block made with the genkey command
+	SigningAlg string
+	EdDSAKey   string
+	// Base64 256-bit key JWTs are encrypted with so their claims can't be
+	// read, not encrypted when empty
+	TokenEncryptionKey string
+	// Permissions of each role, each "permission=ROLE", and how tokens carry
+	// them: "lookup" resolves them when tokens are verified, "embed" lists
+	// them in tokens and "hash" adds a hash of the list
+	Permissions      []string
+	PermissionClaims string
+
+	// "bcrypt" or "argon2id" for new passwords, Argon2Memory is in KiB
+	PasswordHasher    string
+	BcryptCost        int
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+
+	// Folds Gmail addresses before storing and comparing emails, see auth.EmailPolicy
+	EmailFoldGmail bool
+	// Only these email domains can register, any when empty
+	EmailAllowedDomains []string
+	// "off", "warn", "block" or "approve" registrations with disposable emails
+	DisposableEmails string
+
+	// Rules for new usernames, see auth.UsernamePolicy
+	UsernameMinLength int
+	UsernameMaxLength int
+	UsernameReserved  []string
+	UsernameBlocklist []string
+
+	// Rules for new passwords, see auth.PasswordPolicy
+	PasswordMinLength   int
+	PasswordMaxLength   int
+	PasswordMinClasses  int
+	PasswordMaxRepeated int
+	PasswordBannedWords []string
+	PasswordBlockCommon bool
+	// "warn" or "block" to look new passwords up in Have I Been Pwned, empty disables it
+	PasswordBreachCheck string
+	HIBPURL             string
+	BreachCacheTTL      time.Duration
+
+	// How long deleted accounts can be restored
+	DeletionGracePeriod time.Duration
+	// How long audit events are kept
+	AuditRetention time.Duration
+
+	WebhookURLs   []string
+	WebhookSecret string
+
+	// "nats", "kafka" or empty to disable publishing events
+	EventBus         string
+	NATSURL          string
+	KafkaRESTURL     string
+	EventTopicPrefix string
+
+	// OpenTelemetry collector, tracing is disabled when empty
+	OTLPEndpoint string
+	ServiceName  string
+
+	LogLevel string
+	// Share of successful requests logged, whether GraphQL variables are
+	// logged and the names of more variables to redact there
+	LogSampleRate float64
+	LogVariables  bool
+	LogRedact     []string
+
+	// Sentry project internal errors are reported to, and the version of
+	// the deployment they are tagged with
+	SentryDSN     string
+	SentryRelease string
+	// "production" or "development", the details of internal errors are
+	// only answered in development
+	Environment string
+	// Whether GraphQL introspection and the playground are enabled, by
+	// default only in development
+	Introspection bool
+	Playground    bool
+
+	// How many usernameAvailable calls a client address can make per UsernameWindow
+	UsernameLimit  int
+	UsernameWindow time.Duration
+
+	// Limits of GraphQL operations, field=limit/window/key entries such as
+	// "register=5/1m/ip", see ParseRateLimit
+	RateLimits []string
+
+	// Most a GraphQL operation can cost and nest, zero for no limit, and
+	// the cost of each mutation it runs
+	MaxQueryComplexity int
+	MaxQueryDepth      int
+	MutationCost       int
+	// How long a GraphQL operation may run, zero for no limit
+	GraphQLTimeout time.Duration
+
+	// Largest request body in bytes, and how long the HTTP server waits to
+	// read a request, to write its response and for the next request of an
+	// idle connection, zero for no limit
+	MaxBodySize      int
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+
+	// gRPC API, disabled when the port is empty. Callers must present GRPCToken when it is set
+	GRPCPort  string
+	GRPCToken string
+
+	// "lru", "redis" or empty to disable caching user lookups
+	Cache     string
+	CacheSize int
+	CacheTTL  time.Duration
+	RedisURL  string
+
+	// Where revoked tokens are kept, "memory" or "redis"
+	Denylist string
+
+	// Where queries clients persist by hash are kept, "lru" or "redis", and
+	// the manifest of queries known ahead, the only ones allowed with
+	// PersistedQueriesOnly
+	APQCache             string
+	APQCacheSize         int
+	APQTTL               time.Duration
+	PersistedQueries     string
+	PersistedQueriesOnly bool
+
+	// Where background jobs are queued, "memory", "mongo" or "redis", and how many run at once
+	JobQueue   string
+	JobWorkers int
+
+	// How recently users must have entered their password for @recentAuth operations
+	ReauthMaxAge time.Duration
+
+	// Logins users are emailed about: "all", "suspicious" (new devices) or "off"
+	LoginNotifications string
+	// Page of the "this wasn't me" link in login emails, it calls reportLogin with the token
+	LoginReportURL string
+	// Address lookup API, "{ip}" is replaced by the address, empty to leave the location out
+	GeoIPURL string
+
+	// How emails are sent: "smtp", "sendgrid", "ses" or empty to only log them
+	MailProvider   string
+	MailFrom       string
+	SMTPURL        string
+	SendGridAPIKey string
+	// Region and credentials of SES, the session token is optional
+	AWSRegion          string
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	// Directory of templates replacing the built in ones, and the locale of
+	// users without one or whose locale has no translation
+	MailTemplates string
+	DefaultLocale string
+	// Directory of translation bundles of error messages, <locale>.json
+	Translations string
+
+	// Current versions of the terms of service and privacy policy users must
+	// accept, not required when empty
+	TermsVersion         string
+	PrivacyPolicyVersion string
+
+	// Page of the link in organization invitations, it calls register or
+	// acceptInvite with the token. Emails carry the bare token when empty
+	InviteURL string
+	// How long organization invitations can be accepted
+	InviteTTL time.Duration
+
+	// Base64 256-bit key encrypting the email and names of users, stored in
+	// plain text when empty. It can't be changed once set
+	PIIKey string
+
+	// SAML single sign-on, enabled by the metadata of the identity provider, a
+	// file or URL. The entity id of the service defaults to its metadata URL
+	SAMLIdPMetadata string
+	SAMLEntityID    string
+	// User fields and the attributes they are read from, as field=attribute
+	SAMLAttributes []string
+	// Slug of the organization SAML users belong to, the default namespace when empty
+	SAMLOrg string
+	// Accept logins started at the identity provider
+	SAMLAllowIdPInitiated bool
+	// Page browsers are sent to after logging in, with the token in the fragment
+	SAMLRedirectURL string
+
+	// OpenID Connect single sign-on, enabled by the issuer URL of the provider
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCScopes       []string
+	// User fields and the claims they are read from, as field=claim
+	OIDCClaims []string
+	// Slug of the organization OIDC users belong to, the default namespace when empty
+	OIDCOrg string
+	// Page browsers are sent to after logging in, with the token in the fragment
+	OIDCRedirectURL string
+
+	// What single sign-on does with unknown users: "auto" creates them, "approval"
+	// creates them awaiting approval by an administrator, "off" refuses them
+	SSOProvisioning string
+	// Email domains single sign-on creates users for, any when empty
+	SSOAllowedDomains []string
+	// Roles of the users single sign-on creates, and their role in its organization
+	SSODefaultRoles   []string
+	SSODefaultOrgRole string
+	// Endpoint asked about each user single sign-on creates, see webhook.ProvisioningHook
+	SSOProvisioningHook string
+
+	// OAuth 2.0 authorization server, enabled by the page of the deployment
+	// that logs users in and approves authorization requests
+	OAuthLoginURL string
+	// How long refresh tokens of OAuth clients last
+	OAuthRefreshTTL time.Duration
+	// Scopes clients can be granted, each "scope" or "scope=ROLE" for the
+	// ones only users with the role can grant
+	Scopes []string
+	// Initial access token apps register themselves with at /oauth/register,
+	// registration is off when empty
+	OAuthRegistrationToken string
+
+	// Deliver tokens to browsers in Secure, HttpOnly cookies instead of the
+	// GraphQL response, with a CSRF cookie to echo in X-CSRF-Token.
+	// CookieSameSite is "lax", "strict" or "none"
+	CookieAuth     bool
+	CookieDomain   string
+	CookieSameSite string
+	CookieSecure   bool
+
+	// Origins of browser apps allowed to call the service, whether their
+	// requests may carry cookies and how long preflights are cached
+	CORSOrigins     []string
+	CORSCredentials bool
+	CORSMaxAge      time.Duration
+
+	// Certificate and key of HTTPS, or the domains to get certificates of
+	// from Let's Encrypt, kept in TLSAutocertCache. With either, plain HTTP
+	// on HTTPRedirectPort redirects to HTTPS
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSAutocertDomains []string
+	TLSAutocertCache   string
+	TLSAutocertEmail   string
+	HTTPRedirectPort   string
+
+	// Internal services calling MTLSPort, and the gRPC API, must present a
+	// client certificate signed by a CA of MTLSCAFile, and named in
+	// MTLSAllowedNames when it isn't empty
+	MTLSPort         string
+	MTLSCAFile       string
+	MTLSAllowedNames []string
+
+	// Addresses or CIDR ranges of the proxies in front of the service, whose
+	// X-Forwarded-For and X-Real-IP headers name the client
+	TrustedProxies []string
+
+	// Apply pending migrations at startup, otherwise they run with the migrate command
+	MigrateOnStart bool
+
+	// Deadline to drain requests and release resources on shutdown
+	ShutdownTimeout time.Duration
+
+	// Where the signing key and Mongo URI are kept, nil when they come from the environment
+	Secrets                secrets.Provider
+	SecretsRefreshInterval time.Duration
+}
+
+// Load reads the configuration and validates it
+func Load() (*Config, error) {
+	file := os.Getenv("CONFIG_FILE")
+	if file == "" {
+		file = ".env"
+	}
+
+	// The file is optional, the variables may come from the environment alone
+	if err := godotenv.Load(file); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not load %s: %w", file, err)
+	}
+
+	l := loader{}
+	cfg := &Config{
+		Port:                 l.str("PORT", "8080"),
+		PublicURL:            l.str("PUBLIC_URL", ""),
+		MongoURI:             l.str("DB", ""),
+		Database:             l.str("DBNAME", ""),
+		Collection:           l.str("COLLECTION", ""),
+		AuditCollection:      l.str("AUDIT_COLLECTION", "audit"),
+		SigningKey:           l.str("KEY", ""),
+		TokenTTL:             l.duration("TOKEN_TTL", 15*time.Minute),
+		TokenIssuer:          l.str("TOKEN_ISSUER", "auth-service"),
+		TokenAudience:        l.str("TOKEN_AUDIENCE", ""),
+		ClockLeeway:          l.duration("CLOCK_LEEWAY", 30*time.Second),
+		RefreshKey:           l.str("REFRESH_KEY", ""),
+		RefreshTokenTTL:      l.duration("REFRESH_TOKEN_TTL", 720*time.Hour),
+		SessionIdleTimeout:   l.duration("SESSION_IDLE_TIMEOUT", 0),
+		SessionMaxLifetime:   l.duration("SESSION_MAX_LIFETIME", 0),
+		TrustedDeviceTTL:     l.duration("TRUSTED_DEVICE_TTL", 720*time.Hour),
+		TokenFormat:          l.str("TOKEN_FORMAT", "jwt"),
+		TokenStore:           l.str("TOKEN_STORE", "mongo"),
+		SigningAlg:           l.str("SIGNING_ALG", "HS256"),
+		EdDSAKey:             l.str("EDDSA_KEY", ""),
+		TokenEncryptionKey:   l.str("TOKEN_ENCRYPTION_KEY", ""),
+		Permissions:          l.list("PERMISSIONS"),
+		PermissionClaims:     l.str("PERMISSION_CLAIMS", "lookup"),
+		PasswordHasher:       l.str("PASSWORD_HASHER", "bcrypt"),
+		BcryptCost:           l.int("BCRYPT_COST", 14),
+		Argon2Memory:         l.int("ARGON2_MEMORY", 64*1024),
+		Argon2Iterations:     l.int("ARGON2_ITERATIONS", 3),
+		Argon2Parallelism:    l.int("ARGON2_PARALLELISM", 2),
+		EmailFoldGmail:       l.bool("EMAIL_FOLD_GMAIL", false),
+		EmailAllowedDomains:  l.list("EMAIL_ALLOWED_DOMAINS"),
+		DisposableEmails:     l.str("DISPOSABLE_EMAILS", "off"),
+		UsernameMinLength:    l.int("USERNAME_MIN_LENGTH", 3),
+		UsernameMaxLength:    l.int("USERNAME_MAX_LENGTH", 30),
+		UsernameReserved:     l.list("USERNAME_RESERVED"),
+		UsernameBlocklist:    l.list("USERNAME_BLOCKLIST"),
+		PasswordMinLength:    l.int("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxLength:    l.int("PASSWORD_MAX_LENGTH", 100),
+		PasswordMinClasses:   l.int("PASSWORD_MIN_CLASSES", 2),
+		PasswordMaxRepeated:  l.int("PASSWORD_MAX_REPEATED", 3),
+		PasswordBannedWords:  l.list("PASSWORD_BANNED_WORDS"),
+		PasswordBlockCommon:  l.bool("PASSWORD_BLOCK_COMMON", true),
+		PasswordBreachCheck:  l.str("PASSWORD_BREACH_CHECK", ""),
+		HIBPURL:              l.str("HIBP_URL", "https://api.pwnedpasswords.com"),
+		BreachCacheTTL:       l.duration("BREACH_CACHE_TTL", 24*time.Hour),
+		DeletionGracePeriod:  l.duration("DELETION_GRACE_PERIOD", 30*24*time.Hour),
+		AuditRetention:       l.duration("AUDIT_RETENTION", 365*24*time.Hour),
+		WebhookURLs:          l.list("WEBHOOK_URLS"),
+		WebhookSecret:        l.str("WEBHOOK_SECRET", ""),
+		EventBus:             l.str("EVENT_BUS", ""),
+		NATSURL:              l.str("NATS_URL", ""),
+		KafkaRESTURL:         l.str("KAFKA_REST_URL", ""),
+		EventTopicPrefix:     l.str("EVENT_TOPIC_PREFIX", "auth"),
+		OTLPEndpoint:         l.str("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		ServiceName:          l.str("OTEL_SERVICE_NAME", "auth-service"),
+		LogLevel:             l.str("LOG_LEVEL", "info"),
+		LogSampleRate:        l.float("LOG_SAMPLE_RATE", 1),
+		LogVariables:         l.bool("LOG_VARIABLES", true),
+		LogRedact:            l.list("LOG_REDACT"),
+		SentryDSN:            l.str("SENTRY_DSN", ""),
+		SentryRelease:        l.str("SENTRY_RELEASE", ""),
+		Environment:          l.str("ENVIRONMENT", "production"),
+		UsernameLimit:        l.int("USERNAME_RATE_LIMIT", 30),
+		UsernameWindow:       l.duration("USERNAME_RATE_WINDOW", time.Minute),
+		RateLimits:           l.list("RATE_LIMITS"),
+		MaxQueryComplexity:   l.int("MAX_QUERY_COMPLEXITY", 2000),
+		MaxQueryDepth:        l.int("MAX_QUERY_DEPTH", 10),
+		MutationCost:         l.int("MUTATION_COST", 10),
+		GraphQLTimeout:       l.duration("GRAPHQL_TIMEOUT", 15*time.Second),
+		MaxBodySize:          l.int("MAX_BODY_SIZE", 1<<20),
+		HTTPReadTimeout:      l.duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		HTTPWriteTimeout:     l.duration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		HTTPIdleTimeout:      l.duration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		GRPCPort:             l.str("GRPC_PORT", ""),
+		GRPCToken:            l.str("GRPC_TOKEN", ""),
+		Cache:                l.str("CACHE", ""),
+		CacheSize:            l.int("CACHE_SIZE", 10000),
+		CacheTTL:             l.duration("CACHE_TTL", 5*time.Minute),
+		RedisURL:             l.str("REDIS_URL", ""),
+		APQCache:             l.str("APQ_CACHE", "lru"),
+		APQCacheSize:         l.int("APQ_CACHE_SIZE", 1000),
+		APQTTL:               l.duration("APQ_TTL", 24*time.Hour),
+		PersistedQueries:     l.str("PERSISTED_QUERIES", ""),
+		PersistedQueriesOnly: l.bool("PERSISTED_QUERIES_ONLY", false),
+		Denylist:             l.str("DENYLIST", "memory"),
+		JobQueue:             l.str("JOB_QUEUE", "memory"),
+		JobWorkers:           l.int("JOB_WORKERS", 4),
+		ReauthMaxAge:         l.duration("REAUTH_MAX_AGE", 5*time.Minute),
+		LoginNotifications:   l.str("LOGIN_NOTIFICATIONS", "suspicious"),
+		LoginReportURL:       l.str("LOGIN_REPORT_URL", ""),
+		GeoIPURL:             l.str("GEOIP_URL", ""),
+		MailProvider:         l.str("MAIL_PROVIDER", ""),
+		MailFrom:             l.str("MAIL_FROM", ""),
+		SMTPURL:              l.str("SMTP_URL", ""),
+		SendGridAPIKey:       l.str("SENDGRID_API_KEY", ""),
+		AWSRegion:            l.str("AWS_REGION", ""),
+		AWSAccessKeyID:       l.str("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey:   l.str("AWS_SECRET_ACCESS_KEY", ""),
+		AWSSessionToken:      l.str("AWS_SESSION_TOKEN", ""),
+		MailTemplates:        l.str("MAIL_TEMPLATES", ""),
+		DefaultLocale:        l.str("DEFAULT_LOCALE", "en"),
+		Translations:         l.str("TRANSLATIONS", ""),
+		TermsVersion:         l.str("TERMS_VERSION", ""),
+		PrivacyPolicyVersion: l.str("PRIVACY_POLICY_VERSION", ""),
+		InviteURL:            l.str("INVITE_URL", ""),
+		InviteTTL:            l.duration("INVITE_TTL", 7*24*time.Hour),
+		PIIKey:               l.str("PII_KEY", ""),
+		SAMLIdPMetadata:      l.str("SAML_IDP_METADATA", ""),
+		SAMLEntityID:         l.str("SAML_ENTITY_ID", ""),
+		SAMLAttributes:       l.list("SAML_ATTRIBUTES"),
+		SAMLOrg:              l.str("SAML_ORG", ""),
+		SAMLRedirectURL:      l.str("SAML_REDIRECT_URL", ""),
+		OIDCIssuer:           l.str("OIDC_ISSUER", ""),
+		OIDCClientID:         l.str("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:     l.str("OIDC_CLIENT_SECRET", ""),
+		OIDCScopes:           l.list("OIDC_SCOPES"),
+		OIDCClaims:           l.list("OIDC_CLAIMS"),
+		OIDCOrg:              l.str("OIDC_ORG", ""),
+		OIDCRedirectURL:      l.str("OIDC_REDIRECT_URL", ""),
+		SSOProvisioning:      l.str("SSO_PROVISIONING", "auto"),
+		SSOAllowedDomains:    l.list("SSO_ALLOWED_DOMAINS"),
+		SSODefaultRoles:      l.list("SSO_DEFAULT_ROLES"),
+		SSODefaultOrgRole:    l.str("SSO_DEFAULT_ORG_ROLE", "MEMBER"),
+		OAuthLoginURL:        l.str("OAUTH_LOGIN_URL", ""),
+		OAuthRefreshTTL:      l.duration("OAUTH_REFRESH_TTL", 30*24*time.Hour),
+		Scopes:               l.list("SCOPES"),
+		MigrateOnStart:       l.bool("MIGRATE_ON_START", true),
+		ShutdownTimeout:      l.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		SecretsRefreshInterval: l.duration("SECRETS_REFRESH_INTERVAL", 5*time.Minute),
+		SAMLAllowIdPInitiated:  l.bool("SAML_ALLOW_IDP_INITIATED", false),
+		SSOProvisioningHook:    l.str("SSO_PROVISIONING_HOOK", ""),
+		OAuthRegistrationToken: l.str("OAUTH_REGISTRATION_TOKEN", ""),
+		CookieAuth:             l.bool("COOKIE_AUTH", false),
+		CookieDomain:           l.str("COOKIE_DOMAIN", ""),
+		CookieSameSite:         l.str("COOKIE_SAMESITE", "lax"),
+		CookieSecure:           l.bool("COOKIE_SECURE", true),
+		CORSOrigins:            l.list("CORS_ORIGINS"),
+		CORSCredentials:        l.bool("CORS_CREDENTIALS", false),
+		CORSMaxAge:             l.duration("CORS_MAX_AGE", 10*time.Minute),
+		TLSCertFile:            l.str("TLS_CERT_FILE", ""),
+		TLSKeyFile:             l.str("TLS_KEY_FILE", ""),
+		TLSAutocertDomains:     l.list("TLS_AUTOCERT_DOMAINS"),
+		TLSAutocertCache:       l.str("TLS_AUTOCERT_CACHE", "certs"),
+		TLSAutocertEmail:       l.str("TLS_AUTOCERT_EMAIL", ""),
+		HTTPRedirectPort:       l.str("HTTP_REDIRECT_PORT", ""),
+		MTLSPort:               l.str("MTLS_PORT", ""),
+		MTLSCAFile:             l.str("MTLS_CA_FILE", ""),
+		MTLSAllowedNames:       l.list("MTLS_ALLOWED_NAMES"),
+		TrustedProxies:         l.list("TRUSTED_PROXIES"),
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	switch {
+	case cfg.PublicURL != "":
+	case len(cfg.TLSAutocertDomains) > 0:
+		cfg.PublicURL = "https://" + cfg.TLSAutocertDomains[0]
+	case cfg.TLSCertFile != "":
+		cfg.PublicURL = "https://localhost:" + cfg.Port
+	default:
+		cfg.PublicURL = "http://localhost:" + cfg.Port
+	}
+	// Their defaults depend on the environment
+	cfg.Introspection = l.bool("GRAPHQL_INTROSPECTION", !cfg.Production())
+	cfg.Playground = l.bool("GRAPHQL_PLAYGROUND", !cfg.Production())
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	if err := cfg.loadSecrets(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Production reports whether the service runs in production
+func (c *Config) Production() bool {
+	return c.Environment == "production"
+}
+
+// Validate checks required settings are present and values are consistent
+func (c *Config) Validate() error {
+	switch {
+	case c.MongoURI == "":
+		return errors.New("DB is required")
+	case c.Database == "":
+		return errors.New("DBNAME is required")
+	case c.Collection == "":
+		return errors.New("COLLECTION is required")
+	case c.Environment != "production" && c.Environment != "development":
+		return errors.New("ENVIRONMENT must be production or development")
+	case c.SigningKey == "":
+		return errors.New("KEY is required")
+	case c.TokenTTL <= 0:
+		return errors.New("TOKEN_TTL must be positive")
+	case c.RefreshTokenTTL < c.TokenTTL:
+		return errors.New("REFRESH_TOKEN_TTL must be at least TOKEN_TTL")
+	case c.SessionIdleTimeout != 0 && (c.SessionIdleTimeout < c.TokenTTL || c.SessionIdleTimeout > c.RefreshTokenTTL):
+		return errors.New("SESSION_IDLE_TIMEOUT must be between TOKEN_TTL and REFRESH_TOKEN_TTL")
+	case c.SessionMaxLifetime != 0 && c.SessionMaxLifetime < c.TokenTTL:
+		return errors.New("SESSION_MAX_LIFETIME must be at least TOKEN_TTL")
+	case c.RefreshKey != "" && c.RefreshKey == c.SigningKey:
+		return errors.New("REFRESH_KEY must differ from KEY")
+	case c.ClockLeeway < 0 || c.ClockLeeway > 5*time.Minute:
+		return errors.New("CLOCK_LEEWAY must be between 0 and 5m")
+	case c.TokenFormat != "jwt" && c.TokenFormat != "v2.local" && c.TokenFormat != "v4.public" && c.TokenFormat != "opaque":
+		return errors.New("TOKEN_FORMAT must be jwt, v2.local, v4.public or opaque")
+	case c.TokenStore != "mongo" && c.TokenStore != "redis":
+		return errors.New("TOKEN_STORE must be mongo or redis")
+	case c.TokenStore == "redis" && c.TokenFormat == "opaque" && c.RedisURL == "":
+		return errors.New("REDIS_URL is required when TOKEN_STORE is redis")
+	case c.SigningAlg != "HS256" && c.SigningAlg != "EdDSA":
+		return errors.New("SIGNING_ALG must be HS256 or EdDSA")
+	case c.SigningAlg == "EdDSA" && c.EdDSAKey == "":
+		return errors.New("EDDSA_KEY is required when SIGNING_ALG is EdDSA, make one with the genkey command")
+	case c.SigningAlg == "EdDSA" && c.TokenFormat != "jwt" && c.TokenFormat != "opaque":
+		return errors.New("SIGNING_ALG EdDSA signs JWTs, TOKEN_FORMAT must be jwt or opaque")
+	case c.PermissionClaims != "lookup" && c.PermissionClaims != "embed" && c.PermissionClaims != "hash":
+		return errors.New("PERMISSION_CLAIMS must be lookup, embed or hash")
+	case c.DeletionGracePeriod < 0 || c.AuditRetention <= 0:
+		return errors.New("DELETION_GRACE_PERIOD and AUDIT_RETENTION must be positive")
+	case c.TrustedDeviceTTL <= 0:
+		return errors.New("TRUSTED_DEVICE_TTL must be positive")
+	case c.InviteTTL <= 0:
+		return errors.New("INVITE_TTL must be positive")
+	case c.OAuthRefreshTTL <= 0:
+		return errors.New("OAUTH_REFRESH_TTL must be positive")
+	case c.Secrets != nil && c.SecretsRefreshInterval <= 0:
+		return errors.New("SECRETS_REFRESH_INTERVAL must be positive")
+	case c.UsernameMinLength < 1 || c.UsernameMaxLength < c.UsernameMinLength:
+		return errors.New("USERNAME_MIN_LENGTH must be positive and at most USERNAME_MAX_LENGTH")
+	case c.PasswordMinLength < 1 || c.PasswordMaxLength < c.PasswordMinLength:
+		return errors.New("PASSWORD_MIN_LENGTH must be positive and at most PASSWORD_MAX_LENGTH")
+	case c.PasswordMinClasses < 0 || c.PasswordMinClasses > 4 || c.PasswordMaxRepeated < 0:
+		return errors.New("PASSWORD_MIN_CLASSES must be between 0 and 4 and PASSWORD_MAX_REPEATED can't be negative")
+	case c.UsernameLimit < 1 || c.UsernameWindow <= 0:
+		return errors.New("USERNAME_RATE_LIMIT and USERNAME_RATE_WINDOW must be positive")
+	case c.MaxQueryComplexity < 0 || c.MaxQueryDepth < 0 || c.MutationCost < 0:
+		return errors.New("MAX_QUERY_COMPLEXITY, MAX_QUERY_DEPTH and MUTATION_COST can't be negative")
+	case c.LogSampleRate < 0 || c.LogSampleRate > 1:
+		return errors.New("LOG_SAMPLE_RATE must be between 0 and 1")
+	case c.GraphQLTimeout < 0 || c.MaxBodySize < 0 || c.HTTPReadTimeout < 0 || c.HTTPWriteTimeout < 0 || c.HTTPIdleTimeout < 0:
+		return errors.New("GRAPHQL_TIMEOUT, MAX_BODY_SIZE and the HTTP timeouts can't be negative")
+	case c.HTTPWriteTimeout > 0 && (c.GraphQLTimeout == 0 || c.GraphQLTimeout >= c.HTTPWriteTimeout):
+		// Otherwise the connection is cut before the operation can answer its timeout
+		return errors.New("GRAPHQL_TIMEOUT must be shorter than HTTP_WRITE_TIMEOUT")
+	case c.ReauthMaxAge <= 0:
+		return errors.New("REAUTH_MAX_AGE must be positive")
+	case len(c.WebhookURLs) > 0 && c.WebhookSecret == "":
+		return errors.New("WEBHOOK_SECRET is required to sign webhooks")
+	}
+
+	switch strings.ToLower(c.CookieSameSite) {
+	case "lax", "strict":
+	case "none":
+		// Browsers drop SameSite=None cookies that aren't Secure
+		if !c.CookieSecure {
+			return errors.New("COOKIE_SECURE is required when COOKIE_SAMESITE is none")
+		}
+	default:
+		return fmt.Errorf("COOKIE_SAMESITE must be lax, strict or none, got %q", c.CookieSameSite)
+	}
+
+	for _, origin := range c.CORSOrigins {
+		// Any site could then make requests with the user's cookies
+		if origin == "*" && c.CORSCredentials {
+			return errors.New("CORS_ORIGINS can't be * with CORS_CREDENTIALS")
+		}
+	}
+	for _, limit := range c.RateLimits {
+		if _, err := ParseRateLimit(limit); err != nil {
+			return err
+		}
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := ParseNetwork(proxy); err != nil {
+			return err
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		return errors.New("CORS_MAX_AGE can't be negative")
+	}
+	switch {
+	case (c.TLSCertFile == "") != (c.TLSKeyFile == ""):
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE go together")
+	case c.TLSCertFile != "" && len(c.TLSAutocertDomains) > 0:
+		return errors.New("TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS can't both be set")
+	case c.HTTPRedirectPort != "" && c.TLSCertFile == "" && len(c.TLSAutocertDomains) == 0:
+		return errors.New("HTTP_REDIRECT_PORT needs TLS_CERT_FILE or TLS_AUTOCERT_DOMAINS")
+	case c.HTTPRedirectPort != "" && c.HTTPRedirectPort == c.Port:
+		return errors.New("HTTP_REDIRECT_PORT must differ from PORT")
+	case c.MTLSPort != "" && c.MTLSCAFile == "":
+		return errors.New("MTLS_PORT needs MTLS_CA_FILE")
+	case c.MTLSCAFile != "" && c.TLSCertFile == "":
+		// Internal names aren't ones Let's Encrypt issues certificates for
+		return errors.New("MTLS_CA_FILE needs TLS_CERT_FILE")
+	case c.MTLSPort != "" && (c.MTLSPort == c.Port || c.MTLSPort == c.HTTPRedirectPort || c.MTLSPort == c.GRPCPort):
+		return errors.New("MTLS_PORT must differ from PORT, HTTP_REDIRECT_PORT and GRPC_PORT")
+	}
+
+	if err := checkMappings("SAML_ATTRIBUTES", "attribute", c.SAMLAttributes); err != nil {
+		return err
+	}
+	if err := checkMappings("OIDC_CLAIMS", "claim", c.OIDCClaims); err != nil {
+		return err
+	}
+	if c.OIDCIssuer != "" && c.OIDCClientID == "" {
+		return errors.New("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+
+	switch c.SSOProvisioning {
+	case "auto", "approval", "off":
+	default:
+		return fmt.Errorf("unknown SSO_PROVISIONING %q", c.SSOProvisioning)
+	}
+	for _, role := range c.SSODefaultRoles {
+		if role = strings.ToUpper(role); role != "USER" && role != "ADMIN" {
+			return fmt.Errorf("unknown SSO_DEFAULT_ROLES role %q, use USER or ADMIN", role)
+		}
+	}
+	if role := strings.ToUpper(c.SSODefaultOrgRole); role != "MEMBER" && role != "ADMIN" {
+		return fmt.Errorf("SSO_DEFAULT_ORG_ROLE must be MEMBER or ADMIN, got %q", c.SSODefaultOrgRole)
+	}
+	if c.SSOProvisioningHook != "" && c.WebhookSecret == "" {
+		return errors.New("WEBHOOK_SECRET is required to sign SSO_PROVISIONING_HOOK requests")
+	}
+	for _, permission := range c.Permissions {
+		i := strings.LastIndex(permission, "=")
+		if role := strings.ToUpper(permission[i+1:]); i <= 0 || (role != "USER" && role != "ADMIN") {
+			return fmt.Errorf("PERMISSIONS entries must be permission=ROLE with USER or ADMIN, got %q", permission)
+		}
+	}
+	for _, scope := range c.Scopes {
+		i := strings.LastIndex(scope, "=")
+		if i < 0 {
+			continue
+		}
+		if role := strings.ToUpper(scope[i+1:]); i == 0 || (role != "USER" && role != "ADMIN") {
+			return fmt.Errorf("SCOPES entries must be scope or scope=ROLE with USER or ADMIN, got %q", scope)
+		}
+	}
+
+	if c.PIIKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.PIIKey); err != nil || len(key) != 32 {
+			return errors.New("PII_KEY must be 32 bytes encoded in base64")
+		}
+	}
+	if c.TokenEncryptionKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.TokenEncryptionKey); err != nil || len(key) != 32 {
+			return errors.New("TOKEN_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+		}
+		if c.TokenFormat != "jwt" && c.TokenFormat != "opaque" {
+			return errors.New("TOKEN_ENCRYPTION_KEY encrypts JWTs, TOKEN_FORMAT must be jwt or opaque")
+		}
+	}
+
+	switch c.PasswordHasher {
+	case "bcrypt":
+		// The bounds bcrypt accepts
+		if c.BcryptCost < 4 || c.BcryptCost > 31 {
+			return errors.New("BCRYPT_COST must be between 4 and 31")
+		}
+	case "argon2id":
+		if c.Argon2Memory < 8*c.Argon2Parallelism || c.Argon2Iterations < 1 || c.Argon2Parallelism < 1 || c.Argon2Parallelism > 255 {
+			return errors.New("ARGON2_MEMORY, ARGON2_ITERATIONS and ARGON2_PARALLELISM must be positive, with at least 8KiB of memory per thread")
+		}
+	default:
+		return fmt.Errorf("unknown PASSWORD_HASHER %q", c.PasswordHasher)
+	}
+
+	switch c.Cache {
+	case "":
+	case "lru", "redis":
+		if c.CacheSize < 1 || c.CacheTTL <= 0 {
+			return errors.New("CACHE_SIZE and CACHE_TTL must be positive")
+		}
+		if c.Cache == "redis" && c.RedisURL == "" {
+			return errors.New("REDIS_URL is required when CACHE is redis")
+		}
+	default:
+		return fmt.Errorf("unknown CACHE %q", c.Cache)
+	}
+
+	switch c.APQCache {
+	case "lru", "redis":
+		if c.APQCacheSize < 1 || c.APQTTL <= 0 {
+			return errors.New("APQ_CACHE_SIZE and APQ_TTL must be positive")
+		}
+		if c.APQCache == "redis" && c.RedisURL == "" {
+			return errors.New("REDIS_URL is required when APQ_CACHE is redis")
+		}
+	default:
+		return fmt.Errorf("unknown APQ_CACHE %q", c.APQCache)
+	}
+	if c.PersistedQueriesOnly && c.PersistedQueries == "" {
+		return errors.New("PERSISTED_QUERIES_ONLY needs PERSISTED_QUERIES")
+	}
+
+	switch c.Denylist {
+	case "memory":
+	case "redis":
+		if c.RedisURL == "" {
+			return errors.New("REDIS_URL is required when DENYLIST is redis")
+		}
+	default:
+		return fmt.Errorf("unknown DENYLIST %q", c.Denylist)
+	}
+
+	switch c.MailProvider {
+	case "":
+	case "smtp", "sendgrid", "ses":
+		switch {
+		case c.MailFrom == "":
+			return errors.New("MAIL_FROM is required to send emails")
+		case c.MailProvider == "smtp" && c.SMTPURL == "":
+			return errors.New("SMTP_URL is required when MAIL_PROVIDER is smtp")
+		case c.MailProvider == "sendgrid" && c.SendGridAPIKey == "":
+			return errors.New("SENDGRID_API_KEY is required when MAIL_PROVIDER is sendgrid")
+		case c.MailProvider == "ses" && c.AWSRegion == "":
+			return errors.New("AWS_REGION is required when MAIL_PROVIDER is ses")
+		case c.MailProvider == "ses" && (c.AWSAccessKeyID == "" || c.AWSSecretAccessKey == ""):
+			return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required when MAIL_PROVIDER is ses")
+		}
+	default:
+		return fmt.Errorf("unknown MAIL_PROVIDER %q", c.MailProvider)
+	}
+
+	switch c.LoginNotifications {
+	case "all", "suspicious", "off":
+	default:
+		return fmt.Errorf("unknown LOGIN_NOTIFICATIONS %q", c.LoginNotifications)
+	}
+
+	switch c.JobQueue {
+	case "memory", "mongo":
+	case "redis":
+		if c.RedisURL == "" {
+			return errors.New("REDIS_URL is required when JOB_QUEUE is redis")
+		}
+	default:
+		return fmt.Errorf("unknown JOB_QUEUE %q", c.JobQueue)
+	}
+	if c.JobWorkers < 1 {
+		return errors.New("JOB_WORKERS must be positive")
+	}
+
+	switch c.DisposableEmails {
+	case "off", "warn", "block", "approve":
+	default:
+		return fmt.Errorf("unknown DISPOSABLE_EMAILS %q", c.DisposableEmails)
+	}
+
+	switch c.PasswordBreachCheck {
+	case "":
+	case "warn", "block":
+		if c.BreachCacheTTL <= 0 {
+			return errors.New("BREACH_CACHE_TTL must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown PASSWORD_BREACH_CHECK %q", c.PasswordBreachCheck)
+	}
+
+	switch c.EventBus {
+	case "":
+	case "nats":
+		if c.NATSURL == "" {
+			return errors.New("NATS_URL is required when EVENT_BUS is nats")
+		}
+	case "kafka":
+		if c.KafkaRESTURL == "" {
+			return errors.New("KAFKA_REST_URL is required when EVENT_BUS is kafka")
+		}
+	default:
+		return fmt.Errorf("unknown EVENT_BUS %q", c.EventBus)
+	}
+
+	return nil
+}
+
+// checkMappings validates the field=name entries of the variable key, which
+// map user fields to the attributes or claims of an identity provider
+func checkMappings(key, kind string, mappings []string) error {
+	for _, mapping := range mappings {
+		parts := strings.SplitN(mapping, "=", 2)
+		switch {
+		case len(parts) != 2 || parts[1] == "":
+			return fmt.Errorf("%s entries must be field=%s, got %q", key, kind, mapping)
+		case parts[0] != "email" && parts[0] != "username" && parts[0] != "fname" && parts[0] != "lname":
+			return fmt.Errorf("unknown %s field %q, use email, username, fname or lname", key, parts[0])
+		}
+	}
+
+	return nil
+}
+
+// RateLimit allows Limit calls of a root GraphQL field, a query or a
+// mutation, every Window for each client address ("ip") or each user
+// ("user", the address for anonymous requests)
+type RateLimit struct {
+	Field  string
+	Limit  int
+	Window time.Duration
+	Key    string
+}
+
+// ParseRateLimit parses a field=limit/window/key entry of RATE_LIMITS
+func ParseRateLimit(s string) (RateLimit, error) {
+	invalid := fmt.Errorf("RATE_LIMITS entries must be field=limit/window/key like register=5/1m/ip, got %q", s)
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return RateLimit{}, invalid
+	}
+	rule := strings.Split(parts[1], "/")
+	if len(rule) != 3 {
+		return RateLimit{}, invalid
+	}
+
+	limit, err := strconv.Atoi(rule[0])
+	if err != nil || limit < 1 {
+		return RateLimit{}, invalid
+	}
+	window, err := time.ParseDuration(rule[1])
+	if err != nil || window <= 0 {
+		return RateLimit{}, invalid
+	}
+	if rule[2] != "ip" && rule[2] != "user" {
+		return RateLimit{}, fmt.Errorf("RATE_LIMITS keys are ip or user, got %q", s)
+	}
+
+	return RateLimit{Field: parts[0], Limit: limit, Window: window, Key: rule[2]}, nil
+}
+
+// ParseNetwork parses a CIDR range, or an address standing for itself
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES entries must be addresses or CIDR ranges, got %q", s)
+	}
+	return network, nil
+}
+
+// loadSecrets fetches the signing key and Mongo URI from the SECRETS_PROVIDER, if any
+func (c *Config) loadSecrets() error {
+	switch provider := os.Getenv("SECRETS_PROVIDER"); provider {
+	case "":
+		return nil
+	case "vault":
+		c.Secrets = secrets.NewVault(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_SECRET_PATH"))
+	case "aws":
+		c.Secrets = secrets.NewAWS(os.Getenv("AWS_REGION"), os.Getenv("AWS_SECRET_ID"),
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+	default:
+		return fmt.Errorf("unknown SECRETS_PROVIDER %q", provider)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	values, err := c.Secrets.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("could not fetch secrets: %w", err)
+	}
+	c.applySecrets(values)
+
+	return nil
+}
+
+// applySecrets overrides the settings present in values, keyed by their variable name
+func (c *Config) applySecrets(values map[string]string) {
+	if uri := values["DB"]; uri != "" {
+		c.MongoURI = uri
+	}
+	if key := values["KEY"]; key != "" {
+		c.SigningKey = key
+	}
+	if key := values["PII_KEY"]; key != "" {
+		c.PIIKey = key
+	}
+	if key := values["TOKEN_ENCRYPTION_KEY"]; key != "" {
+		c.TokenEncryptionKey = key
+	}
+	if key := values["REFRESH_KEY"]; key != "" {
+		c.RefreshKey = key
+	}
+}
+
+// loader reads typed variables, keeping the first error
+type loader struct {
+	err error
+}
+
+func (l *loader) str(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return def
+}
+
+func (l *loader) list(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func (l *loader) duration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil && l.err == nil {
+		l.err = fmt.Errorf("invalid duration for %s: %w", key, err)
+	}
+
+	return d
+}
+
+func (l *loader) float(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil && l.err == nil {
+		l.err = fmt.Errorf("invalid number for %s: %w", key, err)
+	}
+
+	return f
+}
+
+func (l *loader) bool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil && l.err == nil {
+		l.err = fmt.Errorf("invalid boolean for %s: %w", key, err)
+	}
+
+	return b
+}
+
+func (l *loader) int(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil && l.err == nil {
+		l.err = fmt.Errorf("invalid number for %s: %w", key, err)
+	}
+
+	return n
+}
@@ -0,0 +1,77 @@
+package events
+
+// Publishing of user lifecycle events to a message bus so other services
+// can consume them asynchronously. The bus is fed by the audit log and
+// the transport is abstracted behind the Publisher interface.
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Publisher sends a message to a topic of a message bus
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+	Close() error
+}
+
+// Message is the JSON body published for every event
+type Message struct {
+	ID        string            `json:"id"`
+	Event     string            `json:"event"`
+	Subject   string            `json:"subject"`
+	ActorID   string            `json:"actorId,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Bus publishes audit events through a Publisher, it implements auth.EventSink
+type Bus struct {
+	publisher Publisher
+	prefix    string
+}
+
+// NewBus returns a bus publishing to topics named prefix.<event>, e.g. auth.user.registered
+func NewBus(publisher Publisher, prefix string) *Bus {
+	return &Bus{
+		publisher: publisher,
+		prefix:    prefix,
+	}
+}
+
+// Publish sends the event in the background, events without a name are skipped
+func (b *Bus) Publish(event auth.AuditEvent) {
+	name := event.Name()
+	if name == "" {
+		return
+	}
+
+	payload, err := json.Marshal(Message{
+		ID:        primitive.NewObjectID().Hex(),
+		Event:     name,
+		Subject:   event.Subject,
+		ActorID:   event.ActorID,
+		Details:   event.Details,
+		Timestamp: event.Timestamp,
+	})
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("event", name).Msg("could not encode event")
+		return
+	}
+
+	topic := b.prefix + "." + name
+	go func() {
+		if err := b.publisher.Publish(topic, payload); err != nil {
+			logging.Logger.Error().Err(err).Str("topic", topic).Msg("could not publish event")
+		}
+	}()
+}
+
+// Close releases the underlying publisher
+func (b *Bus) Close() error {
+	return b.publisher.Close()
+}
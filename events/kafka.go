@@ -0,0 +1,92 @@
+package events
+
+// Kafka publisher going through the Confluent REST Proxy (API v2) rather
+// than the Kafka protocol, which keeps the service free of a native Kafka
+// client at the cost of running the proxy next to the brokers. The proxy
+// produces the records, so acks, retries and compression are its settings.
+// See https://docs.confluent.io/platform/current/kafka-rest/api.html
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KafkaRESTPublisher produces messages to Kafka topics through a REST Proxy
+type KafkaRESTPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+// kafkaRecords is the body of a produce request
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Value json.RawMessage `json:"value"`
+}
+
+// kafkaOffsets is the answer to a produce request, records the brokers
+// refused have an error even though the request succeeded
+type kafkaOffsets struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// NewKafkaRESTPublisher returns a publisher for the REST Proxy at baseURL
+func NewKafkaRESTPublisher(baseURL string) *KafkaRESTPublisher {
+	return &KafkaRESTPublisher{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Publish produces payload, which must be JSON, to topic
+func (p *KafkaRESTPublisher) Publish(topic string, payload []byte) error {
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{{Value: payload}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("kafka rest proxy returned %s", res.Status)
+	}
+
+	var offsets kafkaOffsets
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&offsets); err != nil {
+		return fmt.Errorf("invalid answer from the kafka rest proxy: %w", err)
+	}
+	for _, offset := range offsets.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("kafka refused the record: %s (code %d)", offset.Error, *offset.ErrorCode)
+		}
+	}
+
+	return nil
+}
+
+// Close is a no-op, the REST Proxy is stateless
+func (p *KafkaRESTPublisher) Close() error {
+	return nil
+}
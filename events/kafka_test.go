@@ -0,0 +1,63 @@
+package events
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		answer  string
+		wantErr string
+	}{
+		{name: "produced", status: http.StatusOK, answer: `{"offsets":[{"partition":0,"offset":42}]}`},
+		{
+			name:    "record refused",
+			status:  http.StatusOK,
+			answer:  `{"offsets":[{"partition":null,"offset":null,"error_code":40403,"error":"Topic not found."}]}`,
+			wantErr: "Topic not found.",
+		},
+		{name: "proxy error", status: http.StatusInternalServerError, answer: `{}`, wantErr: "500"},
+		{name: "not JSON", status: http.StatusOK, answer: `<html>`, wantErr: "invalid answer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path, contentType, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path, contentType = r.URL.EscapedPath(), r.Header.Get("Content-Type")
+				raw, _ := io.ReadAll(r.Body)
+				body = string(raw)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.answer)
+			}))
+			defer server.Close()
+
+			err := NewKafkaRESTPublisher(server.URL+"/").Publish("auth.user.registered", []byte(`{"id":"1"}`))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Publish() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+
+			if path != "/topics/auth.user.registered" {
+				t.Errorf("posted to %s", path)
+			}
+			if contentType != "application/vnd.kafka.json.v2+json" {
+				t.Errorf("posted %s", contentType)
+			}
+			if want := `{"records":[{"value":{"id":"1"}}]}`; body != want {
+				t.Errorf("posted %s, want %s", body, want)
+			}
+		})
+	}
+}
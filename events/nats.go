@@ -0,0 +1,181 @@
+package events
+
+// Minimal NATS publisher speaking the core text protocol, publishing is
+// all we need so this avoids pulling the full client in.
+// See https://docs.nats.io/reference/reference-protocols/nats-protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// errNATSClosed is returned by Publish after Close
+var errNATSClosed = errors.New("nats publisher closed")
+
+// NATSPublisher publishes messages to a NATS server
+type NATSPublisher struct {
+	mu   sync.Mutex
+	addr string
+	conn net.Conn
+	w    *bufio.Writer
+	// Largest payload the server accepts, from its INFO, it drops the
+	// connection of clients sending more
+	maxPayload int
+	closed     bool
+}
+
+// natsInfo is the part of the INFO of the server read
+type natsInfo struct {
+	MaxPayload int `json:"max_payload"`
+}
+
+// DialNATS connects to the NATS server at addr, either host:port or nats://host:port
+func DialNATS(addr string) (*NATSPublisher, error) {
+	p := &NATSPublisher{addr: strings.TrimPrefix(addr, "nats://")}
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// connect opens the connection and performs the protocol handshake, callers must hold the lock
+func (p *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// The server greets us with its INFO line
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from nats server %s", p.addr)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO")), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid INFO from nats server %s", p.addr)
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprint(w, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"authService\"}\r\nPING\r\n")
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	line, err = r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "PONG") {
+		conn.Close()
+		return fmt.Errorf("nats handshake failed: %s", strings.TrimSpace(line))
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p.conn = conn
+	p.w = w
+	p.maxPayload = info.MaxPayload
+	go p.readLoop(conn, r)
+
+	return nil
+}
+
+// readLoop answers the server keep alive pings and reports protocol errors.
+// The server closes the connection after most errors, once it is gone the
+// next Publish reconnects instead of writing to it
+func (p *NATSPublisher) readLoop(conn net.Conn, r *bufio.Reader) {
+	defer func() {
+		p.mu.Lock()
+		if p.conn == conn {
+			conn.Close()
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			p.mu.Lock()
+			if p.conn == conn {
+				fmt.Fprint(p.w, "PONG\r\n")
+				p.w.Flush()
+			}
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			logging.Logger.Error().Str("error", strings.TrimSpace(line)).Msg("nats error")
+		}
+	}
+}
+
+// Publish sends payload to subject, reconnecting once if the connection was lost
+func (p *NATSPublisher) Publish(subject string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errNATSClosed
+	}
+	// The server would drop the connection rather than refuse the message
+	if p.maxPayload > 0 && len(payload) > p.maxPayload {
+		return fmt.Errorf("payload of %d bytes exceeds the nats max_payload of %d", len(payload), p.maxPayload)
+	}
+
+	if err := p.write(subject, payload); err == nil {
+		return nil
+	}
+
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	if err := p.connect(); err != nil {
+		return err
+	}
+
+	return p.write(subject, payload)
+}
+
+// write sends a PUB message, callers must hold the lock
+func (p *NATSPublisher) write(subject string, payload []byte) error {
+	if p.conn == nil {
+		return fmt.Errorf("not connected to nats")
+	}
+
+	fmt.Fprintf(p.w, "PUB %s %d\r\n", subject, len(payload))
+	p.w.Write(payload)
+	p.w.WriteString("\r\n")
+
+	return p.w.Flush()
+}
+
+// Close closes the connection to the server
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
@@ -0,0 +1,291 @@
+package events
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsServer is a NATS server speaking enough of the protocol for the
+// publisher: it greets clients with info, answers the handshake with
+// handshake and records what they publish
+type natsServer struct {
+	ln        net.Listener
+	info      string
+	handshake string
+	// Connections that completed the handshake
+	conns chan net.Conn
+	// Messages published, as "subject payload", and PONGs received
+	pubs  chan string
+	pongs chan struct{}
+}
+
+// newNATSServer starts a server, info and handshake default to those of a
+// server accepting the client
+func newNATSServer(t *testing.T, info, handshake string) *natsServer {
+	t.Helper()
+
+	if info == "" {
+		info = `INFO {"server_id":"test","max_payload":1048576}`
+	}
+	if handshake == "" {
+		handshake = "PONG"
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &natsServer{
+		ln:        ln,
+		info:      info,
+		handshake: handshake,
+		conns:     make(chan net.Conn, 10),
+		pubs:      make(chan string, 10),
+		pongs:     make(chan struct{}, 10),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+
+	return s
+}
+
+func (s *natsServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *natsServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	fmt.Fprint(conn, s.info+"\r\n")
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"CONNECT ", "PING"} {
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, want) {
+			return
+		}
+	}
+	fmt.Fprint(conn, s.handshake+"\r\n")
+	s.conns <- conn
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "PUB":
+			n, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.pubs <- fields[1] + " " + string(payload[:n])
+		case len(fields) == 1 && fields[0] == "PONG":
+			s.pongs <- struct{}{}
+		}
+	}
+}
+
+// next returns the next connection to complete the handshake
+func (s *natsServer) next(t *testing.T) net.Conn {
+	t.Helper()
+
+	select {
+	case conn := <-s.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection")
+		return nil
+	}
+}
+
+// published returns the next message published
+func (s *natsServer) published(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case pub := <-s.pubs:
+		return pub
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing published")
+		return ""
+	}
+}
+
+// waitDisconnected waits until the publisher noticed its connection is gone
+func waitDisconnected(t *testing.T, p *NATSPublisher) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		p.mu.Lock()
+		conn := p.conn
+		p.mu.Unlock()
+		if conn == nil {
+			return
+		}
+	}
+	t.Fatal("the publisher didn't notice the connection was closed")
+}
+
+func TestNATSPublish(t *testing.T) {
+	s := newNATSServer(t, "", "")
+	p, err := DialNATS("nats://" + s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	s.next(t)
+
+	if err := p.Publish("auth.user.registered", []byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.published(t), `auth.user.registered {"id":"1"}`; got != want {
+		t.Errorf("published %q, want %q", got, want)
+	}
+}
+
+func TestNATSPing(t *testing.T) {
+	s := newNATSServer(t, "", "")
+	p, err := DialNATS(s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	fmt.Fprint(s.next(t), "PING\r\n")
+	select {
+	case <-s.pongs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the publisher didn't answer the PING")
+	}
+}
+
+func TestNATSReconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		// What the server does with the first connection
+		drop func(conn net.Conn)
+	}{
+		{name: "connection closed", drop: func(conn net.Conn) { conn.Close() }},
+		{
+			name: "-ERR",
+			drop: func(conn net.Conn) {
+				fmt.Fprint(conn, "-ERR 'Stale Connection'\r\n")
+				conn.Close()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newNATSServer(t, "", "")
+			p, err := DialNATS(s.ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			tt.drop(s.next(t))
+			waitDisconnected(t, p)
+
+			if err := p.Publish("auth.user.login", []byte("{}")); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+			s.next(t)
+			if got := s.published(t); got != "auth.user.login {}" {
+				t.Errorf("published %q after reconnecting", got)
+			}
+		})
+	}
+}
+
+func TestNATSReconnectFails(t *testing.T) {
+	s := newNATSServer(t, "", "")
+	p, err := DialNATS(s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn := s.next(t)
+	s.ln.Close()
+	conn.Close()
+	waitDisconnected(t, p)
+
+	if err := p.Publish("auth.user.login", []byte("{}")); err == nil {
+		t.Error("Publish() succeeded without a server")
+	}
+}
+
+func TestNATSHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		info      string
+		handshake string
+		wantErr   string
+	}{
+		{name: "-ERR", info: `INFO {}`, handshake: "-ERR 'Authorization Violation'", wantErr: "Authorization Violation"},
+		{name: "not NATS", info: "HTTP/1.1 400 Bad Request", handshake: "PONG", wantErr: "unexpected greeting"},
+		{name: "invalid INFO", info: "INFO {", handshake: "PONG", wantErr: "invalid INFO"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newNATSServer(t, tt.info, tt.handshake)
+
+			_, err := DialNATS(s.ln.Addr().String())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("DialNATS() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNATSMaxPayload(t *testing.T) {
+	s := newNATSServer(t, `INFO {"max_payload":8}`, "")
+	p, err := DialNATS(s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	s.next(t)
+
+	if err := p.Publish("auth.user.login", []byte(`{"id":"123"}`)); err == nil {
+		t.Error("Publish() sent a payload larger than max_payload")
+	}
+	if err := p.Publish("auth.user.login", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.published(t); got != "auth.user.login {}" {
+		t.Errorf("published %q", got)
+	}
+}
+
+func TestNATSClosed(t *testing.T) {
+	s := newNATSServer(t, "", "")
+	p, err := DialNATS(s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.next(t)
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish("auth.user.login", []byte("{}")); err != errNATSClosed {
+		t.Errorf("Publish() after Close error = %v, want %v", err, errNATSClosed)
+	}
+}
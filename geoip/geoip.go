@@ -0,0 +1,89 @@
+package geoip
+
+// Approximate location of client addresses, used to tell users where a
+// login came from. Lookups go to an HTTP service answering JSON such as
+// ipapi.co, nothing is stored locally.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/tracing"
+)
+
+// Locator describes where an address is, e.g. "Toronto, Ontario, Canada"
+type Locator interface {
+	Locate(ctx context.Context, ip string) (string, error)
+}
+
+// HTTP looks addresses up with a JSON API
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTP returns a locator for the API at url, "{ip}" in it is replaced by
+// the address, e.g. "https://ipapi.co/{ip}/json/"
+func NewHTTP(url string) *HTTP {
+	return &HTTP{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// location holds the fields of the common APIs, each names them differently
+type location struct {
+	City        string `json:"city"`
+	Region      string `json:"region"`
+	RegionName  string `json:"regionName"`
+	Country     string `json:"country"`
+	CountryName string `json:"country_name"`
+}
+
+// Locate implements Locator
+func (h *HTTP) Locate(ctx context.Context, ip string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(h.url, "{ip}", url.PathEscape(ip)), nil)
+	if err != nil {
+		return "", err
+	}
+	tracing.Inject(ctx, req.Header)
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("geoip lookup answered %s", res.Status)
+	}
+
+	var loc location
+	if err := json.NewDecoder(res.Body).Decode(&loc); err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, part := range []string{loc.City, first(loc.RegionName, loc.Region), first(loc.CountryName, loc.Country)} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return strings.Join(parts, ", "), nil
+}
+
+// first returns the first non empty value
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
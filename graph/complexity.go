@@ -0,0 +1,150 @@
+package graph
+
+// Limits on what a single operation can cost, so clients can't craft
+// deeply nested queries or ask for huge pages of many fields. Each field
+// costs 1 plus its selections, paginated lists the cost of their
+// selections times the page size, and every top level mutation a fixed
+// cost on top since mutations write and often hash passwords. Introspection
+// fields are left out, they are bounded by the schema.
+
+import (
+	"context"
+	"strings"
+
+	"github.com/99designs/gqlgen/complexity"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/errcode"
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/generated"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// defaultPageSize is the page size of lists when first isn't given
+const defaultPageSize = 20
+
+// Complexity returns the cost of the fields whose cost depends on their
+// arguments
+func Complexity() generated.ComplexityRoot {
+	var c generated.ComplexityRoot
+	c.Query.Users = func(childComplexity int, first *int, after *string, filter *model.UserFilter, sort *model.UserSort) int {
+		return pageCost(childComplexity, first)
+	}
+	c.Query.SearchUsers = func(childComplexity int, search model.UserSearch, first *int, after *string) int {
+		return pageCost(childComplexity, first)
+	}
+	c.Query.AuditEvents = func(childComplexity int, first *int, after *string, filter *model.AuditEventFilter) int {
+		return pageCost(childComplexity, first)
+	}
+	return c
+}
+
+// pageCost is the cost of a page of first items with the given cost each
+func pageCost(childComplexity int, first *int) int {
+	size := defaultPageSize
+	if first != nil && *first > 0 {
+		size = *first
+	}
+	return 1 + size*childComplexity
+}
+
+// Limits is a gqlgen extension rejecting operations that are too costly or
+// nested too deeply, zero disables a limit
+type Limits struct {
+	MaxComplexity int
+	MaxDepth      int
+	// Cost added for each top level mutation
+	MutationCost int
+
+	schema graphql.ExecutableSchema
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+} = &Limits{}
+
+// NewLimits returns the limits of MAX_QUERY_COMPLEXITY, MAX_QUERY_DEPTH and
+// MUTATION_COST
+func NewLimits(cfg *config.Config) *Limits {
+	return &Limits{MaxComplexity: cfg.MaxQueryComplexity, MaxDepth: cfg.MaxQueryDepth, MutationCost: cfg.MutationCost}
+}
+
+// ExtensionName identifies the extension in gqlgen
+func (l *Limits) ExtensionName() string {
+	return "Limits"
+}
+
+// Validate keeps the schema, the cost of fields depends on it
+func (l *Limits) Validate(schema graphql.ExecutableSchema) error {
+	l.schema = schema
+	return nil
+}
+
+// MutateOperationContext rejects the operation when it exceeds a limit
+func (l *Limits) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	op := rc.Doc.Operations.ForName(rc.OperationName)
+	if op == nil {
+		return nil
+	}
+	selections := withoutIntrospection(op.SelectionSet)
+
+	if depth := selectionDepth(selections); l.MaxDepth > 0 && depth > l.MaxDepth {
+		return limitError(auth.CodeDepthLimit, "Operation is nested %d levels deep, the limit is %d.", depth, l.MaxDepth)
+	}
+
+	cost := complexity.Calculate(l.schema, &ast.OperationDefinition{Operation: op.Operation, SelectionSet: selections}, rc.Variables)
+	if op.Operation == ast.Mutation {
+		cost += l.MutationCost * len(graphql.CollectFields(rc, selections, nil))
+	}
+	if l.MaxComplexity > 0 && cost > l.MaxComplexity {
+		return limitError(auth.CodeComplexityLimit, "Operation has complexity %d, the limit is %d.", cost, l.MaxComplexity)
+	}
+
+	return nil
+}
+
+// limitError returns the error of an exceeded limit. Operations are
+// rejected before the error presenter runs, so the code is set here
+func limitError(code auth.ErrorCode, format string, args ...interface{}) *gqlerror.Error {
+	err := gqlerror.Errorf(format, args...)
+	errcode.Set(err, string(code))
+	return err
+}
+
+// withoutIntrospection drops the top level introspection fields
+func withoutIntrospection(selections ast.SelectionSet) ast.SelectionSet {
+	var kept ast.SelectionSet
+	for _, selection := range selections {
+		if field, ok := selection.(*ast.Field); ok && strings.HasPrefix(field.Name, "__") {
+			continue
+		}
+		kept = append(kept, selection)
+	}
+	return kept
+}
+
+// selectionDepth returns how many levels of fields selections nest,
+// fragments don't add a level
+func selectionDepth(selections ast.SelectionSet) int {
+	depth := 0
+	for _, selection := range selections {
+		var d int
+		switch s := selection.(type) {
+		case *ast.Field:
+			d = 1 + selectionDepth(s.SelectionSet)
+		case *ast.InlineFragment:
+			d = selectionDepth(s.SelectionSet)
+		case *ast.FragmentSpread:
+			if s.Definition != nil {
+				d = selectionDepth(s.Definition.SelectionSet)
+			}
+		}
+		if d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
@@ -0,0 +1,69 @@
+package graph
+
+// Cookie delivery of tokens with COOKIE_AUTH, see auth.SetTokenCookie.
+// Mutations returning tokens answer an empty jwt and no refreshToken nor
+// deviceToken once they are in cookies, so scripts of the page never see
+// them, and logouts clear them but the device cookie.
+
+import (
+	"context"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
+// TokenCookies is a gqlgen extension moving the tokens mutations return
+// into cookies
+type TokenCookies struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.FieldInterceptor
+} = TokenCookies{}
+
+// ExtensionName identifies the extension in gqlgen
+func (TokenCookies) ExtensionName() string {
+	return "TokenCookies"
+}
+
+// Validate accepts any schema
+func (TokenCookies) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// InterceptField sets the cookies of top level mutations
+func (TokenCookies) InterceptField(ctx context.Context, next graphql.Resolver) (interface{}, error) {
+	res, err := next(ctx)
+	fc := graphql.GetFieldContext(ctx)
+	if err != nil || fc == nil || fc.Object != "Mutation" {
+		return res, err
+	}
+
+	switch value := res.(type) {
+	case *model.Token:
+		// Impersonation tokens would replace the session of the administrator
+		if value == nil || fc.Field.Name == "impersonate" || value.Jwt == "" {
+			break
+		}
+		var refresh string
+		if value.RefreshToken != nil {
+			refresh = *value.RefreshToken
+		}
+		if auth.SetTokenCookie(ctx, value.Jwt, refresh) {
+			token := *value
+			token.Jwt = ""
+			token.RefreshToken = nil
+			if value.DeviceToken != nil && auth.SetDeviceCookie(ctx, *value.DeviceToken) {
+				token.DeviceToken = nil
+			}
+			return &token, nil
+		}
+	case bool:
+		if value && (fc.Field.Name == "logout" || fc.Field.Name == "logoutAllDevices") {
+			auth.ClearTokenCookie(ctx)
+		}
+	}
+
+	return res, err
+}
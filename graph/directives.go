@@ -0,0 +1,59 @@
+package graph
+
+import (
+	"context"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
+// HasRole implements the @hasRole directive, only users holding role can resolve the field
+func HasRole(ctx context.Context, obj interface{}, next graphql.Resolver, role model.Role) (interface{}, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+	if !hasRole(user, role) {
+		return nil, auth.Errorf(auth.CodeForbidden, "Access denied.")
+	}
+
+	return next(ctx)
+}
+
+// RecentAuth returns the implementation of the @recentAuth directive, the user
+// must have entered their password within maxAge minutes, defaultMaxAge when unset
+func RecentAuth(defaultMaxAge time.Duration) func(ctx context.Context, obj interface{}, next graphql.Resolver, maxAge *int) (interface{}, error) {
+	return func(ctx context.Context, obj interface{}, next graphql.Resolver, maxAge *int) (interface{}, error) {
+		claims := auth.ClaimsForContext(ctx)
+		if claims == nil {
+			return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+		}
+		// Impersonation tokens are issued without the password of the user
+		if claims.Actor != "" {
+			return nil, auth.Errorf(auth.CodeForbidden, "Not allowed while impersonating.")
+		}
+
+		limit := defaultMaxAge
+		if maxAge != nil {
+			limit = time.Duration(*maxAge) * time.Minute
+		}
+		if time.Since(claims.AuthTime) > limit {
+			return nil, auth.Errorf(auth.CodeReauthRequired, "Recent authentication required, use reauthenticate.")
+		}
+
+		return next(ctx)
+	}
+}
+
+// hasRole reports whether user holds role
+func hasRole(user *model.User, role model.Role) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
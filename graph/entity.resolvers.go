@@ -0,0 +1,30 @@
+package graph
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+
+import (
+	"context"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/generated"
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
+func (r *entityResolver) FindUserByID(ctx context.Context, id string) (*model.User, error) {
+	// Entities carry the email and roles, only admins and the user itself may resolve them
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+	if user.ID != id && !hasRole(user, model.RoleAdmin) {
+		return nil, auth.Errorf(auth.CodeForbidden, "Access denied.")
+	}
+
+	return r.store.GetUser(ctx, id)
+}
+
+// Entity returns generated.EntityResolver implementation.
+func (r *Resolver) Entity() generated.EntityResolver { return &entityResolver{r} }
+
+type entityResolver struct{ *Resolver }
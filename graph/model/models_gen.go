@@ -2,9 +2,198 @@
 
 package model
 
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+type AccountDeletion struct {
+	ID      string    `json:"_id"`
+	PurgeAt time.Time `json:"purgeAt"`
+}
+
+type APIKey struct {
+	ID         string     `json:"_id"`
+	ClientID   string     `json:"clientId"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type APIKeyCredentials struct {
+	APIKey *APIKey `json:"apiKey"`
+	Key    string  `json:"key"`
+}
+
+type APIKeyInput struct {
+	ClientID  string   `json:"clientId"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn *int     `json:"expiresIn"`
+}
+
+type ApplicationGrant struct {
+	Client    *OAuthClient `json:"client"`
+	Scopes    []string     `json:"scopes"`
+	GrantedAt time.Time    `json:"grantedAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+type AuditDetail struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type AuditEvent struct {
+	ID        string         `json:"_id"`
+	Type      AuditEventType `json:"type"`
+	ActorID   string         `json:"actorId"`
+	Subject   string         `json:"subject"`
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"userAgent"`
+	Details   []*AuditDetail `json:"details"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+type AuditEventConnection struct {
+	Edges    []*AuditEventEdge `json:"edges"`
+	PageInfo *PageInfo         `json:"pageInfo"`
+}
+
+type AuditEventEdge struct {
+	Cursor string      `json:"cursor"`
+	Node   *AuditEvent `json:"node"`
+}
+
+type AuditEventFilter struct {
+	User *string         `json:"user"`
+	Type *AuditEventType `json:"type"`
+	From *time.Time      `json:"from"`
+	To   *time.Time      `json:"to"`
+}
+
 type Authenticate struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email          string  `json:"email"`
+	Password       string  `json:"password"`
+	Org            *string `json:"org"`
+	Otp            *string `json:"otp"`
+	RememberDevice *bool   `json:"rememberDevice"`
+	DeviceToken    *string `json:"deviceToken"`
+}
+
+type AuthorizationRequest struct {
+	ID              string       `json:"_id"`
+	Client          *OAuthClient `json:"client"`
+	Scope           string       `json:"scope"`
+	Scopes          []string     `json:"scopes"`
+	GrantedScopes   []string     `json:"grantedScopes"`
+	ConsentRequired bool         `json:"consentRequired"`
+	ExpiresAt       time.Time    `json:"expiresAt"`
+}
+
+type ChangePasswordInput struct {
+	Email           string  `json:"email"`
+	Password        string  `json:"password"`
+	Org             *string `json:"org"`
+	NewPassword     string  `json:"newPassword"`
+	ConfirmPassword string  `json:"confirmPassword"`
+	Otp             *string `json:"otp"`
+	DeviceToken     *string `json:"deviceToken"`
+}
+
+type Consent struct {
+	Document   ConsentDocument `json:"document"`
+	Version    string          `json:"version"`
+	AcceptedAt time.Time       `json:"acceptedAt"`
+}
+
+type DataExport struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type Invitation struct {
+	ID        string    `json:"_id"`
+	OrgID     string    `json:"orgId"`
+	Email     string    `json:"email"`
+	Role      OrgRole   `json:"role"`
+	InvitedBy string    `json:"invitedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type LinkedIdentity struct {
+	Provider string    `json:"provider"`
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+type Member struct {
+	User     *User     `json:"user"`
+	Role     OrgRole   `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+type OAuthClient struct {
+	ID                   string      `json:"_id"`
+	Name                 string      `json:"name"`
+	RedirectUris         []string    `json:"redirectUris"`
+	Public               bool        `json:"public"`
+	Service              bool        `json:"service"`
+	GrantTypes           []GrantType `json:"grantTypes"`
+	Scopes               []string    `json:"scopes"`
+	AccessTokenLifetime  *int        `json:"accessTokenLifetime"`
+	RefreshTokenLifetime *int        `json:"refreshTokenLifetime"`
+	CreatedAt            time.Time   `json:"createdAt"`
+}
+
+type OAuthClientCredentials struct {
+	Client *OAuthClient `json:"client"`
+	Secret *string      `json:"secret"`
+}
+
+type OAuthClientInput struct {
+	Name                 string      `json:"name"`
+	RedirectUris         []string    `json:"redirectUris"`
+	Public               *bool       `json:"public"`
+	GrantTypes           []GrantType `json:"grantTypes"`
+	Scopes               []string    `json:"scopes"`
+	AccessTokenLifetime  *int        `json:"accessTokenLifetime"`
+	RefreshTokenLifetime *int        `json:"refreshTokenLifetime"`
+}
+
+type OAuthClientUpdate struct {
+	Name                 *string     `json:"name"`
+	RedirectUris         []string    `json:"redirectUris"`
+	GrantTypes           []GrantType `json:"grantTypes"`
+	Scopes               []string    `json:"scopes"`
+	AccessTokenLifetime  *int        `json:"accessTokenLifetime"`
+	RefreshTokenLifetime *int        `json:"refreshTokenLifetime"`
+}
+
+type Organization struct {
+	ID          string    `json:"_id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Members     []*User   `json:"members"`
+	Memberships []*Member `json:"memberships"`
+}
+
+type OrganizationInput struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+type PageInfo struct {
+	HasNextPage bool    `json:"hasNextPage"`
+	EndCursor   *string `json:"endCursor"`
 }
 
 type RefreshToken struct {
@@ -12,19 +201,510 @@ type RefreshToken struct {
 }
 
 type RegisterInput struct {
-	Fname           string `json:"fname"`
-	Lname           string `json:"lname"`
-	Email           string `json:"email"`
-	Username        string `json:"username"`
-	Password        string `json:"password"`
-	ConfirmPassword string `json:"confirmPassword"`
+	Fname           string  `json:"fname"`
+	Lname           string  `json:"lname"`
+	Email           string  `json:"email"`
+	Username        string  `json:"username"`
+	Password        string  `json:"password"`
+	ConfirmPassword string  `json:"confirmPassword"`
+	Locale          *string `json:"locale"`
+	AcceptTerms     *bool   `json:"acceptTerms"`
+	Org             *string `json:"org"`
+	InviteToken     *string `json:"inviteToken"`
+}
+
+type ScimToken struct {
+	ID          string     `json:"_id"`
+	OrgID       string     `json:"orgId"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+}
+
+type ServiceClientInput struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+type Terms struct {
+	TermsOfService *string `json:"termsOfService"`
+	PrivacyPolicy  *string `json:"privacyPolicy"`
 }
 
 type Token struct {
-	Jwt string `json:"jwt"`
+	Jwt          string  `json:"jwt"`
+	RefreshToken *string `json:"refreshToken"`
+	ExpiresIn    *int    `json:"expiresIn"`
+	DeviceToken  *string `json:"deviceToken"`
+}
+
+type TrustedDevice struct {
+	ID        string    `json:"id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type UpdateUserInput struct {
+	Fname    *string `json:"fname"`
+	Lname    *string `json:"lname"`
+	Email    *string `json:"email"`
+	Username *string `json:"username"`
+	Verified *bool   `json:"verified"`
+	Locale   *string `json:"locale"`
 }
 
 type User struct {
-	ID       string `json:"_id"`
-	Username string `json:"username"`
+	ID                 string              `json:"_id"`
+	Username           string              `json:"username"`
+	Fname              string              `json:"fname"`
+	Lname              string              `json:"lname"`
+	Email              string              `json:"email"`
+	Roles              []Role              `json:"roles"`
+	Disabled           bool                `json:"disabled"`
+	MustResetPassword  bool                `json:"mustResetPassword"`
+	PendingApproval    bool                `json:"pendingApproval"`
+	Verified           bool                `json:"verified"`
+	CreatedAt          time.Time           `json:"createdAt"`
+	LoginNotifications *LoginNotifications `json:"loginNotifications"`
+	Locale             *string             `json:"locale"`
+	ErasedAt           *time.Time          `json:"erasedAt"`
+	Consents           []*Consent          `json:"consents"`
+	OrgID              *string             `json:"orgId"`
+	Identities         []*LinkedIdentity   `json:"identities"`
+	TwoFactorEnabled   bool                `json:"twoFactorEnabled"`
+}
+
+func (User) IsEntity() {}
+
+type UserConnection struct {
+	Edges    []*UserEdge `json:"edges"`
+	PageInfo *PageInfo   `json:"pageInfo"`
+}
+
+type UserEdge struct {
+	Cursor string `json:"cursor"`
+	Node   *User  `json:"node"`
+}
+
+type UserFilter struct {
+	Disabled *bool `json:"disabled"`
+	Role     *Role `json:"role"`
+}
+
+type UserSearch struct {
+	Query         string     `json:"query"`
+	Mode          *MatchMode `json:"mode"`
+	CreatedAfter  *time.Time `json:"createdAfter"`
+	CreatedBefore *time.Time `json:"createdBefore"`
+	Verified      *bool      `json:"verified"`
+	Roles         []Role     `json:"roles"`
+}
+
+type AuditEventType string
+
+const (
+	AuditEventTypeRegister             AuditEventType = "REGISTER"
+	AuditEventTypeLoginSuccess         AuditEventType = "LOGIN_SUCCESS"
+	AuditEventTypeLoginFailure         AuditEventType = "LOGIN_FAILURE"
+	AuditEventTypeTokenRefresh         AuditEventType = "TOKEN_REFRESH"
+	AuditEventTypePasswordChange       AuditEventType = "PASSWORD_CHANGE"
+	AuditEventTypeAccountDeletion      AuditEventType = "ACCOUNT_DELETION"
+	AuditEventTypeAccountRestored      AuditEventType = "ACCOUNT_RESTORED"
+	AuditEventTypeAdminAction          AuditEventType = "ADMIN_ACTION"
+	AuditEventTypeLogout               AuditEventType = "LOGOUT"
+	AuditEventTypeNewDevice            AuditEventType = "NEW_DEVICE"
+	AuditEventTypeReauthenticate       AuditEventType = "REAUTHENTICATE"
+	AuditEventTypeLoginReported        AuditEventType = "LOGIN_REPORTED"
+	AuditEventTypeDataExport           AuditEventType = "DATA_EXPORT"
+	AuditEventTypeUserErased           AuditEventType = "USER_ERASED"
+	AuditEventTypeTermsAccepted        AuditEventType = "TERMS_ACCEPTED"
+	AuditEventTypeMemberInvited        AuditEventType = "MEMBER_INVITED"
+	AuditEventTypeInvitationRevoked    AuditEventType = "INVITATION_REVOKED"
+	AuditEventTypeInvitationAccepted   AuditEventType = "INVITATION_ACCEPTED"
+	AuditEventTypeMemberRoleChanged    AuditEventType = "MEMBER_ROLE_CHANGED"
+	AuditEventTypeMemberRemoved        AuditEventType = "MEMBER_REMOVED"
+	AuditEventTypeOrgKeyRotated        AuditEventType = "ORG_KEY_ROTATED"
+	AuditEventTypeProvisioning         AuditEventType = "PROVISIONING"
+	AuditEventTypeAccountLinked        AuditEventType = "ACCOUNT_LINKED"
+	AuditEventTypeAccountUnlinked      AuditEventType = "ACCOUNT_UNLINKED"
+	AuditEventTypeClientAuthorized     AuditEventType = "CLIENT_AUTHORIZED"
+	AuditEventTypeClientRevoked        AuditEventType = "CLIENT_REVOKED"
+	AuditEventTypeImpersonation        AuditEventType = "IMPERSONATION"
+	AuditEventTypeTokenReuse           AuditEventType = "TOKEN_REUSE"
+	AuditEventTypeMfaEnabled           AuditEventType = "MFA_ENABLED"
+	AuditEventTypeMfaDisabled          AuditEventType = "MFA_DISABLED"
+	AuditEventTypeTrustedDeviceRevoked AuditEventType = "TRUSTED_DEVICE_REVOKED"
+)
+
+var AllAuditEventType = []AuditEventType{
+	AuditEventTypeRegister,
+	AuditEventTypeLoginSuccess,
+	AuditEventTypeLoginFailure,
+	AuditEventTypeTokenRefresh,
+	AuditEventTypePasswordChange,
+	AuditEventTypeAccountDeletion,
+	AuditEventTypeAccountRestored,
+	AuditEventTypeAdminAction,
+	AuditEventTypeLogout,
+	AuditEventTypeNewDevice,
+	AuditEventTypeReauthenticate,
+	AuditEventTypeLoginReported,
+	AuditEventTypeDataExport,
+	AuditEventTypeUserErased,
+	AuditEventTypeTermsAccepted,
+	AuditEventTypeMemberInvited,
+	AuditEventTypeInvitationRevoked,
+	AuditEventTypeInvitationAccepted,
+	AuditEventTypeMemberRoleChanged,
+	AuditEventTypeMemberRemoved,
+	AuditEventTypeOrgKeyRotated,
+	AuditEventTypeProvisioning,
+	AuditEventTypeAccountLinked,
+	AuditEventTypeAccountUnlinked,
+	AuditEventTypeClientAuthorized,
+	AuditEventTypeClientRevoked,
+	AuditEventTypeImpersonation,
+	AuditEventTypeTokenReuse,
+	AuditEventTypeMfaEnabled,
+	AuditEventTypeMfaDisabled,
+	AuditEventTypeTrustedDeviceRevoked,
+}
+
+func (e AuditEventType) IsValid() bool {
+	switch e {
+	case AuditEventTypeRegister, AuditEventTypeLoginSuccess, AuditEventTypeLoginFailure, AuditEventTypeTokenRefresh, AuditEventTypePasswordChange, AuditEventTypeAccountDeletion, AuditEventTypeAccountRestored, AuditEventTypeAdminAction, AuditEventTypeLogout, AuditEventTypeNewDevice, AuditEventTypeReauthenticate, AuditEventTypeLoginReported, AuditEventTypeDataExport, AuditEventTypeUserErased, AuditEventTypeTermsAccepted, AuditEventTypeMemberInvited, AuditEventTypeInvitationRevoked, AuditEventTypeInvitationAccepted, AuditEventTypeMemberRoleChanged, AuditEventTypeMemberRemoved, AuditEventTypeOrgKeyRotated, AuditEventTypeProvisioning, AuditEventTypeAccountLinked, AuditEventTypeAccountUnlinked, AuditEventTypeClientAuthorized, AuditEventTypeClientRevoked, AuditEventTypeImpersonation, AuditEventTypeTokenReuse, AuditEventTypeMfaEnabled, AuditEventTypeMfaDisabled, AuditEventTypeTrustedDeviceRevoked:
+		return true
+	}
+	return false
+}
+
+func (e AuditEventType) String() string {
+	return string(e)
+}
+
+func (e *AuditEventType) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = AuditEventType(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid AuditEventType", str)
+	}
+	return nil
+}
+
+func (e AuditEventType) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ConsentDocument string
+
+const (
+	ConsentDocumentTermsOfService ConsentDocument = "TERMS_OF_SERVICE"
+	ConsentDocumentPrivacyPolicy  ConsentDocument = "PRIVACY_POLICY"
+)
+
+var AllConsentDocument = []ConsentDocument{
+	ConsentDocumentTermsOfService,
+	ConsentDocumentPrivacyPolicy,
+}
+
+func (e ConsentDocument) IsValid() bool {
+	switch e {
+	case ConsentDocumentTermsOfService, ConsentDocumentPrivacyPolicy:
+		return true
+	}
+	return false
+}
+
+func (e ConsentDocument) String() string {
+	return string(e)
+}
+
+func (e *ConsentDocument) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ConsentDocument(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ConsentDocument", str)
+	}
+	return nil
+}
+
+func (e ConsentDocument) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type GrantType string
+
+const (
+	GrantTypeAuthorizationCode GrantType = "AUTHORIZATION_CODE"
+	GrantTypeRefreshToken      GrantType = "REFRESH_TOKEN"
+	GrantTypeClientCredentials GrantType = "CLIENT_CREDENTIALS"
+)
+
+var AllGrantType = []GrantType{
+	GrantTypeAuthorizationCode,
+	GrantTypeRefreshToken,
+	GrantTypeClientCredentials,
+}
+
+func (e GrantType) IsValid() bool {
+	switch e {
+	case GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials:
+		return true
+	}
+	return false
+}
+
+func (e GrantType) String() string {
+	return string(e)
+}
+
+func (e *GrantType) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = GrantType(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid GrantType", str)
+	}
+	return nil
+}
+
+func (e GrantType) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type LoginNotifications string
+
+const (
+	LoginNotificationsAll        LoginNotifications = "ALL"
+	LoginNotificationsSuspicious LoginNotifications = "SUSPICIOUS"
+	LoginNotificationsOff        LoginNotifications = "OFF"
+)
+
+var AllLoginNotifications = []LoginNotifications{
+	LoginNotificationsAll,
+	LoginNotificationsSuspicious,
+	LoginNotificationsOff,
+}
+
+func (e LoginNotifications) IsValid() bool {
+	switch e {
+	case LoginNotificationsAll, LoginNotificationsSuspicious, LoginNotificationsOff:
+		return true
+	}
+	return false
+}
+
+func (e LoginNotifications) String() string {
+	return string(e)
+}
+
+func (e *LoginNotifications) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = LoginNotifications(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid LoginNotifications", str)
+	}
+	return nil
+}
+
+func (e LoginNotifications) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type MatchMode string
+
+const (
+	MatchModePrefix    MatchMode = "PREFIX"
+	MatchModeSubstring MatchMode = "SUBSTRING"
+)
+
+var AllMatchMode = []MatchMode{
+	MatchModePrefix,
+	MatchModeSubstring,
+}
+
+func (e MatchMode) IsValid() bool {
+	switch e {
+	case MatchModePrefix, MatchModeSubstring:
+		return true
+	}
+	return false
+}
+
+func (e MatchMode) String() string {
+	return string(e)
+}
+
+func (e *MatchMode) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = MatchMode(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid MatchMode", str)
+	}
+	return nil
+}
+
+func (e MatchMode) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type OrgRole string
+
+const (
+	OrgRoleOwner  OrgRole = "OWNER"
+	OrgRoleAdmin  OrgRole = "ADMIN"
+	OrgRoleMember OrgRole = "MEMBER"
+)
+
+var AllOrgRole = []OrgRole{
+	OrgRoleOwner,
+	OrgRoleAdmin,
+	OrgRoleMember,
+}
+
+func (e OrgRole) IsValid() bool {
+	switch e {
+	case OrgRoleOwner, OrgRoleAdmin, OrgRoleMember:
+		return true
+	}
+	return false
+}
+
+func (e OrgRole) String() string {
+	return string(e)
+}
+
+func (e *OrgRole) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = OrgRole(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid OrgRole", str)
+	}
+	return nil
+}
+
+func (e OrgRole) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type Role string
+
+const (
+	RoleAdmin Role = "ADMIN"
+	RoleUser  Role = "USER"
+)
+
+var AllRole = []Role{
+	RoleAdmin,
+	RoleUser,
+}
+
+func (e Role) IsValid() bool {
+	switch e {
+	case RoleAdmin, RoleUser:
+		return true
+	}
+	return false
+}
+
+func (e Role) String() string {
+	return string(e)
+}
+
+func (e *Role) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Role(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Role", str)
+	}
+	return nil
+}
+
+func (e Role) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type UserSort string
+
+const (
+	UserSortIDAsc  UserSort = "ID_ASC"
+	UserSortIDDesc UserSort = "ID_DESC"
+)
+
+var AllUserSort = []UserSort{
+	UserSortIDAsc,
+	UserSortIDDesc,
+}
+
+func (e UserSort) IsValid() bool {
+	switch e {
+	case UserSortIDAsc, UserSortIDDesc:
+		return true
+	}
+	return false
+}
+
+func (e UserSort) String() string {
+	return string(e)
+}
+
+func (e *UserSort) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = UserSort(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid UserSort", str)
+	}
+	return nil
+}
+
+func (e UserSort) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
 }
@@ -0,0 +1,155 @@
+package graph
+
+// Persisted queries, so clients such as mobile apps send the SHA-256 of a
+// query instead of the whole document. Automatic persisted queries (APQ)
+// learn the query the first time a client sends it along with its hash,
+// and keep it in process or in Redis, shared between instances. Queries can
+// also be known ahead from a manifest, which in production can be the only
+// queries allowed to run.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/cache"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// QueryCache keeps persisted queries in a cache.Cache, errors are misses
+type QueryCache struct {
+	cache cache.Cache
+	ttl   time.Duration
+}
+
+// Get returns the query of hash
+func (c *QueryCache) Get(ctx context.Context, hash string) (interface{}, bool) {
+	query, ok, err := c.cache.Get(ctx, "apq:"+hash)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return string(query), true
+}
+
+// Add persists query under hash
+func (c *QueryCache) Add(ctx context.Context, hash string, query interface{}) {
+	c.cache.Set(ctx, "apq:"+hash, []byte(query.(string)), c.ttl)
+}
+
+// manifestCache looks queries up in the manifest, then in next. Clients
+// only persist queries in next, nil when the manifest is all there is
+type manifestCache struct {
+	manifest map[string]string
+	next     graphql.Cache
+}
+
+func (c *manifestCache) Get(ctx context.Context, hash string) (interface{}, bool) {
+	if query, ok := c.manifest[hash]; ok {
+		return query, true
+	}
+	if c.next == nil {
+		return nil, false
+	}
+	return c.next.Get(ctx, hash)
+}
+
+func (c *manifestCache) Add(ctx context.Context, hash string, query interface{}) {
+	if c.next != nil {
+		c.next.Add(ctx, hash, query)
+	}
+}
+
+// PersistedQueries is a gqlgen extension resolving the hashes of persisted
+// queries, and with only rejecting the queries missing from the manifest
+type PersistedQueries struct {
+	apq      extension.AutomaticPersistedQuery
+	manifest map[string]string
+	only     bool
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationParameterMutator
+} = &PersistedQueries{}
+
+// NewPersistedQueries returns the persisted queries of APQ_CACHE and
+// PERSISTED_QUERIES, redis is the connection of REDIS_URL
+func NewPersistedQueries(cfg *config.Config, redis *cache.Redis) (*PersistedQueries, error) {
+	p := &PersistedQueries{only: cfg.PersistedQueriesOnly}
+	if cfg.PersistedQueries != "" {
+		manifest, err := LoadManifest(cfg.PersistedQueries)
+		if err != nil {
+			return nil, err
+		}
+		p.manifest = manifest
+	}
+
+	c := &manifestCache{manifest: p.manifest}
+	if !p.only {
+		var store cache.Cache = cache.NewLRU(cfg.APQCacheSize)
+		if cfg.APQCache == "redis" {
+			store = redis
+		}
+		c.next = &QueryCache{cache: store, ttl: cfg.APQTTL}
+	}
+	p.apq = extension.AutomaticPersistedQuery{Cache: c}
+
+	return p, nil
+}
+
+// LoadManifest parses a JSON object mapping the SHA-256 of queries, in hex,
+// to the queries
+func LoadManifest(path string) (map[string]string, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(src, &manifest); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+
+	for hash, query := range manifest {
+		if queryHash(query) != hash {
+			return nil, fmt.Errorf("manifest %s: %s isn't the hash of its query", path, hash)
+		}
+	}
+	return manifest, nil
+}
+
+// ExtensionName identifies the extension in gqlgen
+func (p *PersistedQueries) ExtensionName() string {
+	return "PersistedQueries"
+}
+
+// Validate checks the extension can run
+func (p *PersistedQueries) Validate(schema graphql.ExecutableSchema) error {
+	return p.apq.Validate(schema)
+}
+
+// MutateOperationParameters replaces the hash of a persisted query by the
+// query, then rejects queries that aren't allowed
+func (p *PersistedQueries) MutateOperationParameters(ctx context.Context, rawParams *graphql.RawParams) *gqlerror.Error {
+	if err := p.apq.MutateOperationParameters(ctx, rawParams); err != nil {
+		return err
+	}
+
+	if _, ok := p.manifest[queryHash(rawParams.Query)]; p.only && !ok {
+		return limitError(auth.CodeQueryNotAllowed, "Only persisted queries are allowed.")
+	}
+	return nil
+}
+
+// queryHash returns the SHA-256 of query in hex, as clients compute it
+func queryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,115 @@
+package graph
+
+// Rate limits of GraphQL operations, declared per root field in
+// RATE_LIMITS, so abuse of costly or sensitive operations such as register
+// is cut off for each client address or user. Limits are kept in process,
+// each instance enforces them on its own.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// rateRule is a limit of RATE_LIMITS with its counters
+type rateRule struct {
+	config.RateLimit
+	limiter *auth.RateLimiter
+}
+
+// RateLimits is a gqlgen extension rejecting operations whose root fields
+// were called too often by the client
+type RateLimits struct {
+	rules map[string][]*rateRule
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+} = &RateLimits{}
+
+// NewRateLimits returns the limits of RATE_LIMITS
+func NewRateLimits(cfg *config.Config) (*RateLimits, error) {
+	l := &RateLimits{rules: map[string][]*rateRule{}}
+	for _, entry := range cfg.RateLimits {
+		limit, err := config.ParseRateLimit(entry)
+		if err != nil {
+			return nil, err
+		}
+		l.rules[limit.Field] = append(l.rules[limit.Field], &rateRule{limit, auth.NewRateLimiter(limit.Limit, limit.Window)})
+	}
+
+	return l, nil
+}
+
+// Sweepers returns the counters to sweep
+func (l *RateLimits) Sweepers() []auth.Sweeper {
+	var sweepers []auth.Sweeper
+	for _, rules := range l.rules {
+		for _, rule := range rules {
+			sweepers = append(sweepers, rule.limiter)
+		}
+	}
+	return sweepers
+}
+
+// ExtensionName identifies the extension in gqlgen
+func (l *RateLimits) ExtensionName() string {
+	return "RateLimits"
+}
+
+// Validate checks the limited fields are queries or mutations, so typos
+// don't go unnoticed
+func (l *RateLimits) Validate(schema graphql.ExecutableSchema) error {
+	s := schema.Schema()
+	for field := range l.rules {
+		if s.Query.Fields.ForName(field) == nil && (s.Mutation == nil || s.Mutation.Fields.ForName(field) == nil) {
+			return fmt.Errorf("RATE_LIMITS: no query or mutation %s", field)
+		}
+	}
+	return nil
+}
+
+// MutateOperationContext counts the calls of the root fields of the
+// operation, and rejects it when one is over its limit
+func (l *RateLimits) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	op := rc.Doc.Operations.ForName(rc.OperationName)
+	if op == nil || len(l.rules) == 0 {
+		return nil
+	}
+
+	root := "Query"
+	if op.Operation == ast.Mutation {
+		root = "Mutation"
+	}
+	for _, field := range graphql.CollectFields(rc, op.SelectionSet, []string{root}) {
+		for _, rule := range l.rules[field.Name] {
+			if !rule.limiter.Allow(rateKey(ctx, rule.Key)) {
+				return limitError(auth.CodeRateLimited, "Too many %s requests, try again later.", field.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// rateKey returns who a limit of the given key counts the calls of
+func rateKey(ctx context.Context, key string) string {
+	if key == "user" {
+		if claims := auth.ClaimsForContext(ctx); claims != nil && claims.UserID != "" {
+			return "user:" + claims.UserID
+		}
+		// Service clients and API keys have no user
+		if claims := auth.APIKeyForContext(ctx); claims != nil {
+			return "client:" + claims.ClientID
+		}
+		if claims := auth.ClaimsForContext(ctx); claims != nil && claims.ClientID != "" {
+			return "client:" + claims.ClientID
+		}
+	}
+	return "ip:" + auth.IPForContext(ctx)
+}
@@ -1,7 +1,137 @@
 package graph
 
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
 // This file will not be regenerated automatically.
 //
 // It serves as dependency injection for your app, add any dependencies you require here.
 
-type Resolver struct{}
+// UserStore is the storage the resolvers depend on, implemented by auth.DB
+type UserStore interface {
+	RegisterUser(ctx context.Context, input *model.RegisterInput) (*model.Token, error)
+	AuthenticateUser(ctx context.Context, auth *model.Authenticate) (*model.Token, error)
+	RefreshUserToken(ctx context.Context, token *model.RefreshToken) (*model.Token, error)
+	ScheduleDeletion(ctx context.Context, id string) (*model.AccountDeletion, error)
+	CancelDeletion(ctx context.Context, auth *model.Authenticate) (*model.Token, error)
+	AcceptTerms(ctx context.Context, auth *model.Authenticate) (*model.Token, error)
+	CurrentTerms() *model.Terms
+	ChangePassword(ctx context.Context, input *model.ChangePasswordInput) (*model.Token, error)
+	UsernameAvailable(ctx context.Context, username string, org *string) (bool, error)
+	VerifyToken(ctx context.Context, tokenString string) (*auth.Claims, error)
+	RevokeToken(ctx context.Context, claims *auth.Claims) error
+	RevokeTokenString(ctx context.Context, tokenString string) error
+	ListSessions(ctx context.Context, userID, current string) ([]*model.Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID string) error
+	LogoutAllDevices(ctx context.Context, userID string) error
+	SetupTwoFactor(ctx context.Context, id string) (*model.TwoFactorSetup, error)
+	EnableTwoFactor(ctx context.Context, id, code string) (*model.User, error)
+	DisableTwoFactor(ctx context.Context, id string) (*model.User, error)
+	ListTrustedDevices(ctx context.Context, userID string) ([]*model.TrustedDevice, error)
+	RevokeTrustedDevice(ctx context.Context, userID, deviceID string) error
+	RevokeTrustedDevices(ctx context.Context, userID string) error
+	Reauthenticate(ctx context.Context, claims *auth.Claims, password string, otp, deviceToken *string) (*model.Token, error)
+	SetLoginNotifications(ctx context.Context, id string, mode *model.LoginNotifications) (*model.User, error)
+	SetLocale(ctx context.Context, id string, locale *string) (*model.User, error)
+	ReportLogin(ctx context.Context, token string) (string, error)
+	ExportUserData(ctx context.Context, userID string) (*model.DataExport, error)
+
+	GetUser(ctx context.Context, id string) (*model.User, error)
+	SetDisabled(ctx context.Context, id string, disabled bool) (*model.User, error)
+	ForcePasswordReset(ctx context.Context, id string) (*model.User, error)
+	SetRoles(ctx context.Context, id string, roles []model.Role) (*model.User, error)
+	UpdateProfile(ctx context.Context, id string, input *model.UpdateUserInput) (*model.User, error)
+	DeleteUser(ctx context.Context, id string) error
+	EraseUser(ctx context.Context, id string) error
+	ListUsers(ctx context.Context, first *int, after *string, filter *model.UserFilter, sort *model.UserSort) (*model.UserConnection, error)
+	SearchUsers(ctx context.Context, search *model.UserSearch, first *int, after *string) (*model.UserConnection, error)
+	RotateSigningKey(ctx context.Context) (string, error)
+	ApproveUser(ctx context.Context, id string) (*model.User, error)
+	DisposableDomains(ctx context.Context) ([]string, error)
+	SetDisposableDomain(ctx context.Context, domain string, blocked bool) error
+	CreateOrganization(ctx context.Context, input *model.OrganizationInput) (*model.Organization, error)
+	UpdateOrganization(ctx context.Context, id string, input *model.OrganizationInput) (*model.Organization, error)
+	DeleteOrganization(ctx context.Context, id string) error
+	GetOrganization(ctx context.Context, id string) (*model.Organization, error)
+	ListOrganizations(ctx context.Context) ([]*model.Organization, error)
+	OrganizationMembers(ctx context.Context, id string) ([]*model.User, error)
+	OrganizationMemberships(ctx context.Context, id string) ([]*model.Member, error)
+	RequireOrgRole(ctx context.Context, claims *auth.Claims, orgID string, role model.OrgRole) error
+	SetMemberRole(ctx context.Context, claims *auth.Claims, orgID, userID string, role model.OrgRole) (*model.Member, error)
+	RemoveMember(ctx context.Context, claims *auth.Claims, orgID, userID string) error
+	RotateOrgSigningKey(ctx context.Context, orgID string) (string, error)
+	CreateScimToken(ctx context.Context, orgID, description string) (string, error)
+	GetScimToken(ctx context.Context, id string) (*model.ScimToken, error)
+	ListScimTokens(ctx context.Context, orgID string) ([]*model.ScimToken, error)
+	RevokeScimToken(ctx context.Context, id string) error
+	InviteMember(ctx context.Context, orgID, email string, role model.OrgRole, invitedBy string) (*model.Invitation, error)
+	GetInvitation(ctx context.Context, id string) (*model.Invitation, error)
+	ListInvitations(ctx context.Context, orgID string) ([]*model.Invitation, error)
+	ResendInvitation(ctx context.Context, id string) (*model.Invitation, error)
+	RevokeInvitation(ctx context.Context, id string) error
+	AcceptInvite(ctx context.Context, userID, token string) (*model.Token, error)
+	LinkIdentityURL(ctx context.Context, userID, provider string) (string, error)
+	UnlinkIdentity(ctx context.Context, userID, issuer, subject string) (*model.User, error)
+	CreateOAuthClient(ctx context.Context, input *model.OAuthClientInput) (*model.OAuthClientCredentials, error)
+	CreateServiceClient(ctx context.Context, input *model.ServiceClientInput) (*model.OAuthClientCredentials, error)
+	UpdateOAuthClient(ctx context.Context, id string, input *model.OAuthClientUpdate) (*model.OAuthClient, error)
+	RotateOAuthClientSecret(ctx context.Context, id string, grace time.Duration) (*model.OAuthClientCredentials, error)
+	ListOAuthClients(ctx context.Context) ([]*model.OAuthClient, error)
+	DeleteOAuthClient(ctx context.Context, id string) error
+	Impersonate(ctx context.Context, userID string) (*model.Token, error)
+	CreateAPIKey(ctx context.Context, input *model.APIKeyInput) (*model.APIKeyCredentials, error)
+	ListAPIKeys(ctx context.Context, clientID *string) ([]*model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+	GetAuthorizationRequest(ctx context.Context, claims *auth.Claims, id string) (*model.AuthorizationRequest, error)
+	ListApplications(ctx context.Context, userID string) ([]*model.ApplicationGrant, error)
+	RevokeApplication(ctx context.Context, userID, clientID string) error
+	ApproveAuthorization(ctx context.Context, claims *auth.Claims, requestID string) (string, error)
+	DenyAuthorization(ctx context.Context, requestID string) (string, error)
+
+	Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string)
+	ListAuditEvents(ctx context.Context, first *int, after *string, filter *model.AuditEventFilter) (*model.AuditEventConnection, error)
+}
+
+var _ UserStore = (*auth.DB)(nil)
+
+type Resolver struct {
+	store UserStore
+	// Limits usernameAvailable calls per client address
+	usernameLimiter *auth.RateLimiter
+}
+
+// NewResolver returns the root resolver backed by store
+func NewResolver(store UserStore, cfg *config.Config) *Resolver {
+	return &Resolver{
+		store:           store,
+		usernameLimiter: auth.NewRateLimiter(cfg.UsernameLimit, cfg.UsernameWindow),
+	}
+}
+
+// Sweepers returns the in process stores of the resolvers that need sweeping
+func (r *Resolver) Sweepers() []auth.Sweeper {
+	return []auth.Sweeper{r.usernameLimiter}
+}
+
+// requireOrgRole fails unless the user of the request has at least role in
+// the organization with the given id
+func (r *Resolver) requireOrgRole(ctx context.Context, orgID string, role model.OrgRole) error {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.RequireOrgRole(ctx, claims, orgID, role)
+}
+
+// auditAdmin records an admin operation on the user with the given id,
+// resolvers call it once the operation succeeded so refused ones aren't logged
+func (r *Resolver) auditAdmin(ctx context.Context, action string, id string) {
+	r.store.Audit(ctx, model.AuditEventTypeAdminAction, id, map[string]string{"action": action})
+}
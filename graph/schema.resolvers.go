@@ -5,50 +5,919 @@ package graph
 
 import (
 	"context"
+	"time"
 
 	"github.com/cesar-yoab/authService/auth"
 	"github.com/cesar-yoab/authService/graph/generated"
 	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
-var dbClient = auth.ConnectMongo()
-
 func (r *mutationResolver) Register(ctx context.Context, registerInput *model.RegisterInput) (*model.Token, error) {
 	input, err := auth.ValidateAndPrepare(registerInput)
 	if err != nil {
 		return nil, err
 	}
 
-	user, err := dbClient.RegisterUser(input)
+	user, err := r.store.RegisterUser(ctx, input)
 
 	if err != nil {
 		return nil, err
 	}
 
+	r.store.Audit(ctx, model.AuditEventTypeRegister, input.Username, nil)
+	if input.InviteToken != nil && *input.InviteToken != "" {
+		r.store.Audit(ctx, model.AuditEventTypeInvitationAccepted, input.Username, nil)
+	}
+
 	return user, nil
 }
 
 func (r *mutationResolver) UserAuth(ctx context.Context, auth *model.Authenticate) (*model.Token, error) {
-	token, err := dbClient.AuthenticateUser(auth)
+	token, err := r.store.AuthenticateUser(ctx, auth)
 
 	if err != nil {
+		r.store.Audit(ctx, model.AuditEventTypeLoginFailure, auth.Email, map[string]string{"reason": err.Error()})
 		return nil, err
 	}
 
+	r.store.Audit(ctx, model.AuditEventTypeLoginSuccess, auth.Email, nil)
+
 	return token, nil
 }
 
 func (r *mutationResolver) RefreshToken(ctx context.Context, token *model.RefreshToken) (*model.Token, error) {
-	newToken, err := auth.RefreshJWT(token)
+	// Browsers using cookies refresh with the refresh cookie
+	if token == nil {
+		cookie := auth.RefreshCookieForContext(ctx)
+		if cookie == "" {
+			return nil, gqlerror.Errorf("A refresh token is required.")
+		}
+		token = &model.RefreshToken{OldToken: cookie}
+	}
+
+	newToken, err := r.store.RefreshUserToken(ctx, token)
 
 	if err != nil {
 		return nil, err
 	}
 
+	var subject string
+	if claims, err := r.store.VerifyToken(ctx, newToken.Jwt); err == nil {
+		subject = claims.UserID
+	}
+	r.store.Audit(ctx, model.AuditEventTypeTokenRefresh, subject, nil)
+
 	return newToken, nil
 }
 
+func (r *mutationResolver) DeleteAccount(ctx context.Context) (*model.AccountDeletion, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	deletion, err := r.store.ScheduleDeletion(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeAccountDeletion, user.ID, nil)
+
+	return deletion, nil
+}
+
+func (r *mutationResolver) CancelDeletion(ctx context.Context, auth *model.Authenticate) (*model.Token, error) {
+	token, err := r.store.CancelDeletion(ctx, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeAccountRestored, auth.Email, nil)
+
+	return token, nil
+}
+
+func (r *mutationResolver) AcceptTerms(ctx context.Context, auth model.Authenticate) (*model.Token, error) {
+	token, err := r.store.AcceptTerms(ctx, &auth)
+	if err != nil {
+		r.store.Audit(ctx, model.AuditEventTypeLoginFailure, auth.Email, map[string]string{"reason": err.Error()})
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeTermsAccepted, auth.Email, nil)
+	r.store.Audit(ctx, model.AuditEventTypeLoginSuccess, auth.Email, nil)
+
+	return token, nil
+}
+
+func (r *mutationResolver) ChangePassword(ctx context.Context, input model.ChangePasswordInput) (*model.Token, error) {
+	token, err := r.store.ChangePassword(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypePasswordChange, input.Email, nil)
+
+	return token, nil
+}
+
+func (r *mutationResolver) Logout(ctx context.Context) (bool, error) {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.RevokeToken(ctx, claims); err != nil {
+		return false, err
+	}
+
+	// Refreshing another token of the session would bring it back
+	if claims.SessionID != "" {
+		if err := r.store.RevokeSession(ctx, claims.UserID, claims.SessionID); err != nil {
+			return false, err
+		}
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeLogout, claims.UserID, nil)
+
+	return true, nil
+}
+
+func (r *mutationResolver) RevokeSession(ctx context.Context, id string) (bool, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.RevokeSession(ctx, user.ID, id); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeLogout, user.ID, map[string]string{"session": id})
+
+	return true, nil
+}
+
+func (r *mutationResolver) LogoutAllDevices(ctx context.Context) (bool, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.LogoutAllDevices(ctx, user.ID); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeLogout, user.ID, map[string]string{"scope": "all"})
+
+	return true, nil
+}
+
+func (r *mutationResolver) SetupTwoFactor(ctx context.Context) (*model.TwoFactorSetup, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.SetupTwoFactor(ctx, user.ID)
+}
+
+func (r *mutationResolver) EnableTwoFactor(ctx context.Context, code string) (*model.User, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	updated, err := r.store.EnableTwoFactor(ctx, user.ID, code)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeMfaEnabled, user.ID, nil)
+
+	return updated, nil
+}
+
+func (r *mutationResolver) DisableTwoFactor(ctx context.Context) (*model.User, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	updated, err := r.store.DisableTwoFactor(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeMfaDisabled, user.ID, nil)
+
+	return updated, nil
+}
+
+func (r *mutationResolver) RevokeTrustedDevice(ctx context.Context, id string) (bool, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.RevokeTrustedDevice(ctx, user.ID, id); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeTrustedDeviceRevoked, user.ID, map[string]string{"device": id})
+
+	return true, nil
+}
+
+func (r *mutationResolver) RevokeTrustedDevices(ctx context.Context) (bool, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.RevokeTrustedDevices(ctx, user.ID); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeTrustedDeviceRevoked, user.ID, map[string]string{"scope": "all"})
+
+	return true, nil
+}
+
+func (r *mutationResolver) Reauthenticate(ctx context.Context, password string, otp *string, deviceToken *string) (*model.Token, error) {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	token, err := r.store.Reauthenticate(ctx, claims, password, otp, deviceToken)
+	if err != nil {
+		r.store.Audit(ctx, model.AuditEventTypeLoginFailure, claims.UserID, map[string]string{"reason": err.Error()})
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeReauthenticate, claims.UserID, nil)
+
+	return token, nil
+}
+
+func (r *mutationResolver) SetLoginNotifications(ctx context.Context, mode *model.LoginNotifications) (*model.User, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.SetLoginNotifications(ctx, user.ID, mode)
+}
+
+func (r *mutationResolver) SetLocale(ctx context.Context, locale *string) (*model.User, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.SetLocale(ctx, user.ID, locale)
+}
+
+func (r *mutationResolver) ReportLogin(ctx context.Context, token string) (bool, error) {
+	id, err := r.store.ReportLogin(ctx, token)
+	if err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeLoginReported, id, nil)
+
+	return true, nil
+}
+
+func (r *mutationResolver) ExportMyData(ctx context.Context) (*model.DataExport, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	export, err := r.store.ExportUserData(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeDataExport, user.ID, nil)
+
+	return export, nil
+}
+
+func (r *mutationResolver) EraseMyAccount(ctx context.Context) (bool, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.EraseUser(ctx, user.ID); err != nil {
+		return false, err
+	}
+
+	// Recorded after the erasure so the event itself is kept as its trail
+	r.store.Audit(ctx, model.AuditEventTypeUserErased, user.ID, nil)
+
+	return true, nil
+}
+
+func (r *mutationResolver) AcceptInvite(ctx context.Context, token string) (*model.Token, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	newToken, err := r.store.AcceptInvite(ctx, user.ID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeInvitationAccepted, user.ID, nil)
+
+	return newToken, nil
+}
+
+func (r *mutationResolver) LinkIdentity(ctx context.Context, provider string) (string, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return "", auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	// Audited once the provider confirms the link
+	return r.store.LinkIdentityURL(ctx, user.ID, provider)
+}
+
+func (r *mutationResolver) UnlinkIdentity(ctx context.Context, issuer string, subject string) (*model.User, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	updated, err := r.store.UnlinkIdentity(ctx, user.ID, issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeAccountUnlinked, user.ID, map[string]string{"issuer": issuer})
+
+	return updated, nil
+}
+
+func (r *mutationResolver) ApproveAuthorization(ctx context.Context, request string) (string, error) {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return "", auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	redirect, err := r.store.ApproveAuthorization(ctx, claims, request)
+	if err != nil {
+		return "", err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeClientAuthorized, claims.UserID, nil)
+
+	return redirect, nil
+}
+
+func (r *mutationResolver) DenyAuthorization(ctx context.Context, request string) (string, error) {
+	if auth.ForContext(ctx) == nil {
+		return "", auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.DenyAuthorization(ctx, request)
+}
+
+func (r *mutationResolver) RevokeApplication(ctx context.Context, clientID string) (bool, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.RevokeApplication(ctx, user.ID, clientID); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeClientRevoked, user.ID, map[string]string{"client": clientID})
+
+	return true, nil
+}
+
+func (r *mutationResolver) InviteMember(ctx context.Context, orgID string, email string, role *model.OrgRole) (*model.Invitation, error) {
+	memberRole := model.OrgRoleMember
+	if role != nil {
+		memberRole = *role
+	}
+
+	// Only owners invite owners
+	required := model.OrgRoleAdmin
+	if memberRole == model.OrgRoleOwner {
+		required = model.OrgRoleOwner
+	}
+	if err := r.requireOrgRole(ctx, orgID, required); err != nil {
+		return nil, err
+	}
+
+	invitation, err := r.store.InviteMember(ctx, orgID, email, memberRole, auth.ClaimsForContext(ctx).UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeMemberInvited, invitation.Email, map[string]string{"orgId": orgID, "role": string(memberRole)})
+
+	return invitation, nil
+}
+
+func (r *mutationResolver) ResendInvitation(ctx context.Context, id string) (*model.Invitation, error) {
+	invitation, err := r.store.GetInvitation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.requireOrgRole(ctx, invitation.OrgID, model.OrgRoleAdmin); err != nil {
+		return nil, err
+	}
+
+	return r.store.ResendInvitation(ctx, id)
+}
+
+func (r *mutationResolver) RevokeInvitation(ctx context.Context, id string) (bool, error) {
+	invitation, err := r.store.GetInvitation(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if err := r.requireOrgRole(ctx, invitation.OrgID, model.OrgRoleAdmin); err != nil {
+		return false, err
+	}
+
+	if err := r.store.RevokeInvitation(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeInvitationRevoked, invitation.Email, map[string]string{"orgId": invitation.OrgID})
+
+	return true, nil
+}
+
+func (r *mutationResolver) SetMemberRole(ctx context.Context, orgID string, userID string, role model.OrgRole) (*model.Member, error) {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	member, err := r.store.SetMemberRole(ctx, claims, orgID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeMemberRoleChanged, userID, map[string]string{"orgId": orgID, "role": string(role)})
+
+	return member, nil
+}
+
+func (r *mutationResolver) RemoveMember(ctx context.Context, orgID string, userID string) (bool, error) {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return false, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	if err := r.store.RemoveMember(ctx, claims, orgID, userID); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeMemberRemoved, userID, map[string]string{"orgId": orgID})
+
+	return true, nil
+}
+
+func (r *mutationResolver) RotateOrgSigningKey(ctx context.Context, orgID string) (string, error) {
+	if err := r.requireOrgRole(ctx, orgID, model.OrgRoleOwner); err != nil {
+		return "", err
+	}
+
+	kid, err := r.store.RotateOrgSigningKey(ctx, orgID)
+	if err != nil {
+		return "", err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeOrgKeyRotated, orgID, map[string]string{"kid": kid})
+
+	return kid, nil
+}
+
+func (r *mutationResolver) CreateScimToken(ctx context.Context, orgID string, description string) (string, error) {
+	if err := r.requireOrgRole(ctx, orgID, model.OrgRoleOwner); err != nil {
+		return "", err
+	}
+
+	token, err := r.store.CreateScimToken(ctx, orgID, description)
+	if err != nil {
+		return "", err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeProvisioning, orgID, map[string]string{"action": "createScimToken"})
+
+	return token, nil
+}
+
+func (r *mutationResolver) RevokeScimToken(ctx context.Context, id string) (bool, error) {
+	token, err := r.store.GetScimToken(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if err := r.requireOrgRole(ctx, token.OrgID, model.OrgRoleOwner); err != nil {
+		return false, err
+	}
+
+	if err := r.store.RevokeScimToken(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.store.Audit(ctx, model.AuditEventTypeProvisioning, token.OrgID, map[string]string{"action": "revokeScimToken", "tokenId": id})
+
+	return true, nil
+}
+
+func (r *mutationResolver) DisableUser(ctx context.Context, id string) (*model.User, error) {
+	user, err := r.store.SetDisabled(ctx, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "disableUser", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) EnableUser(ctx context.Context, id string) (*model.User, error) {
+	user, err := r.store.SetDisabled(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "enableUser", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) ForcePasswordReset(ctx context.Context, id string) (*model.User, error) {
+	user, err := r.store.ForcePasswordReset(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "forcePasswordReset", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) UpdateUser(ctx context.Context, id string, input model.UpdateUserInput) (*model.User, error) {
+	user, err := r.store.UpdateProfile(ctx, id, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "updateUser", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) SetUserRoles(ctx context.Context, id string, roles []model.Role) (*model.User, error) {
+	user, err := r.store.SetRoles(ctx, id, roles)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "setUserRoles", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) ResetTwoFactor(ctx context.Context, id string) (*model.User, error) {
+	user, err := r.store.DisableTwoFactor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "resetTwoFactor", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) AdminDeleteUser(ctx context.Context, id string) (bool, error) {
+	if err := r.store.DeleteUser(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "adminDeleteUser", id)
+
+	return true, nil
+}
+
+func (r *mutationResolver) EraseUser(ctx context.Context, id string) (bool, error) {
+	if err := r.store.EraseUser(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "eraseUser", id)
+
+	return true, nil
+}
+
+func (r *mutationResolver) CreateOrganization(ctx context.Context, input model.OrganizationInput) (*model.Organization, error) {
+	org, err := r.store.CreateOrganization(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "createOrganization", org.ID)
+
+	return org, nil
+}
+
+func (r *mutationResolver) UpdateOrganization(ctx context.Context, id string, input model.OrganizationInput) (*model.Organization, error) {
+	org, err := r.store.UpdateOrganization(ctx, id, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "updateOrganization", id)
+
+	return org, nil
+}
+
+func (r *mutationResolver) DeleteOrganization(ctx context.Context, id string) (bool, error) {
+	if err := r.store.DeleteOrganization(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "deleteOrganization", id)
+
+	return true, nil
+}
+
+func (r *mutationResolver) RotateSigningKey(ctx context.Context) (string, error) {
+	kid, err := r.store.RotateSigningKey(ctx)
+	if err != nil {
+		return "", auth.Errorf(auth.CodeInternal, "Could not rotate signing key.")
+	}
+
+	r.auditAdmin(ctx, "rotateSigningKey", kid)
+
+	return kid, nil
+}
+
+func (r *mutationResolver) ApproveUser(ctx context.Context, id string) (*model.User, error) {
+	user, err := r.store.ApproveUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "approveUser", id)
+
+	return user, nil
+}
+
+func (r *mutationResolver) RevokeToken(ctx context.Context, token string) (bool, error) {
+	var subject string
+	if claims, err := r.store.VerifyToken(ctx, token); err == nil {
+		subject = claims.UserID
+	}
+
+	if err := r.store.RevokeTokenString(ctx, token); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "revokeToken", subject)
+
+	return true, nil
+}
+
+func (r *mutationResolver) BlockDisposableDomain(ctx context.Context, domain string) (bool, error) {
+	if err := r.store.SetDisposableDomain(ctx, domain, true); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "blockDisposableDomain", domain)
+
+	return true, nil
+}
+
+func (r *mutationResolver) UnblockDisposableDomain(ctx context.Context, domain string) (bool, error) {
+	if err := r.store.SetDisposableDomain(ctx, domain, false); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "unblockDisposableDomain", domain)
+
+	return true, nil
+}
+
+func (r *mutationResolver) CreateOAuthClient(ctx context.Context, input model.OAuthClientInput) (*model.OAuthClientCredentials, error) {
+	credentials, err := r.store.CreateOAuthClient(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "createOAuthClient", credentials.Client.ID)
+
+	return credentials, nil
+}
+
+func (r *mutationResolver) CreateServiceClient(ctx context.Context, input model.ServiceClientInput) (*model.OAuthClientCredentials, error) {
+	credentials, err := r.store.CreateServiceClient(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "createServiceClient", credentials.Client.ID)
+
+	return credentials, nil
+}
+
+func (r *mutationResolver) UpdateOAuthClient(ctx context.Context, id string, input model.OAuthClientUpdate) (*model.OAuthClient, error) {
+	client, err := r.store.UpdateOAuthClient(ctx, id, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "updateOAuthClient", id)
+
+	return client, nil
+}
+
+func (r *mutationResolver) RotateOAuthClientSecret(ctx context.Context, id string, gracePeriod *int) (*model.OAuthClientCredentials, error) {
+	grace := time.Duration(0)
+	if gracePeriod != nil {
+		grace = time.Duration(*gracePeriod) * time.Second
+	}
+
+	credentials, err := r.store.RotateOAuthClientSecret(ctx, id, grace)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "rotateOAuthClientSecret", id)
+
+	return credentials, nil
+}
+
+func (r *mutationResolver) Impersonate(ctx context.Context, userID string) (*model.Token, error) {
+	return r.store.Impersonate(ctx, userID)
+}
+
+func (r *mutationResolver) DeleteOAuthClient(ctx context.Context, id string) (bool, error) {
+	if err := r.store.DeleteOAuthClient(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "deleteOAuthClient", id)
+
+	return true, nil
+}
+
+func (r *mutationResolver) CreateAPIKey(ctx context.Context, input model.APIKeyInput) (*model.APIKeyCredentials, error) {
+	credentials, err := r.store.CreateAPIKey(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	r.auditAdmin(ctx, "createApiKey", credentials.APIKey.ID)
+
+	return credentials, nil
+}
+
+func (r *mutationResolver) RevokeAPIKey(ctx context.Context, id string) (bool, error) {
+	if err := r.store.RevokeAPIKey(ctx, id); err != nil {
+		return false, err
+	}
+
+	r.auditAdmin(ctx, "revokeApiKey", id)
+
+	return true, nil
+}
+
+func (r *organizationResolver) Members(ctx context.Context, obj *model.Organization) ([]*model.User, error) {
+	return r.store.OrganizationMembers(ctx, obj.ID)
+}
+
+func (r *organizationResolver) Memberships(ctx context.Context, obj *model.Organization) ([]*model.Member, error) {
+	return r.store.OrganizationMemberships(ctx, obj.ID)
+}
+
+func (r *queryResolver) UsernameAvailable(ctx context.Context, username string, org *string) (bool, error) {
+	if !r.usernameLimiter.Allow(auth.IPForContext(ctx)) {
+		return false, auth.Errorf(auth.CodeRateLimited, "Too many requests, try again later.")
+	}
+
+	return r.store.UsernameAvailable(ctx, username, org)
+}
+
+func (r *queryResolver) Terms(ctx context.Context) (*model.Terms, error) {
+	return r.store.CurrentTerms(), nil
+}
+
+func (r *queryResolver) MySessions(ctx context.Context) ([]*model.Session, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.ListSessions(ctx, user.ID, auth.ClaimsForContext(ctx).SessionID)
+}
+
+func (r *queryResolver) TrustedDevices(ctx context.Context) ([]*model.TrustedDevice, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.ListTrustedDevices(ctx, user.ID)
+}
+
+func (r *queryResolver) Users(ctx context.Context, first *int, after *string, filter *model.UserFilter, sort *model.UserSort) (*model.UserConnection, error) {
+	return r.store.ListUsers(ctx, first, after, filter, sort)
+}
+
+func (r *queryResolver) SearchUsers(ctx context.Context, search model.UserSearch, first *int, after *string) (*model.UserConnection, error) {
+	return r.store.SearchUsers(ctx, &search, first, after)
+}
+
+func (r *queryResolver) AuditEvents(ctx context.Context, first *int, after *string, filter *model.AuditEventFilter) (*model.AuditEventConnection, error) {
+	return r.store.ListAuditEvents(ctx, first, after, filter)
+}
+
+func (r *queryResolver) DisposableDomains(ctx context.Context) ([]string, error) {
+	return r.store.DisposableDomains(ctx)
+}
+
+func (r *queryResolver) Organizations(ctx context.Context) ([]*model.Organization, error) {
+	return r.store.ListOrganizations(ctx)
+}
+
+func (r *queryResolver) Organization(ctx context.Context, id string) (*model.Organization, error) {
+	if err := r.requireOrgRole(ctx, id, model.OrgRoleMember); err != nil {
+		return nil, err
+	}
+
+	return r.store.GetOrganization(ctx, id)
+}
+
+func (r *queryResolver) Invitations(ctx context.Context, orgID string) ([]*model.Invitation, error) {
+	if err := r.requireOrgRole(ctx, orgID, model.OrgRoleAdmin); err != nil {
+		return nil, err
+	}
+
+	return r.store.ListInvitations(ctx, orgID)
+}
+
+func (r *queryResolver) ScimTokens(ctx context.Context, orgID string) ([]*model.ScimToken, error) {
+	if err := r.requireOrgRole(ctx, orgID, model.OrgRoleOwner); err != nil {
+		return nil, err
+	}
+
+	return r.store.ListScimTokens(ctx, orgID)
+}
+
+func (r *queryResolver) OauthClients(ctx context.Context) ([]*model.OAuthClient, error) {
+	return r.store.ListOAuthClients(ctx)
+}
+
+func (r *queryResolver) APIKeys(ctx context.Context, clientID *string) ([]*model.APIKey, error) {
+	return r.store.ListAPIKeys(ctx, clientID)
+}
+
+func (r *queryResolver) AuthorizationRequest(ctx context.Context, id string) (*model.AuthorizationRequest, error) {
+	claims := auth.ClaimsForContext(ctx)
+	if claims == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.GetAuthorizationRequest(ctx, claims, id)
+}
+
+func (r *queryResolver) MyApplications(ctx context.Context) ([]*model.ApplicationGrant, error) {
+	user := auth.ForContext(ctx)
+	if user == nil {
+		return nil, auth.Errorf(auth.CodeUnauthenticated, "Access denied.")
+	}
+
+	return r.store.ListApplications(ctx, user.ID)
+}
+
+func (r *queryResolver) UserApplications(ctx context.Context, userID string) ([]*model.ApplicationGrant, error) {
+	return r.store.ListApplications(ctx, userID)
+}
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
+// Organization returns generated.OrganizationResolver implementation.
+func (r *Resolver) Organization() generated.OrganizationResolver { return &organizationResolver{r} }
+
+// Query returns generated.QueryResolver implementation.
+func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
+
 type mutationResolver struct{ *Resolver }
+type organizationResolver struct{ *Resolver }
+type queryResolver struct{ *Resolver }
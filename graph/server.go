@@ -0,0 +1,50 @@
+package graph
+
+import (
+	"context"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/cesar-yoab/authService/config"
+)
+
+// NewServer returns the GraphQL handler of es, set up like gqlgen's default
+// server except introspection is only enabled with GRAPHQL_INTROSPECTION,
+// operations are cut off after GRAPHQL_TIMEOUT and persisted queries are
+// left to PersistedQueries
+func NewServer(es graphql.ExecutableSchema, cfg *config.Config) *handler.Server {
+	srv := handler.New(es)
+
+	srv.AddTransport(transport.Websocket{KeepAlivePingInterval: 10 * time.Second})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+
+	srv.SetQueryCache(lru.New(1000))
+
+	// Without it __schema and __type queries fail, so the schema isn't
+	// advertised. Federation gateways use _service, which stays available
+	if cfg.Introspection {
+		srv.Use(extension.Introspection{})
+	}
+	if cfg.GraphQLTimeout > 0 {
+		srv.AroundResponses(timeout(cfg.GraphQLTimeout))
+	}
+
+	return srv
+}
+
+// timeout cancels the context of operations running longer than d, the
+// resolvers still waiting on the database then fail with auth.CodeTimeout
+func timeout(d time.Duration) graphql.ResponseMiddleware {
+	return func(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return next(ctx)
+	}
+}
@@ -0,0 +1,221 @@
+package grpcapi
+
+// gRPC API for internal services to verify tokens and look up users, see
+// proto/auth/v1/auth.proto for the definitions clients are generated from.
+// Callers authenticate with GRPC_TOKEN, a client certificate with
+// MTLS_CA_FILE, or both.
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"strings"
+
+	"github.com/cesar-yoab/authService/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Store is what the API needs from the database, implemented by auth.DB
+type Store interface {
+	VerifyToken(ctx context.Context, tokenString string) (*auth.Claims, error)
+	FindByID(ctx context.Context, id string) (*auth.UserModel, error)
+}
+
+// service implements the AuthService RPCs
+type service struct {
+	store Store
+}
+
+// NewServer returns a gRPC server with AuthService registered. When token is
+// set callers must send it as a bearer token in the authorization metadata.
+// With mutual, a TLS config requiring client certificates, callers must also
+// present one peers allows.
+func NewServer(store Store, token string, mutual *tls.Config, peers *auth.MutualTLSPolicy) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(codec{})}
+	var interceptors []grpc.UnaryServerInterceptor
+	if mutual != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(mutual)))
+		interceptors = append(interceptors, requirePeer(peers))
+	}
+	if token != "" {
+		interceptors = append(interceptors, requireToken(token))
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(interceptors...))
+
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&serviceDesc, &service{store: store})
+
+	return srv
+}
+
+// requireToken rejects calls without the shared token
+func requireToken(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			given := strings.TrimPrefix(value, "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+}
+
+// requirePeer rejects calls without an allowed client certificate, and
+// stores the peer of the others in their context
+func requirePeer(peers *auth.MutualTLSPolicy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var state *tls.ConnectionState
+		if p, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				state = &tlsInfo.State
+			}
+		}
+
+		caller, err := peers.Identify(state)
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return handler(auth.WithPeer(ctx, caller), req)
+	}
+}
+
+// Verify checks a token, invalid tokens are not an error but a response with Valid false
+func (s *service) Verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
+	claims, err := s.store.VerifyToken(ctx, req.Token)
+	if err != nil {
+		return &VerifyResponse{}, nil
+	}
+
+	return &VerifyResponse{
+		Valid:       true,
+		UserID:      claims.UserID,
+		Username:    claims.Username,
+		Roles:       roleNames(claims),
+		ExpiresAt:   claims.Expiry.Unix(),
+		Permissions: claims.Permissions,
+	}, nil
+}
+
+// Introspect describes a token, inactive tokens only have Active set
+func (s *service) Introspect(ctx context.Context, req *IntrospectRequest) (*IntrospectResponse, error) {
+	claims, err := s.store.VerifyToken(ctx, req.Token)
+	if err != nil {
+		return &IntrospectResponse{}, nil
+	}
+
+	return &IntrospectResponse{
+		Active:      true,
+		Sub:         claims.UserID,
+		Username:    claims.Username,
+		Iss:         claims.Issuer,
+		Aud:         claims.Audience,
+		Iat:         claims.IssuedAt.Unix(),
+		Exp:         claims.Expiry.Unix(),
+		Roles:       roleNames(claims),
+		Permissions: claims.Permissions,
+	}, nil
+}
+
+// GetUser returns the profile of an account
+func (s *service) GetUser(ctx context.Context, req *GetUserRequest) (*User, error) {
+	if req.UserID == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+
+	user, err := s.store.FindByID(ctx, req.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user %s not found", req.UserID)
+	}
+
+	roles := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, string(role))
+	}
+
+	return &User{
+		ID:        user.ID.Hex(),
+		Username:  user.Username,
+		Fname:     user.Fname,
+		Lname:     user.Lname,
+		Email:     user.Email,
+		Roles:     roles,
+		Verified:  user.Verified,
+		Disabled:  user.Disabled,
+		CreatedAt: user.ID.Timestamp().Unix(),
+	}, nil
+}
+
+func roleNames(claims *auth.Claims) []string {
+	roles := make([]string, 0, len(claims.Roles))
+	for _, role := range claims.Roles {
+		roles = append(roles, string(role))
+	}
+
+	return roles
+}
+
+// serviceDesc is what protoc-gen-go-grpc would generate for AuthService
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "auth.v1.AuthService",
+	HandlerType: (*service)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Verify",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(VerifyRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				call := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(*service).Verify(ctx, req.(*VerifyRequest))
+				}
+				if interceptor == nil {
+					return call(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/auth.v1.AuthService/Verify"}, call)
+			},
+		},
+		{
+			MethodName: "Introspect",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(IntrospectRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				call := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(*service).Introspect(ctx, req.(*IntrospectRequest))
+				}
+				if interceptor == nil {
+					return call(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/auth.v1.AuthService/Introspect"}, call)
+			},
+		},
+		{
+			MethodName: "GetUser",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(GetUserRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				call := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(*service).GetUser(ctx, req.(*GetUserRequest))
+				}
+				if interceptor == nil {
+					return call(ctx, req)
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/auth.v1.AuthService/GetUser"}, call)
+			},
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/auth/v1/auth.proto",
+}
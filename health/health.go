@@ -0,0 +1,54 @@
+package health
+
+// Liveness and readiness endpoints for orchestrators. Liveness only tells
+// the process is up, readiness runs the dependency checks so traffic is
+// not routed to instances that can't serve it.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// timeout bounds how long all checks of a readiness probe can take
+const timeout = 2 * time.Second
+
+// Check returns an error when a dependency is not usable
+type Check func(ctx context.Context) error
+
+// Live always answers 200 while the process can serve HTTP
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// response is the body of a readiness probe
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Ready runs every check and answers 503 if any of them fails
+func Ready(checks map[string]Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		res := response{Status: "ok", Checks: make(map[string]string, len(checks))}
+		for name, check := range checks {
+			if err := check(ctx); err != nil {
+				res.Status = "unavailable"
+				res.Checks[name] = err.Error()
+				continue
+			}
+			res.Checks[name] = "ok"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if res.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+}
@@ -0,0 +1,152 @@
+package i18n
+
+// Translations of the messages answered to clients, such as errors. A bundle
+// per locale, e.g. locales/es.json, maps message keys to fmt formats that
+// get the arguments of the message, "%[2]s" picks them out of order. There
+// is no English bundle: messages without a translation keep their text.
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales
+var builtin embed.FS
+
+// Bundle holds the translations of every locale
+type Bundle struct {
+	// Locale tried when none of the client's has a translation
+	fallback string
+	messages map[string]map[string]string
+}
+
+// Load parses the built in bundles, then the ones in dir whose messages
+// replace them or add locales. dir may be empty.
+func Load(dir, fallback string) (*Bundle, error) {
+	b := &Bundle{fallback: normalize(fallback), messages: map[string]map[string]string{}}
+
+	sub, err := fs.Sub(builtin, "locales")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.load(sub); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := b.load(os.DirFS(dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// load merges every bundle of fsys, named after their locale
+func (b *Bundle) load(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		src, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(src, &messages); err != nil {
+			return fmt.Errorf("bundle %s: %w", name, err)
+		}
+
+		locale := normalize(strings.TrimSuffix(path.Base(name), ".json"))
+		if b.messages[locale] == nil {
+			b.messages[locale] = map[string]string{}
+		}
+		for key, message := range messages {
+			b.messages[locale][key] = message
+		}
+	}
+
+	return nil
+}
+
+// Translate returns message key in the first of locales with a translation,
+// trying "pt" after "pt-br", then in the fallback locale
+func (b *Bundle) Translate(locales []string, key string, args ...interface{}) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+
+	var candidates []string
+	for _, locale := range append(locales[:len(locales):len(locales)], b.fallback) {
+		locale = normalize(locale)
+		candidates = append(candidates, locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			candidates = append(candidates, locale[:i])
+		}
+	}
+
+	for _, locale := range candidates {
+		format, ok := b.messages[locale][key]
+		if !ok {
+			continue
+		}
+		// Formats that don't match the arguments would answer garbage
+		message := fmt.Sprintf(format, args...)
+		if strings.Contains(message, "%!") {
+			return "", false
+		}
+		return message, true
+	}
+
+	return "", false
+}
+
+// ParseAcceptLanguage returns the locales of an Accept-Language header,
+// most preferred first
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{locale, q})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	locales := make([]string, len(tags))
+	for i, tag := range tags {
+		locales[i] = tag.locale
+	}
+	return locales
+}
+
+// normalize lowercases a language tag, "pt_BR" becomes "pt-br"
+func normalize(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
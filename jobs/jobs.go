@@ -0,0 +1,231 @@
+package jobs
+
+// Background work that shouldn't hold up requests, such as sending emails
+// and delivering webhooks. Jobs are queued in a Backend, in process or
+// shared between instances through Mongo or Redis, and run by a pool of
+// workers that retry failures with exponential backoff.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/metrics"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxAttempts before a failing job is dropped
+const MaxAttempts = 5
+
+// Job is a unit of work of a given type, the payload is the JSON its handler decodes
+type Job struct {
+	ID      string          `bson:"_id" json:"id"`
+	Type    string          `bson:"type" json:"type"`
+	Payload json.RawMessage `bson:"payload" json:"payload"`
+	// Number of times the job already failed
+	Attempts int       `bson:"attempts" json:"attempts"`
+	RunAt    time.Time `bson:"runAt" json:"runAt"`
+}
+
+// Decode unmarshals the payload into v
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Backend stores queued jobs
+type Backend interface {
+	// Push queues a job, or queues it again after a failure
+	Push(ctx context.Context, job *Job) error
+	// Pop takes a job that is due, nil when there is none
+	Pop(ctx context.Context) (*Job, error)
+	// Done removes a job that won't run again
+	Done(ctx context.Context, job *Job) error
+}
+
+// Handler runs a job, returning an error retries it
+type Handler func(ctx context.Context, job *Job) error
+
+// Runner runs queued jobs and periodic tasks until it is closed
+type Runner struct {
+	backend  Backend
+	handlers map[string]Handler
+	workers  int
+	// How often idle workers look for new jobs
+	poll time.Duration
+	// Delay before the first retry, doubled on every attempt
+	backoff time.Duration
+	// Deadline of a single run
+	timeout time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a runner taking jobs from backend with workers running at once
+func New(backend Backend, workers int) *Runner {
+	return &Runner{
+		backend:  backend,
+		handlers: map[string]Handler{},
+		workers:  workers,
+		poll:     time.Second,
+		backoff:  time.Second,
+		timeout:  time.Minute,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Handle registers the handler of a job type, before Start is called
+func (r *Runner) Handle(jobType string, h Handler) {
+	r.handlers[jobType] = h
+}
+
+// Enqueue queues a job running as soon as a worker is free
+func (r *Runner) Enqueue(ctx context.Context, jobType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	job := &Job{
+		ID:      primitive.NewObjectID().Hex(),
+		Type:    jobType,
+		Payload: body,
+		RunAt:   time.Now(),
+	}
+	if err := r.backend.Push(ctx, job); err != nil {
+		return fmt.Errorf("could not queue %s job: %w", jobType, err)
+	}
+
+	metrics.JobsQueued.WithLabelValues(jobType).Inc()
+	return nil
+}
+
+// Start starts the workers
+func (r *Runner) Start() {
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+}
+
+// Every runs fn every interval until the runner is closed. Periodic tasks
+// aren't queued, every instance runs them so they must be safe to repeat
+func (r *Runner) Every(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+			start := time.Now()
+			err := fn(ctx)
+			cancel()
+
+			r.observe(name, start, err)
+			if err != nil {
+				logging.Logger.Error().Err(err).Str("task", name).Msg("periodic task failed")
+			}
+		}
+	}()
+}
+
+// work runs jobs until the runner is closed, polling when the queue is empty
+func (r *Runner) work() {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		job, err := r.backend.Pop(context.Background())
+		if err != nil {
+			logging.Logger.Error().Err(err).Msg("could not take a job")
+		}
+		if job == nil {
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(r.poll):
+			}
+			continue
+		}
+
+		r.run(job)
+	}
+}
+
+// run runs a job, queueing it again with a delay when it fails
+func (r *Runner) run(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	handler, ok := r.handlers[job.Type]
+	if !ok {
+		logging.Logger.Error().Str("job", job.Type).Msg("no handler for job type, dropping it")
+		r.backend.Done(ctx, job)
+		return
+	}
+
+	start := time.Now()
+	err := handler(ctx, job)
+	r.observe(job.Type, start, err)
+
+	if err == nil {
+		if err := r.backend.Done(ctx, job); err != nil {
+			logging.Logger.Error().Err(err).Str("job", job.Type).Msg("could not remove finished job")
+		}
+		return
+	}
+
+	job.Attempts++
+	if job.Attempts >= MaxAttempts {
+		logging.Logger.Warn().Err(err).Str("job", job.Type).Int("attempts", job.Attempts).Msg("job failed, dropping it")
+		r.backend.Done(ctx, job)
+		return
+	}
+
+	job.RunAt = time.Now().Add(r.backoff << (job.Attempts - 1))
+	if err := r.backend.Push(ctx, job); err != nil {
+		logging.Logger.Error().Err(err).Str("job", job.Type).Msg("could not queue job for a retry")
+	}
+}
+
+// observe records the outcome of a job or task
+func (r *Runner) observe(name string, start time.Time, err error) {
+	metrics.JobsProcessed.WithLabelValues(name, metrics.Result(err)).Inc()
+	metrics.ObserveSince(metrics.JobDuration.WithLabelValues(name), start)
+}
+
+// Close stops taking jobs and waits for the ones running to finish or ctx
+// to be done. Queued jobs stay in the backend, in process ones are lost
+func (r *Runner) Close(ctx context.Context) error {
+	close(r.stop)
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
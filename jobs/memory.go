@@ -0,0 +1,53 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory keeps jobs in process, they are lost when the instance stops
+type Memory struct {
+	mu   sync.Mutex
+	jobs []*Job
+}
+
+// NewMemory returns an empty in process backend
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Push implements Backend
+func (m *Memory) Push(ctx context.Context, job *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs = append(m.jobs, job)
+	return nil
+}
+
+// Pop implements Backend, returning the job that is due the longest
+func (m *Memory) Pop(ctx context.Context) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	next := -1
+	for i, job := range m.jobs {
+		if !job.RunAt.After(now) && (next < 0 || job.RunAt.Before(m.jobs[next].RunAt)) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return nil, nil
+	}
+
+	job := m.jobs[next]
+	m.jobs = append(m.jobs[:next], m.jobs[next+1:]...)
+	return job, nil
+}
+
+// Done implements Backend, popped jobs are already removed
+func (m *Memory) Done(ctx context.Context, job *Job) error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// lease is how long a popped job is hidden from other workers, a job whose
+// worker died runs again once it is over
+const lease = 5 * time.Minute
+
+// Mongo keeps jobs in a collection shared by every instance
+type Mongo struct {
+	jobs *mongo.Collection
+}
+
+// NewMongo returns a backend storing jobs in collection
+func NewMongo(collection *mongo.Collection) *Mongo {
+	return &Mongo{jobs: collection}
+}
+
+// EnsureIndexes indexes jobs by the time they are due
+func (m *Mongo) EnsureIndexes(ctx context.Context) error {
+	_, err := m.jobs.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"runAt": 1}})
+	return err
+}
+
+// Push implements Backend
+func (m *Mongo) Push(ctx context.Context, job *Job) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.jobs.ReplaceOne(ctx, bson.M{"_id": job.ID}, job, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Pop implements Backend, the job is leased by pushing its runAt forward
+func (m *Mongo) Pop(ctx context.Context) (*Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"runAt": 1})
+	var job Job
+	err := m.jobs.FindOneAndUpdate(ctx, bson.M{"runAt": bson.M{"$lte": now}}, bson.M{"$set": bson.M{"runAt": now.Add(lease)}}, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// Done implements Backend
+func (m *Mongo) Done(ctx context.Context, job *Job) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.jobs.DeleteOne(ctx, bson.M{"_id": job.ID})
+	return err
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/cesar-yoab/authService/cache"
+)
+
+// redisKey is the sorted set of queued jobs, scored by when they are due
+const redisKey = "jobs:queue"
+
+// popScript removes and returns the job due the longest, an empty string when
+// none is due. It runs atomically so two workers never take the same job
+const popScript = `
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #jobs == 0 then return '' end
+redis.call('ZREM', KEYS[1], jobs[1])
+return jobs[1]`
+
+// Redis keeps jobs in a Redis server shared by every instance. A job taken
+// by an instance that stops before finishing it is lost
+type Redis struct {
+	client *cache.Redis
+}
+
+// NewRedis returns a backend storing jobs through client
+func NewRedis(client *cache.Redis) *Redis {
+	return &Redis{client: client}
+}
+
+// Push implements Backend
+func (r *Redis) Push(ctx context.Context, job *Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Do(ctx, "ZADD", redisKey, strconv.FormatInt(job.RunAt.UnixNano()/int64(time.Millisecond), 10), string(body))
+	return err
+}
+
+// Pop implements Backend
+func (r *Redis) Pop(ctx context.Context) (*Job, error) {
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	reply, err := r.client.Do(ctx, "EVAL", popScript, "1", redisKey, now)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := reply.([]byte)
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	var job Job
+	if err := json.Unmarshal(body, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Done implements Backend, popped jobs are already removed
+func (r *Redis) Done(ctx context.Context, job *Job) error {
+	return nil
+}
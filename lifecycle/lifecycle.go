@@ -0,0 +1,147 @@
+package lifecycle
+
+// Lifecycle of the HTTP server. The server runs until the process gets
+// SIGINT or SIGTERM, then stops accepting connections, waits for the
+// requests in flight and runs the shutdown hooks, all within a deadline.
+// Slow clients and oversized bodies are cut off, see SetTimeouts and
+// LimitBody.
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// hook releases a resource on shutdown
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Server is an HTTP server that shuts down gracefully
+type Server struct {
+	http    *http.Server
+	timeout time.Duration
+	hooks   []hook
+	// Servers running next to it, such as the HTTP to HTTPS redirect
+	others []*http.Server
+	// Timeouts of every server, zero for none
+	read, write, idle time.Duration
+}
+
+// New returns a server for handler on addr, timeout bounds the whole shutdown
+func New(addr string, handler http.Handler, timeout time.Duration) *Server {
+	return &Server{
+		http:    &http.Server{Addr: addr, Handler: handler},
+		timeout: timeout,
+	}
+}
+
+// UseTLS serves HTTPS with config, which provides the certificates
+func (s *Server) UseTLS(config *tls.Config) {
+	s.http.TLSConfig = config
+}
+
+// SetTimeouts bounds how long the servers wait to read a request, to write
+// its response and for the next request of an idle connection
+func (s *Server) SetTimeouts(read, write, idle time.Duration) {
+	s.read, s.write, s.idle = read, write, idle
+}
+
+// Also serves handler on addr too, until the server shuts down
+func (s *Server) Also(addr string, handler http.Handler) {
+	s.others = append(s.others, &http.Server{Addr: addr, Handler: handler})
+}
+
+// AlsoTLS serves handler on addr over TLS with config, until the server
+// shuts down
+func (s *Server) AlsoTLS(addr string, handler http.Handler, config *tls.Config) {
+	s.others = append(s.others, &http.Server{Addr: addr, Handler: handler, TLSConfig: config})
+}
+
+// OnShutdown registers fn to run once requests are drained, hooks run in registration order
+func (s *Server) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.hooks = append(s.hooks, hook{name: name, fn: fn})
+}
+
+// Run serves until a termination signal is received and the shutdown completes
+func (s *Server) Run() error {
+	errs := make(chan error, 1+len(s.others))
+	for _, srv := range append([]*http.Server{s.http}, s.others...) {
+		srv := srv
+		srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout = s.read, s.write, s.idle
+		go func() {
+			if err := listen(srv); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		logging.Logger.Info().Str("signal", sig.String()).Msg("shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for in flight requests
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		logging.Logger.Error().Err(err).Msg("could not drain requests")
+	}
+	for _, other := range s.others {
+		if otherErr := other.Shutdown(ctx); otherErr != nil {
+			logging.Logger.Error().Err(otherErr).Str("addr", other.Addr).Msg("could not drain requests")
+		}
+	}
+
+	for _, h := range s.hooks {
+		if hookErr := h.fn(ctx); hookErr != nil {
+			logging.Logger.Error().Err(hookErr).Str("hook", h.name).Msg("shutdown hook failed")
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+
+	return err
+}
+
+// listen serves HTTPS when srv has a TLS config, HTTP otherwise
+func listen(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// LimitBody returns handler rejecting request bodies of more than max bytes
+// with 413, zero for no limit
+func LimitBody(max int64, handler http.Handler) http.Handler {
+	if max == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bodies of unknown length fail once they are read past max
+		if r.ContentLength > max {
+			http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,193 @@
+package logging
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/rs/zerolog"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// redacted replaces the values of secret variables
+const redacted = "[REDACTED]"
+
+// secretNames are parts of the names of arguments and input fields that
+// hold secrets, such as password, newPassword, refreshToken, clientSecret
+// or the code of 2FA
+var secretNames = []string{"password", "secret", "token", "key", "code", "otp", "assertion", "credential"}
+
+// GraphQL is a gqlgen extension adding the operation and its outcome to the request logger
+type GraphQL struct {
+	// Whether variables are logged, with secrets redacted
+	Variables bool
+	// Parts of the names of more variables to redact, e.g. "email"
+	Redact []string
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+} = GraphQL{}
+
+// ExtensionName identifies the extension in gqlgen
+func (GraphQL) ExtensionName() string {
+	return "Logging"
+}
+
+// Validate accepts any schema
+func (GraphQL) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// InterceptResponse records the operation, its variables, how long it took and whether it failed
+func (g GraphQL) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	if oc := graphql.GetOperationContext(ctx); oc != nil && oc.Operation != nil {
+		With(ctx, "operation_type", string(oc.Operation.Operation))
+		if oc.OperationName != "" {
+			With(ctx, "operation", oc.OperationName)
+		}
+		if g.Variables && len(oc.Variables) > 0 {
+			variables := g.redact(oc.Variables, bindings(oc.Operation))
+			update(ctx, func(c zerolog.Context) zerolog.Context {
+				return c.Interface("variables", variables)
+			})
+		}
+	}
+
+	start := time.Now()
+	res := next(ctx)
+	update(ctx, func(c zerolog.Context) zerolog.Context {
+		return c.Dur("operation_latency", time.Since(start))
+	})
+
+	switch {
+	case res == nil:
+	case len(res.Errors) == 0:
+		With(ctx, "graphql_status", "ok")
+	default:
+		status := "partial"
+		if string(res.Data) == "" || string(res.Data) == "null" {
+			status = "error"
+		}
+		With(ctx, "graphql_status", status)
+		// Messages are meant for clients and never echo credentials
+		With(ctx, "graphql_errors", res.Errors.Error())
+		// Errors are answered with 200, sampling can't tell them apart
+		Keep(ctx)
+	}
+
+	return res
+}
+
+// redact returns a copy of variables whose secrets are replaced. Clients
+// name variables as they like, so they are redacted by the arguments and
+// input fields they are bound to, found by bindings, and by their own name
+// on top. Fields of input objects are named by the schema
+func (g GraphQL) redact(variables map[string]interface{}, bound map[string][]string) map[string]interface{} {
+	copied := make(map[string]interface{}, len(variables))
+	for name, value := range variables {
+		secret := g.secret(name)
+		for _, field := range bound[name] {
+			secret = secret || g.secret(field)
+		}
+		if secret {
+			copied[name] = redacted
+		} else {
+			copied[name] = g.redactValue(value)
+		}
+	}
+	return copied
+}
+
+// redactValue redacts the fields of input objects, in lists too
+func (g GraphQL) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return g.redact(v, nil)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = g.redactValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// secret reports whether the variable or field name holds a secret
+func (g GraphQL) secret(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range append(secretNames, g.Redact...) {
+		if strings.Contains(name, strings.ToLower(part)) {
+			return true
+		}
+	}
+	return false
+}
+
+// bindings returns the names of the arguments and input fields each
+// variable of op is passed to, in its fields and the fragments they spread.
+// The operation was validated, its argument and field names are the schema's
+func bindings(op *ast.OperationDefinition) map[string][]string {
+	bound := map[string][]string{}
+	if op != nil {
+		bindSelections(bound, op.SelectionSet, map[*ast.FragmentDefinition]bool{})
+	}
+	return bound
+}
+
+// bindSelections adds the variables passed to the fields of set to bound,
+// seen keeps fragments spread more than once from being walked again
+func bindSelections(bound map[string][]string, set ast.SelectionSet, seen map[*ast.FragmentDefinition]bool) {
+	for _, selection := range set {
+		switch s := selection.(type) {
+		case *ast.Field:
+			bindArguments(bound, s.Arguments)
+			bindDirectives(bound, s.Directives)
+			bindSelections(bound, s.SelectionSet, seen)
+		case *ast.InlineFragment:
+			bindDirectives(bound, s.Directives)
+			bindSelections(bound, s.SelectionSet, seen)
+		case *ast.FragmentSpread:
+			bindDirectives(bound, s.Directives)
+			if s.Definition != nil && !seen[s.Definition] {
+				seen[s.Definition] = true
+				bindSelections(bound, s.Definition.SelectionSet, seen)
+			}
+		}
+	}
+}
+
+func bindDirectives(bound map[string][]string, directives ast.DirectiveList) {
+	for _, directive := range directives {
+		bindArguments(bound, directive.Arguments)
+	}
+}
+
+func bindArguments(bound map[string][]string, arguments ast.ArgumentList) {
+	for _, argument := range arguments {
+		bindValue(bound, argument.Name, argument.Value)
+	}
+}
+
+// bindValue adds the variables of value, passed to the argument or input
+// field name, to bound. Variables in input objects are passed to their field
+func bindValue(bound map[string][]string, name string, value *ast.Value) {
+	if value == nil {
+		return
+	}
+	switch value.Kind {
+	case ast.Variable:
+		bound[value.Raw] = append(bound[value.Raw], name)
+	case ast.ObjectValue:
+		for _, child := range value.Children {
+			bindValue(bound, child.Name, child.Value)
+		}
+	case ast.ListValue:
+		for _, child := range value.Children {
+			bindValue(bound, name, child.Value)
+		}
+	}
+}
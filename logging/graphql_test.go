@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const testSchema = `
+type Query {
+	me: User
+}
+
+type User {
+	id: ID!
+	sessions(refreshToken: String): [String!]
+}
+
+input LoginInput {
+	username: String!
+	password: String!
+	otp: String
+}
+
+type Mutation {
+	login(input: LoginInput!): User
+	reauthenticate(password: String!): User
+	rename(username: String!): User
+	samlLogin(assertion: String!): User
+}
+`
+
+func TestRedact(t *testing.T) {
+	schema := gqlparser.MustLoadSchema(&ast.Source{Name: "schema.graphql", Input: testSchema})
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		redact    []string
+		want      map[string]interface{}
+	}{
+		{
+			name:      "renamed variable",
+			query:     `mutation($p: String!) { reauthenticate(password: $p) { id } }`,
+			variables: map[string]interface{}{"p": "hunter2"},
+			want:      map[string]interface{}{"p": redacted},
+		},
+		{
+			name:      "variables in an input object",
+			query:     `mutation($u: String!, $x: String!, $y: String) { login(input: {username: $u, password: $x, otp: $y}) { id } }`,
+			variables: map[string]interface{}{"u": "ada", "x": "hunter2", "y": "123456"},
+			want:      map[string]interface{}{"u": "ada", "x": redacted, "y": redacted},
+		},
+		{
+			name:      "input object variable",
+			query:     `mutation($in: LoginInput!) { login(input: $in) { id } }`,
+			variables: map[string]interface{}{"in": map[string]interface{}{"username": "ada", "password": "hunter2", "otp": "123456"}},
+			want:      map[string]interface{}{"in": map[string]interface{}{"username": "ada", "password": redacted, "otp": redacted}},
+		},
+		{
+			name:      "variable in a fragment",
+			query:     `query($r: String) { me { ...s } } fragment s on User { sessions(refreshToken: $r) }`,
+			variables: map[string]interface{}{"r": "rt_abc"},
+			want:      map[string]interface{}{"r": redacted},
+		},
+		{
+			name:      "variable in an inline fragment",
+			query:     `mutation($a: String!) { ... on Mutation { samlLogin(assertion: $a) { id } } }`,
+			variables: map[string]interface{}{"a": "PHNhbWw+"},
+			want:      map[string]interface{}{"a": redacted},
+		},
+		{
+			name:      "variable named like a secret",
+			query:     `mutation($password: String!) { rename(username: $password) { id } }`,
+			variables: map[string]interface{}{"password": "ada"},
+			want:      map[string]interface{}{"password": redacted},
+		},
+		{
+			name:      "configured names",
+			query:     `mutation($n: String!) { rename(username: $n) { id } }`,
+			variables: map[string]interface{}{"n": "ada"},
+			redact:    []string{"Username"},
+			want:      map[string]interface{}{"n": redacted},
+		},
+		{
+			name:      "no secrets",
+			query:     `mutation($n: String!) { rename(username: $n) { id } }`,
+			variables: map[string]interface{}{"n": "ada"},
+			want:      map[string]interface{}{"n": "ada"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, errs := gqlparser.LoadQuery(schema, tt.query)
+			if len(errs) > 0 {
+				t.Fatalf("invalid query: %v", errs)
+			}
+
+			g := GraphQL{Variables: true, Redact: tt.redact}
+			got := g.redact(tt.variables, bindings(doc.Operations[0]))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redact() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package logging
+
+// Structured JSON logging. Every request gets an id and a logger carrying
+// it in its context, handlers add fields such as the user or the GraphQL
+// operation so the access log line written when the request completes has
+// all of them. Request bodies and headers are never logged, and GraphQL
+// variables only with passwords, tokens and other secrets redacted, so
+// they can't leak into the output. Busy deployments can log a sample of
+// successful requests, failures are always logged.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Logger is used outside of requests, e.g. by background jobs
+var Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+type contextKey struct{}
+
+// keepKey marks requests to log whatever the sampling
+type keepKey struct{}
+
+// sampleRate is the share of successful requests logged
+var sampleRate = 1.0
+
+// SetSampleRate logs only a share of successful requests, between 0 and 1
+func SetSampleRate(rate float64) {
+	sampleRate = rate
+}
+
+// Keep logs the request in ctx even when it isn't sampled, e.g. because it
+// failed in a way its status doesn't tell
+func Keep(ctx context.Context) {
+	if keep, ok := ctx.Value(keepKey{}).(*bool); ok {
+		*keep = true
+	}
+}
+
+// SetLevel changes the minimum level that is logged, e.g. "debug" or "warn"
+func SetLevel(level string) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	Logger = Logger.Level(lvl)
+	return nil
+}
+
+// Ctx returns the logger of the request in ctx, falling back to Logger
+func Ctx(ctx context.Context) *zerolog.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*zerolog.Logger); ok {
+		return l
+	}
+
+	return &Logger
+}
+
+// With adds a string field to the logger of the request in ctx
+func With(ctx context.Context, key, value string) {
+	update(ctx, func(c zerolog.Context) zerolog.Context {
+		return c.Str(key, value)
+	})
+}
+
+// update changes the fields of the logger of the request in ctx
+func update(ctx context.Context, fn func(c zerolog.Context) zerolog.Context) {
+	if l, ok := ctx.Value(contextKey{}).(*zerolog.Logger); ok {
+		l.UpdateContext(fn)
+	}
+}
+
+// RequestID returns the id assigned to the request in ctx
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type requestIDKey struct{}
+
+// validRequestID accepts ids sent by proxies as long as they can't mess up the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID returns a random id
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware assigns a request id, echoed in the X-Request-ID header, stores
+// a logger in the request context and logs the request once it completes
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		l := Logger.With().Str("request_id", id).Logger()
+		keep := false
+		ctx := context.WithValue(r.Context(), contextKey{}, &l)
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+		ctx = context.WithValue(ctx, keepKey{}, &keep)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if !keep && rec.status < http.StatusBadRequest && sampleRate < 1 && mathrand.Float64() >= sampleRate {
+			return
+		}
+		l.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", rec.status).
+			Dur("latency", time.Since(start)).
+			Msg("request")
+	})
+}
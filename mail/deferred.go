@@ -0,0 +1,35 @@
+package mail
+
+import (
+	"context"
+
+	"github.com/cesar-yoab/authService/jobs"
+)
+
+// jobType is the type of the background jobs sending emails
+const jobType = "email"
+
+// Deferred queues messages as background jobs sent through another Mailer,
+// failures are retried by the job runner. Send only queues the message.
+type Deferred struct {
+	runner *jobs.Runner
+}
+
+// NewDeferred registers the job sending messages through mailer and returns
+// the Mailer queueing them
+func NewDeferred(runner *jobs.Runner, mailer Mailer) *Deferred {
+	runner.Handle(jobType, func(ctx context.Context, job *jobs.Job) error {
+		var msg Message
+		if err := job.Decode(&msg); err != nil {
+			return err
+		}
+		return mailer.Send(ctx, msg)
+	})
+
+	return &Deferred{runner: runner}
+}
+
+// Send implements Mailer, the message is sent later
+func (d *Deferred) Send(ctx context.Context, msg Message) error {
+	return d.runner.Enqueue(ctx, jobType, msg)
+}
@@ -0,0 +1,34 @@
+package mail
+
+// Outbound email. Flows that notify users go through the Mailer interface so
+// the delivery provider can be swapped without touching them.
+
+import (
+	"context"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// Message is an email to a single recipient, HTML is optional and the text
+// is the fallback of clients that don't show it
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Log writes messages to the log instead of sending them, it is used when no
+// provider is configured
+type Log struct{}
+
+// Send implements Mailer
+func (Log) Send(ctx context.Context, msg Message) error {
+	logging.Ctx(ctx).Info().Str("to", msg.To).Str("subject", msg.Subject).Msg("email not sent, no mail provider configured")
+	return nil
+}
@@ -0,0 +1,142 @@
+package mail
+
+// Amazon SES client using the v2 SendEmail API. Requests are signed with
+// Signature Version 4, see https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sesPath is the SendEmail endpoint
+const sesPath = "/v2/email/outbound-emails"
+
+// SES sends messages with Amazon SES
+type SES struct {
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	from         string
+	client       *http.Client
+}
+
+// NewSES returns a mailer for SES in region, credentials are the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optional AWS_SESSION_TOKEN
+func NewSES(region, accessKey, secretKey, sessionToken, from string) *SES {
+	return &SES{
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		from:         from,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type sesData struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset"`
+}
+
+// sesEmail is the body of a SendEmail request
+type sesEmail struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses []string `json:"ToAddresses"`
+	} `json:"Destination"`
+	Content struct {
+		Simple struct {
+			Subject sesData `json:"Subject"`
+			Body    struct {
+				Text sesData  `json:"Text"`
+				HTML *sesData `json:"Html,omitempty"`
+			} `json:"Body"`
+		} `json:"Simple"`
+	} `json:"Content"`
+}
+
+// Send implements Mailer
+func (s *SES) Send(ctx context.Context, msg Message) error {
+	var email sesEmail
+	email.FromEmailAddress = s.from
+	email.Destination.ToAddresses = []string{msg.To}
+	email.Content.Simple.Subject = sesData{Data: msg.Subject, Charset: "UTF-8"}
+	email.Content.Simple.Body.Text = sesData{Data: msg.Text, Charset: "UTF-8"}
+	if msg.HTML != "" {
+		email.Content.Simple.Body.HTML = &sesData{Data: msg.HTML, Charset: "UTF-8"}
+	}
+
+	body, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+
+	host := "email." + s.region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+sesPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, host, body, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("ses answered %s", res.Status)
+	}
+
+	return nil
+}
+
+// sign adds the SigV4 Authorization header to req
+func (s *SES) sign(req *http.Request, host string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := "content-type;host;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + host + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		headers += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + s.sessionToken + "\n"
+	}
+
+	canonicalRequest := "POST\n" + sesPath + "\n\n" + canonicalHeaders + "\n" + headers + "\n" + hashHex(body)
+	scope := date + "/" + s.region + "/ses/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "ses")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+headers+", Signature="+signature)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
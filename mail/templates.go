@@ -0,0 +1,149 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Messages are a pair of templates in a directory per locale, e.g.
+// templates/en/login_alert.txt and templates/en/login_alert.html. The text
+// template defines the subject in a "subject" block, the HTML one is optional.
+//
+//go:embed templates
+var builtin embed.FS
+
+// Templates renders the messages of every locale
+type Templates struct {
+	// Locale used when the user's has no translation
+	fallback string
+	text     map[string]*texttemplate.Template
+	html     map[string]*htmltemplate.Template
+}
+
+// LoadTemplates parses the built in templates, then the ones in dir which
+// replace them or add locales. dir may be empty.
+func LoadTemplates(dir, fallback string) (*Templates, error) {
+	t := &Templates{
+		fallback: strings.ToLower(fallback),
+		text:     map[string]*texttemplate.Template{},
+		html:     map[string]*htmltemplate.Template{},
+	}
+
+	sub, err := fs.Sub(builtin, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if err := t.load(sub); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := t.load(os.DirFS(dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	for key := range t.text {
+		if strings.HasPrefix(key, t.fallback+"/") {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no templates for locale %q", fallback)
+}
+
+// load parses every template of fsys, keyed by locale/name
+func (t *Templates) load(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		ext := path.Ext(p)
+		if ext != ".txt" && ext != ".html" {
+			return nil
+		}
+		key := strings.ToLower(strings.TrimSuffix(p, ext))
+
+		src, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		if ext == ".txt" {
+			tmpl, err := texttemplate.New(key).Parse(string(src))
+			if err != nil {
+				return fmt.Errorf("template %s: %w", p, err)
+			}
+			if tmpl.Lookup("subject") == nil {
+				return fmt.Errorf("template %s doesn't define a subject", p)
+			}
+			t.text[key] = tmpl
+		} else {
+			tmpl, err := htmltemplate.New(key).Parse(string(src))
+			if err != nil {
+				return fmt.Errorf("template %s: %w", p, err)
+			}
+			t.html[key] = tmpl
+		}
+
+		return nil
+	})
+}
+
+// lookup picks the translation of name closest to locale: "pt-br", then "pt",
+// then the fallback locale
+func (t *Templates) lookup(name, locale string) (string, bool) {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, t.fallback)
+
+	for _, l := range candidates {
+		if _, ok := t.text[l+"/"+name]; ok && l != "" {
+			return l + "/" + name, true
+		}
+	}
+
+	return "", false
+}
+
+// Render builds message name for a recipient in their locale, data is
+// available to the templates
+func (t *Templates) Render(name, locale, to string, data interface{}) (Message, error) {
+	key, ok := t.lookup(name, locale)
+	if !ok {
+		return Message{}, fmt.Errorf("no template for %s", name)
+	}
+
+	var subject, text bytes.Buffer
+	if err := t.text[key].ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, err
+	}
+	if err := t.text[key].Execute(&text, data); err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}
+
+	if tmpl, ok := t.html[key]; ok {
+		var html bytes.Buffer
+		if err := tmpl.Execute(&html, data); err != nil {
+			return Message{}, err
+		}
+		msg.HTML = html.String()
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,105 @@
+package metrics
+
+// Prometheus instrumentation for the service. Collectors are registered
+// with the default registry and exposed by Handler.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Registrations counts users successfully registered
+	Registrations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_registrations_total",
+		Help: "Number of users registered.",
+	})
+
+	// Logins counts authentication attempts by result, "success" or "failure"
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_logins_total",
+		Help: "Number of login attempts by result.",
+	}, []string{"result"})
+
+	// TokensIssued counts every signed token
+	TokensIssued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_tokens_issued_total",
+		Help: "Number of tokens issued.",
+	})
+
+	// TokenRefreshes counts refresh attempts by result, "success" or "failure"
+	TokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_token_refreshes_total",
+		Help: "Number of token refresh attempts by result.",
+	}, []string{"result"})
+
+	// HashDuration observes how long hashing a password takes
+	HashDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "auth_password_hash_duration_seconds",
+		Help:    "Time spent hashing passwords.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	// MongoDuration observes Mongo commands by command name
+	MongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_mongo_command_duration_seconds",
+		Help:    "Duration of Mongo commands.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command", "result"})
+
+	// JobsQueued counts background jobs queued by type
+	JobsQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_jobs_queued_total",
+		Help: "Number of background jobs queued by type.",
+	}, []string{"type"})
+
+	// JobsProcessed counts runs of background jobs and periodic tasks by type and result
+	JobsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_jobs_processed_total",
+		Help: "Number of background job runs by type and result.",
+	}, []string{"type", "result"})
+
+	// JobDuration observes how long background jobs take by type
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "auth_job_duration_seconds",
+		Help:    "Duration of background job runs.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+)
+
+// Result returns the label value for an operation that returned err
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
+
+// ObserveSince records the time elapsed since start in h
+func ObserveSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// MongoMonitor returns a command monitor for the Mongo client that feeds MongoDuration
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			MongoDuration.WithLabelValues(e.CommandName, "success").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			MongoDuration.WithLabelValues(e.CommandName, "failure").Observe(time.Duration(e.DurationNanos).Seconds())
+		},
+	}
+}
+
+// Handler serves the collected metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
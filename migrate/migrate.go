@@ -0,0 +1,141 @@
+package migrate
+
+// Versioned schema migrations. Each migration runs once per database, in
+// order of version, and is recorded in the migrations collection. A lock
+// document keeps instances that start together from running them twice.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection records applied migrations as {_id: version, description, appliedAt}
+const Collection = "migrations"
+
+// lockID is the _id of the lock document, which can't clash with a version
+const lockID = "lock"
+
+// lockTTL is how long a lock is honored, in case its holder died mid run
+const lockTTL = 10 * time.Minute
+
+// Migration is a change to the data, Up must be safe to run again if the
+// process dies before the migration is recorded
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// Run applies the migrations db hasn't seen yet and returns how many ran
+func Run(ctx context.Context, db *mongo.Database, migrations []Migration) (int, error) {
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	collection := db.Collection(Collection)
+	if err := lock(ctx, collection); err != nil {
+		return 0, err
+	}
+	defer unlock(collection)
+
+	applied, err := appliedVersions(ctx, collection)
+	if err != nil {
+		return 0, err
+	}
+
+	ran := 0
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		logging.Logger.Info().Int("version", m.Version).Str("migration", m.Description).Msg("applying migration")
+		if err := m.Up(ctx, db); err != nil {
+			return ran, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+
+		record := bson.M{"_id": m.Version, "description": m.Description, "appliedAt": time.Now()}
+		if _, err := collection.InsertOne(ctx, record); err != nil {
+			return ran, fmt.Errorf("could not record migration %d: %w", m.Version, err)
+		}
+		ran++
+	}
+
+	return ran, nil
+}
+
+// appliedVersions returns the versions recorded in the collection
+func appliedVersions(ctx context.Context, collection *mongo.Collection) (map[int]bool, error) {
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []struct {
+		Version int `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]bool{}
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+
+	return applied, nil
+}
+
+// lock takes the migration lock, waiting for another instance to finish
+func lock(ctx context.Context, collection *mongo.Collection) error {
+	for {
+		now := time.Now()
+		// Takes the lock when it is missing or expired, fails with a duplicate key while it is held
+		filter := bson.M{"_id": lockID, "expiresAt": bson.M{"$lt": now}}
+		update := bson.M{"$set": bson.M{"expiresAt": now.Add(lockTTL)}}
+		_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+		if !isDuplicateKey(err) {
+			return fmt.Errorf("could not take the migration lock: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the migration lock: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// unlock releases the lock, even when the context of the run was cancelled
+func unlock(collection *mongo.Collection) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": lockID}); err != nil {
+		logging.Logger.Error().Err(err).Msg("could not release the migration lock")
+	}
+}
+
+// isDuplicateKey reports whether err is a unique index violation
+func isDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, writeErr := range e.WriteErrors {
+			if writeErr.Code == 11000 {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == 11000
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+package oauth
+
+// OpenID Connect discovery, userinfo and the keys ID tokens are signed with,
+// so off-the-shelf OpenID Connect clients work with the service. Clients
+// compare the issuer of the document with the one they were configured
+// with, TOKEN_ISSUER must be the public URL of the service for them.
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cesar-yoab/authService/config"
+)
+
+// discoveryPath is where clients look for the discovery document of an issuer
+const discoveryPath = "/.well-known/openid-configuration"
+
+// metadata is the discovery document, OpenID Connect Discovery 1.0 section 3
+type metadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// discovery serves the discovery document, endpoints are under PUBLIC_URL
+func discovery(cfg *config.Config) http.HandlerFunc {
+	base := strings.TrimSuffix(cfg.PublicURL, "/") + "/oauth/"
+	doc := metadata{
+		Issuer:                            cfg.TokenIssuer,
+		TokenEndpoint:                     base + "token",
+		UserinfoEndpoint:                  base + "userinfo",
+		JWKSURI:                           base + "jwks.json",
+		IntrospectionEndpoint:             base + "introspect",
+		RevocationEndpoint:                base + "revoke",
+		ScopesSupported:                   []string{"openid", "profile", "email"},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"ES256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "given_name",
+			"family_name", "preferred_username", "email", "email_verified"},
+	}
+	if cfg.OAuthLoginURL != "" {
+		doc.AuthorizationEndpoint = base + "authorize"
+	}
+	if cfg.OAuthRegistrationToken != "" {
+		doc.RegistrationEndpoint = base + "register"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		writeJSON(w, http.StatusOK, doc)
+	}
+}
+
+// userinfo returns the claims about the user of the bearer token, OpenID
+// Connect Core section 5.3
+func userinfo(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, http.StatusMethodNotAllowed, "invalid_request", "Use GET or POST.")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oauth"`)
+			writeError(w, http.StatusUnauthorized, "invalid_request", "Send the access token as a bearer token.")
+			return
+		}
+
+		claims, err := store.UserInfo(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "invalid_token", message(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, claims)
+	}
+}
+
+// jwks serves the public keys ID tokens, and EdDSA access tokens, are verified with
+func jwks(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Verifiers refetch within minutes of a rotation
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSON(w, http.StatusOK, store.JWKS())
+	}
+}
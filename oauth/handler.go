@@ -0,0 +1,326 @@
+package oauth
+
+// OAuth 2.0 authorization server, RFC 6749, for the authorization code grant
+// with PKCE, RFC 7636. The authorization endpoint validates requests and
+// sends the browser to the login page of the deployment, which shows the
+// request with the authorizationRequest query and answers it with the
+// approveAuthorization or denyAuthorization mutation. The token endpoint
+// exchanges codes and refresh tokens, and issues tokens of service clients
+// with the client_credentials grant. Resource servers check tokens at the
+// introspection endpoint, RFC 7662, and clients revoke theirs at the
+// revocation endpoint, RFC 7009. Apps can register themselves, see
+// register.go. OpenID Connect clients find the endpoints
+// in the discovery document, see discovery.go.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Store is what the endpoints need from the database, implemented by auth.DB
+type Store interface {
+	CreateOAuthClient(ctx context.Context, input *model.OAuthClientInput) (*model.OAuthClientCredentials, error)
+	FindOAuthClient(ctx context.Context, id string) (*auth.OAuthClient, error)
+	AuthenticateClient(ctx context.Context, id, secret string) (*auth.OAuthClient, error)
+	StartAuthorization(ctx context.Context, client *auth.OAuthClient, request *auth.AuthorizationRequest) (string, error)
+	ExchangeCode(ctx context.Context, client *auth.OAuthClient, code, redirectURI, verifier string) (*auth.OAuthToken, error)
+	RefreshOAuthToken(ctx context.Context, client *auth.OAuthClient, token string) (*auth.OAuthToken, error)
+	IssueServiceToken(ctx context.Context, client *auth.OAuthClient, scope string) (*auth.OAuthToken, error)
+	IntrospectToken(ctx context.Context, token, hint string) *auth.Introspection
+	RevokeOAuthToken(ctx context.Context, client *auth.OAuthClient, token string) (string, error)
+	UserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error)
+	JWKS() *auth.JSONWebKeySet
+	Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string)
+}
+
+// errorBody is the body of failed requests, RFC 6749 section 5.2
+type errorBody struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Handler serves the endpoints under /oauth and the OpenID Connect discovery
+// document. /oauth/authorize needs OAUTH_LOGIN_URL to send users to with
+// the id of their request, /oauth/register needs OAUTH_REGISTRATION_TOKEN
+func Handler(store Store, cfg *config.Config) http.Handler {
+	mux := http.NewServeMux()
+	if cfg.OAuthLoginURL != "" {
+		mux.Handle("/oauth/authorize", authorize(store, cfg.OAuthLoginURL))
+	}
+	mux.Handle("/oauth/token", token(store))
+	mux.Handle("/oauth/introspect", introspect(store))
+	mux.Handle("/oauth/revoke", revoke(store))
+	mux.Handle("/oauth/userinfo", userinfo(store))
+	mux.Handle("/oauth/jwks.json", jwks(store))
+	if cfg.OAuthRegistrationToken != "" {
+		mux.Handle("/oauth/register", register(store, cfg.OAuthRegistrationToken))
+	}
+	mux.Handle(discoveryPath, discovery(cfg))
+
+	return mux
+}
+
+// InternalHandler returns the endpoints internal services reach over mutual
+// TLS, REQUIRES auth.RequirePeer to have run
+func InternalHandler(store Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/oauth/introspect", introspect(store))
+
+	return mux
+}
+
+// authorize validates an authorization request and sends the browser to the
+// login page. Until the client and redirect_uri are known to be valid errors
+// are answered here, after that they are sent to the client
+func authorize(store Store, loginURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		client, err := store.FindOAuthClient(r.Context(), query.Get("client_id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Unknown client_id.")
+			return
+		}
+		redirectURI := query.Get("redirect_uri")
+		if !client.AllowsRedirect(redirectURI) {
+			writeError(w, http.StatusBadRequest, "invalid_request", "The redirect_uri isn't registered for the client.")
+			return
+		}
+
+		state := query.Get("state")
+		fail := func(code, description string) {
+			params := url.Values{"error": {code}, "error_description": {description}}
+			if state != "" {
+				params.Set("state", state)
+			}
+			http.Redirect(w, r, withQuery(redirectURI, params), http.StatusFound)
+		}
+
+		if query.Get("response_type") != "code" {
+			fail("unsupported_response_type", "Only the code response type is supported.")
+			return
+		}
+		// PKCE is required of every client, as OAuth 2.1 does
+		challenge := query.Get("code_challenge")
+		if challenge == "" || query.Get("code_challenge_method") != "S256" {
+			fail("invalid_request", "A code_challenge with the S256 method is required.")
+			return
+		}
+
+		id, err := store.StartAuthorization(r.Context(), client, &auth.AuthorizationRequest{
+			RedirectURI:   redirectURI,
+			Scope:         query.Get("scope"),
+			State:         state,
+			CodeChallenge: challenge,
+			Nonce:         query.Get("nonce"),
+		})
+		if err != nil {
+			var oauthErr *auth.OAuthError
+			if errors.As(err, &oauthErr) {
+				fail(oauthErr.Code, oauthErr.Description)
+				return
+			}
+			fail("server_error", message(err))
+			return
+		}
+
+		http.Redirect(w, r, withQuery(loginURL, url.Values{"request": {id}}), http.StatusFound)
+	}
+}
+
+// token exchanges codes and refresh tokens of authenticated clients, and
+// issues tokens to service clients
+func token(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, ok := clientRequest(w, r, store)
+		if !ok {
+			return
+		}
+
+		var res *auth.OAuthToken
+		var err error
+		grant := r.PostForm.Get("grant_type")
+		switch grant {
+		case "authorization_code":
+			res, err = store.ExchangeCode(r.Context(), client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		case "refresh_token":
+			res, err = store.RefreshOAuthToken(r.Context(), client, r.PostForm.Get("refresh_token"))
+		case "client_credentials":
+			res, err = store.IssueServiceToken(r.Context(), client, r.PostForm.Get("scope"))
+		default:
+			writeError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code, refresh_token and client_credentials grants are supported.")
+			return
+		}
+		if err != nil {
+			fail(w, err)
+			return
+		}
+
+		store.Audit(r.Context(), model.AuditEventTypeTokenRefresh, client.ID.Hex(), map[string]string{"client": client.ID.Hex(), "grant": grant})
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// introspect describes a token to a confidential client or to an internal
+// service identified by its certificate, RFC 7662
+func introspect(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth.PeerForContext(r.Context()) != nil {
+			if formRequest(w, r) {
+				writeJSON(w, http.StatusOK, store.IntrospectToken(r.Context(), r.PostForm.Get("token"), r.PostForm.Get("token_type_hint")))
+			}
+			return
+		}
+
+		client, ok := clientRequest(w, r, store)
+		if !ok {
+			return
+		}
+		// Public clients could be anyone
+		if client.Public() {
+			fail(w, &auth.OAuthError{Code: "invalid_client", Description: "Public clients can't introspect tokens."})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, store.IntrospectToken(r.Context(), r.PostForm.Get("token"), r.PostForm.Get("token_type_hint")))
+	}
+}
+
+// revoke revokes a token of the client, RFC 7009. Unknown tokens are
+// answered like revoked ones
+func revoke(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, ok := clientRequest(w, r, store)
+		if !ok {
+			return
+		}
+
+		userID, err := store.RevokeOAuthToken(r.Context(), client, r.PostForm.Get("token"))
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		if userID != "" {
+			store.Audit(r.Context(), model.AuditEventTypeLogout, userID, map[string]string{"client": client.ID.Hex()})
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// clientRequest checks a POST of a client to the token endpoints and returns
+// the client, failed requests are answered
+func clientRequest(w http.ResponseWriter, r *http.Request, store Store) (*auth.OAuthClient, bool) {
+	if !formRequest(w, r) {
+		return nil, false
+	}
+
+	client, err := authenticate(r.Context(), store, r)
+	if err != nil {
+		fail(w, err)
+		return nil, false
+	}
+
+	return client, true
+}
+
+// formRequest parses the form of a POST request, answering the others with
+// an error
+func formRequest(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST.")
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid form body.")
+		return false
+	}
+
+	return true
+}
+
+// authenticate returns the client of a token request, authenticated with
+// HTTP Basic or the client_id and client_secret parameters
+func authenticate(ctx context.Context, store Store, r *http.Request) (*auth.OAuthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// Credentials are form encoded before Basic encoding, RFC 6749 section 2.3.1
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil, &auth.OAuthError{Code: "invalid_client", Description: "Invalid client credentials."}
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, &auth.OAuthError{Code: "invalid_client", Description: "Invalid client credentials."}
+		}
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	return store.AuthenticateClient(ctx, id, secret)
+}
+
+// fail answers a failed token request
+func fail(w http.ResponseWriter, err error) {
+	var oauthErr *auth.OAuthError
+	if !errors.As(err, &oauthErr) {
+		writeError(w, http.StatusBadRequest, "invalid_request", message(err))
+		return
+	}
+
+	status := http.StatusBadRequest
+	switch oauthErr.Code {
+	case "invalid_client":
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		status = http.StatusUnauthorized
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	writeError(w, status, oauthErr.Code, oauthErr.Description)
+}
+
+// withQuery adds params to the query of rawURL, keeping the ones it has
+func withQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// message returns the client facing text of err, without the "input: "
+// prefix gqlerror adds
+func message(err error) string {
+	if gqlErr, ok := err.(*gqlerror.Error); ok {
+		return gqlErr.Message
+	}
+
+	return err.Error()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, errorBody{Error: code, Description: description})
+}
@@ -0,0 +1,393 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/graph/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testRedirect = "https://app.example.com/callback"
+	testLogin    = "https://login.example.com/authorize"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// fakeRefresh is a refresh token of fakeStore, tokens rotated from the same
+// code share a family
+type fakeRefresh struct {
+	clientID string
+	family   int
+	used     bool
+}
+
+// fakeStore keeps clients, codes and refresh tokens in memory, and follows
+// the rules auth.DB does: codes are taken on the first attempt and proven
+// with the S256 challenge, refresh tokens are replaced on every use and
+// exchanging one again revokes its family. The endpoints under test don't
+// call the other methods of Store
+type fakeStore struct {
+	Store
+	clients  map[string]*auth.OAuthClient
+	secrets  map[string]string
+	requests []*auth.AuthorizationRequest
+	// Challenge of every code, by code
+	codes   map[string]string
+	refresh map[string]*fakeRefresh
+	revoked map[int]bool
+	issued  int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		clients: map[string]*auth.OAuthClient{},
+		secrets: map[string]string{},
+		codes:   map[string]string{},
+		refresh: map[string]*fakeRefresh{},
+		revoked: map[int]bool{},
+	}
+}
+
+// addClient registers a client, public when secret is empty
+func (s *fakeStore) addClient(secret string) *auth.OAuthClient {
+	client := &auth.OAuthClient{ID: primitive.NewObjectID(), RedirectURIs: []string{testRedirect}}
+	if secret != "" {
+		client.SecretHash = "hash of " + secret
+	}
+	s.clients[client.ID.Hex()] = client
+	s.secrets[client.ID.Hex()] = secret
+
+	return client
+}
+
+func (s *fakeStore) FindOAuthClient(ctx context.Context, id string) (*auth.OAuthClient, error) {
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown client %s", id)
+	}
+
+	return client, nil
+}
+
+func (s *fakeStore) AuthenticateClient(ctx context.Context, id, secret string) (*auth.OAuthClient, error) {
+	client, ok := s.clients[id]
+	if !ok || (!client.Public() && s.secrets[id] != secret) {
+		return nil, &auth.OAuthError{Code: "invalid_client", Description: "Unknown client or wrong secret."}
+	}
+
+	return client, nil
+}
+
+func (s *fakeStore) StartAuthorization(ctx context.Context, client *auth.OAuthClient, request *auth.AuthorizationRequest) (string, error) {
+	s.requests = append(s.requests, request)
+
+	return fmt.Sprintf("request-%d", len(s.requests)), nil
+}
+
+func (s *fakeStore) ExchangeCode(ctx context.Context, client *auth.OAuthClient, code, redirectURI, verifier string) (*auth.OAuthToken, error) {
+	challenge, ok := s.codes[code]
+	delete(s.codes, code)
+	if !ok {
+		return nil, &auth.OAuthError{Code: "invalid_grant", Description: "The code is invalid, expired or was already used."}
+	}
+	if challengeOf(verifier) != challenge {
+		return nil, &auth.OAuthError{Code: "invalid_grant", Description: "The code_verifier doesn't match the code_challenge."}
+	}
+
+	s.issued++
+	return s.issue(client, s.issued), nil
+}
+
+func (s *fakeStore) RefreshOAuthToken(ctx context.Context, client *auth.OAuthClient, token string) (*auth.OAuthToken, error) {
+	record, ok := s.refresh[token]
+	if !ok || record.clientID != client.ID.Hex() || s.revoked[record.family] {
+		return nil, &auth.OAuthError{Code: "invalid_grant", Description: "The refresh token is invalid or expired."}
+	}
+	if record.used {
+		s.revoked[record.family] = true
+		return nil, &auth.OAuthError{Code: "invalid_grant", Description: "The refresh token is invalid or expired."}
+	}
+	record.used = true
+
+	return s.issue(client, record.family), nil
+}
+
+// issue returns tokens of a new refresh token in family
+func (s *fakeStore) issue(client *auth.OAuthClient, family int) *auth.OAuthToken {
+	refresh := fmt.Sprintf("refresh-%d", len(s.refresh)+1)
+	s.refresh[refresh] = &fakeRefresh{clientID: client.ID.Hex(), family: family}
+
+	return &auth.OAuthToken{AccessToken: "access-" + refresh, TokenType: "Bearer", RefreshToken: refresh}
+}
+
+func (s *fakeStore) IntrospectToken(ctx context.Context, token, hint string) *auth.Introspection {
+	return &auth.Introspection{Active: token == "access-refresh-1"}
+}
+
+func (s *fakeStore) Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string) {
+}
+
+// challengeOf returns the S256 code_challenge of verifier, RFC 7636 section 4.2
+func challengeOf(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func testHandler(store *fakeStore) http.Handler {
+	return Handler(store, &config.Config{OAuthLoginURL: testLogin})
+}
+
+// post sends a form to path, with the client credentials in HTTP Basic when
+// id is set
+func post(handler http.Handler, path string, form url.Values, id, secret string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id != "" {
+		r.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// decode returns the JSON body of a response
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("invalid body %q: %v", w.Body.String(), err)
+	}
+}
+
+func TestAuthorizeRequiresS256(t *testing.T) {
+	challenge := challengeOf(testVerifier)
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		wantError string
+	}{
+		{name: "s256", challenge: challenge, method: "S256"},
+		{name: "plain", challenge: testVerifier, method: "plain", wantError: "invalid_request"},
+		{name: "no method", challenge: challenge, wantError: "invalid_request"},
+		{name: "lowercase method", challenge: challenge, method: "s256", wantError: "invalid_request"},
+		{name: "no challenge", method: "S256", wantError: "invalid_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			client := store.addClient("")
+			query := url.Values{
+				"client_id":     {client.ID.Hex()},
+				"redirect_uri":  {testRedirect},
+				"response_type": {"code"},
+				"state":         {"xyz"},
+			}
+			if tt.challenge != "" {
+				query.Set("code_challenge", tt.challenge)
+			}
+			if tt.method != "" {
+				query.Set("code_challenge_method", tt.method)
+			}
+			w := httptest.NewRecorder()
+			testHandler(store).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+query.Encode(), nil))
+
+			if w.Code != http.StatusFound {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusFound)
+			}
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("invalid Location: %v", err)
+			}
+			if tt.wantError == "" {
+				if !strings.HasPrefix(location.String(), testLogin+"?") || len(store.requests) != 1 {
+					t.Fatalf("Location = %s, want the login page with the request", location)
+				}
+				if got := store.requests[0].CodeChallenge; got != tt.challenge {
+					t.Errorf("stored challenge = %q, want %q", got, tt.challenge)
+				}
+				return
+			}
+
+			if got := location.Query().Get("error"); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+			if got := location.Query().Get("state"); got != "xyz" {
+				t.Errorf("state = %q, want xyz", got)
+			}
+			if len(store.requests) != 0 {
+				t.Error("authorization request stored without an S256 challenge")
+			}
+		})
+	}
+}
+
+func TestTokenCodeReuse(t *testing.T) {
+	store := newFakeStore()
+	client := store.addClient("secret")
+	handler := testHandler(store)
+	store.codes["code"] = challengeOf(testVerifier)
+	store.codes["other"] = challengeOf(testVerifier)
+	exchange := func(code, verifier string) *httptest.ResponseRecorder {
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirect}, "code_verifier": {verifier}}
+		return post(handler, "/oauth/token", form, client.ID.Hex(), "secret")
+	}
+
+	if w := exchange("code", testVerifier); w.Code != http.StatusOK {
+		t.Fatalf("first exchange status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	// A wrong verifier uses the code up too
+	if w := exchange("other", "wrong"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong verifier status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	for _, code := range []string{"code", "other"} {
+		w := exchange(code, testVerifier)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("reused %s status = %d, want %d", code, w.Code, http.StatusBadRequest)
+		}
+		var body errorBody
+		decode(t, w, &body)
+		if body.Error != "invalid_grant" {
+			t.Errorf("reused %s error = %q, want invalid_grant", code, body.Error)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Cache-Control = %q, want no-store", got)
+		}
+	}
+}
+
+func TestTokenRefreshReuse(t *testing.T) {
+	store := newFakeStore()
+	client := store.addClient("secret")
+	handler := testHandler(store)
+	store.codes["code"] = challengeOf(testVerifier)
+
+	var first auth.OAuthToken
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {"code"}, "redirect_uri": {testRedirect}, "code_verifier": {testVerifier}}
+	w := post(handler, "/oauth/token", form, client.ID.Hex(), "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("exchange status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	decode(t, w, &first)
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}}
+		return post(handler, "/oauth/token", form, client.ID.Hex(), "secret")
+	}
+
+	var second auth.OAuthToken
+	w = refresh(first.RefreshToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	decode(t, w, &second)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token %q wasn't replaced", first.RefreshToken)
+	}
+
+	// Replaying the first token revokes the one that replaced it
+	for _, token := range []string{first.RefreshToken, second.RefreshToken} {
+		w := refresh(token)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("refresh of %s after reuse status = %d, want %d", token, w.Code, http.StatusBadRequest)
+		}
+		var body errorBody
+		decode(t, w, &body)
+		if body.Error != "invalid_grant" {
+			t.Errorf("refresh of %s after reuse error = %q, want invalid_grant", token, body.Error)
+		}
+	}
+
+	// Another client can't use the tokens at all
+	other := store.addClient("other")
+	store.codes["code"] = challengeOf(testVerifier)
+	var third auth.OAuthToken
+	decode(t, post(handler, "/oauth/token", form, client.ID.Hex(), "secret"), &third)
+	w = post(handler, "/oauth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {third.RefreshToken}}, other.ID.Hex(), "other")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("refresh by another client status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := refresh(third.RefreshToken); w.Code != http.StatusOK {
+		t.Errorf("refresh by its client status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestIntrospectAuthenticatesClient(t *testing.T) {
+	store := newFakeStore()
+	confidential := store.addClient("s3cret/+")
+	public := store.addClient("")
+	handler := testHandler(store)
+
+	tests := []struct {
+		name       string
+		method     string
+		form       url.Values
+		id         string
+		secret     string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "basic", method: http.MethodPost, id: confidential.ID.Hex(), secret: "s3cret/+", wantStatus: http.StatusOK},
+		{
+			name:       "form",
+			method:     http.MethodPost,
+			form:       url.Values{"client_id": {confidential.ID.Hex()}, "client_secret": {"s3cret/+"}},
+			wantStatus: http.StatusOK,
+		},
+		{name: "no credentials", method: http.MethodPost, wantStatus: http.StatusUnauthorized, wantError: "invalid_client"},
+		{name: "wrong secret", method: http.MethodPost, id: confidential.ID.Hex(), secret: "wrong", wantStatus: http.StatusUnauthorized, wantError: "invalid_client"},
+		{name: "unknown client", method: http.MethodPost, id: primitive.NewObjectID().Hex(), secret: "s3cret/+", wantStatus: http.StatusUnauthorized, wantError: "invalid_client"},
+		{name: "public client", method: http.MethodPost, id: public.ID.Hex(), wantStatus: http.StatusUnauthorized, wantError: "invalid_client"},
+		{name: "get", method: http.MethodGet, id: confidential.ID.Hex(), secret: "s3cret/+", wantStatus: http.StatusMethodNotAllowed, wantError: "invalid_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"token": {"access-refresh-1"}}
+			for key, values := range tt.form {
+				form[key] = values
+			}
+			r := httptest.NewRequest(tt.method, "/oauth/introspect", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.id != "" {
+				r.SetBasicAuth(url.QueryEscape(tt.id), url.QueryEscape(tt.secret))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantError == "" {
+				var res auth.Introspection
+				decode(t, w, &res)
+				if !res.Active {
+					t.Error("token introspected as inactive")
+				}
+				return
+			}
+
+			var body errorBody
+			decode(t, w, &body)
+			if body.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", body.Error, tt.wantError)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
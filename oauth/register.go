@@ -0,0 +1,124 @@
+package oauth
+
+// Dynamic client registration, RFC 7591. Apps register themselves with the
+// initial access token of OAUTH_REGISTRATION_TOKEN, which the deployment
+// hands out to the teams allowed to, instead of asking an administrator to
+// run createOAuthClient. Clients get the same checks either way.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
+// clientMetadata is the body of registration requests and responses, RFC 7591
+// section 2
+type clientMetadata struct {
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+}
+
+// registration is the answer to a registration, RFC 7591 section 3.2.1
+type registration struct {
+	clientMetadata
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt      int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+}
+
+// register creates a client from the metadata of a request bearing the
+// initial access token
+func register(store Store, initialToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST.")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(initialToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "invalid_token", "A valid initial access token is required.")
+			return
+		}
+
+		var meta clientMetadata
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&meta); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_client_metadata", "Invalid JSON body.")
+			return
+		}
+
+		public := false
+		switch meta.TokenEndpointAuthMethod {
+		case "", "client_secret_basic", "client_secret_post":
+			meta.TokenEndpointAuthMethod = "client_secret_basic"
+		case "none":
+			public = true
+		default:
+			writeError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported token_endpoint_auth_method.")
+			return
+		}
+		grants := []model.GrantType{}
+		for _, grant := range meta.GrantTypes {
+			g := model.GrantType(strings.ToUpper(grant))
+			if !g.IsValid() {
+				writeError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported grant type "+grant+".")
+				return
+			}
+			grants = append(grants, g)
+		}
+		if len(meta.GrantTypes) == 0 {
+			grants = nil
+		}
+		if len(meta.RedirectURIs) == 0 && (grants == nil || containsGrant(grants, model.GrantTypeAuthorizationCode)) {
+			writeError(w, http.StatusBadRequest, "invalid_redirect_uri", "At least one redirect_uri is required.")
+			return
+		}
+
+		credentials, err := store.CreateOAuthClient(r.Context(), &model.OAuthClientInput{
+			Name:         meta.ClientName,
+			RedirectUris: meta.RedirectURIs,
+			Public:       &public,
+			GrantTypes:   grants,
+			Scopes:       strings.Fields(meta.Scope),
+		})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_client_metadata", message(err))
+			return
+		}
+
+		client := credentials.Client
+		res := registration{clientMetadata: meta, ClientID: client.ID, ClientIDIssuedAt: client.CreatedAt.Unix()}
+		res.GrantTypes = []string{}
+		for _, grant := range client.GrantTypes {
+			res.GrantTypes = append(res.GrantTypes, strings.ToLower(string(grant)))
+		}
+		res.Scope = strings.Join(client.Scopes, " ")
+		if credentials.Secret != nil {
+			res.ClientSecret = *credentials.Secret
+		}
+
+		store.Audit(r.Context(), model.AuditEventTypeAdminAction, client.ID, map[string]string{"action": "registerOAuthClient"})
+		writeJSON(w, http.StatusCreated, res)
+	}
+}
+
+// containsGrant reports whether grants include grant
+func containsGrant(grants []model.GrantType, grant model.GrantType) bool {
+	for _, g := range grants {
+		if g == grant {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// loginCookie holds the state, nonce and PKCE verifier of a login in
+// progress, so the callback can only complete a login the same browser
+// started, and the link token when the login links an identity
+const loginCookie = "oidc_login"
+
+// loginTTL is how long a login can take at the provider
+const loginTTL = 10 * time.Minute
+
+// Store is what the endpoints need from the database, implemented by auth.DB
+type Store interface {
+	SSOLogin(ctx context.Context, org string, identity *auth.SSOIdentity) (*model.Token, bool, error)
+	LinkIdentity(ctx context.Context, token, org string, identity *auth.SSOIdentity) (string, error)
+	Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string)
+}
+
+// errorBody is the body of failed requests, as in the rest package
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Handler starts logins with p at /oidc/login and completes them at /oidc/callback
+func Handler(store Store, p *Provider) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oidc/login", p.login)
+	mux.Handle("/oidc/callback", p.callback(store))
+
+	return mux
+}
+
+// login redirects to the provider with a new state, nonce and PKCE verifier.
+// With the link parameter of linkIdentity the login links the identity instead
+func (p *Provider) login(w http.ResponseWriter, r *http.Request) {
+	var values [3]string
+	for i := range values {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			writeError(w, http.StatusInternalServerError, "server_error", "Could not start the login.")
+			return
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	value := strings.Join(values[:], ".")
+	if link := r.URL.Query().Get("link"); link != "" {
+		value += "." + link
+	}
+	http.SetCookie(w, p.cookie(value, int(loginTTL.Seconds())))
+	http.Redirect(w, r, p.AuthURL(state, nonce, verifier), http.StatusFound)
+}
+
+// cookie returns the login cookie. The provider redirects back with a top
+// level GET, which Lax cookies survive
+func (p *Provider) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/oidc/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.RedirectURI, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// callback exchanges the code the provider redirected back with and logs the user in
+func (p *Provider) callback(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(loginCookie)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Start the login at /oidc/login.")
+			return
+		}
+		// The login is completed once, whatever the outcome
+		http.SetCookie(w, p.cookie("", -1))
+
+		// Link tokens have dots of their own
+		values := strings.SplitN(cookie.Value, ".", 4)
+		query := r.URL.Query()
+		if len(values) < 3 || query.Get("state") != values[0] {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Start the login at /oidc/login.")
+			return
+		}
+		nonce, verifier := values[1], values[2]
+
+		// Why a login was rejected is only audited, not told to the browser
+		fail := func(subject, reason, msg string) {
+			store.Audit(r.Context(), model.AuditEventTypeLoginFailure, subject, map[string]string{"method": "oidc", "reason": reason})
+			writeError(w, http.StatusForbidden, "access_denied", msg)
+		}
+
+		if code := query.Get("error"); code != "" {
+			fail("", code+": "+query.Get("error_description"), "The login was cancelled or denied.")
+			return
+		}
+		claims, err := p.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+		if err != nil {
+			fail("", err.Error(), "Could not log in with the identity provider.")
+			return
+		}
+
+		identity := p.Identity(claims)
+		if len(values) == 4 {
+			userID, err := store.LinkIdentity(r.Context(), values[3], p.Org, identity)
+			if err != nil {
+				writeError(w, http.StatusForbidden, "access_denied", message(err))
+				return
+			}
+			store.Audit(r.Context(), model.AuditEventTypeAccountLinked, userID, map[string]string{"method": "oidc", "issuer": identity.Issuer})
+			linked(w, r, p.RedirectURL)
+			return
+		}
+
+		token, created, err := store.SSOLogin(r.Context(), p.Org, identity)
+		// Users awaiting approval are created without logging in
+		if created {
+			store.Audit(r.Context(), model.AuditEventTypeRegister, identity.Email, map[string]string{"method": "oidc"})
+		}
+		if err != nil {
+			fail(identity.Email, message(err), message(err))
+			return
+		}
+		store.Audit(r.Context(), model.AuditEventTypeLoginSuccess, identity.Email, map[string]string{"method": "oidc"})
+
+		// The fragment keeps the token out of server logs
+		if p.RedirectURL != "" {
+			http.Redirect(w, r, p.RedirectURL+"#token="+url.QueryEscape(token.Jwt), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, token)
+	}
+}
+
+// linked answers a login that linked an identity, the browser is sent back
+// to the page logins redirect to
+func linked(w http.ResponseWriter, r *http.Request, redirectURL string) {
+	if redirectURL != "" {
+		http.Redirect(w, r, redirectURL+"#linked=true", http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"linked": true})
+}
+
+// challenge returns the S256 PKCE challenge of verifier, RFC 7636
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// message returns the client facing text of err, without the "input: "
+// prefix gqlerror adds
+func message(err error) string {
+	if gqlErr, ok := err.(*gqlerror.Error); ok {
+		return gqlErr.Message
+	}
+
+	return err.Error()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorBody{Error: code, Message: message})
+}
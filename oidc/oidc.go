@@ -0,0 +1,430 @@
+package oidc
+
+// Login with any OpenID Connect provider, with this service as a relying
+// party. The provider is found through discovery from its issuer URL, users
+// log in with the authorization code flow and PKCE, and the ID token the
+// code is exchanged for is verified against the provider's JWKS before the
+// user is logged in and issued a token like userAuth.
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/tracing"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// clockSkew is how far the clocks of the provider and this service can drift apart
+const clockSkew = 2 * time.Minute
+
+// jwksRefresh is how often the keys are refetched at most, when a token is
+// signed with a key that isn't known yet
+const jwksRefresh = time.Minute
+
+// defaultClaims are the claims user fields are read from, by field
+var defaultClaims = map[string]string{
+	"email":    "email",
+	"username": "preferred_username",
+	"fname":    "given_name",
+	"lname":    "family_name",
+}
+
+// Provider is the OpenID Connect provider users log in with
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Callback of the authorization code flow
+	RedirectURI string
+	// Claims user fields are read from, by field, see defaultClaims
+	Claims map[string]string
+	// Slug of the organization users belong to, empty for the default namespace
+	Org string
+	// Page browsers are sent to after logging in, with the token in the
+	// fragment. The token is answered as JSON when empty
+	RedirectURL string
+
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+	client                *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// discovery is the part of the provider's configuration used
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discover returns the provider the configuration describes, reading its
+// endpoints from its discovery document
+func Discover(ctx context.Context, cfg *config.Config) (*Provider, error) {
+	p := &Provider{
+		Issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: cfg.OIDCClientSecret,
+		Scopes:       cfg.OIDCScopes,
+		RedirectURI:  strings.TrimSuffix(cfg.PublicURL, "/") + "/oidc/callback",
+		Claims:       map[string]string{},
+		Org:          cfg.OIDCOrg,
+		RedirectURL:  cfg.OIDCRedirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	// Without the openid scope the provider answers plain OAuth 2.0, without an ID token
+	if !contains(p.Scopes, "openid") {
+		p.Scopes = append([]string{"openid"}, p.Scopes...)
+	}
+	for field, claim := range defaultClaims {
+		p.Claims[field] = claim
+	}
+	// Configured as field=claim, the config validates the fields
+	for _, mapping := range cfg.OIDCClaims {
+		parts := strings.SplitN(mapping, "=", 2)
+		p.Claims[parts[0]] = parts[1]
+	}
+
+	var doc discovery
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	// The issuer of the document must be the one configured, RFC 8414
+	if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks the authorization, token or JWKS endpoint")
+	}
+	p.authorizationEndpoint, p.tokenEndpoint, p.jwksURI = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+
+	return p, nil
+}
+
+// getJSON fetches a JSON document
+func (p *Provider) getJSON(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	tracing.Inject(ctx, req.Header)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// AuthURL returns the URL of the provider that starts a login. The state
+// ties the callback to the browser, the nonce the ID token to the login and
+// the PKCE verifier the code to this service
+func (p *Provider) AuthURL(state, nonce, verifier string) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURI},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.authorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange trades the code of a callback for the ID token, verified
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (jwt.MapClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURI},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, the credentials are form encoded first, RFC 6749 section 2.3.1
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return nil, errors.New("token endpoint returned no ID token")
+	}
+
+	return p.Verify(ctx, body.IDToken, nonce, time.Now())
+}
+
+// Verify checks the signature and claims of an ID token and returns its claims
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string, now time.Time) (jwt.MapClaims, error) {
+	parser := jwt.Parser{
+		ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"},
+		// Checked below with leeway for clock skew
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.Issuer {
+		return nil, fmt.Errorf("ID token issued by %s", iss)
+	}
+	if !audienceHas(claims["aud"], p.ClientID) {
+		return nil, errors.New("ID token is for another client")
+	}
+	// With several audiences the authorized party must be this client
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID {
+		return nil, errors.New("ID token is for another client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || !now.Add(-clockSkew).Before(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("ID token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("ID token issued in the future")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("ID token not valid yet")
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, errors.New("ID token doesn't answer the login request")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return claims, nil
+}
+
+// contains reports whether values has value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// audienceHas reports whether the aud claim, a string or a list, has clientID
+func audienceHas(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Identity returns the user the claims of an ID token describe. Emails the
+// provider says aren't verified are left out
+func (p *Provider) Identity(claims jwt.MapClaims) *auth.SSOIdentity {
+	str := func(field string) string {
+		value, _ := claims[p.Claims[field]].(string)
+		return value
+	}
+
+	identity := &auth.SSOIdentity{
+		Provider: "oidc",
+		Issuer:   p.Issuer,
+		Email:    str("email"),
+		Username: str("username"),
+		Fname:    str("fname"),
+		Lname:    str("lname"),
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	// Provisioning hooks read the claims no field maps, as strings
+	identity.Attributes = map[string][]string{}
+	for name, value := range claims {
+		switch value := value.(type) {
+		case []interface{}:
+			for _, v := range value {
+				identity.Attributes[name] = append(identity.Attributes[name], claimString(v))
+			}
+		case map[string]interface{}:
+			// Structured claims such as address are left out
+		default:
+			identity.Attributes[name] = []string{claimString(value)}
+		}
+	}
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		identity.Email = ""
+	}
+
+	return identity
+}
+
+// claimString formats a JSON value of a claim, numbers without exponents
+func claimString(value interface{}) string {
+	if n, ok := value.(float64); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(value)
+}
+
+// jsonWebKey is a public key of the provider, RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the key of the provider with the given id, refetching the
+// keys when it isn't known so rotations are picked up
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.fetchedAt) < jwksRefresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &set); err != nil {
+		return nil, err
+	}
+	p.fetchedAt = time.Now()
+
+	p.keys = map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// publicKey decodes the RSA or EC public key of k
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,65 @@
+package reporting
+
+// Error reporting. Failures on our side, errors the clients get as
+// INTERNAL_SERVER_ERROR and panics, are sent to an error tracker such as
+// Sentry with the request they happened in, so they are noticed without
+// searching the logs. Reports are best effort: they never fail or slow
+// down the request.
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+// Reporter sends errors to an error tracker
+type Reporter interface {
+	Report(ctx context.Context, event *Event)
+}
+
+// Event is an error and the request it happened in
+type Event struct {
+	Time time.Time
+	// Go type of the error, or the code of errors that lost it, and its
+	// message. Panics have the type "panic"
+	Type    string
+	Message string
+	// Where the error happened, most recent call last, for panics
+	Stack []Frame
+	// GraphQL operation and the path of the field that failed
+	Operation string
+	Path      string
+	RequestID string
+	UserID    string
+	IP        string
+}
+
+// Frame is a function call of a stack
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// Stack returns the stack of the caller, skip leaves out that many more
+// of the most recent calls
+func Stack(skip int) []Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+
+	var stack []Frame
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		stack = append(stack, Frame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		if !more {
+			break
+		}
+	}
+
+	// Most recent call last, as trackers show them
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
@@ -0,0 +1,191 @@
+package reporting
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// sentryQueue is how many events wait to be sent, more are dropped
+const sentryQueue = 100
+
+// Sentry sends events to a Sentry project through its envelope endpoint,
+// in the background
+type Sentry struct {
+	dsn         string
+	endpoint    string
+	key         string
+	environment string
+	release     string
+	serverName  string
+	client      *http.Client
+	events      chan *Event
+	done        chan struct{}
+}
+
+// NewSentry returns a reporter to the project of dsn, such as
+// "https://<key>@o1.ingest.sentry.io/<project>", events are tagged with
+// environment and release
+func NewSentry(dsn, environment, release string) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("invalid SENTRY_DSN")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || u.Path[i+1:] == "" {
+		return nil, errors.New("invalid SENTRY_DSN, it has no project")
+	}
+
+	serverName, _ := os.Hostname()
+	s := &Sentry{
+		dsn:         dsn,
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, u.Path[:i], u.Path[i+1:]),
+		key:         u.User.Username(),
+		environment: environment,
+		release:     release,
+		serverName:  serverName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		events:      make(chan *Event, sentryQueue),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// Report implements Reporter, REQUIRES Close not to have been called
+func (s *Sentry) Report(ctx context.Context, event *Event) {
+	select {
+	case s.events <- event:
+	default:
+		logging.Ctx(ctx).Warn().Msg("error report dropped, too many are waiting")
+	}
+}
+
+// Close sends the events waiting, until ctx is done
+func (s *Sentry) Close(ctx context.Context) error {
+	close(s.events)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run sends the events until Close
+func (s *Sentry) run() {
+	defer close(s.done)
+	for event := range s.events {
+		if err := s.send(event); err != nil {
+			logging.Logger.Warn().Err(err).Str("request_id", event.RequestID).Msg("could not report error to Sentry")
+		}
+	}
+}
+
+type sentryFrame struct {
+	Function string `json:"function,omitempty"`
+	Filename string `json:"abs_path,omitempty"`
+	Line     int    `json:"lineno,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryUser struct {
+	ID        string `json:"id,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// sentryEvent is the event payload, see
+// https://develop.sentry.dev/sdk/event-payloads/
+type sentryEvent struct {
+	EventID     string `json:"event_id"`
+	Timestamp   string `json:"timestamp"`
+	Platform    string `json:"platform"`
+	Level       string `json:"level"`
+	Environment string `json:"environment,omitempty"`
+	Release     string `json:"release,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
+	Transaction string `json:"transaction,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Tags map[string]string `json:"tags,omitempty"`
+	User *sentryUser       `json:"user,omitempty"`
+}
+
+// send posts event in an envelope
+func (s *Sentry) send(event *Event) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	payload := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   event.Time.UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       "error",
+		Environment: s.environment,
+		Release:     s.release,
+		ServerName:  s.serverName,
+		Transaction: event.Operation,
+		Tags:        map[string]string{"request_id": event.RequestID},
+	}
+	exception := sentryException{Type: event.Type, Value: event.Message}
+	if len(event.Stack) > 0 {
+		exception.Stacktrace = &sentryStacktrace{}
+		for _, frame := range event.Stack {
+			exception.Stacktrace.Frames = append(exception.Stacktrace.Frames, sentryFrame{frame.Function, frame.File, frame.Line})
+		}
+	}
+	payload.Exception.Values = []sentryException{exception}
+	if event.Path != "" {
+		payload.Tags["path"] = event.Path
+	}
+	if event.UserID != "" || event.IP != "" {
+		payload.User = &sentryUser{ID: event.UserID, IPAddress: event.IP}
+	}
+
+	item, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": payload.EventID, "dsn": s.dsn, "sent_at": time.Now().UTC().Format(time.RFC3339)})
+	itemHeader, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(item)})
+	body := bytes.Join([][]byte{header, itemHeader, item}, []byte("\n"))
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=auth-service/1.0, sentry_key="+s.key)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sentry answered %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package rest
+
+// JSON REST endpoints for clients that can't speak GraphQL. They mirror the
+// register, userAuth and refreshToken mutations and go through the same
+// validation in the auth package. Errors have the body
+//
+//	{"error": "invalid_request", "message": "Invalid email address."}
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// maxBodySize caps request bodies, the inputs are a handful of short strings
+const maxBodySize = 1 << 16
+
+// Store is what the endpoints need from the database, implemented by auth.DB
+type Store interface {
+	RegisterUser(ctx context.Context, input *model.RegisterInput) (*model.Token, error)
+	AuthenticateUser(ctx context.Context, auth *model.Authenticate) (*model.Token, error)
+	RefreshUserToken(ctx context.Context, token *model.RefreshToken) (*model.Token, error)
+	VerifyToken(ctx context.Context, tokenString string) (*auth.Claims, error)
+	DownloadExport(ctx context.Context, token string) ([]byte, error)
+	OrgJWKS(ctx context.Context, slug string) (*auth.JSONWebKeySet, error)
+	Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string)
+}
+
+// errorBody is the body of failed requests
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// Field level failures of validation errors
+	Fields interface{} `json:"fields,omitempty"`
+}
+
+// Handler serves /v1/register, /v1/login, /v1/refresh, the data export
+// downloads of /v1/exports and the keys of organizations at /v1/orgs/{slug}/jwks.json
+func Handler(store Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/register", post(register(store)))
+	mux.Handle("/v1/login", post(login(store)))
+	mux.Handle("/v1/refresh", post(refresh(store)))
+	mux.Handle("/v1/exports", get(download(store)))
+	mux.Handle("/v1/orgs/", get(jwks(store)))
+
+	return mux
+}
+
+// post rejects other methods and limits the body size
+func post(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use POST.")
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next(w, r)
+	})
+}
+
+// get rejects other methods
+func get(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use GET.")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func register(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body model.RegisterInput
+		if !decode(w, r, &body) {
+			return
+		}
+
+		input, err := auth.ValidateAndPrepare(&body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorBody{Error: "invalid_request", Message: message(err), Fields: fields(err)})
+			return
+		}
+
+		token, err := store.RegisterUser(r.Context(), input)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "registration_failed", message(err))
+			return
+		}
+
+		store.Audit(r.Context(), model.AuditEventTypeRegister, input.Username, nil)
+		writeJSON(w, http.StatusCreated, token)
+	}
+}
+
+func login(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body model.Authenticate
+		if !decode(w, r, &body) {
+			return
+		}
+
+		token, err := store.AuthenticateUser(r.Context(), &body)
+		if err != nil {
+			store.Audit(r.Context(), model.AuditEventTypeLoginFailure, body.Email, map[string]string{"reason": err.Error()})
+			code := "invalid_credentials"
+			switch auth.CodeOf(err) {
+			case auth.CodeMFARequired:
+				// The client asks for the code and sends the login again with otp
+				code = "mfa_required"
+			case auth.CodeInvalidOTP:
+				code = "invalid_otp"
+			}
+			writeError(w, http.StatusUnauthorized, code, message(err))
+			return
+		}
+
+		store.Audit(r.Context(), model.AuditEventTypeLoginSuccess, body.Email, nil)
+		writeJSON(w, http.StatusOK, token)
+	}
+}
+
+func refresh(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body model.RefreshToken
+		if !decode(w, r, &body) {
+			return
+		}
+
+		token, err := store.RefreshUserToken(r.Context(), &body)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid_token", message(err))
+			return
+		}
+
+		var subject string
+		if claims, err := store.VerifyToken(r.Context(), token.Jwt); err == nil {
+			subject = claims.UserID
+		}
+		store.Audit(r.Context(), model.AuditEventTypeTokenRefresh, subject, nil)
+		writeJSON(w, http.StatusOK, token)
+	}
+}
+
+// download serves the export the signed link in the token query parameter points to
+func download(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := store.DownloadExport(r.Context(), r.URL.Query().Get("token"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid_link", message(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="data-export.json"`)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+	}
+}
+
+// jwks serves the public keys of the organization in the path
+func jwks(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.TrimPrefix(r.URL.Path, "/v1/orgs/")
+		if !strings.HasSuffix(slug, "/jwks.json") || strings.Count(slug, "/") != 1 {
+			writeError(w, http.StatusNotFound, "not_found", "Not found.")
+			return
+		}
+
+		set, err := store.OrgJWKS(r.Context(), strings.TrimSuffix(slug, "/jwks.json"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "not_found", message(err))
+			return
+		}
+
+		// Verifiers refetch within minutes of a rotation
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSON(w, http.StatusOK, set)
+	}
+}
+
+// decode reads the JSON body into v, answering 400 when it is malformed
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Request body must be a valid JSON object.")
+		return false
+	}
+
+	return true
+}
+
+// message returns the client facing text of err, without the "input: "
+// prefix gqlerror adds
+func message(err error) string {
+	if gqlErr, ok := err.(*gqlerror.Error); ok {
+		return gqlErr.Message
+	}
+
+	return err.Error()
+}
+
+// fields returns the field errors of a validation error, if any
+func fields(err error) interface{} {
+	if gqlErr, ok := err.(*gqlerror.Error); ok {
+		return gqlErr.Extensions["fields"]
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorBody{Error: code, Message: message})
+}
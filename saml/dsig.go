@@ -0,0 +1,149 @@
+package saml
+
+// Verification of enveloped XML signatures (XML-DSig) over SAML messages.
+// Only the forms identity providers use in practice are accepted: a single
+// reference to the signed element itself, exclusive canonicalization and
+// RSA or ECDSA with SHA-256. The keys come from the identity provider's
+// metadata, the KeyInfo of signatures is ignored.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	dsigNS       = "http://www.w3.org/2000/09/xmldsig#"
+	excC14N      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSig = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	rsaSHA256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	ecdsaSHA256  = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	sha256Digest = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+// errNotSigned is returned for elements without a signature
+var errNotSigned = errors.New("not signed")
+
+// verifySignature checks the signature e carries over itself was made with
+// one of the certificates
+func verifySignature(e *element, certs []*x509.Certificate) error {
+	signatures := e.all(dsigNS, "Signature")
+	switch len(signatures) {
+	case 0:
+		return errNotSigned
+	case 1:
+	default:
+		return errors.New("more than one signature")
+	}
+	signature := signatures[0]
+
+	signedInfo := signature.child(dsigNS, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("signature without SignedInfo")
+	}
+	method := signedInfo.child(dsigNS, "CanonicalizationMethod")
+	if method.attr("Algorithm") != excC14N {
+		return fmt.Errorf("unsupported canonicalization %q", method.attr("Algorithm"))
+	}
+	algorithm := signedInfo.child(dsigNS, "SignatureMethod").attr("Algorithm")
+	if algorithm != rsaSHA256 && algorithm != ecdsaSHA256 {
+		return fmt.Errorf("unsupported signature algorithm %q", algorithm)
+	}
+
+	// The single reference must be to e, so what is read from e is what was signed
+	references := signedInfo.all(dsigNS, "Reference")
+	if len(references) != 1 {
+		return errors.New("signature must have one reference")
+	}
+	reference := references[0]
+	if id := e.attr("ID"); id == "" || reference.attr("URI") != "#"+id {
+		return errors.New("signature doesn't reference the signed element")
+	}
+
+	var enveloped bool
+	var prefixes []string
+	for _, transforms := range reference.all(dsigNS, "Transforms") {
+		for _, transform := range transforms.all(dsigNS, "Transform") {
+			switch transform.attr("Algorithm") {
+			case envelopedSig:
+				enveloped = true
+			case excC14N:
+				prefixes = inclusivePrefixes(transform)
+			default:
+				return fmt.Errorf("unsupported transform %q", transform.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped {
+		return errors.New("signature must be enveloped")
+	}
+
+	if digestMethod := reference.child(dsigNS, "DigestMethod").attr("Algorithm"); digestMethod != sha256Digest {
+		return fmt.Errorf("unsupported digest %q", digestMethod)
+	}
+	digest, err := decodeBase64(reference.child(dsigNS, "DigestValue").text())
+	if err != nil {
+		return errors.New("invalid digest")
+	}
+	sum := sha256.Sum256(canonicalize(e, signature, prefixes))
+	if !bytes.Equal(digest, sum[:]) {
+		return errors.New("digest doesn't match the signed element")
+	}
+
+	value, err := decodeBase64(signature.child(dsigNS, "SignatureValue").text())
+	if err != nil {
+		return errors.New("invalid signature value")
+	}
+	hashed := sha256.Sum256(canonicalize(signedInfo, nil, inclusivePrefixes(method)))
+	for _, cert := range certs {
+		if verifyWith(cert, algorithm, hashed[:], value) {
+			return nil
+		}
+	}
+
+	return errors.New("signature doesn't match the identity provider's certificates")
+}
+
+// verifyWith checks the signature of hashed with the key of cert
+func verifyWith(cert *x509.Certificate, algorithm string, hashed, signature []byte) bool {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return algorithm == rsaSHA256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed, signature) == nil
+	case *ecdsa.PublicKey:
+		// XML-DSig ECDSA signatures are r and s concatenated
+		if algorithm != ecdsaSHA256 || len(signature)%2 != 0 {
+			return false
+		}
+		half := len(signature) / 2
+		r, s := new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])
+		return ecdsa.Verify(key, hashed, r, s)
+	}
+
+	return false
+}
+
+// inclusivePrefixes returns the PrefixList of the InclusiveNamespaces of an
+// exclusive canonicalization element
+func inclusivePrefixes(e *element) []string {
+	if e == nil {
+		return nil
+	}
+	if namespaces := e.child(excC14N, "InclusiveNamespaces"); namespaces != nil {
+		return strings.Fields(namespaces.attr("PrefixList"))
+	}
+
+	return nil
+}
+
+// decodeBase64 decodes base64 that may be split over lines
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
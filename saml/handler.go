@@ -0,0 +1,203 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// maxBodySize caps posted responses, signed assertions with certificates are a few KiB
+const maxBodySize = 1 << 20
+
+// requestCookie holds the id of the AuthnRequest of a login in progress, so
+// the response can only complete a login the same browser started, and the
+// link token when the login links an identity
+const requestCookie = "saml_request"
+
+// requestTTL is how long a login can take at the identity provider
+const requestTTL = 10 * time.Minute
+
+// Store is what the endpoints need from the database, implemented by auth.DB
+type Store interface {
+	SSOLogin(ctx context.Context, org string, identity *auth.SSOIdentity) (*model.Token, bool, error)
+	LinkIdentity(ctx context.Context, token, org string, identity *auth.SSOIdentity) (string, error)
+	UseAssertion(ctx context.Context, issuer, id string, expiresAt time.Time) error
+	Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string)
+}
+
+// errorBody is the body of failed requests, as in the rest package
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Handler serves the metadata of sp at /saml/metadata, starts logins at
+// /saml/login and consumes assertions at /saml/acs
+func Handler(store Store, sp *ServiceProvider) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/saml/metadata", sp.metadata)
+	mux.HandleFunc("/saml/login", sp.login)
+	mux.Handle("/saml/acs", sp.acs(store))
+
+	return mux
+}
+
+func (sp *ServiceProvider) metadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(sp.Metadata())
+}
+
+// login redirects to the identity provider with a new AuthnRequest. With
+// the link parameter of linkIdentity the login links the identity instead
+func (sp *ServiceProvider) login(w http.ResponseWriter, r *http.Request) {
+	// IDs must not start with a digit
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "Could not start the login.")
+		return
+	}
+	id := "_" + hex.EncodeToString(raw)
+
+	target, err := sp.AuthnRequestURL(id, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", "Could not start the login.")
+		return
+	}
+
+	value := id
+	if link := r.URL.Query().Get("link"); link != "" {
+		value += "." + link
+	}
+	http.SetCookie(w, sp.cookie(value, int(requestTTL.Seconds())))
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// cookie returns the request cookie. The identity provider posts the
+// response from its own site, which only SameSite=None cookies survive, and
+// those must be secure
+func (sp *ServiceProvider) cookie(value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     requestCookie,
+		Value:    value,
+		Path:     "/saml/acs",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if strings.HasPrefix(sp.ACSURL, "https://") {
+		cookie.Secure, cookie.SameSite = true, http.SameSiteNoneMode
+	}
+
+	return cookie
+}
+
+// acs verifies the posted response and logs the user in
+func (sp *ServiceProvider) acs(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use POST.")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+		// The request is answered once, whatever the outcome
+		var requestID, link string
+		if cookie, err := r.Cookie(requestCookie); err == nil {
+			requestID = cookie.Value
+			if i := strings.IndexByte(requestID, '.'); i >= 0 {
+				requestID, link = requestID[:i], requestID[i+1:]
+			}
+			http.SetCookie(w, sp.cookie("", -1))
+		} else if !sp.AllowIdPInitiated {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Start the login at /saml/login.")
+			return
+		}
+
+		// Why a response was rejected is only audited, not told to the browser
+		fail := func(subject, reason, msg string) {
+			store.Audit(r.Context(), model.AuditEventTypeLoginFailure, subject, map[string]string{"method": "saml", "reason": reason})
+			writeError(w, http.StatusForbidden, "access_denied", msg)
+		}
+
+		assertion, err := sp.ParseResponse(r.PostFormValue("SAMLResponse"), requestID, time.Now())
+		if err != nil {
+			fail("", err.Error(), "Invalid SAML response.")
+			return
+		}
+		if err := store.UseAssertion(r.Context(), assertion.Issuer, assertion.ID, assertion.ExpiresAt); err != nil {
+			fail(assertion.NameID, message(err), message(err))
+			return
+		}
+
+		identity := sp.Identity(assertion)
+		if link != "" {
+			userID, err := store.LinkIdentity(r.Context(), link, sp.Org, identity)
+			if err != nil {
+				writeError(w, http.StatusForbidden, "access_denied", message(err))
+				return
+			}
+			store.Audit(r.Context(), model.AuditEventTypeAccountLinked, userID, map[string]string{"method": "saml", "issuer": identity.Issuer})
+			linked(w, r, sp.RedirectURL)
+			return
+		}
+
+		token, created, err := store.SSOLogin(r.Context(), sp.Org, identity)
+		// Users awaiting approval are created without logging in
+		if created {
+			store.Audit(r.Context(), model.AuditEventTypeRegister, identity.Email, map[string]string{"method": "saml"})
+		}
+		if err != nil {
+			fail(identity.Email, message(err), message(err))
+			return
+		}
+		store.Audit(r.Context(), model.AuditEventTypeLoginSuccess, identity.Email, map[string]string{"method": "saml"})
+
+		// The fragment keeps the token out of server logs
+		if sp.RedirectURL != "" {
+			http.Redirect(w, r, sp.RedirectURL+"#token="+url.QueryEscape(token.Jwt), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, token)
+	}
+}
+
+// linked answers a login that linked an identity, the browser is sent back
+// to the page logins redirect to
+func linked(w http.ResponseWriter, r *http.Request, redirectURL string) {
+	if redirectURL != "" {
+		http.Redirect(w, r, redirectURL+"#linked=true", http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"linked": true})
+}
+
+// message returns the client facing text of err, without the "input: "
+// prefix gqlerror adds
+func message(err error) string {
+	if gqlErr, ok := err.(*gqlerror.Error); ok {
+		return gqlErr.Message
+	}
+
+	return err.Error()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorBody{Error: code, Message: message})
+}
@@ -0,0 +1,472 @@
+package saml
+
+// SAML 2.0 single sign-on, with this service as the service provider of one
+// identity provider. Logins start at /saml/login, which redirects to the
+// identity provider with an AuthnRequest (HTTP-Redirect binding), and end at
+// the assertion consumer service, which receives the signed response
+// (HTTP-POST binding), logs the user in and issues a token like userAuth.
+//
+// Either the response or its assertion must be signed with a certificate
+// of the identity provider's metadata. Encrypted assertions aren't
+// supported, the assertion travels through the browser in the clear.
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/config"
+)
+
+const (
+	protocolNS      = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNS     = "urn:oasis:names:tc:SAML:2.0:assertion"
+	statusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bearerMethod    = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	postBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	redirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	emailFormat     = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+)
+
+// clockSkew is how far the clocks of the identity provider and this service
+// can drift apart
+const clockSkew = 3 * time.Minute
+
+// defaultAttributes are the attributes user fields are read from, by field,
+// covering the names of common identity providers
+var defaultAttributes = map[string][]string{
+	"email": {"email", "mail", "emailAddress", "urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"},
+	"username": {"username", "uid", "urn:oid:0.9.2342.19200300.100.1.1"},
+	"fname": {"firstName", "givenName", "urn:oid:2.5.4.42",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname"},
+	"lname": {"lastName", "sn", "surname", "urn:oid:2.5.4.4",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname"},
+}
+
+// IdentityProvider is the identity provider users log in with
+type IdentityProvider struct {
+	EntityID string
+	// Where AuthnRequests are sent with the HTTP-Redirect binding
+	SSOURL string
+	// Certificates whose keys sign responses or assertions
+	Certificates []*x509.Certificate
+}
+
+// entityDescriptor is the part of the identity provider's metadata read
+type entityDescriptor struct {
+	EntityID string `xml:"entityID,attr"`
+	IDP      *struct {
+		Keys []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SSO []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// ParseMetadata reads the entity id, single sign-on URL and signing
+// certificates from the metadata of an identity provider
+func ParseMetadata(data []byte) (*IdentityProvider, error) {
+	var entity entityDescriptor
+	if err := xml.Unmarshal(data, &entity); err != nil {
+		return nil, err
+	}
+	if entity.EntityID == "" || entity.IDP == nil {
+		return nil, errors.New("metadata has no IDPSSODescriptor")
+	}
+
+	idp := &IdentityProvider{EntityID: entity.EntityID}
+	for _, sso := range entity.IDP.SSO {
+		if sso.Binding == redirectBinding {
+			idp.SSOURL = sso.Location
+		}
+	}
+	if idp.SSOURL == "" {
+		return nil, errors.New("metadata has no SingleSignOnService with the HTTP-Redirect binding")
+	}
+
+	for _, key := range entity.IDP.Keys {
+		if key.Use != "" && key.Use != "signing" {
+			continue
+		}
+		for _, encoded := range key.Certificates {
+			der, err := decodeBase64(encoded)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			idp.Certificates = append(idp.Certificates, cert)
+		}
+	}
+	if len(idp.Certificates) == 0 {
+		return nil, errors.New("metadata has no signing certificate")
+	}
+
+	return idp, nil
+}
+
+// LoadMetadata reads the metadata of an identity provider from a file or an
+// http(s) URL
+func LoadMetadata(location string) (*IdentityProvider, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://") {
+		client := http.Client{Timeout: 10 * time.Second}
+		var resp *http.Response
+		if resp, err = client.Get(location); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("metadata request returned %s", resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	} else {
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseMetadata(data)
+}
+
+// ServiceProvider is this service as the service provider of idp
+type ServiceProvider struct {
+	EntityID string
+	// Assertion consumer service, where the identity provider posts responses
+	ACSURL string
+	IdP    *IdentityProvider
+	// Attributes user fields are read from, by field, see defaultAttributes
+	Attributes map[string][]string
+	// Accept responses the service didn't request, which can't be tied to the
+	// browser they arrive in
+	AllowIdPInitiated bool
+	// Slug of the organization users belong to, empty for the default namespace
+	Org string
+	// Page browsers are sent to after logging in, with the token in the
+	// fragment. The token is answered as JSON when empty
+	RedirectURL string
+}
+
+// NewServiceProvider returns the service provider of idp the configuration describes
+func NewServiceProvider(cfg *config.Config, idp *IdentityProvider) *ServiceProvider {
+	sp := &ServiceProvider{
+		EntityID:          cfg.SAMLEntityID,
+		ACSURL:            strings.TrimSuffix(cfg.PublicURL, "/") + "/saml/acs",
+		IdP:               idp,
+		Attributes:        map[string][]string{},
+		AllowIdPInitiated: cfg.SAMLAllowIdPInitiated,
+		Org:               cfg.SAMLOrg,
+		RedirectURL:       cfg.SAMLRedirectURL,
+	}
+	if sp.EntityID == "" {
+		sp.EntityID = strings.TrimSuffix(cfg.PublicURL, "/") + "/saml/metadata"
+	}
+
+	for field, names := range defaultAttributes {
+		sp.Attributes[field] = names
+	}
+	// Configured as field=attribute, the config validates the fields
+	for _, mapping := range cfg.SAMLAttributes {
+		parts := strings.SplitN(mapping, "=", 2)
+		sp.Attributes[parts[0]] = []string{parts[1]}
+	}
+
+	return sp
+}
+
+// Metadata returns the metadata of the service provider for the identity provider
+func (sp *ServiceProvider) Metadata() []byte {
+	type service struct {
+		Binding  string `xml:"Binding,attr"`
+		Location string `xml:"Location,attr"`
+		Index    int    `xml:"index,attr"`
+	}
+	metadata := struct {
+		XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+		EntityID string   `xml:"entityID,attr"`
+		SP       struct {
+			AuthnRequestsSigned  bool    `xml:"AuthnRequestsSigned,attr"`
+			WantAssertionsSigned bool    `xml:"WantAssertionsSigned,attr"`
+			Protocols            string  `xml:"protocolSupportEnumeration,attr"`
+			NameIDFormat         string  `xml:"NameIDFormat"`
+			ACS                  service `xml:"AssertionConsumerService"`
+		} `xml:"SPSSODescriptor"`
+	}{EntityID: sp.EntityID}
+	metadata.SP.WantAssertionsSigned = true
+	metadata.SP.Protocols = protocolNS
+	metadata.SP.NameIDFormat = emailFormat
+	metadata.SP.ACS = service{Binding: postBinding, Location: sp.ACSURL, Index: 0}
+
+	data, _ := xml.MarshalIndent(metadata, "", "  ")
+	return append([]byte(xml.Header), data...)
+}
+
+// AuthnRequestURL returns the URL of the identity provider that starts a
+// login, id is the id of the request the response must be in response to
+func (sp *ServiceProvider) AuthnRequestURL(id string, now time.Time) (string, error) {
+	request := struct {
+		XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+		ID                          string   `xml:"ID,attr"`
+		Version                     string   `xml:"Version,attr"`
+		IssueInstant                string   `xml:"IssueInstant,attr"`
+		Destination                 string   `xml:"Destination,attr"`
+		ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+		AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+		Issuer                      struct {
+			XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+			Value   string   `xml:",chardata"`
+		}
+	}{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                now.UTC().Format(time.RFC3339),
+		Destination:                 sp.IdP.SSOURL,
+		ProtocolBinding:             postBinding,
+		AssertionConsumerServiceURL: sp.ACSURL,
+	}
+	request.Issuer.Value = sp.EntityID
+
+	data, err := xml.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	// The redirect binding deflates the request
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+
+	target, err := url.Parse(sp.IdP.SSOURL)
+	if err != nil {
+		return "", err
+	}
+	query := target.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	target.RawQuery = query.Encode()
+
+	return target.String(), nil
+}
+
+// Assertion is what a verified response says about the user
+type Assertion struct {
+	ID     string
+	NameID string
+	Format string
+	Issuer string
+	// Attribute values by name and friendly name
+	Attributes map[string][]string
+	// When the assertion stops being accepted, it must be used once until then
+	ExpiresAt time.Time
+}
+
+// ParseResponse verifies a base64 encoded response posted to the assertion
+// consumer service and returns its assertion. requestID is the id of the
+// AuthnRequest it answers, empty for responses the identity provider started
+func (sp *ServiceProvider) ParseResponse(encoded, requestID string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, errors.New("response is not base64")
+	}
+	response, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if !response.is(protocolNS, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+
+	if response.attr("Version") != "2.0" {
+		return nil, errors.New("unsupported SAML version")
+	}
+	if destination := response.attr("Destination"); destination != "" && destination != sp.ACSURL {
+		return nil, fmt.Errorf("response is for %s", destination)
+	}
+	if response.attr("InResponseTo") != requestID {
+		return nil, errors.New("response doesn't answer the login request")
+	}
+	if issuer := response.child(assertionNS, "Issuer"); issuer != nil && issuer.text() != sp.IdP.EntityID {
+		return nil, fmt.Errorf("response issued by %s", issuer.text())
+	}
+	status := response.child(protocolNS, "Status").child(protocolNS, "StatusCode").attr("Value")
+	if status != statusSuccess {
+		return nil, fmt.Errorf("login failed with status %s", status)
+	}
+
+	if len(response.all(assertionNS, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions := response.all(assertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must have one assertion")
+	}
+	assertion := assertions[0]
+
+	// A signed response covers its assertion
+	err = verifySignature(response, sp.IdP.Certificates)
+	if err == errNotSigned {
+		err = verifySignature(assertion, sp.IdP.Certificates)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return sp.readAssertion(assertion, requestID, now)
+}
+
+// readAssertion checks the conditions of a verified assertion and reads it
+func (sp *ServiceProvider) readAssertion(assertion *element, requestID string, now time.Time) (*Assertion, error) {
+	if issuer := assertion.child(assertionNS, "Issuer").text(); issuer != sp.IdP.EntityID {
+		return nil, fmt.Errorf("assertion issued by %s", issuer)
+	}
+	a := &Assertion{ID: assertion.attr("ID"), Issuer: sp.IdP.EntityID, Attributes: map[string][]string{}}
+	if a.ID == "" {
+		return nil, errors.New("assertion has no ID")
+	}
+
+	conditions := assertion.child(assertionNS, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+	if notBefore, ok := parseTime(conditions.attr("NotBefore")); ok && now.Add(clockSkew).Before(notBefore) {
+		return nil, errors.New("assertion is not valid yet")
+	}
+	if notOnOrAfter, ok := parseTime(conditions.attr("NotOnOrAfter")); ok {
+		if !now.Add(-clockSkew).Before(notOnOrAfter) {
+			return nil, errors.New("assertion expired")
+		}
+		a.ExpiresAt = notOnOrAfter
+	}
+	// Every audience restriction must name this service
+	restrictions := conditions.all(assertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errors.New("assertion has no audience")
+	}
+	for _, restriction := range restrictions {
+		var ok bool
+		for _, audience := range restriction.all(assertionNS, "Audience") {
+			ok = ok || audience.text() == sp.EntityID
+		}
+		if !ok {
+			return nil, errors.New("assertion is for another audience")
+		}
+	}
+
+	subject := assertion.child(assertionNS, "Subject")
+	nameID := subject.child(assertionNS, "NameID")
+	a.NameID, a.Format = nameID.text(), nameID.attr("Format")
+	if a.NameID == "" {
+		return nil, errors.New("assertion has no NameID")
+	}
+	if !sp.bearerConfirmed(subject, requestID, now, a) {
+		return nil, errors.New("assertion has no valid bearer confirmation")
+	}
+
+	if len(assertion.all(assertionNS, "AuthnStatement")) == 0 {
+		return nil, errors.New("assertion has no authentication statement")
+	}
+	for _, statement := range assertion.all(assertionNS, "AttributeStatement") {
+		for _, attribute := range statement.all(assertionNS, "Attribute") {
+			var values []string
+			for _, value := range attribute.all(assertionNS, "AttributeValue") {
+				values = append(values, value.text())
+			}
+			for _, name := range []string{attribute.attr("Name"), attribute.attr("FriendlyName")} {
+				if name != "" {
+					a.Attributes[name] = append(a.Attributes[name], values...)
+				}
+			}
+		}
+	}
+
+	if a.ExpiresAt.IsZero() {
+		return nil, errors.New("assertion has no expiry")
+	}
+
+	return a, nil
+}
+
+// bearerConfirmed reports whether a bearer confirmation of subject is for
+// this service, the request and still valid. Its expiry bounds the assertion's
+func (sp *ServiceProvider) bearerConfirmed(subject *element, requestID string, now time.Time, a *Assertion) bool {
+	if subject == nil {
+		return false
+	}
+
+	for _, confirmation := range subject.all(assertionNS, "SubjectConfirmation") {
+		if confirmation.attr("Method") != bearerMethod {
+			continue
+		}
+		data := confirmation.child(assertionNS, "SubjectConfirmationData")
+		notOnOrAfter, ok := parseTime(data.attr("NotOnOrAfter"))
+		if data == nil || data.attr("Recipient") != sp.ACSURL || data.attr("InResponseTo") != requestID ||
+			!ok || !now.Add(-clockSkew).Before(notOnOrAfter) {
+			continue
+		}
+		if notBefore, ok := parseTime(data.attr("NotBefore")); ok && now.Add(clockSkew).Before(notBefore) {
+			continue
+		}
+
+		if a.ExpiresAt.IsZero() || notOnOrAfter.Before(a.ExpiresAt) {
+			a.ExpiresAt = notOnOrAfter
+		}
+		return true
+	}
+
+	return false
+}
+
+// parseTime parses an xs:dateTime
+func parseTime(value string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	return t, err == nil
+}
+
+// Identity returns the user an assertion describes
+func (sp *ServiceProvider) Identity(a *Assertion) *auth.SSOIdentity {
+	first := func(field string) string {
+		for _, name := range sp.Attributes[field] {
+			if values := a.Attributes[name]; len(values) > 0 {
+				return values[0]
+			}
+		}
+		return ""
+	}
+
+	identity := &auth.SSOIdentity{
+		Provider: "saml",
+		Issuer:   a.Issuer,
+		Subject:  a.NameID,
+		Email:    first("email"),
+		Username: first("username"),
+		Fname:    first("fname"),
+		Lname:    first("lname"),
+		// Provisioning hooks read the attributes no field maps
+		Attributes: a.Attributes,
+	}
+	if identity.Email == "" && a.Format == emailFormat {
+		identity.Email = a.NameID
+	}
+
+	return identity
+}
@@ -0,0 +1,400 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdP = "https://idp.example.com"
+	testSP  = "https://sp.example.com/saml/metadata"
+	testACS = "https://sp.example.com/saml/acs"
+)
+
+// testResponse answers the request _request, {{RESPONSE}} and {{ASSERTION}}
+// are where the signatures of the response and the assertion go
+const testResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_response" Version="2.0" IssueInstant="2026-10-16T12:00:00Z" Destination="https://sp.example.com/saml/acs" InResponseTo="_request">
+  <saml:Issuer>https://idp.example.com</saml:Issuer>{{RESPONSE}}
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion ID="_assertion" Version="2.0" IssueInstant="2026-10-16T12:00:00Z">
+    <saml:Issuer>https://idp.example.com</saml:Issuer>{{ASSERTION}}
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">ada@example.com</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData InResponseTo="_request" Recipient="https://sp.example.com/saml/acs" NotOnOrAfter="2026-10-16T12:05:00Z"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="2026-10-16T11:59:00Z" NotOnOrAfter="2026-10-16T12:10:00Z">
+      <saml:AudienceRestriction><saml:Audience>https://sp.example.com/saml/metadata</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="2026-10-16T12:00:00Z"/>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="email"><saml:AttributeValue>ada@example.com</saml:AttributeValue></saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+var testNow = time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+// testKey signs the test responses, its certificate is the identity
+// provider's. otherKey is a key the identity provider doesn't have
+var testKey, otherKey = newKey(), newKey()
+
+func newKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func testServiceProvider(t *testing.T) *ServiceProvider {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    testNow.Add(-time.Hour),
+		NotAfter:     testNow.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &testKey.PublicKey, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ServiceProvider{
+		EntityID: testSP,
+		ACSURL:   testACS,
+		IdP:      &IdentityProvider{EntityID: testIdP, Certificates: []*x509.Certificate{cert}},
+	}
+}
+
+// signature describes the signature sign makes
+type signature struct {
+	// Element signed, "response" or "assertion"
+	element string
+	// Reference URI, "#" and the ID of the element by default
+	uri string
+	// Transforms, the enveloped signature transform and exclusive
+	// canonicalization by default
+	transforms []string
+	key        *rsa.PrivateKey
+}
+
+// sign signs doc as s describes, the way identity providers do
+func sign(t *testing.T, doc string, s signature) string {
+	t.Helper()
+
+	id := "_" + s.element
+	if s.uri == "" {
+		s.uri = "#" + id
+	}
+	if s.transforms == nil {
+		s.transforms = []string{envelopedSig, excC14N}
+	}
+	if s.key == nil {
+		s.key = testKey
+	}
+
+	var transforms string
+	for _, transform := range s.transforms {
+		transforms += `<ds:Transform Algorithm="` + transform + `"/>`
+	}
+	placeholder := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="` + excC14N + `"/>` +
+		`<ds:SignatureMethod Algorithm="` + rsaSHA256 + `"/>` +
+		`<ds:Reference URI="` + s.uri + `"><ds:Transforms>` + transforms + `</ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="` + sha256Digest + `"/><ds:DigestValue>{{DIGEST}}</ds:DigestValue></ds:Reference>` +
+		`</ds:SignedInfo><ds:SignatureValue>{{SIGNATURE}}</ds:SignatureValue></ds:Signature>`
+
+	doc = strings.Replace(doc, "{{"+strings.ToUpper(s.element)+"}}", placeholder, 1)
+	doc = strings.NewReplacer("{{RESPONSE}}", "", "{{ASSERTION}}", "").Replace(doc)
+
+	// The digest is over the element without its signature
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := findID(root, id)
+	digest := sha256.Sum256(canonicalize(e, e.child(dsigNS, "Signature"), nil))
+	doc = strings.Replace(doc, "{{DIGEST}}", base64.StdEncoding.EncodeToString(digest[:]), 1)
+
+	root, err = parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedInfo := findID(root, id).child(dsigNS, "Signature").child(dsigNS, "SignedInfo")
+	hashed := sha256.Sum256(canonicalize(signedInfo, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Replace(doc, "{{SIGNATURE}}", base64.StdEncoding.EncodeToString(value), 1)
+}
+
+// between returns the part of s from the first from to the end of the next to
+func between(s, from, to string) string {
+	i := strings.Index(s, from)
+	j := strings.Index(s[i:], to)
+	return s[i : i+j+len(to)]
+}
+
+func TestParseResponse(t *testing.T) {
+	sp := testServiceProvider(t)
+	assertion := signature{element: "assertion"}
+
+	tests := []struct {
+		name string
+		// Changes made before and after signing
+		edit      func(doc string) string
+		signature *signature
+		tamper    func(doc string) string
+		now       time.Time
+		want      string
+		wantErr   string
+	}{
+		{
+			name:      "signed assertion",
+			signature: &assertion,
+			want:      "ada@example.com",
+		},
+		{
+			name:      "signed response",
+			signature: &signature{element: "response"},
+			want:      "ada@example.com",
+		},
+		{
+			name:    "unsigned",
+			wantErr: "not signed",
+		},
+		{
+			name:      "signed with another key",
+			signature: &signature{element: "assertion", key: otherKey},
+			wantErr:   "doesn't match the identity provider's certificates",
+		},
+		{
+			name:      "assertion edited after signing",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				return strings.Replace(doc, ">ada@example.com</saml:NameID>", ">eve@example.com</saml:NameID>", 1)
+			},
+			wantErr: "digest doesn't match",
+		},
+		{
+			name:      "assertion of a signed response replaced",
+			signature: &signature{element: "response"},
+			tamper: func(doc string) string {
+				return strings.Replace(doc, ">ada@example.com</saml:NameID>", ">eve@example.com</saml:NameID>", 1)
+			},
+			wantErr: "digest doesn't match",
+		},
+		{
+			name:      "signed assertion moved to the extensions",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				signed := between(doc, "<saml:Assertion", "</saml:Assertion>")
+				evil := strings.Replace(signed, between(signed, "<ds:Signature", "</ds:Signature>"), "", 1)
+				evil = strings.Replace(evil, `ID="_assertion"`, `ID="_evil"`, 1)
+				evil = strings.Replace(evil, ">ada@example.com</saml:NameID>", ">eve@example.com</saml:NameID>", 1)
+				return strings.Replace(doc, signed, "<samlp:Extensions>"+signed+"</samlp:Extensions>"+evil, 1)
+			},
+			wantErr: "not signed",
+		},
+		{
+			name:      "signed assertion duplicated",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				signed := between(doc, "<saml:Assertion", "</saml:Assertion>")
+				evil := strings.Replace(signed, `ID="_assertion"`, `ID="_evil"`, 1)
+				evil = strings.Replace(evil, ">ada@example.com</saml:NameID>", ">eve@example.com</saml:NameID>", 1)
+				return strings.Replace(doc, signed, evil+signed, 1)
+			},
+			wantErr: "one assertion",
+		},
+		{
+			name:      "signed assertion wrapped in the signature of another",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				signed := between(doc, "<saml:Assertion", "</saml:Assertion>")
+				sig := between(signed, "<ds:Signature", "</ds:Signature>")
+				wrapped := strings.Replace(sig, "</ds:Signature>", "<ds:Object>"+signed+"</ds:Object></ds:Signature>", 1)
+				evil := strings.Replace(signed, ">ada@example.com</saml:NameID>", ">eve@example.com</saml:NameID>", 1)
+				evil = strings.Replace(evil, sig, wrapped, 1)
+				return strings.Replace(doc, signed, evil, 1)
+			},
+			wantErr: "digest doesn't match",
+		},
+		{
+			name:      "signed response wrapped in another",
+			signature: &signature{element: "response"},
+			tamper: func(doc string) string {
+				evil := strings.NewReplacer(`ID="_response"`, `ID="_evil"`, "ada@example.com", "eve@example.com").Replace(testResponse)
+				evil = strings.NewReplacer("{{RESPONSE}}", "", "{{ASSERTION}}", "").Replace(evil)
+				i := strings.Index(evil, "<samlp:Status>")
+				return evil[:i] + "<samlp:Extensions>" + doc + "</samlp:Extensions>" + evil[i:]
+			},
+			wantErr: "not signed",
+		},
+		{
+			name: "comment in the NameID",
+			edit: func(doc string) string {
+				return strings.Replace(doc, ">ada@example.com</saml:NameID>", ">ada@example.com.evil.com</saml:NameID>", 1)
+			},
+			signature: &assertion,
+			tamper: func(doc string) string {
+				return strings.Replace(doc, ">ada@example.com.evil.com<", ">ada@example.com<!---->.evil.com<", 1)
+			},
+			want: "ada@example.com.evil.com",
+		},
+		{
+			name:      "comments between elements",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				return strings.Replace(doc, "<saml:Subject>", "<saml:Subject><!-- added -->", 1)
+			},
+			want: "ada@example.com",
+		},
+		{
+			name:      "whitespace added after signing",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				return strings.Replace(doc, "<saml:Subject>", "<saml:Subject>\n", 1)
+			},
+			wantErr: "digest doesn't match",
+		},
+		{
+			name:      "whitespace in the signed info",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				return strings.Replace(doc, "<ds:SignedInfo>", "<ds:SignedInfo>\n", 1)
+			},
+			wantErr: "doesn't match the identity provider's certificates",
+		},
+		{
+			name:      "signature value split over lines",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				value := between(doc, "<ds:SignatureValue>", "</ds:SignatureValue>")
+				value = strings.TrimSuffix(strings.TrimPrefix(value, "<ds:SignatureValue>"), "</ds:SignatureValue>")
+				return strings.Replace(doc, value, "\n"+value[:64]+"\n"+value[64:]+"\n", 1)
+			},
+			want: "ada@example.com",
+		},
+		{
+			name:      "reference to another element",
+			signature: &signature{element: "assertion", uri: "#_response"},
+			wantErr:   "doesn't reference the signed element",
+		},
+		{
+			name:      "reference to the document",
+			signature: &signature{element: "assertion", uri: "#"},
+			wantErr:   "doesn't reference the signed element",
+		},
+		{
+			name:      "XPath transform",
+			signature: &signature{element: "assertion", transforms: []string{envelopedSig, "http://www.w3.org/TR/1999/REC-xpath-19991116", excC14N}},
+			wantErr:   "unsupported transform",
+		},
+		{
+			name:      "canonicalization with comments",
+			signature: &signature{element: "assertion", transforms: []string{envelopedSig, excC14N + "WithComments"}},
+			wantErr:   "unsupported transform",
+		},
+		{
+			name:      "not enveloped",
+			signature: &signature{element: "assertion", transforms: []string{excC14N}},
+			wantErr:   "must be enveloped",
+		},
+		{
+			name:      "DTD",
+			signature: &assertion,
+			tamper: func(doc string) string {
+				return `<!DOCTYPE samlp:Response [<!ENTITY e "eve@example.com">]>` + doc
+			},
+			wantErr: "DTDs are not allowed",
+		},
+		{
+			name: "another audience",
+			edit: func(doc string) string {
+				return strings.Replace(doc, "<saml:Audience>"+testSP, "<saml:Audience>https://other.example.com", 1)
+			},
+			signature: &assertion,
+			wantErr:   "another audience",
+		},
+		{
+			name: "another recipient",
+			edit: func(doc string) string {
+				return strings.Replace(doc, `Recipient="`+testACS, `Recipient="https://other.example.com/saml/acs`, 1)
+			},
+			signature: &assertion,
+			wantErr:   "no valid bearer confirmation",
+		},
+		{
+			name:      "conditions expired",
+			signature: &assertion,
+			now:       testNow.Add(10*time.Minute + clockSkew),
+			wantErr:   "assertion expired",
+		},
+		{
+			name:      "bearer confirmation expired",
+			signature: &assertion,
+			now:       testNow.Add(5*time.Minute + clockSkew),
+			wantErr:   "no valid bearer confirmation",
+		},
+		{
+			name:      "expired within the clock skew",
+			signature: &assertion,
+			now:       testNow.Add(5 * time.Minute),
+			want:      "ada@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := testResponse
+			if tt.edit != nil {
+				doc = tt.edit(doc)
+			}
+			if tt.signature != nil {
+				doc = sign(t, doc, *tt.signature)
+			} else {
+				doc = strings.NewReplacer("{{RESPONSE}}", "", "{{ASSERTION}}", "").Replace(doc)
+			}
+			if tt.tamper != nil {
+				doc = tt.tamper(doc)
+			}
+			now := tt.now
+			if now.IsZero() {
+				now = testNow
+			}
+
+			a, err := sp.ParseResponse(base64.StdEncoding.EncodeToString([]byte(doc)), "_request", now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseResponse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseResponse() error = %v", err)
+			}
+			if a.NameID != tt.want {
+				t.Errorf("ParseResponse() NameID = %q, want %q", a.NameID, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package saml
+
+// A minimal XML tree keeping prefixes and namespace declarations as they are
+// written, which canonicalization needs and encoding/xml's decoding into
+// structs loses, and the exclusive canonical form signatures are computed
+// over (Exclusive XML Canonicalization 1.0, without comments).
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// xmlNS is the namespace bound to the xml prefix
+const xmlNS = "http://www.w3.org/XML/1998/namespace"
+
+// element is an element of a parsed document. Names keep their prefix in
+// Space, attrs include the namespace declarations
+type element struct {
+	name   xml.Name
+	attrs  []xml.Attr
+	parent *element
+	// *element, text or procInst
+	children []interface{}
+}
+
+type text string
+
+type procInst struct {
+	target string
+	inst   string
+}
+
+// parseXML parses a document, rejecting DTDs so entities can't be declared
+func parseXML(data []byte) (*element, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = true
+
+	var root, current *element
+	for {
+		token, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &element{name: t.Name, attrs: append([]xml.Attr{}, t.Attr...), parent: current}
+			if current != nil {
+				current.children = append(current.children, e)
+			} else if root != nil {
+				return nil, errors.New("more than one root element")
+			} else {
+				root = e
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || current.name != t.Name {
+				return nil, fmt.Errorf("unexpected end of element %s", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, text(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("text outside the root element")
+			}
+		case xml.ProcInst:
+			if current != nil {
+				current.children = append(current.children, procInst{target: t.Target, inst: string(t.Inst)})
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("incomplete document")
+	}
+
+	return root, root.checkPrefixes()
+}
+
+// checkPrefixes makes sure every prefix in the tree is declared
+func (e *element) checkPrefixes() error {
+	names := []xml.Name{e.name}
+	for _, attr := range e.attrs {
+		if !isNamespaceDecl(attr) {
+			names = append(names, attr.Name)
+		}
+	}
+	for _, name := range names {
+		if strings.Contains(name.Local, ":") {
+			return fmt.Errorf("invalid name %s:%s", name.Space, name.Local)
+		}
+		if _, ok := e.lookupNS(name.Space); !ok {
+			return fmt.Errorf("undeclared prefix %s", name.Space)
+		}
+	}
+
+	for _, child := range e.children {
+		if c, ok := child.(*element); ok {
+			if err := c.checkPrefixes(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isNamespaceDecl reports whether attr declares a namespace
+func isNamespaceDecl(attr xml.Attr) bool {
+	return attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns")
+}
+
+// lookupNS returns the namespace prefix is bound to at e, "" being the
+// default namespace
+func (e *element) lookupNS(prefix string) (string, bool) {
+	switch prefix {
+	case "xml":
+		return xmlNS, true
+	case "xmlns":
+		return "", false
+	}
+
+	for el := e; el != nil; el = el.parent {
+		for _, attr := range el.attrs {
+			if prefix == "" && attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+				return attr.Value, true
+			}
+			if prefix != "" && attr.Name.Space == "xmlns" && attr.Name.Local == prefix {
+				return attr.Value, true
+			}
+		}
+	}
+
+	// Without a declaration the default namespace is no namespace
+	return "", prefix == ""
+}
+
+// is reports whether e is the element local of namespace ns
+func (e *element) is(ns, local string) bool {
+	uri, _ := e.lookupNS(e.name.Space)
+	return e.name.Local == local && uri == ns
+}
+
+// all returns the child elements local of namespace ns
+func (e *element) all(ns, local string) []*element {
+	if e == nil {
+		return nil
+	}
+
+	var found []*element
+	for _, child := range e.children {
+		if c, ok := child.(*element); ok && c.is(ns, local) {
+			found = append(found, c)
+		}
+	}
+
+	return found
+}
+
+// child returns the first child element local of namespace ns, nil when there is none
+func (e *element) child(ns, local string) *element {
+	if found := e.all(ns, local); len(found) > 0 {
+		return found[0]
+	}
+
+	return nil
+}
+
+// attr returns the value of an attribute without prefix
+func (e *element) attr(local string) string {
+	if e == nil {
+		return ""
+	}
+	for _, attr := range e.attrs {
+		if attr.Name.Space == "" && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
+
+// text returns the text directly inside e, trimmed
+func (e *element) text() string {
+	if e == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, child := range e.children {
+		if t, ok := child.(text); ok {
+			b.WriteString(string(t))
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// canonicalize returns the exclusive canonical form of e without the element
+// skip, the enveloped signature. inclusive are the prefixes of the
+// InclusiveNamespaces PrefixList, handled like inclusive canonicalization does
+func canonicalize(e, skip *element, inclusive []string) []byte {
+	var buf bytes.Buffer
+	writeCanonical(&buf, e, skip, inclusive, map[string]string{})
+	return buf.Bytes()
+}
+
+// writeCanonical writes e, rendered are the namespaces output ancestors declared
+func writeCanonical(buf *bytes.Buffer, e, skip *element, inclusive []string, rendered map[string]string) {
+	// Namespaces are declared where they are visibly used
+	used := map[string]bool{e.name.Space: true}
+	var attrs []xml.Attr
+	for _, attr := range e.attrs {
+		if isNamespaceDecl(attr) {
+			continue
+		}
+		attrs = append(attrs, attr)
+		if attr.Name.Space != "" {
+			used[attr.Name.Space] = true
+		}
+	}
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		if _, ok := e.lookupNS(prefix); ok {
+			used[prefix] = true
+		}
+	}
+
+	type decl struct{ prefix, uri string }
+	var decls []decl
+	scope := map[string]string{}
+	for prefix, uri := range rendered {
+		scope[prefix] = uri
+	}
+	for prefix := range used {
+		uri, ok := e.lookupNS(prefix)
+		if !ok || prefix == "xml" {
+			continue
+		}
+		previous, declared := rendered[prefix]
+		if declared && previous == uri {
+			continue
+		}
+		// An empty default namespace is only declared to undo an ancestor's
+		if prefix == "" && uri == "" && !declared {
+			continue
+		}
+		decls = append(decls, decl{prefix, uri})
+		scope[prefix] = uri
+	}
+	sort.Slice(decls, func(i, j int) bool { return decls[i].prefix < decls[j].prefix })
+
+	// Attributes are sorted by namespace, then name
+	uri := func(attr xml.Attr) string {
+		ns, _ := e.lookupNS(attr.Name.Space)
+		if attr.Name.Space == "" {
+			ns = ""
+		}
+		return ns
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if a, b := uri(attrs[i]), uri(attrs[j]); a != b {
+			return a < b
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	buf.WriteByte('<')
+	buf.WriteString(qualified(e.name))
+	for _, d := range decls {
+		if d.prefix == "" {
+			buf.WriteString(` xmlns="`)
+		} else {
+			buf.WriteString(` xmlns:` + d.prefix + `="`)
+		}
+		buf.WriteString(escapeAttr(d.uri))
+		buf.WriteByte('"')
+	}
+	for _, attr := range attrs {
+		buf.WriteString(" " + qualified(attr.Name) + `="`)
+		buf.WriteString(escapeAttr(attr.Value))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('>')
+
+	for _, child := range e.children {
+		switch c := child.(type) {
+		case *element:
+			if c != skip {
+				writeCanonical(buf, c, skip, inclusive, scope)
+			}
+		case text:
+			buf.WriteString(escapeText(string(c)))
+		case procInst:
+			buf.WriteString("<?" + c.target)
+			if c.inst != "" {
+				buf.WriteString(" " + c.inst)
+			}
+			buf.WriteString("?>")
+		}
+	}
+
+	buf.WriteString("</" + qualified(e.name) + ">")
+}
+
+// qualified returns the name as written
+func qualified(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
@@ -0,0 +1,157 @@
+package saml
+
+import (
+	"strings"
+	"testing"
+)
+
+// findID returns the element of the tree with the given ID attribute
+func findID(e *element, id string) *element {
+	if e.attr("ID") == id {
+		return e
+	}
+	for _, child := range e.children {
+		if c, ok := child.(*element); ok {
+			if found := findID(c, id); found != nil {
+				return found
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		id        string
+		skip      string
+		inclusive []string
+		want      string
+	}{
+		{
+			name: "comments are dropped",
+			doc:  `<r ID="r"><!-- before --><a>ada<!-- in -->@example.com</a><!-- after --></r>`,
+			id:   "r",
+			want: `<r ID="r"><a>ada@example.com</a></r>`,
+		},
+		{
+			name: "whitespace is kept",
+			doc:  "<r ID=\"r\">\n  <a> ada </a>\n\t<b/>\n</r>",
+			id:   "r",
+			want: "<r ID=\"r\">\n  <a> ada </a>\n\t<b></b>\n</r>",
+		},
+		{
+			name: "whitespace in tags is normalized",
+			doc:  "<r  ID = \"r\"\n  b='2'   a=\"1\" ></r >",
+			id:   "r",
+			want: `<r ID="r" a="1" b="2"></r>`,
+		},
+		{
+			name: "attributes sorted by namespace then name",
+			doc:  `<r xmlns:z="urn:a" xmlns:a="urn:z" ID="r" a:x="1" z:y="2" c="3"></r>`,
+			id:   "r",
+			want: `<r xmlns:a="urn:z" xmlns:z="urn:a" ID="r" c="3" z:y="2" a:x="1"></r>`,
+		},
+		{
+			name: "unused namespaces are dropped",
+			doc:  `<p:r xmlns:p="urn:p" xmlns:q="urn:q" xmlns="urn:d" ID="r"><p:a/></p:r>`,
+			id:   "r",
+			want: `<p:r xmlns:p="urn:p" ID="r"><p:a></p:a></p:r>`,
+		},
+		{
+			name: "namespaces declared where they are used",
+			doc:  `<p:r xmlns:p="urn:p" xmlns:q="urn:q" ID="r"><q:a q:x="1"><q:b/></q:a></p:r>`,
+			id:   "r",
+			want: `<p:r xmlns:p="urn:p" ID="r"><q:a xmlns:q="urn:q" q:x="1"><q:b></q:b></q:a></p:r>`,
+		},
+		{
+			name: "ancestor namespaces of a nested element",
+			doc:  `<p:r xmlns:p="urn:p" xmlns="urn:d"><a ID="a"><p:b/></a></p:r>`,
+			id:   "a",
+			want: `<a xmlns="urn:d" ID="a"><p:b xmlns:p="urn:p"></p:b></a>`,
+		},
+		{
+			name:      "inclusive namespaces",
+			doc:       `<p:r xmlns:p="urn:p" xmlns:q="urn:q"><p:a ID="a"/></p:r>`,
+			id:        "a",
+			inclusive: []string{"q"},
+			want:      `<p:a xmlns:p="urn:p" xmlns:q="urn:q" ID="a"></p:a>`,
+		},
+		{
+			name: "default namespace undone",
+			doc:  `<r xmlns="urn:d" ID="r"><a xmlns=""/></r>`,
+			id:   "r",
+			want: `<r xmlns="urn:d" ID="r"><a xmlns=""></a></r>`,
+		},
+		{
+			name: "escaping",
+			doc:  `<r ID="r" a='"&lt;&#9;'>1 &lt; 2 &amp;&amp; 3 &gt; 2</r>`,
+			id:   "r",
+			want: `<r ID="r" a="&quot;&lt;&#x9;">1 &lt; 2 &amp;&amp; 3 &gt; 2</r>`,
+		},
+		{
+			name: "CDATA as text",
+			doc:  `<r ID="r"><![CDATA[<a>]]></r>`,
+			id:   "r",
+			want: `<r ID="r">&lt;a&gt;</r>`,
+		},
+		{
+			name: "enveloped signature skipped",
+			doc:  `<r ID="r"><a/><Signature ID="s"><b/></Signature><c/></r>`,
+			id:   "r",
+			skip: "s",
+			want: `<r ID="r"><a></a><c></c></r>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseXML([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("parseXML() error = %v", err)
+			}
+
+			var skip *element
+			if tt.skip != "" {
+				skip = findID(root, tt.skip)
+			}
+			if got := string(canonicalize(findID(root, tt.id), skip, tt.inclusive)); got != tt.want {
+				t.Errorf("canonicalize() = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXML(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "declaration", doc: `<?xml version="1.0" encoding="UTF-8"?><r/>`},
+		{name: "DTD", doc: `<!DOCTYPE r [<!ENTITY e "ada">]><r>&e;</r>`, wantErr: "DTDs are not allowed"},
+		{name: "external DTD", doc: `<!DOCTYPE r SYSTEM "http://example.com/r.dtd"><r/>`, wantErr: "DTDs are not allowed"},
+		{name: "undeclared prefix", doc: `<p:r/>`, wantErr: "undeclared prefix p"},
+		{name: "undeclared attribute prefix", doc: `<r p:a="1"/>`, wantErr: "undeclared prefix p"},
+		{name: "two roots", doc: `<r/><s/>`, wantErr: "more than one root element"},
+		{name: "text outside the root", doc: `<r/>ada`, wantErr: "text outside the root element"},
+		{name: "unclosed", doc: `<r><a></a>`, wantErr: "incomplete document"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseXML([]byte(tt.doc))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("parseXML() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseXML() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
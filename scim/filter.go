@@ -0,0 +1,377 @@
+package scim
+
+// Filters of list requests and of PATCH paths, RFC 7644 section 3.4.2.2.
+// They are evaluated against the JSON form of resources, comparisons of
+// strings ignore case since none of the attributes served are case exact.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filter is a parsed filter expression
+type filter interface {
+	match(resource map[string]interface{}) bool
+}
+
+// logical joins two filters with "and" or "or"
+type logical struct {
+	and         bool
+	left, right filter
+}
+
+func (f logical) match(resource map[string]interface{}) bool {
+	if f.and {
+		return f.left.match(resource) && f.right.match(resource)
+	}
+	return f.left.match(resource) || f.right.match(resource)
+}
+
+// negation is "not (filter)"
+type negation struct {
+	inner filter
+}
+
+func (f negation) match(resource map[string]interface{}) bool {
+	return !f.inner.match(resource)
+}
+
+// comparison compares an attribute with a value, value is nil for "pr"
+type comparison struct {
+	path  string
+	op    string
+	value interface{}
+}
+
+func (f comparison) match(resource map[string]interface{}) bool {
+	values := lookup(resource, f.path)
+	if f.op == "pr" {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if compare(v, f.op, f.value) {
+			return true
+		}
+	}
+	// Absent attributes are only unequal
+	return len(values) == 0 && f.op == "ne"
+}
+
+// compare applies op to an attribute value and the value of a filter
+func compare(attr interface{}, op string, value interface{}) bool {
+	switch want := value.(type) {
+	case string:
+		got, ok := attr.(string)
+		if !ok {
+			return false
+		}
+		got, want = strings.ToLower(got), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return got == want
+		case "ne":
+			return got != want
+		case "co":
+			return strings.Contains(got, want)
+		case "sw":
+			return strings.HasPrefix(got, want)
+		case "ew":
+			return strings.HasSuffix(got, want)
+		case "gt":
+			return got > want
+		case "ge":
+			return got >= want
+		case "lt":
+			return got < want
+		case "le":
+			return got <= want
+		}
+	case bool, nil, float64:
+		switch op {
+		case "eq":
+			return attr == want
+		case "ne":
+			return attr != want
+		}
+	}
+
+	return false
+}
+
+// lookup returns the values at path in resource, e.g. "name.givenName". The
+// values of multi-valued attributes are flattened, "emails" stands for
+// "emails.value"
+func lookup(resource map[string]interface{}, path string) []interface{} {
+	current := []interface{}{resource}
+	for _, part := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, c := range current {
+			object, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if key, ok := findKey(object, part); ok {
+				next = append(next, flatten(object[key])...)
+			}
+		}
+		current = next
+	}
+
+	values := []interface{}{}
+	for _, c := range current {
+		if object, ok := c.(map[string]interface{}); ok {
+			if key, ok := findKey(object, "value"); ok {
+				values = append(values, object[key])
+			}
+			continue
+		}
+		values = append(values, c)
+	}
+
+	return values
+}
+
+// flatten returns the elements of multi-valued attributes
+func flatten(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+// findKey returns the key of object matching name, attribute names are case insensitive
+func findKey(object map[string]interface{}, name string) (string, bool) {
+	if _, ok := object[name]; ok {
+		return name, true
+	}
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+
+	return name, false
+}
+
+// filterParser is a recursive descent parser of filters
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseFilter parses a filter expression
+func parseFilter(expr string) (filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	return f, nil
+}
+
+// tokenize splits a filter into attribute paths, operators, parentheses and
+// quoted strings, which keep their quotes
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, expr[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(expr) && expr[end] != ' ' && expr[end] != '(' && expr[end] != ')' {
+				end++
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) or() (filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) and() (filter, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) factor() (filter, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case token == "(":
+		return p.group()
+	case strings.EqualFold(token, "not"):
+		if p.next() != "(" {
+			return nil, fmt.Errorf("expected ( after not")
+		}
+		inner, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+		return negation{inner: inner}, nil
+	}
+
+	path := stripSchema(token)
+	if !validPath(path) {
+		return nil, fmt.Errorf("invalid attribute %q", token)
+	}
+
+	op := strings.ToLower(p.next())
+	switch op {
+	case "pr":
+		return comparison{path: path, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("invalid operator %q", op)
+	}
+
+	value, err := parseValue(p.next())
+	if err != nil {
+		return nil, err
+	}
+
+	return comparison{path: path, op: op, value: value}, nil
+}
+
+// group parses the rest of a parenthesized filter
+func (p *filterParser) group() (filter, error) {
+	inner, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.next() != ")" {
+		return nil, fmt.Errorf("expected )")
+	}
+
+	return inner, nil
+}
+
+// parseValue parses the value of a comparison
+func parseValue(token string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(token, `"`):
+		return strconv.Unquote(token)
+	case token == "true":
+		return true, nil
+	case token == "false":
+		return false, nil
+	case token == "null":
+		return nil, nil
+	}
+
+	n, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", token)
+	}
+	return n, nil
+}
+
+// validPath reports whether path is made of attribute names
+func validPath(path string) bool {
+	for _, part := range strings.Split(path, ".") {
+		if part == "" || !unicode.IsLetter(rune(part[0])) {
+			return false
+		}
+		for _, r := range part {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '$' && r != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// stripSchema removes the schema URN attributes can be prefixed with.
+// Attributes of extension schemas, e.g. the enterprise user, lose it too and
+// are ignored like other unknown attributes
+func stripSchema(path string) string {
+	for _, schema := range []string{userSchema, groupSchema} {
+		if len(path) > len(schema) && strings.EqualFold(path[:len(schema)+1], schema+":") {
+			return path[len(schema)+1:]
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		// Attribute names can't have colons, filters after them can
+		name := path
+		if open := strings.Index(path, "["); open >= 0 {
+			name = path[:open]
+		}
+		return path[strings.LastIndex(name, ":")+1:]
+	}
+
+	return path
+}
@@ -0,0 +1,213 @@
+package scim
+
+// The Groups resource, one fixed group per organization role. Adding a
+// member to a group gives it the role, removing it from Owners or Admins
+// makes it a plain member. Groups can't be created or deleted.
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+)
+
+// fixedGroup is the group of an organization role
+type fixedGroup struct {
+	id   string
+	name string
+	role model.OrgRole
+}
+
+var fixedGroups = []fixedGroup{
+	{id: "owners", name: "Owners", role: model.OrgRoleOwner},
+	{id: "admins", name: "Admins", role: model.OrgRoleAdmin},
+	{id: "members", name: "Members", role: model.OrgRoleMember},
+}
+
+// groupOf returns the group of role
+func groupOf(role model.OrgRole) fixedGroup {
+	for _, group := range fixedGroups {
+		if group.role == role {
+			return group
+		}
+	}
+
+	return fixedGroups[len(fixedGroups)-1]
+}
+
+// group is the JSON form of a Group resource
+type group struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	DisplayName string      `json:"displayName"`
+	Members     []memberRef `json:"members"`
+	Meta        *meta       `json:"meta,omitempty"`
+}
+
+// memberRef is a member of a group
+type memberRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// toGroup returns the resource of g listing the members with its role
+func (s *server) toGroup(g fixedGroup, members []*auth.OrgMember) *group {
+	resource := &group{
+		Schemas:     []string{groupSchema},
+		ID:          g.id,
+		DisplayName: g.name,
+		Members:     []memberRef{},
+		Meta:        &meta{ResourceType: "Group", Location: s.baseURL + "/Groups/" + g.id},
+	}
+	for _, member := range members {
+		if member.Role == g.role {
+			id := member.User.ID.Hex()
+			resource.Members = append(resource.Members, memberRef{Value: id, Display: member.User.Username, Ref: s.baseURL + "/Users/" + id})
+		}
+	}
+
+	return resource
+}
+
+// groupMap returns the JSON form of a group, without its members when the
+// request excludes them
+func groupMap(r *http.Request, resource *group) map[string]interface{} {
+	m := toMap(resource)
+	for _, attr := range strings.Split(r.URL.Query().Get("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(attr), "members") {
+			delete(m, "members")
+		}
+	}
+
+	return m
+}
+
+// groups serves the collection
+func (s *server) groups(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		writeError(w, http.StatusForbidden, "mutability", "Groups are the roles of the organization, they can't be created.")
+		return
+	}
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	members, err := s.store.OrgMembers(r.Context(), orgID(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	resources := []map[string]interface{}{}
+	for _, g := range fixedGroups {
+		resources = append(resources, groupMap(r, s.toGroup(g, members)))
+	}
+	list(w, r, resources)
+}
+
+// group serves a single group
+func (s *server) group(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Groups/")
+	var g *fixedGroup
+	for i := range fixedGroups {
+		if fixedGroups[i].id == id {
+			g = &fixedGroups[i]
+		}
+	}
+	if g == nil {
+		writeError(w, http.StatusNotFound, "", "Could not find group with id '"+id+"'.")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		writeError(w, http.StatusForbidden, "mutability", "Groups are the roles of the organization, they can't be deleted.")
+		return
+	}
+	if !allow(w, r, http.MethodGet, http.MethodPut, http.MethodPatch) {
+		return
+	}
+
+	members, err := s.store.OrgMembers(r.Context(), orgID(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	current := s.toGroup(*g, members)
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, groupMap(r, current))
+		return
+	}
+
+	var body group
+	action := "replaceGroup"
+	if r.Method == http.MethodPut {
+		if !decode(w, r, &body) {
+			return
+		}
+	} else {
+		action = "patchGroup"
+		ops, ok := decodePatch(w, r)
+		if !ok {
+			return
+		}
+
+		resource := toMap(current)
+		if err := applyPatch(resource, ops); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidPath", err.Error())
+			return
+		}
+		if err := fromMap(resource, &body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", "Invalid attribute values.")
+			return
+		}
+	}
+
+	if !s.setMembers(w, r, *g, current.Members, body.Members) {
+		return
+	}
+
+	s.audit(r, action, map[string]string{"group": g.id})
+	if members, err = s.store.OrgMembers(r.Context(), orgID(r)); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, groupMap(r, s.toGroup(*g, members)))
+}
+
+// setMembers gives the role of g to the members added to it and makes the
+// ones removed from it plain members
+func (s *server) setMembers(w http.ResponseWriter, r *http.Request, g fixedGroup, before, after []memberRef) bool {
+	was := map[string]bool{}
+	for _, member := range before {
+		was[member.Value] = true
+	}
+	is := map[string]bool{}
+	for _, member := range after {
+		is[member.Value] = true
+	}
+
+	// Additions first, so an owner replacing another keeps one
+	for id := range is {
+		if was[id] {
+			continue
+		}
+		if err := s.store.SetOrgRole(r.Context(), orgID(r), id, g.role); err != nil {
+			writeStoreError(w, err)
+			return false
+		}
+	}
+	for id := range was {
+		if is[id] || g.role == model.OrgRoleMember {
+			continue
+		}
+		if err := s.store.SetOrgRole(r.Context(), orgID(r), id, model.OrgRoleMember); err != nil {
+			writeStoreError(w, err)
+			return false
+		}
+	}
+
+	return true
+}
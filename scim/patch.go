@@ -0,0 +1,213 @@
+package scim
+
+// PATCH operations, RFC 7644 section 3.5.2. They are applied to the JSON
+// form of a resource, which is then read back like the body of a PUT.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// patchRequest is the body of PATCH requests
+type patchRequest struct {
+	Schemas    []string  `json:"schemas"`
+	Operations []patchOp `json:"Operations"`
+}
+
+// patchOp is one operation of a PATCH request
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// patchPath is a parsed PATCH path, e.g. emails[type eq "work"].value
+type patchPath struct {
+	attr string
+	// Selects elements of a multi-valued attribute, nil for all of it
+	filter filter
+	sub    string
+}
+
+// parsePatchPath parses the path of an operation
+func parsePatchPath(path string) (*patchPath, error) {
+	path = stripSchema(path)
+	p := &patchPath{attr: path}
+
+	if open := strings.Index(path, "["); open >= 0 {
+		end := strings.LastIndex(path, "]")
+		if end < open {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		f, err := parseFilter(path[open+1 : end])
+		if err != nil {
+			return nil, err
+		}
+
+		p.attr, p.filter = path[:open], f
+		p.sub = strings.TrimPrefix(path[end+1:], ".")
+	} else if dot := strings.Index(path, "."); dot >= 0 {
+		p.attr, p.sub = path[:dot], path[dot+1:]
+	}
+
+	if !validPath(p.attr) || (p.sub != "" && !validPath(p.sub)) {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+
+	return p, nil
+}
+
+// applyPatch applies the operations to resource in order
+func applyPatch(resource map[string]interface{}, ops []patchOp) error {
+	for _, op := range ops {
+		name := strings.ToLower(op.Op)
+		if name != "add" && name != "replace" && name != "remove" {
+			return fmt.Errorf("invalid operation %q", op.Op)
+		}
+
+		// Without a path the value holds the attributes to add or replace
+		if op.Path == "" {
+			values, ok := op.Value.(map[string]interface{})
+			if name == "remove" || !ok {
+				return fmt.Errorf("operation %q needs a path", op.Op)
+			}
+			for attr, value := range values {
+				path, err := parsePatchPath(attr)
+				if err != nil {
+					return err
+				}
+				if err := applyOp(resource, name, path, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		path, err := parsePatchPath(op.Path)
+		if err != nil {
+			return err
+		}
+		if err := applyOp(resource, name, path, op.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyOp applies one operation at path
+func applyOp(resource map[string]interface{}, op string, path *patchPath, value interface{}) error {
+	key, _ := findKey(resource, path.attr)
+
+	if path.filter == nil {
+		if path.sub != "" {
+			object, ok := resource[key].(map[string]interface{})
+			if !ok {
+				if op == "remove" {
+					return nil
+				}
+				object = map[string]interface{}{}
+				resource[key] = object
+			}
+			return applyOp(object, op, &patchPath{attr: path.sub}, value)
+		}
+
+		switch op {
+		case "remove":
+			if list, ok := resource[key].([]interface{}); ok && value != nil {
+				resource[key] = without(list, flatten(value))
+			} else {
+				delete(resource, key)
+			}
+		case "add":
+			// Adding to a multi-valued attribute appends
+			if list, ok := resource[key].([]interface{}); ok {
+				resource[key] = append(list, flatten(value)...)
+			} else {
+				resource[key] = value
+			}
+		default:
+			resource[key] = value
+		}
+		return nil
+	}
+
+	list, _ := resource[key].([]interface{})
+	kept := []interface{}{}
+	matched := false
+	for _, element := range list {
+		object, ok := element.(map[string]interface{})
+		if !ok || !path.filter.match(object) {
+			kept = append(kept, element)
+			continue
+		}
+
+		matched = true
+		switch {
+		case op == "remove" && path.sub == "":
+			continue
+		case op == "remove":
+			subKey, _ := findKey(object, path.sub)
+			delete(object, subKey)
+		case path.sub == "":
+			if values, ok := value.(map[string]interface{}); ok {
+				for k, v := range values {
+					object[k] = v
+				}
+			}
+		default:
+			subKey, _ := findKey(object, path.sub)
+			object[subKey] = value
+		}
+		kept = append(kept, object)
+	}
+
+	// Setting a sub-attribute of an element that doesn't exist yet creates it
+	// from the equality in the filter, e.g. emails[type eq "work"].value
+	if !matched && op != "remove" {
+		element := map[string]interface{}{}
+		if eq, ok := path.filter.(comparison); ok && eq.op == "eq" {
+			element[eq.path] = eq.value
+		}
+		if path.sub != "" {
+			element[path.sub] = value
+		} else if values, ok := value.(map[string]interface{}); ok {
+			for k, v := range values {
+				element[k] = v
+			}
+		}
+		kept = append(kept, element)
+	}
+
+	resource[key] = kept
+	return nil
+}
+
+// without returns the elements of list whose value isn't in removed
+func without(list, removed []interface{}) []interface{} {
+	drop := map[interface{}]bool{}
+	for _, r := range removed {
+		if object, ok := r.(map[string]interface{}); ok {
+			if key, ok := findKey(object, "value"); ok {
+				drop[object[key]] = true
+			}
+			continue
+		}
+		drop[r] = true
+	}
+
+	kept := []interface{}{}
+	for _, element := range list {
+		value := element
+		if object, ok := element.(map[string]interface{}); ok {
+			if key, ok := findKey(object, "value"); ok {
+				value = object[key]
+			}
+		}
+		if !drop[value] {
+			kept = append(kept, element)
+		}
+	}
+
+	return kept
+}
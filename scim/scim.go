@@ -0,0 +1,301 @@
+package scim
+
+// SCIM 2.0 provisioning API, RFC 7643 and RFC 7644, for identity providers
+// managing the members of an organization. They authenticate with a
+// provisioning token of the organization, created with the createScimToken
+// mutation, and only see its members.
+//
+// Users are the members of the organization. Those created through SCIM
+// live in its namespace and can be changed, other members can only be given
+// roles or removed. Groups are the fixed Owners, Admins and Members groups,
+// one per organization role. Filters are evaluated in memory over the
+// members, organizations are expected to have thousands of them at most.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/graph/model"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Schemas of resources and messages
+const (
+	userSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	groupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	configSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	listSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	errorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// maxBodySize caps request bodies, group changes can list many members
+const maxBodySize = 1 << 20
+
+// maxResults caps the resources of a list response
+const maxResults = 200
+
+// Store is what the API needs from the database, implemented by auth.DB
+type Store interface {
+	ScimOrg(ctx context.Context, token string) (string, error)
+	OrgMembers(ctx context.Context, orgID string) ([]*auth.OrgMember, error)
+	FindOrgMember(ctx context.Context, orgID, userID string) (*auth.OrgMember, error)
+	ProvisionUser(ctx context.Context, orgID string, input *auth.ProvisionedUser) (*auth.OrgMember, error)
+	UpdateProvisionedUser(ctx context.Context, orgID, userID string, input *auth.ProvisionedUser) (*auth.OrgMember, error)
+	DeprovisionUser(ctx context.Context, orgID, userID string) error
+	SetOrgRole(ctx context.Context, orgID, userID string, role model.OrgRole) error
+	Audit(ctx context.Context, eventType model.AuditEventType, subject string, details map[string]string)
+}
+
+// server serves the API of the organization a request's token belongs to
+type server struct {
+	store Store
+	// URL of the API, prefix of the locations of resources
+	baseURL string
+}
+
+type orgCtxKey struct{}
+
+// orgID returns the organization the request was authenticated for
+func orgID(r *http.Request) string {
+	org, _ := r.Context().Value(orgCtxKey{}).(string)
+	return org
+}
+
+// errorBody is the body of failed requests
+type errorBody struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// listResponse is the body of list requests
+type listResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// meta are the attributes of a resource describing it
+type meta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	Location     string `json:"location"`
+}
+
+// Handler serves the API under /scim/v2, baseURL is its public URL
+func Handler(store Store, baseURL string) http.Handler {
+	s := &server{store: store, baseURL: strings.TrimSuffix(baseURL, "/")}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scim/v2/Users", s.users)
+	mux.HandleFunc("/scim/v2/Users/", s.user)
+	mux.HandleFunc("/scim/v2/Groups", s.groups)
+	mux.HandleFunc("/scim/v2/Groups/", s.group)
+	mux.HandleFunc("/scim/v2/ServiceProviderConfig", s.config)
+
+	return s.authenticate(mux)
+}
+
+// authenticate resolves the provisioning token to its organization and
+// limits the body size
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeError(w, http.StatusUnauthorized, "", "A provisioning token is required.")
+			return
+		}
+
+		org, err := s.store.ScimOrg(r.Context(), strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "", message(err))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), orgCtxKey{}, org)))
+	})
+}
+
+// audit records a change made by the identity provider of the organization
+func (s *server) audit(r *http.Request, action string, details map[string]string) {
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["action"] = action
+	s.store.Audit(r.Context(), model.AuditEventTypeProvisioning, orgID(r), details)
+}
+
+// config serves the ServiceProviderConfig resource
+func (s *server) config(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	supported := func(ok bool) map[string]bool { return map[string]bool{"supported": ok} }
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{configSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": maxResults},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Provisioning token",
+			"description": "Token created by an owner of the organization with the createScimToken mutation.",
+			"primary":     true,
+		}},
+		"meta": meta{ResourceType: "ServiceProviderConfig", Location: s.baseURL + "/ServiceProviderConfig"},
+	})
+}
+
+// list answers a list request over resources, in their JSON form, applying
+// the filter, startIndex and count query parameters
+func list(w http.ResponseWriter, r *http.Request, resources []map[string]interface{}) {
+	query := r.URL.Query()
+
+	if expr := query.Get("filter"); expr != "" {
+		f, err := parseFilter(expr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+
+		matched := []map[string]interface{}{}
+		for _, resource := range resources {
+			if f.match(resource) {
+				matched = append(matched, resource)
+			}
+		}
+		resources = matched
+	}
+
+	// startIndex is 1-based, values below 1 mean 1
+	start := 1
+	if n, err := strconv.Atoi(query.Get("startIndex")); err == nil && n > 1 {
+		start = n
+	}
+	count := maxResults
+	if n, err := strconv.Atoi(query.Get("count")); err == nil && n >= 0 && n < maxResults {
+		count = n
+	}
+
+	page := []interface{}{}
+	for i := start - 1; i < len(resources) && len(page) < count; i++ {
+		page = append(page, resources[i])
+	}
+
+	writeJSON(w, http.StatusOK, listResponse{
+		Schemas:      []string{listSchema},
+		TotalResults: len(resources),
+		StartIndex:   start,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// toMap returns the JSON form of v
+func toMap(v interface{}) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	var resource map[string]interface{}
+	json.Unmarshal(data, &resource)
+	return resource
+}
+
+// fromMap reads the JSON form of a resource back into v
+func fromMap(resource map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodePatch reads the body of a PATCH request
+func decodePatch(w http.ResponseWriter, r *http.Request) ([]patchOp, bool) {
+	var body patchRequest
+	if !decode(w, r, &body) {
+		return nil, false
+	}
+	if len(body.Operations) == 0 {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "Operations are required.")
+		return nil, false
+	}
+
+	return body.Operations, true
+}
+
+// allow rejects methods other than the given ones
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "", "Use "+strings.Join(methods, " or ")+".")
+	return false
+}
+
+// decode reads the JSON body into v, answering 400 when it is malformed
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "Request body must be a valid JSON object.")
+		return false
+	}
+
+	return true
+}
+
+// message returns the client facing text of err, without the "input: "
+// prefix gqlerror adds
+func message(err error) string {
+	if gqlErr, ok := err.(*gqlerror.Error); ok {
+		return gqlErr.Message
+	}
+
+	return err.Error()
+}
+
+// writeStoreError answers with the error of a failed change, validation
+// failures and taken usernames or emails are the identity provider's fault
+func writeStoreError(w http.ResponseWriter, err error) {
+	gqlErr, ok := err.(*gqlerror.Error)
+	switch {
+	case ok && gqlErr.Extensions["fields"] != nil:
+		writeError(w, http.StatusBadRequest, "invalidValue", gqlErr.Message)
+	case auth.CodeOf(err) == auth.CodeUsernameTaken || auth.CodeOf(err) == auth.CodeEmailTaken:
+		writeError(w, http.StatusConflict, "uniqueness", gqlErr.Message)
+	case ok:
+		writeError(w, http.StatusBadRequest, "", gqlErr.Message)
+	default:
+		writeError(w, http.StatusInternalServerError, "", "Could not complete the request, try again later.")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeJSON(w, status, errorBody{
+		Schemas:  []string{errorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
@@ -0,0 +1,207 @@
+package scim
+
+// The Users resource, the members of the organization.
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+)
+
+// user is the JSON form of a User resource
+type user struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	UserName    string   `json:"userName"`
+	Name        *name    `json:"name,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Emails      []email  `json:"emails,omitempty"`
+	// Missing means active
+	Active *bool `json:"active,omitempty"`
+	// Only ever set by identity providers
+	Password string     `json:"password,omitempty"`
+	Groups   []groupRef `json:"groups,omitempty"`
+	Meta     *meta      `json:"meta,omitempty"`
+}
+
+type name struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+type email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// groupRef is a group of a user
+type groupRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display"`
+	Ref     string `json:"$ref"`
+}
+
+// toUser converts a member into its resource
+func (s *server) toUser(member *auth.OrgMember) *user {
+	account := member.User
+	active := !account.Disabled
+	group := groupOf(member.Role)
+	formatted := strings.TrimSpace(account.Fname + " " + account.Lname)
+
+	return &user{
+		Schemas:     []string{userSchema},
+		ID:          account.ID.Hex(),
+		ExternalID:  account.ExternalID,
+		UserName:    account.Username,
+		Name:        &name{GivenName: account.Fname, FamilyName: account.Lname, Formatted: formatted},
+		DisplayName: formatted,
+		Emails:      []email{{Value: account.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Groups:      []groupRef{{Value: group.id, Display: group.name, Ref: s.baseURL + "/Groups/" + group.id}},
+		Meta: &meta{
+			ResourceType: "User",
+			Created:      account.CreatedAt.UTC().Format(time.RFC3339),
+			Location:     s.baseURL + "/Users/" + account.ID.Hex(),
+		},
+	}
+}
+
+// provisioned returns what the resource sets about the user
+func (u *user) provisioned() *auth.ProvisionedUser {
+	input := &auth.ProvisionedUser{
+		Username:   u.UserName,
+		ExternalID: u.ExternalID,
+		Active:     u.Active == nil || *u.Active,
+		Password:   u.Password,
+	}
+	if u.Name != nil {
+		input.Fname, input.Lname = u.Name.GivenName, u.Name.FamilyName
+	}
+
+	// The primary email, or the first one
+	for i, e := range u.Emails {
+		if i == 0 || e.Primary {
+			input.Email = e.Value
+		}
+		if e.Primary {
+			break
+		}
+	}
+
+	return input
+}
+
+// users serves the collection, listing members and creating users
+func (s *server) users(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var body user
+		if !decode(w, r, &body) {
+			return
+		}
+
+		member, err := s.store.ProvisionUser(r.Context(), orgID(r), body.provisioned())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		s.audit(r, "createUser", map[string]string{"userId": member.User.ID.Hex()})
+		resource := s.toUser(member)
+		w.Header().Set("Location", resource.Meta.Location)
+		writeJSON(w, http.StatusCreated, resource)
+		return
+	}
+
+	members, err := s.store.OrgMembers(r.Context(), orgID(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	resources := []map[string]interface{}{}
+	for _, member := range members {
+		resources = append(resources, toMap(s.toUser(member)))
+	}
+	list(w, r, resources)
+}
+
+// user serves a single member
+func (s *server) user(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Users/")
+	member, err := s.store.FindOrgMember(r.Context(), orgID(r), id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", message(err))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.toUser(member))
+		return
+	case http.MethodDelete:
+		if err := s.store.DeprovisionUser(r.Context(), orgID(r), id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		s.audit(r, "deleteUser", map[string]string{"userId": id})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !member.Managed {
+		writeError(w, http.StatusForbidden, "mutability", "Only users created in the organization can be changed.")
+		return
+	}
+
+	var body user
+	action := "replaceUser"
+	if r.Method == http.MethodPut {
+		if !decode(w, r, &body) {
+			return
+		}
+	} else {
+		action = "patchUser"
+		ops, ok := decodePatch(w, r)
+		if !ok {
+			return
+		}
+
+		resource := toMap(s.toUser(member))
+		if err := applyPatch(resource, ops); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidPath", err.Error())
+			return
+		}
+		// Some identity providers send booleans as strings
+		if key, ok := findKey(resource, "active"); ok {
+			if active, ok := resource[key].(string); ok {
+				resource[key] = strings.EqualFold(active, "true")
+			}
+		}
+		if err := fromMap(resource, &body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", "Invalid attribute values.")
+			return
+		}
+	}
+
+	member, err = s.store.UpdateProvisionedUser(r.Context(), orgID(r), id, body.provisioned())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	s.audit(r, action, map[string]string{"userId": id})
+	writeJSON(w, http.StatusOK, s.toUser(member))
+}
@@ -0,0 +1,123 @@
+package secrets
+
+// AWS Secrets Manager client. Requests are signed with Signature Version 4,
+// see https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AWS reads a secret stored as a JSON object from AWS Secrets Manager
+type AWS struct {
+	region       string
+	secretID     string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// NewAWS returns a provider for secretID, credentials are the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and optional AWS_SESSION_TOKEN
+func NewAWS(region, secretID, accessKey, secretKey, sessionToken string) *AWS {
+	return &AWS{
+		region:       region,
+		secretID:     secretID,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Fetch calls GetSecretValue and decodes the secret string
+func (a *AWS) Fetch(ctx context.Context) (map[string]string, error) {
+	body, err := json.Marshal(map[string]string{"SecretId": a.secretID})
+	if err != nil {
+		return nil, err
+	}
+
+	host := "secretsmanager." + a.region + ".amazonaws.com"
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	a.sign(req, host, body, time.Now().UTC())
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secrets manager returned %s for %s", res.Status, a.secretID)
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal([]byte(out.SecretString), &values); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object of strings", a.secretID)
+	}
+
+	return values, nil
+}
+
+// sign adds the SigV4 Authorization header to req
+func (a *AWS) sign(req *http.Request, host string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := "content-type;host;x-amz-date;x-amz-target"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + host + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if a.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+		headers = "content-type;host;x-amz-date;x-amz-security-token;x-amz-target"
+		canonicalHeaders += "x-amz-security-token:" + a.sessionToken + "\n"
+	}
+	canonicalHeaders += "x-amz-target:" + req.Header.Get("X-Amz-Target") + "\n"
+
+	canonicalRequest := "POST\n/\n\n" + canonicalHeaders + "\n" + headers + "\n" + hashHex(body)
+	scope := date + "/" + a.region + "/secretsmanager/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, "secretsmanager")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.accessKey+"/"+scope+
+		", SignedHeaders="+headers+", Signature="+signature)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
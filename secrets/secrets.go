@@ -0,0 +1,49 @@
+package secrets
+
+// Secret providers keep sensitive settings such as the signing key and the
+// Mongo URI out of files on disk. A provider returns the key/value pairs of
+// a secret, e.g. {"KEY": "...", "DB": "mongodb+srv://..."}, which are
+// fetched at startup and refreshed periodically.
+
+import (
+	"context"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// Provider fetches the current values of a secret
+type Provider interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// Refresh fetches the secret every interval and passes the values to apply,
+// failed fetches keep the previous values. It runs until stop is called.
+func Refresh(provider Provider, interval time.Duration, apply func(map[string]string)) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			values, err := provider.Fetch(ctx)
+			cancel()
+			if err != nil {
+				logging.Logger.Error().Err(err).Msg("could not refresh secrets")
+				continue
+			}
+
+			apply(values)
+		}
+	}()
+
+	return func() { close(done) }
+}
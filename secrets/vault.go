@@ -0,0 +1,70 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault reads a secret from HashiCorp Vault's KV engine, version 1 or 2
+type Vault struct {
+	addr   string
+	token  string
+	path   string
+	client *http.Client
+}
+
+// NewVault returns a provider for the secret at path, e.g. "secret/data/auth-service" for KV v2
+func NewVault(addr, token, path string) *Vault {
+	return &Vault{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Fetch reads the secret through the Vault HTTP API
+func (v *Vault) Fetch(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", v.token)
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s for %s", res.Status, v.path)
+	}
+
+	// KV v2 nests the values in data.data, KV v1 returns them in data
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	var v2 struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(body.Data, &v2); err == nil && v2.Data != nil {
+		return v2.Data, nil
+	}
+
+	var v1 map[string]string
+	if err := json.Unmarshal(body.Data, &v1); err != nil {
+		return nil, fmt.Errorf("unexpected secret format at %s", v.path)
+	}
+
+	return v1, nil
+}
@@ -1,29 +1,391 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
+	"time"
 
-	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/playground"
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/cache"
+	"github.com/cesar-yoab/authService/config"
+	"github.com/cesar-yoab/authService/events"
+	"github.com/cesar-yoab/authService/geoip"
 	"github.com/cesar-yoab/authService/graph"
 	"github.com/cesar-yoab/authService/graph/generated"
+	"github.com/cesar-yoab/authService/grpcapi"
+	"github.com/cesar-yoab/authService/health"
+	"github.com/cesar-yoab/authService/jobs"
+	"github.com/cesar-yoab/authService/lifecycle"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/mail"
+	"github.com/cesar-yoab/authService/metrics"
+	"github.com/cesar-yoab/authService/oauth"
+	"github.com/cesar-yoab/authService/oidc"
+	"github.com/cesar-yoab/authService/reporting"
+	"github.com/cesar-yoab/authService/rest"
+	"github.com/cesar-yoab/authService/saml"
+	"github.com/cesar-yoab/authService/scim"
+	"github.com/cesar-yoab/authService/secrets"
+	"github.com/cesar-yoab/authService/tlsconfig"
+	"github.com/cesar-yoab/authService/tracing"
+	"github.com/cesar-yoab/authService/webhook"
 )
 
-const defaultPort = "8080"
-
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = defaultPort
+	// "genkey" prints a new EDDSA_KEY and exits, it needs no configuration
+	if len(os.Args) > 1 && os.Args[1] == "genkey" {
+		key, err := auth.GenerateEdDSAKey()
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not generate a key")
+		}
+		os.Stdout.WriteString(key)
+		return
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("invalid configuration")
+	}
+
+	if err := logging.SetLevel(cfg.LogLevel); err != nil {
+		logging.Logger.Fatal().Err(err).Msg("invalid LOG_LEVEL")
+	}
+	logging.SetSampleRate(cfg.LogSampleRate)
+	auth.SetPasswordHasher(auth.NewPasswordHasher(cfg))
+	policy, err := auth.NewPasswordPolicy(cfg)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not load the password policy")
+	}
+	auth.SetPasswordPolicy(policy)
+	auth.SetUsernamePolicy(auth.NewUsernamePolicy(cfg))
+	auth.SetEmailPolicy(auth.NewEmailPolicy(cfg))
+	provisioning := auth.NewProvisioningPolicy(cfg)
+	if cfg.SSOProvisioningHook != "" {
+		provisioning.Hook = webhook.NewProvisioningHook(cfg.SSOProvisioningHook, cfg.WebhookSecret)
+	}
+	auth.SetProvisioningPolicy(provisioning)
+	auth.SetScopePolicy(auth.NewScopePolicy(cfg))
+	auth.SetPermissionPolicy(auth.NewPermissionPolicy(cfg))
+	auth.SetCookiePolicy(auth.NewCookiePolicy(cfg))
+	proxies, err := auth.NewProxyPolicy(cfg)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("invalid TRUSTED_PROXIES")
+	}
+	auth.SetProxyPolicy(proxies)
+	translations, err := auth.NewTranslations(cfg)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not load TRANSLATIONS")
+	}
+	auth.SetTranslations(translations)
+
+	db, err := auth.ConnectMongo(cfg)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not connect to the database")
+	}
+
+	// "migrate" applies pending migrations and exits, for deployments that
+	// don't run them at startup
+	migrateOnly := len(os.Args) > 1 && os.Args[1] == "migrate"
+	if cfg.MigrateOnStart || migrateOnly {
+		n, err := db.Migrate(context.Background())
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not migrate the database")
+		}
+		logging.Logger.Info().Int("count", n).Msg("migrations applied")
+
+		if migrateOnly {
+			db.Close(context.Background())
+			return
+		}
+	}
+
+	if err := db.EnsureIndexes(context.Background()); err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not create indexes")
+	}
+
+	// Personal data is encrypted once a key is configured, users stored before are rewritten
+	if cfg.PIIKey != "" {
+		if err := db.EnablePIIEncryption(context.Background(), cfg.PIIKey); err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not enable PII encryption")
+		}
+		if _, err := db.EncryptUsers(context.Background()); err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not encrypt users")
+		}
+	}
+
+	if err := db.LoadKeys(context.Background()); err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not load signing keys")
+	}
+	stopKeys := db.StartKeyRefresh(time.Minute)
+
+	// Redis is shared by the cache, the token denylist and opaque tokens
+	var redis *cache.Redis
+	if cfg.RedisURL != "" {
+		redis, err = cache.NewRedis(cfg.RedisURL)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("invalid REDIS_URL")
+		}
+	}
+
+	// Cache username and email lookups, in process or shared through Redis
+	switch cfg.Cache {
+	case "lru":
+		db.SetCache(cache.NewLRU(cfg.CacheSize), cfg.CacheTTL)
+	case "redis":
+		db.SetCache(redis, cfg.CacheTTL)
+	}
+
+	// Revoked tokens are kept in process unless instances share them through Redis
+	if cfg.Denylist == "redis" {
+		db.SetDenylist(auth.NewCacheDenylist(redis))
+	}
+
+	// Opaque tokens are kept in Mongo or shared through Redis
+	if cfg.TokenFormat == string(auth.FormatOpaque) {
+		switch cfg.TokenStore {
+		case "mongo":
+			db.SetTokenStore(auth.NewMongoTokenStore(db))
+		case "redis":
+			db.SetTokenStore(auth.NewCacheTokenStore(redis))
+		}
+	}
+
+	// Emails, webhooks and periodic tasks run in the background, queued jobs are
+	// shared between instances unless they are kept in process
+	var backend jobs.Backend = jobs.NewMemory()
+	switch cfg.JobQueue {
+	case "mongo":
+		queue := jobs.NewMongo(db.Collection("jobs"))
+		if err := queue.EnsureIndexes(context.Background()); err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not create job indexes")
+		}
+		backend = queue
+	case "redis":
+		backend = jobs.NewRedis(redis)
+	}
+	runner := jobs.New(backend, cfg.JobWorkers)
+
+	// Emails are sent through the configured provider, or only logged
+	var mailer mail.Mailer = mail.Log{}
+	switch cfg.MailProvider {
+	case "smtp":
+		mailer, err = mail.NewSMTP(cfg.SMTPURL, cfg.MailFrom)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("invalid SMTP_URL")
+		}
+	case "sendgrid":
+		mailer = mail.NewSendGrid(cfg.SendGridAPIKey, cfg.MailFrom)
+	case "ses":
+		mailer = mail.NewSES(cfg.AWSRegion, cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey, cfg.AWSSessionToken, cfg.MailFrom)
 	}
+	db.SetMailer(mail.NewDeferred(runner, mailer))
 
-	srv := handler.NewDefaultServer(generated.NewExecutableSchema(generated.Config{Resolvers: &graph.Resolver{}}))
+	// Approximate the location of logins in notification emails
+	if cfg.GeoIPURL != "" {
+		db.SetLocator(geoip.NewHTTP(cfg.GeoIPURL))
+	}
+
+	// Webhooks are optional
+	if len(cfg.WebhookURLs) > 0 {
+		db.AddSink(webhook.NewDispatcher(cfg.WebhookURLs, cfg.WebhookSecret, db.Collection("webhook_deliveries"), runner))
+	}
+
+	// Optionally publish user lifecycle events to a message bus
+	switch cfg.EventBus {
+	case "nats":
+		publisher, err := events.DialNATS(cfg.NATSURL)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not connect to NATS")
+		}
+		db.AddSink(events.NewBus(publisher, cfg.EventTopicPrefix))
+	case "kafka":
+		db.AddSink(events.NewBus(events.NewKafkaRESTPublisher(cfg.KafkaRESTURL), cfg.EventTopicPrefix))
+	}
+
+	// Export traces when an OpenTelemetry collector is configured
+	if cfg.OTLPEndpoint != "" {
+		tracing.Init(cfg.OTLPEndpoint, cfg.ServiceName)
+	}
+
+	// Report internal errors to Sentry
+	stopReporting := func(context.Context) error { return nil }
+	if cfg.SentryDSN != "" {
+		sentry, err := reporting.NewSentry(cfg.SentryDSN, cfg.Environment, cfg.SentryRelease)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("invalid SENTRY_DSN")
+		}
+		auth.SetErrorReporter(sentry)
+		stopReporting = sentry.Close
+	}
+
+	// Pick up rotated signing keys, a new Mongo URI only applies after a restart
+	stopSecrets := func() {}
+	if cfg.Secrets != nil {
+		stopSecrets = secrets.Refresh(cfg.Secrets, cfg.SecretsRefreshInterval, func(values map[string]string) {
+			if key := values["KEY"]; key != "" {
+				db.SetSigningKey(key)
+			}
+		})
+	}
+
+	resolver := graph.NewResolver(db, cfg)
+	rateLimits, err := graph.NewRateLimits(cfg)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("invalid RATE_LIMITS")
+	}
+
+	// Remove accounts whose deletion grace period is over, and expired records
+	// of the stores Mongo doesn't expire with TTL indexes
+	runner.Every("purge_deleted_users", time.Hour, db.PurgeJob)
+	runner.Every("sweep_expired", time.Minute, auth.SweepTask(append(append(db.Sweepers(), resolver.Sweepers()...), rateLimits.Sweepers()...)...))
+	runner.Start()
+
+	srv := graph.NewServer(generated.NewExecutableSchema(generated.Config{
+		Resolvers:  resolver,
+		Directives: generated.DirectiveRoot{HasRole: graph.HasRole, RecentAuth: graph.RecentAuth(cfg.ReauthMaxAge)},
+		Complexity: graph.Complexity(),
+	}), cfg)
+	srv.SetErrorPresenter(auth.ErrorPresenter)
+	srv.SetRecoverFunc(auth.Recover(cfg.Production()))
+	srv.AroundFields(auth.MaskErrors(cfg.Production()))
+	persisted, err := graph.NewPersistedQueries(cfg, redis)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not load PERSISTED_QUERIES")
+	}
+	srv.Use(persisted)
+	srv.Use(graph.NewLimits(cfg))
+	srv.Use(rateLimits)
+	srv.Use(tracing.GraphQL{})
+	srv.Use(logging.GraphQL{Variables: cfg.LogVariables, Redact: cfg.LogRedact})
+	srv.Use(graph.TokenCookies{})
 
-	http.Handle("/", playground.Handler("GraphQL playground", "/query"))
-	http.Handle("/query", srv)
+	if cfg.Playground {
+		http.Handle("/", playground.Handler("GraphQL playground", "/query"))
+	}
+	http.Handle("/query", logging.Middleware(tracing.Middleware(auth.Middleware(db)(srv))))
+	http.Handle("/v1/", logging.Middleware(tracing.Middleware(auth.Middleware(db)(rest.Handler(db)))))
+	http.Handle("/scim/v2/", logging.Middleware(tracing.Middleware(auth.ClientMiddleware(scim.Handler(db, cfg.PublicURL+"/scim/v2")))))
+
+	// SAML single sign-on is optional
+	if cfg.SAMLIdPMetadata != "" {
+		idp, err := saml.LoadMetadata(cfg.SAMLIdPMetadata)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not load SAML_IDP_METADATA")
+		}
+		sp := saml.NewServiceProvider(cfg, idp)
+		http.Handle("/saml/", logging.Middleware(tracing.Middleware(auth.ClientMiddleware(saml.Handler(db, sp)))))
+	}
+	// So is OpenID Connect, the provider must be reachable at startup
+	if cfg.OIDCIssuer != "" {
+		discoverCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		provider, err := oidc.Discover(discoverCtx, cfg)
+		cancel()
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not discover OIDC_ISSUER")
+		}
+		http.Handle("/oidc/", logging.Middleware(tracing.Middleware(auth.ClientMiddleware(oidc.Handler(db, provider)))))
+	}
+	// Service clients get tokens from the OAuth 2.0 endpoints, apps users
+	// authorize need the login page too
+	oauthHandler := logging.Middleware(tracing.Middleware(auth.ClientMiddleware(oauth.Handler(db, cfg))))
+	http.Handle("/oauth/", oauthHandler)
+	http.Handle("/.well-known/openid-configuration", oauthHandler)
+
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/healthz", health.Live)
+	http.Handle("/readyz", health.Ready(map[string]health.Check{
+		"mongo":      db.Ping,
+		"signingKey": db.CheckSigningKey,
+	}))
+
+	handler := lifecycle.LimitBody(int64(cfg.MaxBodySize), auth.CORS(auth.NewCORSPolicy(cfg))(http.DefaultServeMux))
+	server := lifecycle.New(":"+cfg.Port, handler, cfg.ShutdownTimeout)
+	server.SetTimeouts(cfg.HTTPReadTimeout, cfg.HTTPWriteTimeout, cfg.HTTPIdleTimeout)
+	tlsConfig, redirect, err := tlsconfig.New(cfg)
+	if err != nil {
+		logging.Logger.Fatal().Err(err).Msg("could not load TLS_CERT_FILE")
+	}
+	if tlsConfig != nil {
+		server.UseTLS(tlsConfig)
+		if cfg.HTTPRedirectPort != "" {
+			server.Also(":"+cfg.HTTPRedirectPort, redirect)
+		}
+	}
+	// Internal services may have to identify with client certificates
+	var mutual *tls.Config
+	peers := auth.NewMutualTLSPolicy(cfg)
+	if peers != nil {
+		mutual, err = tlsconfig.Mutual(tlsConfig, cfg.MTLSCAFile)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not load MTLS_CA_FILE")
+		}
+	}
+	if cfg.MTLSPort != "" {
+		internal := http.NewServeMux()
+		internal.Handle("/oauth/introspect", auth.ClientMiddleware(oauth.InternalHandler(db)))
+		internal.Handle("/v1/", auth.Middleware(db)(rest.Handler(db)))
+		internalHandler := logging.Middleware(tracing.Middleware(auth.RequirePeer(peers)(internal)))
+		server.AlsoTLS(":"+cfg.MTLSPort, lifecycle.LimitBody(int64(cfg.MaxBodySize), internalHandler), mutual)
+	}
+	// Internal services verify tokens over gRPC
+	if cfg.GRPCPort != "" {
+		listener, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			logging.Logger.Fatal().Err(err).Msg("could not listen for gRPC")
+		}
+
+		grpcServer := grpcapi.NewServer(db, cfg.GRPCToken, mutual, peers)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				logging.Logger.Error().Err(err).Msg("gRPC server stopped")
+			}
+		}()
+
+		server.OnShutdown("grpc", func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
 
-	log.Printf("connect to http://localhost:%s/ for GraphQL playground", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				grpcServer.Stop()
+				return ctx.Err()
+			}
+		})
+	}
+	server.OnShutdown("jobs", runner.Close)
+	server.OnShutdown("keys", func(context.Context) error {
+		stopKeys()
+		return nil
+	})
+	server.OnShutdown("secrets", func(context.Context) error {
+		stopSecrets()
+		return nil
+	})
+	server.OnShutdown("tracing", tracing.Shutdown)
+	server.OnShutdown("reporting", stopReporting)
+	server.OnShutdown("mongo", db.Close)
+
+	if cfg.Playground {
+		// Certificates from Let's Encrypt are only valid for their domains
+		scheme, host := "http", "localhost"
+		if tlsConfig != nil {
+			scheme = "https"
+			if len(cfg.TLSAutocertDomains) > 0 {
+				host = cfg.TLSAutocertDomains[0]
+			}
+		}
+		logging.Logger.Info().Msgf("connect to %s://%s:%s/ for GraphQL playground", scheme, host, cfg.Port)
+	}
+	if err := server.Run(); err != nil {
+		logging.Logger.Fatal().Err(err).Msg("server stopped")
+	}
 }
@@ -0,0 +1,87 @@
+package tlsconfig
+
+// TLS of the HTTP server, so deployments don't need a proxy in front to be
+// secure. Certificates come from TLS_CERT_FILE and TLS_KEY_FILE, or from
+// Let's Encrypt for the domains of TLS_AUTOCERT_DOMAINS, answering the
+// TLS-ALPN challenge on the HTTPS port and the HTTP one on the redirect
+// port when there is one. Internal services may be required to present
+// client certificates, see Mutual.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/cesar-yoab/authService/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// New returns the TLS config of the server, nil when TLS is off, and the
+// handler of HTTP_REDIRECT_PORT, redirecting to HTTPS
+func New(cfg *config.Config) (*tls.Config, http.Handler, error) {
+	redirect := Redirect(cfg.Port)
+
+	switch {
+	case len(cfg.TLSAutocertDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLSAutocertDomains...),
+			Cache:      autocert.DirCache(cfg.TLSAutocertCache),
+			Email:      cfg.TLSAutocertEmail,
+		}
+		tlsConfig := m.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, m.HTTPHandler(redirect), nil
+	case cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, redirect, nil
+	}
+
+	return nil, nil, nil
+}
+
+// Redirect answers requests with a permanent redirect to the same URL over
+// HTTPS on port
+func Redirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		// Other requests already sent their body, and maybe credentials, in
+		// the clear: fail them so the client gets fixed rather than redirected
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS.", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Mutual returns a copy of base that also requires client certificates
+// signed by a CA of the PEM bundle caFile
+func Mutual(base *tls.Config, caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	config := base.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = pool
+	return config, nil
+}
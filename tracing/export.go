@@ -0,0 +1,225 @@
+package tracing
+
+// Export of finished spans with the OTLP/HTTP JSON protocol.
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// Spans are sent in batches of up to batchSize or every batchInterval
+const (
+	batchSize     = 512
+	batchInterval = 5 * time.Second
+)
+
+// exporter batches spans and posts them to a collector
+type exporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+	done     chan struct{}
+}
+
+var (
+	mu      sync.RWMutex
+	current *exporter
+)
+
+// Init starts exporting spans to the OTLP collector at endpoint, e.g.
+// http://localhost:4318. Until Init is called spans are only used for
+// propagation and are dropped when they end.
+func Init(endpoint, service string) {
+	e := &exporter{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, 4*batchSize),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+
+	mu.Lock()
+	current = e
+	mu.Unlock()
+}
+
+// Shutdown flushes the queued spans and stops exporting
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	e := current
+	current = nil
+	mu.Unlock()
+
+	if e == nil {
+		return nil
+	}
+
+	close(e.queue)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// export queues a finished span, spans are dropped when the queue is full
+func export(span *Span) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if current == nil {
+		return
+	}
+
+	select {
+	case current.queue <- span:
+	default:
+	}
+}
+
+// run collects spans into batches until the queue is closed
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == batchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// OTLP JSON types, only the fields we fill in
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// send posts a batch of spans to the collector
+func (e *exporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: fmt.Sprint(s.start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprint(s.end.UnixNano()),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.err != "" {
+			// STATUS_CODE_ERROR
+			span.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+
+		spans = append(spans, span)
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: e.service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/cesar-yoab/authService/tracing"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		logging.Logger.Error().Err(err).Msg("could not encode spans")
+		return
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Logger.Error().Err(err).Msg("could not export spans")
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		logging.Logger.Error().Str("status", res.Status).Msg("could not export spans")
+	}
+}
@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is an OTLP/HTTP collector recording the requests it receives
+type collector struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+	paths    []string
+	types    []string
+}
+
+func newCollector(t *testing.T, status int) (*collector, *httptest.Server) {
+	t.Helper()
+
+	c := &collector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid export: %v", err)
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, req)
+		c.paths = append(c.paths, r.URL.Path)
+		c.types = append(c.types, r.Header.Get("Content-Type"))
+		c.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return c, server
+}
+
+// spans returns the spans received, in order
+func (c *collector) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var spans []otlpSpan
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func shutdown(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	c, server := newCollector(t, http.StatusOK)
+	Init(server.URL+"/", "auth-test")
+
+	ctx, parent := StartKind(context.Background(), "HTTP POST /query", KindServer)
+	_, child := Start(ctx, "password.compare")
+	child.SetAttribute("db.system", "mongodb")
+	child.RecordError(errors.New("mismatch"))
+	child.End()
+	child.End()
+	parent.End()
+	shutdown(t)
+
+	if len(c.requests) != 1 {
+		t.Fatalf("collector got %d requests, want 1", len(c.requests))
+	}
+	if c.paths[0] != "/v1/traces" || c.types[0] != "application/json" {
+		t.Errorf("exported to %s as %s", c.paths[0], c.types[0])
+	}
+	resource := c.requests[0].ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || resource[0].Value.StringValue != "auth-test" {
+		t.Errorf("resource = %+v, want service.name auth-test", resource)
+	}
+
+	spans := c.spans()
+	if len(spans) != 2 {
+		t.Fatalf("collector got %d spans, want 2", len(spans))
+	}
+	got, root := spans[0], spans[1]
+	if got.Name != "password.compare" || got.Kind != KindInternal || root.Kind != KindServer {
+		t.Errorf("spans = %+v", spans)
+	}
+	if got.TraceID != parent.TraceID() || root.TraceID != parent.TraceID() {
+		t.Errorf("trace ids = %s, %s, want %s", got.TraceID, root.TraceID, parent.TraceID())
+	}
+	if got.ParentSpanID != root.SpanID || root.ParentSpanID != "" {
+		t.Errorf("parent ids = %q, %q, want %q and none", got.ParentSpanID, root.ParentSpanID, root.SpanID)
+	}
+	if got.Status.Code != 2 || got.Status.Message != "mismatch" || root.Status.Code != 0 {
+		t.Errorf("statuses = %+v, %+v", got.Status, root.Status)
+	}
+	if len(got.Attributes) != 1 || got.Attributes[0].Key != "db.system" || got.Attributes[0].Value.StringValue != "mongodb" {
+		t.Errorf("attributes = %+v", got.Attributes)
+	}
+	if got.StartTimeUnixNano == "" || got.EndTimeUnixNano < got.StartTimeUnixNano {
+		t.Errorf("times = %s to %s", got.StartTimeUnixNano, got.EndTimeUnixNano)
+	}
+}
+
+func TestExportSkipsUnsampled(t *testing.T) {
+	c, server := newCollector(t, http.StatusOK)
+	Init(server.URL, "auth-test")
+
+	parent, _ := parseTraceparent("00-" + traceID + "-" + spanID + "-00")
+	_, span := Start(context.WithValue(context.Background(), contextKey{}, parent), "not sampled")
+	span.End()
+	parent.End()
+	shutdown(t)
+
+	if spans := c.spans(); len(spans) != 0 {
+		t.Errorf("exported %+v, want nothing", spans)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	c, server := newCollector(t, http.StatusOK)
+	Init(server.URL, "auth-test")
+
+	for i := 0; i < batchSize+1; i++ {
+		_, span := Start(context.Background(), "span")
+		span.End()
+	}
+	shutdown(t)
+
+	if len(c.requests) != 2 {
+		t.Fatalf("collector got %d requests, want 2", len(c.requests))
+	}
+	if n := len(c.requests[0].ResourceSpans[0].ScopeSpans[0].Spans); n != batchSize {
+		t.Errorf("first batch has %d spans, want %d", n, batchSize)
+	}
+	if n := len(c.spans()); n != batchSize+1 {
+		t.Errorf("collector got %d spans, want %d", n, batchSize+1)
+	}
+}
+
+func TestExportCollectorError(t *testing.T) {
+	c, server := newCollector(t, http.StatusServiceUnavailable)
+	Init(server.URL, "auth-test")
+
+	_, span := Start(context.Background(), "span")
+	span.End()
+	shutdown(t)
+
+	if len(c.requests) != 1 {
+		t.Errorf("collector got %d requests, want 1", len(c.requests))
+	}
+}
+
+func TestNoExporter(t *testing.T) {
+	_, span := Start(context.Background(), "span")
+	span.End()
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() without Init error = %v", err)
+	}
+}
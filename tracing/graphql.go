@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// GraphQL is a gqlgen extension creating a span per operation and per resolver
+type GraphQL struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.ResponseInterceptor
+	graphql.FieldInterceptor
+} = GraphQL{}
+
+// ExtensionName identifies the extension in gqlgen
+func (GraphQL) ExtensionName() string {
+	return "Tracing"
+}
+
+// Validate accepts any schema
+func (GraphQL) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// InterceptResponse wraps the whole operation in a span
+func (GraphQL) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	name := "graphql"
+	if oc := graphql.GetOperationContext(ctx); oc != nil && oc.Operation != nil {
+		name = "graphql." + string(oc.Operation.Operation)
+		if oc.OperationName != "" {
+			name += " " + oc.OperationName
+		}
+	}
+
+	ctx, span := Start(ctx, name)
+	defer span.End()
+
+	res := next(ctx)
+	if res != nil && len(res.Errors) > 0 {
+		span.RecordError(res.Errors)
+	}
+
+	return res
+}
+
+// InterceptField creates spans for fields with a resolver, plain struct fields are not traced
+func (GraphQL) InterceptField(ctx context.Context, next graphql.Resolver) (interface{}, error) {
+	fc := graphql.GetFieldContext(ctx)
+	if fc == nil || !fc.IsResolver {
+		return next(ctx)
+	}
+
+	ctx, span := Start(ctx, "resolve "+fc.Object+"."+fc.Field.Name)
+	defer span.End()
+
+	res, err := next(ctx)
+	span.RecordError(err)
+
+	return res, err
+}
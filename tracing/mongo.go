@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// commandKey identifies a command in flight
+type commandKey struct {
+	connection string
+	request    int64
+}
+
+// MongoMonitor returns a command monitor creating a client span for every
+// Mongo command issued with a context that carries a span
+func MongoMonitor() *event.CommandMonitor {
+	var spans sync.Map
+
+	finish := func(connection string, request int64, err error) {
+		if s, ok := spans.Load(commandKey{connection, request}); ok {
+			spans.Delete(commandKey{connection, request})
+			span := s.(*Span)
+			span.RecordError(err)
+			span.End()
+		}
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if FromContext(ctx) == nil {
+				return
+			}
+
+			_, span := StartKind(ctx, "mongo."+e.CommandName, KindClient)
+			span.SetAttribute("db.system", "mongodb")
+			span.SetAttribute("db.name", e.DatabaseName)
+			span.SetAttribute("db.operation", e.CommandName)
+			spans.Store(commandKey{e.ConnectionID, e.RequestID}, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			finish(e.ConnectionID, e.RequestID, nil)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finish(e.ConnectionID, e.RequestID, errors.New(e.Failure))
+		},
+	}
+}
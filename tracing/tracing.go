@@ -0,0 +1,230 @@
+package tracing
+
+// Lightweight tracing compatible with OpenTelemetry. Spans follow the W3C
+// trace context so traces continue across services, and are exported with
+// the OTLP/HTTP JSON protocol to any OpenTelemetry collector.
+//
+// The OpenTelemetry SDK isn't used because of what it drags in: the OTLP
+// exporters need grpc 1.46 and protobuf 1.28 and otelmongo needs
+// mongo-driver 1.9, while the service pins grpc 1.43, protobuf 1.25 and
+// mongo-driver 1.4 for its generated code. What the service needs, spans
+// with string attributes, traceparent propagation and batched OTLP/JSON
+// export, fits in this package.
+// See https://www.w3.org/TR/trace-context/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesar-yoab/authService/logging"
+)
+
+// Span kinds, values match the OTLP protobuf enum
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span is a timed operation that is part of a trace
+type Span struct {
+	mu       sync.Mutex
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      string
+	sampled  bool
+	ended    bool
+}
+
+type contextKey struct{}
+
+// FromContext returns the span stored in ctx, nil if there is none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+// Start creates a span as a child of the span in ctx, or the root of a new trace
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+// StartKind is Start for spans that are not internal operations, e.g. server or client calls
+func StartKind(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	span := &Span{
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+		sampled: true,
+	}
+	rand.Read(span.spanID[:])
+
+	if parent := FromContext(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+	}
+
+	return context.WithValue(ctx, contextKey{}, span), span
+}
+
+// SetAttribute annotates the span
+func (s *Span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// RecordError marks the span as failed, nil errors are ignored
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and hands it to the exporter, calling End twice has no effect
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled {
+		export(s)
+	}
+}
+
+// TraceID returns the hex encoded id of the trace the span belongs to
+func (s *Span) TraceID() string {
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Traceparent formats the span as a W3C traceparent header value
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// Inject adds the traceparent header of the span in ctx to an outgoing
+// request so the callee continues the trace, it does nothing without a span
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set("traceparent", span.Traceparent())
+	}
+}
+
+// isLowerHex reports whether s is made of lowercase hex digits only, the
+// trace context forbids uppercase ones
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceparent extracts the remote parent of a request from its traceparent header
+func parseTraceparent(header string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	for _, part := range parts[:4] {
+		if !isLowerHex(part) {
+			return nil, false
+		}
+	}
+	// Version ff is invalid, version 00 has exactly four fields and later
+	// versions may append fields we ignore
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, false
+	}
+
+	var parent Span
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, false
+	}
+
+	// All zero ids are invalid
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return nil, false
+	}
+
+	parent.sampled = flags[0]&1 == 1
+	parent.ended = true
+	return &parent, true
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// of the caller when the request carries a traceparent header
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, contextKey{}, parent)
+		}
+
+		ctx, span := StartKind(ctx, "HTTP "+r.Method+" "+r.URL.Path, KindServer)
+		defer span.End()
+		logging.With(ctx, "trace_id", span.TraceID())
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", fmt.Sprint(rec.status))
+		if rec.status >= 500 {
+			span.RecordError(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
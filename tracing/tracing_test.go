@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		wantOK      bool
+		wantSampled bool
+	}{
+		{name: "sampled", header: "00-" + traceID + "-" + spanID + "-01", wantOK: true, wantSampled: true},
+		{name: "not sampled", header: "00-" + traceID + "-" + spanID + "-00", wantOK: true},
+		{name: "other flags", header: "00-" + traceID + "-" + spanID + "-09", wantOK: true, wantSampled: true},
+		{name: "surrounding spaces", header: " 00-" + traceID + "-" + spanID + "-01 ", wantOK: true, wantSampled: true},
+		{name: "later version", header: "01-" + traceID + "-" + spanID + "-01-extra", wantOK: true, wantSampled: true},
+		{name: "version ff", header: "ff-" + traceID + "-" + spanID + "-01"},
+		{name: "version 00 with more fields", header: "00-" + traceID + "-" + spanID + "-01-extra"},
+		{name: "uppercase", header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01"},
+		{name: "not hex", header: "00-" + traceID + "-" + "00f067aa0ba902bz" + "-01"},
+		{name: "zero trace id", header: "00-00000000000000000000000000000000-" + spanID + "-01"},
+		{name: "zero span id", header: "00-" + traceID + "-0000000000000000-01"},
+		{name: "short trace id", header: "00-" + traceID[1:] + "-" + spanID + "-01"},
+		{name: "missing flags", header: "00-" + traceID + "-" + spanID},
+		{name: "empty", header: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, ok := parseTraceparent(tt.header)
+			if ok != tt.wantOK {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := parent.TraceID(); got != traceID {
+				t.Errorf("trace id = %s, want %s", got, traceID)
+			}
+			if got := hex.EncodeToString(parent.spanID[:]); got != spanID {
+				t.Errorf("span id = %s, want %s", got, spanID)
+			}
+			if parent.sampled != tt.wantSampled {
+				t.Errorf("sampled = %v, want %v", parent.sampled, tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	ctx, root := Start(context.Background(), "root")
+	if root.parentID != [8]byte{} || root.traceID == [16]byte{} || root.spanID == [8]byte{} {
+		t.Fatalf("Start() without a parent = %+v, want a new trace", root)
+	}
+
+	_, child := Start(ctx, "child")
+	if child.traceID != root.traceID || child.parentID != root.spanID || child.spanID == root.spanID {
+		t.Errorf("Start() with a parent = %+v, want a child of %+v", child, root)
+	}
+}
+
+func TestInject(t *testing.T) {
+	header := http.Header{}
+	Inject(context.Background(), header)
+	if got := header.Get("traceparent"); got != "" {
+		t.Errorf("Inject() without a span set traceparent %s", got)
+	}
+
+	ctx, span := Start(context.Background(), "call")
+	Inject(ctx, header)
+	parent, ok := parseTraceparent(header.Get("traceparent"))
+	if !ok {
+		t.Fatalf("Inject() set traceparent %q", header.Get("traceparent"))
+	}
+	if parent.traceID != span.traceID || parent.spanID != span.spanID || !parent.sampled {
+		t.Errorf("Inject() propagated %+v, want %+v", parent, span)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		// Whether the server span continues the trace of the caller
+		wantRemote  bool
+		wantSampled bool
+	}{
+		{name: "no traceparent", wantSampled: true},
+		{name: "sampled caller", traceparent: "00-" + traceID + "-" + spanID + "-01", wantRemote: true, wantSampled: true},
+		{name: "caller not sampled", traceparent: "00-" + traceID + "-" + spanID + "-00", wantRemote: true},
+		{name: "invalid traceparent", traceparent: "ff-" + traceID + "-" + spanID + "-01", wantSampled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var span *Span
+			var outgoing string
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				span = FromContext(r.Context())
+				header := http.Header{}
+				Inject(r.Context(), header)
+				outgoing = header.Get("traceparent")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/me", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if span == nil {
+				t.Fatal("the handler got no span")
+			}
+			if span.kind != KindServer || span.name != "HTTP GET /v1/me" {
+				t.Errorf("server span = %s kind %d", span.name, span.kind)
+			}
+			remote := span.TraceID() == traceID && hex.EncodeToString(span.parentID[:]) == spanID
+			if remote != tt.wantRemote {
+				t.Errorf("span continues the trace of the caller = %v, want %v", remote, tt.wantRemote)
+			}
+			if span.sampled != tt.wantSampled {
+				t.Errorf("sampled = %v, want %v", span.sampled, tt.wantSampled)
+			}
+			if outgoing != span.Traceparent() {
+				t.Errorf("outgoing traceparent = %s, want %s", outgoing, span.Traceparent())
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package webhook
+
+// Provisioning hook asking an HTTP endpoint about each user single sign-on
+// is about to create. Unlike webhooks the request is made during the login
+// and its answer decides the user: the endpoint receives the identity and
+// the user the policy would create, signed like webhooks, and answers the
+// user to create, changed or not, 204 to keep it as it is, or 403 with a
+// message to refuse it. Any other answer refuses the user too.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/logging"
+	"github.com/cesar-yoab/authService/tracing"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ProvisioningHook implements auth.ProvisioningHook with an HTTP endpoint
+type ProvisioningHook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// provisioningRequest is the JSON body sent to the endpoint
+type provisioningRequest struct {
+	Identity *auth.SSOIdentity `json:"identity"`
+	User     *auth.SSOUser     `json:"user"`
+}
+
+// NewProvisioningHook returns a hook posting to url and signing requests with secret
+func NewProvisioningHook(url, secret string) *ProvisioningHook {
+	return &ProvisioningHook{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Provision implements auth.ProvisioningHook
+func (h *ProvisioningHook) Provision(ctx context.Context, identity *auth.SSOIdentity, user *auth.SSOUser) error {
+	body, err := json.Marshal(provisioningRequest{Identity: identity, User: user})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", "sso.provision")
+	req.Header.Set("X-Webhook-Signature", Sign(h.secret, body))
+	tracing.Inject(ctx, req.Header)
+
+	failed := gqlerror.Errorf("Could not create user, try again later.")
+	res, err := h.client.Do(req)
+	if err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("provisioning hook failed")
+		return failed
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		// Fields left out of the answer keep their values
+		if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(user); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("provisioning hook answered invalid JSON")
+			return failed
+		}
+		return nil
+	case http.StatusNoContent:
+		return nil
+	case http.StatusForbidden:
+		var refusal struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&refusal)
+		if refusal.Message == "" {
+			refusal.Message = "Your account can't be created, ask an administrator for access."
+		}
+		return gqlerror.Errorf("%s", refusal.Message)
+	}
+
+	logging.Ctx(ctx).Error().Str("status", res.Status).Msg("provisioning hook answered an unexpected status")
+	return failed
+}
@@ -0,0 +1,202 @@
+package webhook
+
+// Dispatcher of outbound webhooks. Audit events are turned into JSON
+// payloads signed with HMAC-SHA256 and POSTed to every configured URL.
+// Deliveries are background jobs, failed ones are retried with exponential
+// backoff and the state of each delivery is tracked in Mongo.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cesar-yoab/authService/auth"
+	"github.com/cesar-yoab/authService/jobs"
+	"github.com/cesar-yoab/authService/logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+)
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// jobType is the type of the background jobs delivering webhooks
+const jobType = "webhook"
+
+// Payload is the JSON body sent to webhook receivers
+type Payload struct {
+	ID        string            `json:"id"`
+	Event     string            `json:"event"`
+	Subject   string            `json:"subject"`
+	ActorID   string            `json:"actorId,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Delivery representation of a delivery attempt record in the database
+type Delivery struct {
+	ID         primitive.ObjectID `bson:"_id" json:"_id"`
+	URL        string             `bson:"url" json:"url"`
+	Event      string             `bson:"event" json:"event"`
+	Status     string             `bson:"status" json:"status"`
+	Attempts   int                `bson:"attempts" json:"attempts"`
+	StatusCode int                `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	LastError  string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt  time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// job is the payload of a delivery job
+type job struct {
+	URL     string  `json:"url"`
+	Payload Payload `json:"payload"`
+}
+
+// Dispatcher sends webhooks for audit events, it implements auth.EventSink
+type Dispatcher struct {
+	urls       []string
+	secret     []byte
+	deliveries *mongo.Collection
+	client     *http.Client
+	runner     *jobs.Runner
+}
+
+// NewDispatcher returns a dispatcher posting to urls and signing payloads with
+// secret, deliveries run as jobs of runner
+func NewDispatcher(urls []string, secret string, deliveries *mongo.Collection, runner *jobs.Runner) *Dispatcher {
+	d := &Dispatcher{
+		urls:       urls,
+		secret:     []byte(secret),
+		deliveries: deliveries,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		runner:     runner,
+	}
+	runner.Handle(jobType, d.deliver)
+
+	return d
+}
+
+// Sign returns the signature receivers should compare against the
+// X-Webhook-Signature header, computed over the raw request body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Publish queues a webhook for every configured URL, delivery happens in the background
+func (d *Dispatcher) Publish(event auth.AuditEvent) {
+	name := event.Name()
+	if name == "" {
+		return
+	}
+
+	for _, url := range d.urls {
+		payload := Payload{
+			ID:        primitive.NewObjectID().Hex(),
+			Event:     name,
+			Subject:   event.Subject,
+			ActorID:   event.ActorID,
+			Details:   event.Details,
+			Timestamp: event.Timestamp,
+		}
+
+		if err := d.runner.Enqueue(context.Background(), jobType, job{URL: url, Payload: payload}); err != nil {
+			logging.Logger.Error().Err(err).Str("event", name).Msg("could not queue webhook")
+		}
+	}
+}
+
+// deliver runs a delivery job, the job runner retries it when it fails
+func (d *Dispatcher) deliver(ctx context.Context, j *jobs.Job) error {
+	var w job
+	if err := j.Decode(&w); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(w.Payload)
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("event", w.Payload.Event).Msg("could not encode webhook")
+		return nil
+	}
+
+	attempt := j.Attempts + 1
+	id, _ := primitive.ObjectIDFromHex(w.Payload.ID)
+	if attempt == 1 {
+		d.track(bson.M{"$setOnInsert": Delivery{
+			ID:        id,
+			URL:       w.URL,
+			Event:     w.Payload.Event,
+			Status:    StatusPending,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}}, id)
+	}
+
+	code, err := d.post(ctx, w.URL, w.Payload, body)
+
+	update := bson.M{"attempts": attempt, "statusCode": code, "updatedAt": time.Now()}
+	if err == nil {
+		update["status"] = StatusDelivered
+		d.track(bson.M{"$set": update, "$unset": bson.M{"lastError": ""}}, id)
+		return nil
+	}
+
+	update["lastError"] = err.Error()
+	if attempt == jobs.MaxAttempts {
+		update["status"] = StatusFailed
+		logging.Logger.Warn().Err(err).Str("event", w.Payload.Event).Str("url", w.URL).Int("attempts", attempt).Msg("webhook delivery failed")
+	}
+	d.track(bson.M{"$set": update}, id)
+
+	return err
+}
+
+// post sends a single delivery attempt and returns the response status code
+func (d *Dispatcher) post(ctx context.Context, url string, payload Payload, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", payload.Event)
+	req.Header.Set("X-Webhook-Delivery", payload.ID)
+	req.Header.Set("X-Webhook-Signature", Sign(d.secret, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+// track records the state of a delivery, tracking failures don't stop the delivery
+func (d *Dispatcher) track(update bson.M, id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := d.deliveries.UpdateOne(ctx, bson.M{"_id": id}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		logging.Logger.Error().Err(err).Str("delivery", id.Hex()).Msg("could not track webhook delivery")
+	}
+}